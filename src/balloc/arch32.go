@@ -0,0 +1,9 @@
+//go:build 386 || arm || mips || mipsle
+
+package balloc
+
+// Pool size limit for 32-bit address spaces.
+// The largest pool is 2^30 bytes so block offsets, sizes and buddy addresses all fit a 32-bit uintptr
+const (
+	MAX_K uint = 31 // maximum size of the buddy memory pool. 1 larger than needed to allow indexed 1-N instead of 0-N. internal max memory is MAX_K-1
+)
@@ -0,0 +1,38 @@
+//go:build 386 || arm || mips || mipsle
+
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArch32Limits(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing pool limits on a 32-bit address space")
+	assert.Equal(t, uint(31), MAX_K)
+	assert.Equal(t, MAX_K, btok(^uintptr(0)))
+	assert.Equal(t, BLOCK_HEADER+2*4, AVAIL_HEADER)
+
+	// The largest pool is 2^30 bytes, strict init rejects anything above it
+	var pool BuddyPool
+	err := buddyInitWithOptions(&pool, 1<<31, Options{Strict: true})
+	assert.ErrorIs(t, err, ErrSizeOutOfRange)
+
+	// Alloc and free across the whole pool, buddies are found with 32-bit offsets
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	half, err := buddyMalloc(&pool, uint(pool.numBytes/2-BLOCK_HEADER))
+	assert.NoError(t, err)
+	small, err := buddyMalloc(&pool, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, pool.base+pool.numBytes/2+BLOCK_HEADER, uintptr(small))
+	assert.Equal(t, unsafe.Pointer(pool.base+pool.numBytes/2), unsafe.Pointer(buddyCalc(&pool, ptrToBlock(&pool, half))))
+	assert.NoError(t, buddyFree(&pool, small))
+	assert.NoError(t, buddyFree(&pool, half))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
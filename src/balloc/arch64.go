@@ -0,0 +1,8 @@
+//go:build !(386 || arm || mips || mipsle)
+
+package balloc
+
+// Pool size limit for 64-bit address spaces
+const (
+	MAX_K uint = 48 // maximum size of the buddy memory pool. 1 larger than needed to allow indexed 1-N instead of 0-N. internal max memory is MAX_K-1
+)
@@ -1,8 +1,12 @@
 package balloc
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
 	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -10,20 +14,69 @@ import (
 
 // Define constants
 const (
-	DEFAULT_K  uint = 30 // default amount of memory that this memeory manager will manage unless explicitly set. This is calculated as 2^DEFAULT_K bytes
-	MIN_K      uint = 20 // minimum size of the buddy memory pool
-	MAX_K      uint = 48 // maximum size of the buddy memory pool. 1 larger than needed to allow indexed 1-N instead of 0-N. internal max memory is MAX_K-1
-	SMALLEST_K uint = 6  // smallest memory block size that can be returned by the buddy_malloc. value must be large enough to account for the avail header
+	DEFAULT_K   uint = 30 // default amount of memory that this memeory manager will manage unless explicitly set. This is calculated as 2^DEFAULT_K bytes
+	MIN_K       uint = 20 // minimum size of the buddy memory pool
+	SMALLEST_K  uint = 6  // smallest memory block size that can be returned by the buddy_malloc. value must be large enough to account for the avail header
+	HUGE_PAGE_K uint = 21 // size of a huge page as 2^HUGE_PAGE_K bytes. pools backed by huge pages are at least this large
 
 	BLOCK_AVAIL    uint16 = 1 // block is available to allocate
 	BLOCK_RESERVED uint16 = 0 // block has been handed to user
+	BLOCK_CACHED   uint16 = 2 // block is parked in the free cache, reserved in the pool but not held by the user
 	BLOCK_UNUSED   uint16 = 3 // block is unused completely
+
+	REDZONE_BYTE byte = 0xFD // canary written into the slack after the requested size in redzone mode
+	POISON_BYTE  byte = 0xDE // fill written over freed memory in poison mode
+
+	BLOCK_HEADER uintptr = unsafe.Offsetof(Avail{}.next) // bytes kept in front of a reserved block's user pointer: tag, kval and size. the list links are reused as user data
+	AVAIL_HEADER uintptr = unsafe.Sizeof(Avail{})        // bytes a free block needs for its header including the next and prev links
+	CACHE_LINE   uintptr = 64                            // bytes in a cache line, the header size of pools aligning allocations to cache lines
+	MIN_ALIGN    uintptr = 8                             // every user pointer is aligned to at least this many bytes, enough for any Go scalar type
+
+	SIZE_CLASS_MAX   uint = 4096 // largest request SizeClasses carves out of a shared run, larger ones take their own buddy block
+	SIZE_CLASS_SLOTS uint = 8    // minimum number of slots in each run a size class carves from one buddy block
+)
+
+// Fails to compile unless BLOCK_HEADER is a multiple of MIN_ALIGN, which is what keeps user pointers aligned
+var _ [0]struct{} = [BLOCK_HEADER % MIN_ALIGN]struct{}{}
+
+// Fails to compile unless a SMALLEST_K block can hold an Avail header once it is freed
+var _ [0]struct{} = [(AVAIL_HEADER - 1) >> SMALLEST_K]struct{}{}
+
+// Define errors
+var (
+	ErrDoubleFree             = errors.New("balloc: block is already free")                     // returned when freeing a block that is already BLOCK_AVAIL
+	ErrInvalidPointer         = errors.New("balloc: pointer does not belong to the pool")       // returned when a pointer is outside the pool or misaligned
+	ErrInvalidOptions         = errors.New("balloc: invalid pool options")                      // returned when init is given options it cannot honor
+	ErrSizeOutOfRange         = errors.New("balloc: pool size out of range")                    // returned by strict init instead of clamping the pool size
+	ErrBadAlignment           = errors.New("balloc: alignment must be a power of two")          // returned by aligned allocation for a non power of two alignment
+	ErrBufferOverflow         = errors.New("balloc: redzone overwritten")                       // returned by free in redzone mode when the canary after the block was corrupted
+	ErrCorruptPool            = errors.New("balloc: pool invariant violated")                   // returned by buddyVerify describing the first broken invariant
+	ErrPoolInUse              = errors.New("balloc: pool has live allocations")                 // returned by operations that would invalidate outstanding pointers
+	ErrInvalidSnapshot        = errors.New("balloc: snapshot does not match pool")              // returned by buddyRestore for a snapshot of another pool or with overlapping blocks
+	ErrBufferClosed           = errors.New("balloc: buffer is closed")                          // returned by Buffer reads and writes after Close
+	ErrReadOnly               = errors.New("balloc: pool is read-only")                         // returned by malloc, free and every other write to a pool opened with buddyInitReadOnly
+	ErrCorruptedHeader        = errors.New("balloc: block header checksum mismatch")            // returned in checksum mode when a block header was overwritten
+	ErrReservationUsed        = errors.New("balloc: reservation already committed or released") // returned by Reservation methods once the block has been handed over or freed
+	ErrAllocationsOutstanding = errors.New("balloc: allocations outstanding")                   // returned by destroy in strict destroy mode while blocks are still reserved
+	ErrAlreadyInitialized     = errors.New("balloc: pool is already initialized")               // returned by init on a pool that is mapped and has not been destroyed
+	ErrPoolClosed             = errors.New("balloc: pool is not initialized")                   // returned by malloc and free on a pool that was never initialized or has been destroyed
+	ErrInvalidExport          = errors.New("balloc: invalid pool export")                       // returned by buddyImport for a stream that is not a complete, consistent pool export
 )
 
-// Represents one block in the free list
+// Lifecycle states of a pool, kept in BuddyPool.state
+const (
+	poolUninitialized int32 = iota // zero value, the pool has never been mapped
+	poolActive                     // mapped by init and serving allocations
+	poolDestroyed                  // unmapped by destroy, it may be initialized again
+)
+
+// Represents one block in the free list.
+// Only the first BLOCK_HEADER bytes survive while a block is reserved, next and
+// prev overlap the user region and are rewritten when the block is freed
 type Avail struct {
 	tag  uint16 // tag for block status i.e. BLOCK_AVAIL, BLOCK_RESERVED
 	kval uint16 // the k value of the block
+	size uint32 // user requested size, only recorded in redzone mode. 0 if not recorded or too large to fit. holds the header checksum in checksum mode
 	next *Avail // pointer to the next memory block
 	prev *Avail // pointer to the last memory block
 }
@@ -31,58 +84,294 @@ type Avail struct {
 // Buddy memory pool.
 // Tracks the whole region of memory we are managing
 type BuddyPool struct {
-	kvalM    uint         // the max kval of this pool, largest k we manage
-	numBytes uintptr      // total number of bytes this pool manages
-	base     uintptr      // the base address of mmap'd memory used for the buddy calculations
-	avail    [MAX_K]Avail // the array of free available memory block headers set to an array of size MAX_K
-	lock     sync.Mutex   // mutex lock for thread safety
+	kvalM         uint                  // the max kval of this pool, largest k we manage
+	smallestK     uint                  // the smallest kval this pool will hand out
+	header        uintptr               // bytes from the start of a reserved block to its user pointer. BLOCK_HEADER, or CACHE_LINE when aligning to cache lines
+	numBytes      uintptr               // total number of bytes this pool manages
+	base          uintptr               // the base address of mmap'd memory used for the buddy calculations
+	avail         [MAX_K]Avail          // the array of free available memory block headers set to an array of size MAX_K
+	state         atomic.Int32          // lifecycle state, changed only while holding lifecycle and read atomically by malloc and free
+	lifecycle     sync.Mutex            // serializes init, destroy, grow and reset so one never runs halfway through another
+	allocs        atomic.Int64          // number of blocks currently handed out to the user
+	totalAllocs   atomic.Uint64         // number of blocks handed out since init or the last reset
+	totalFrees    atomic.Uint64         // number of blocks given back since init or the last reset
+	totalSplits   atomic.Uint64         // number of blocks split in two since init or the last reset
+	totalMerges   atomic.Uint64         // number of buddy pairs merged since init or the last reset
+	reserved      atomic.Int64          // usable bytes of the blocks currently handed out to the user
+	peak          atomic.Int64          // highest reserved has reached since init or the last reset
+	maxReserved   int64                 // cap on reserved, malloc fails rather than exceed it. 0 disables
+	maxAllocs     int64                 // cap on allocs, malloc fails rather than exceed it. 0 disables
+	locked        bool                  // the mapping has been mlock'd and must be munlock'd on destroy
+	hugePages     bool                  // the mapping is backed by huge pages
+	fileBacked    bool                  // the mapping is MAP_SHARED over a file and must be msync'd on destroy
+	readOnly      bool                  // the mapping is a PROT_READ view of a persisted pool, anything that would write fails with ErrReadOnly
+	region        []byte                // caller supplied memory managed in place of a mapping, kept to hold it alive. nil if the pool mapped its own, which destroy unmaps
+	redzone       bool                  // write a canary after each allocation and verify it on free
+	checksum      bool                  // keep a checksum of each header's tag, kval and offset in its size field and verify it before trusting the header
+	poison        bool                  // fill freed memory with POISON_BYTE and verify it is untouched when reused
+	secureClear   bool                  // zero freed memory so a later allocation cannot read it
+	onPoison      PoisonFunc            // called with the user pointer and offset of the first overwritten byte on a poison mismatch
+	onOOM         OOMFunc               // called when malloc cannot satisfy a request, before it is retried once
+	onSplit       SplitFunc             // traces every split under the class locks
+	onMerge       MergeFunc             // traces every merge under the class locks
+	logger        Logger                // receives allocator diagnostics. nil discards them
+	histogram     *[MAX_K]atomic.Uint64 // number of allocations served from each k. nil unless enabled in Options
+	adviseK       uint                  // freeing a block of at least this k advises MADV_DONTNEED on its pages. 0 disables
+	drainAt       float64               // fragmentation above which a free drains the large free blocks to the OS. 0 disables
+	drainK        uint                  // smallest k drained once drainAt is crossed
+	drained       bool                  // fragmentation is still above drainAt since the last drain. guarded by every class lock
+	drains        uint64                // number of times drainAt has been crossed. guarded by every class lock
+	strategy      Strategy              // how malloc picks the free block to split
+	splitHigh     bool                  // splits keep the upper half and free the lower one, so allocations pack towards the end of the pool
+	uniqueZero    bool                  // zero size mallocs get a distinct smallest block instead of nil
+	strictDestroy bool                  // destroy fails with ErrAllocationsOutstanding instead of unmapping while blocks are reserved
+	panicOnError  bool                  // misuse errors from free and retain panic instead of being returned
+	verifyFrees   bool                  // every free checks the pool invariants with buddyVerify before returning
+	deferCoalesce bool                  // free only links blocks into their avail list, merging is left to buddyCoalesceAll
+	holdSplits    int64                 // most pairs of free buddies a free may leave unmerged at their child size. 0 disables
+	held          atomic.Int64          // pairs of free buddies currently left unmerged, including a prewarmed pair. only tracked when holdSplits is set
+	prewarmK      uint                  // init and reset split the pool down to a pair of free blocks of this k. 0 disables
+	prewarmPair   atomic.Uintptr        // address of the lower half of the prewarmed pair while neither half was allocated or merged, 0 otherwise
+	cache         *freeCache            // front-end cache of recently freed blocks. nil unless enabled in Options
+	sites         map[uintptr][]uintptr // call stack of each live allocation keyed by user pointer. nil unless leak tracking is on
+	locks         [MAX_K]sync.RWMutex   // one lock per avail[k] list, always taken in ascending k order. read-only sweeps share them
+	lockStats     *lockCounters         // time spent waiting on the class locks. nil unless enabled in Options
+	siteLock      sync.Mutex            // guards sites, which is shared by every size class
+	refs          map[uintptr]int32     // extra references taken with buddyRetain keyed by user pointer. nil until the first retain
+	refLock       sync.Mutex            // guards refs
+	retained      atomic.Bool           // set by the first retain, frees only drop reference counts once it is
+	tagged        atomic.Bool           // set by the first tagged malloc, frees only look up owners once it is
+	owners        map[uintptr]uint32    // owner id of each live tagged allocation keyed by user pointer
+	usage         map[uint32]uint       // usable bytes reserved by each owner
+	ownerLock     sync.Mutex            // guards owners and usage
+	waitLock      sync.Mutex            // guards freed
+	freed         chan struct{}         // closed on the next free to wake goroutines blocked in buddyMallocWait. nil if nobody waits
+	waiting       atomic.Bool           // set while freed is non-nil, lets frees skip waitLock when nobody waits
 }
 
+// Initializes the pool with the default options
 func buddyInit(pool *BuddyPool, size uintptr) error {
-	pool.lock.Lock()
-	defer pool.lock.Unlock()
+	return buddyInitWithOptions(pool, size, Options{})
+}
+
+// Initializes the pool using the given options.
+// Zero valued options fall back to the package defaults
+func buddyInitWithOptions(pool *BuddyPool, size uintptr, opts Options) error {
+	return initPool(pool, -1, size, opts)
+}
+
+// Initializes the pool on top of the file behind fd so its contents can outlive the process.
+// The file is mapped MAP_SHARED and must already be at least as large as the pool
+func buddyInitFromFd(pool *BuddyPool, fd int, size uintptr) error {
+	if fd < 0 {
+		return fmt.Errorf("%w: invalid file descriptor %d", ErrInvalidOptions, fd)
+	}
+
+	return initPool(pool, fd, size, Options{})
+}
+
+// Shared init for anonymous (fd < 0) and file-backed pools
+func initPool(pool *BuddyPool, fd int, size uintptr, opts Options) error {
+	pool.lifecycle.Lock()
+	defer pool.lifecycle.Unlock()
+
+	// Mapping over an active pool would leak its memory and strand every pointer into it
+	if pool.state.Load() == poolActive {
+		return fmt.Errorf("%w: destroy it before initializing it again", ErrAlreadyInitialized)
+	}
+
+	lockAll(pool)
+	defer unlockAll(pool)
+
+	// Debug flags from the environment apply on top of whatever the caller asked for
+	opts = envOptions(opts)
 
 	// Evaluate and check default values
 	var kval uint
-	if size == 0 {
-		kval = DEFAULT_K
-	} else {
-		kval = btok(size)
+	var err error
+	kval, err = poolKval(size, opts.Strict)
+	if err != nil {
+		return err
 	}
 
-	if kval < MIN_K {
-		kval = MIN_K
+	// Round the pool up to a whole huge page so the mapping is a multiple of the huge page size
+	if opts.HugePages && kval < HUGE_PAGE_K {
+		kval = HUGE_PAGE_K
 	}
-	if kval > MAX_K {
-		kval = MAX_K - 1
+
+	// Evaluate and check the smallest block size. It must hold an Avail header and fit in the pool
+	var smallestK uint = opts.SmallestK
+	if smallestK == 0 {
+		smallestK = SMALLEST_K
+	}
+	if opts.NumaBind && opts.NumaNode < 0 {
+		return fmt.Errorf("%w: NUMA node %d is negative", ErrInvalidOptions, opts.NumaNode)
+	}
+	if smallestK < headerK() {
+		return fmt.Errorf("%w: smallest k %d gives %d byte blocks, too small for the %d byte Avail header (need k >= %d)",
+			ErrInvalidOptions, smallestK, uintptr(1)<<smallestK, AVAIL_HEADER, headerK())
+	}
+	if smallestK > kval {
+		return fmt.Errorf("%w: smallest k %d must be within [%d, %d]", ErrInvalidOptions, smallestK, headerK(), kval)
+	}
+	if math.IsNaN(opts.DrainAt) || opts.DrainAt < 0 || opts.DrainAt >= 1 {
+		return fmt.Errorf("%w: drain fragmentation %v must be within [0, 1)", ErrInvalidOptions, opts.DrainAt)
+	}
+	var drainK uint = opts.DrainK
+	if drainK == 0 {
+		drainK = btokMin(uintptr(unix.Getpagesize()), 0) + 1
+	}
+	if opts.DrainAt != 0 && (drainK < smallestK || drainK > kval) {
+		return fmt.Errorf("%w: drain k %d must be within [%d, %d]", ErrInvalidOptions, drainK, smallestK, kval)
+	}
+	if opts.Checksum && opts.Redzone {
+		return fmt.Errorf("%w: checksum mode keeps its checksum where redzone mode records the requested size", ErrInvalidOptions)
+	}
+	if opts.HoldSplits < 0 || (opts.HoldSplits != 0 && opts.DeferCoalesce) {
+		return fmt.Errorf("%w: hold splits %d must not be negative or combined with deferred coalescing", ErrInvalidOptions, opts.HoldSplits)
+	}
+	if opts.PrewarmK != 0 && (opts.PrewarmK < smallestK || opts.PrewarmK > kval) {
+		return fmt.Errorf("%w: prewarm k %d must be within [%d, %d]", ErrInvalidOptions, opts.PrewarmK, smallestK, kval)
 	}
 
 	// Set kval and numBytes value using kval as offset
 	pool.kvalM = kval
+	pool.smallestK = smallestK
 	pool.numBytes = uintptr(1) << pool.kvalM
+	pool.header = BLOCK_HEADER
+	if opts.AlignToCacheLine {
+		pool.header = CACHE_LINE
+	}
+	pool.logger = opts.Logger
 
 	// Memory map a chunk of raw data we will manage
 	var data []byte
-	var err error
-	data, err = unix.Mmap(-1, 0, int(pool.numBytes), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	data, err = mapPool(pool, fd, opts)
 	if err != nil {
 		return err
 	}
+	pool.region = opts.region
+
+	// Bind the mapping to a NUMA node before anything touches it. Unmap on failure unless best effort
+	if opts.NumaBind {
+		err = bindNode(data, opts.NumaNode)
+		if err != nil && !opts.NumaBestEffort {
+			_ = unmapPool(pool, data)
+			return err
+		}
+		if err != nil {
+			logf(pool, "WARNING: Could not bind pool to NUMA node %d: %v", opts.NumaNode, err)
+		}
+	}
+
+	// Let transparent huge pages back the mapping where they can. Only strict init fails if the hint is rejected
+	if opts.TransparentHugePages && !pool.hugePages {
+		err = unix.Madvise(data, unix.MADV_HUGEPAGE)
+		if err != nil && opts.Strict {
+			_ = unmapPool(pool, data)
+			return err
+		}
+		if err != nil {
+			logf(pool, "WARNING: Transparent huge page hint rejected: %v", err)
+		}
+	}
+	pool.fileBacked = fd >= 0 && !opts.readOnly
+	pool.redzone = opts.Redzone
+	pool.checksum = opts.Checksum
+	pool.poison = opts.Poison
+	pool.secureClear = opts.SecureClear
+	pool.onPoison = opts.OnPoison
+	pool.onOOM = opts.OnOOM
+	pool.onSplit = opts.OnSplit
+	pool.onMerge = opts.OnMerge
+	pool.deferCoalesce = opts.DeferCoalesce
+	pool.holdSplits = int64(opts.HoldSplits)
+	pool.uniqueZero = opts.UniqueZero
+	pool.strictDestroy = opts.StrictDestroy
+	pool.panicOnError = opts.PanicOnError
+	pool.verifyFrees = opts.VerifyFrees
+	pool.adviseK = opts.MadviseK
+	pool.drainAt = opts.DrainAt
+	pool.drainK = drainK
+	pool.drained = false
+	pool.drains = 0
+	pool.strategy = opts.Strategy
+	pool.splitHigh = opts.SplitHigh
+	pool.prewarmK = opts.PrewarmK
+	pool.maxReserved = int64(opts.MaxReserved)
+	pool.maxAllocs = int64(opts.MaxAllocations)
+	pool.cache = nil
+	if opts.CacheDepth > 0 {
+		pool.cache = newFreeCache(opts.CacheDepth, opts.Deterministic)
+	}
+	pool.lockStats = nil
+	if opts.LockStats {
+		pool.lockStats = new(lockCounters)
+	}
+	pool.histogram = nil
+	if opts.Histogram {
+		pool.histogram = new([MAX_K]atomic.Uint64)
+	}
+	pool.sites = nil
+	if opts.TrackLeaks {
+		pool.sites = make(map[uintptr][]uintptr)
+	}
+
+	// Pin the mapping in RAM if asked. Unmap on failure so the mapping is not leaked
+	if opts.Mlock {
+		err = unix.Mlock(data)
+		if err != nil {
+			_ = unmapPool(pool, data)
+			return err
+		}
+	}
+	pool.locked = opts.Mlock
+
+	// MAP_POPULATE is best effort so write a byte in every page to guarantee residency
+	if opts.TouchPages {
+		touchPages(data)
+	}
+
+	// Make sure every page can really be written before handing any of it out. Unmap on failure
+	if opts.Probe {
+		err = probePages(data)
+		if err != nil {
+			logf(pool, "ERROR: Pool memory cannot be backed: %v", err)
+			_ = unmapPool(pool, data)
+			return err
+		}
+	}
+
 	// Saving base addr for pointer arithmetic later. Casting as go doesn't give raw pointers as default
 	pool.base = uintptr(unsafe.Pointer(&data[0]))
+	pool.readOnly = opts.readOnly
 
-	// Init the avail list and set all blocks to empty
-	for i := range pool.avail {
-		pool.avail[i].next = &pool.avail[i]
-		pool.avail[i].prev = &pool.avail[i]
-		pool.avail[i].kval = uint16(i)
-		pool.avail[i].tag = BLOCK_UNUSED
+	// A read-only pool keeps the blocks it finds in the file, everything else starts as one free block
+	if opts.readOnly {
+		err = openReadOnly(pool, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		resetAvail(pool)
 	}
+	pool.state.Store(poolActive)
+
+	return nil
+}
+
+// Empties every avail list and makes the whole pool a single free block of kvalM
+func resetAvail(pool *BuddyPool) {
+	var kval uint = pool.kvalM
+
+	// Init the avail list and set all blocks to empty
+	resetHeads(pool)
 
 	// Setup the first block
 	var firstBlock *Avail = (*Avail)(unsafe.Pointer(pool.base)) // cast raw memory to usable *Avail pointer
 	firstBlock.tag = BLOCK_AVAIL
 	firstBlock.kval = uint16(kval)
+	sealHeader(pool, firstBlock)
 	firstBlock.next = &pool.avail[kval]
 	firstBlock.prev = &pool.avail[kval]
 
@@ -91,14 +380,133 @@ func buddyInit(pool *BuddyPool, size uintptr) error {
 	pool.avail[kval].next = firstBlock
 	pool.avail[kval].prev = firstBlock
 
-	return nil
+	// Free memory starts out poisoned so the first allocations are checked too
+	if pool.poison {
+		poisonBlock(firstBlock)
+	}
+
+	// Do the splits the first small allocations would otherwise pay for
+	pool.prewarmPair.Store(0)
+	if pool.prewarmK != 0 {
+		prewarm(pool, pool.prewarmK)
+	}
+	pool.held.Store(0)
+	if pool.holdSplits != 0 {
+		pool.held.Store(countHeld(pool))
+	}
+}
+
+// Points every avail list head at itself so all of the lists are empty
+func resetHeads(pool *BuddyPool) {
+	for i := range pool.avail {
+		pool.avail[i].next = &pool.avail[i]
+		pool.avail[i].prev = &pool.avail[i]
+		pool.avail[i].kval = uint16(i)
+		pool.avail[i].tag = BLOCK_UNUSED
+	}
+}
+
+// Maps numBytes of memory for the pool. Anonymous pools may ask for huge pages
+// and fall back to normal pages if the kernel rejects them. File-backed pools are
+// mapped MAP_SHARED so writes reach the file
+func mapPool(pool *BuddyPool, fd int, opts Options) ([]byte, error) {
+	// Caller supplied memory is used as is
+	if opts.region != nil {
+		pool.hugePages = false
+		return opts.region, nil
+	}
+
+	// Read-only pools get a private copy on write view so relinking the avail lists never reaches the file
+	if opts.readOnly {
+		return unix.Mmap(fd, 0, int(pool.numBytes), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE)
+	}
+
+	var flags int = unix.MAP_PRIVATE | unix.MAP_ANONYMOUS
+	if fd >= 0 {
+		flags = unix.MAP_SHARED
+	}
+	if opts.Populate {
+		flags |= unix.MAP_POPULATE // ask the kernel to prefault the whole mapping up front
+	}
+
+	// Try huge pages first and fall back to a normal mapping if the kernel rejects them
+	pool.hugePages = false
+	if opts.HugePages && fd < 0 {
+		var data []byte
+		var err error
+		data, err = unix.Mmap(-1, 0, int(pool.numBytes), unix.PROT_READ|unix.PROT_WRITE, flags|unix.MAP_HUGETLB)
+		if err == nil {
+			pool.hugePages = true
+			return data, nil
+		}
+		logf(pool, "WARNING: Huge pages unavailable, falling back to normal pages: %v", err)
+	}
+
+	return unix.Mmap(fd, 0, int(pool.numBytes), unix.PROT_READ|unix.PROT_WRITE, flags)
+}
+
+// Unmaps the pool's memory in data unless the caller supplied it, in which case it is left alone
+func unmapPool(pool *BuddyPool, data []byte) error {
+	if pool.region != nil {
+		return nil
+	}
+
+	return unix.Munmap(data)
+}
+
+// Faults in every page of data by writing one word per page.
+// Adding zero atomically leaves the contents unchanged, and unlike writing a byte back with its
+// own value the compiler cannot drop it as a dead store
+func touchPages(data []byte) {
+	var pageSize int = unix.Getpagesize()
+	for i := 0; i < len(data); i += pageSize {
+		atomic.AddUint32((*uint32)(unsafe.Pointer(&data[i])), 0)
+	}
+}
+
+// Works out the k value of a pool asked to manage size bytes.
+// Out of range sizes are clamped to [MIN_K, MAX_K-1] unless strict is set,
+// in which case an ErrSizeOutOfRange describing the request is returned
+func poolKval(size uintptr, strict bool) (uint, error) {
+	if size == 0 {
+		return DEFAULT_K, nil
+	}
+
+	var kval uint = btok(size)
+	if kval < MIN_K {
+		if strict {
+			return 0, fmt.Errorf("%w: %d bytes is below the minimum pool size of 2^%d bytes", ErrSizeOutOfRange, size, MIN_K)
+		}
+		kval = MIN_K
+	}
+	if kval >= MAX_K {
+		if strict {
+			return 0, fmt.Errorf("%w: %d bytes is above the maximum pool size of 2^%d bytes", ErrSizeOutOfRange, size, MAX_K-1)
+		}
+		kval = MAX_K - 1
+	}
+
+	return kval, nil
 }
 
 // Converts the given bytes to the equivalent k value
 // such that 2^k is >= bytes
 func btok(bytes uintptr) uint {
+	return btokMin(bytes, SMALLEST_K)
+}
+
+// Converts the given bytes to the equivalent k value
+// such that 2^k is >= bytes, never returning less than minK.
+// Anything above the largest pool of 2^(MAX_K-1) bytes returns MAX_K
+// without searching, which no pool can serve
+func btokMin(bytes uintptr, minK uint) uint {
+	// Exit early before the shift below could ever wrap to 0
+	if bytes > uintptr(1)<<(MAX_K-1) {
+		return MAX_K
+	}
+
 	// Init k to the smallest allowed size
-	var k uint = SMALLEST_K
+	var k uint = minK
 	// Finds smallest k value that is >= bytes using bitshifting
 	for (uintptr(1) << k) < bytes {
 		k++
@@ -107,6 +515,23 @@ func btok(bytes uintptr) uint {
 	return k
 }
 
+// Returns the k of the block needed to hold size user bytes plus the header.
+// If size+header would wrap around the address space the result is MAX_K,
+// which is always larger than any pool's kvalM
+func requestK(pool *BuddyPool, size uint) uint {
+	var header uintptr = pool.header
+	if uintptr(size) > ^uintptr(0)-header {
+		return MAX_K
+	}
+
+	return btokMin(uintptr(size)+header, pool.smallestK)
+}
+
+// Returns the smallest k whose block can hold an Avail header once it is free
+func headerK() uint {
+	return btokMin(AVAIL_HEADER, 0)
+}
+
 // Calculate offset using go uintptr for pointer arithmetic workaround
 func buddyCalc(pool *BuddyPool, block *Avail) *Avail {
 	var offset uintptr = uintptr(unsafe.Pointer(block)) - pool.base // checks how far into the pool the block of memory is
@@ -117,63 +542,609 @@ func buddyCalc(pool *BuddyPool, block *Avail) *Avail {
 }
 
 // Mallocs the memory based on the requested size and the availability
-// in the memory pool
+// in the memory pool. If the pool is out of memory and has an OnOOM callback
+// it is called with no locks held and the allocation is retried once.
+// Before that every free block parked outside the avail lists is reclaimed and the
+// allocation retried if there were any, so an empty pool always serves a request spanning all of it.
+// A zero size returns nil unless the pool hands out unique pointers for it
 func buddyMalloc(pool *BuddyPool, size uint) (unsafe.Pointer, error) {
-	// Check if pool is nil
-	if pool == nil || size == 0 {
+	// Check if pool is nil or the request is an empty zero size one
+	if pool == nil || (size == 0 && !pool.uniqueZero) {
 		return nil, nil
 	}
+	if pool.state.Load() != poolActive {
+		return nil, ErrPoolClosed
+	}
+	if pool.readOnly {
+		logf(pool, "ERROR: Malloc on a read-only pool")
+		return nil, ErrReadOnly
+	}
+
+	ptr, err := mallocBlock(pool, size)
+
+	// Free memory may be parked where no malloc looks for it
+	if errors.Is(err, unix.ENOMEM) && reclaimParked(pool) {
+		ptr, err = mallocBlock(pool, size)
+	}
+
+	if errors.Is(err, unix.ENOMEM) && pool.onOOM != nil {
+		pool.onOOM(size)
+		ptr, err = mallocBlock(pool, size)
+	}
+
+	return ptr, err
+}
+
+// Mallocs like buddyMalloc and also returns the kval of the block backing the pointer,
+// read from its header. A nil pointer has a kval of 0
+func buddyMallocK(pool *BuddyPool, size uint) (unsafe.Pointer, uint, error) {
+	ptr, err := buddyMalloc(pool, size)
+	if ptr == nil {
+		return nil, 0, err
+	}
+
+	return ptr, uint(ptrToBlock(pool, ptr).kval), nil
+}
+
+// Does a single attempt at buddyMalloc, returning a BallocError wrapping ENOMEM if no block is large enough
+func mallocBlock(pool *BuddyPool, size uint) (unsafe.Pointer, error) {
+	// Get the correct kval (block size) for the request, never going below the pool's smallest block
+	var k uint = requestK(pool, size)
+
+	// Requests larger than the whole pool, including ones whose size+header overflows, can never be satisfied
+	if k > pool.kvalM {
+		logf(pool, "ERROR: No memory available to be allocated")
+		return nil, oomError(pool, unix.ENOMEM, size, k)
+	}
 
-	// Lock malloc and defer unlock till function complete
-	pool.lock.Lock()
-	defer pool.lock.Unlock()
+	// Charge the block against the reserved cap before looking for it
+	var usable int64 = int64((uintptr(1) << k) - pool.header)
+	if !chargeReserved(pool, usable) {
+		logf(pool, "ERROR: Allocation would exceed the reserved byte cap")
+		return nil, oomError(pool, unix.ENOMEM, size, k)
+	}
+	if !chargeAllocs(pool, 1) {
+		pool.reserved.Add(-usable)
+		logf(pool, "ERROR: Allocation would exceed the allocation count cap")
+		return nil, oomError(pool, unix.ENOMEM, size, k)
+	}
 
-	// Get the correct kval (block size) for the request
-	var k uint = btok(uintptr(size) + uintptr(unsafe.Sizeof(Avail{})))
+	// Try the free cache first so hot sizes skip the class locks
+	if pool.cache != nil {
+		var cached *Avail = pool.cache.get(k)
+		if cached != nil {
+			return reserveBlock(pool, cached, size), nil
+		}
+	}
 
-	// Ensure k is the minimum smallest value we take
-	if k < SMALLEST_K {
-		k = SMALLEST_K
+	// Fast path: a free block of exactly class k is handed out with nothing to climb or split
+	lockClass(pool, k)
+	if pool.avail[k].next != &pool.avail[k] {
+		defer unlockRange(pool, k, k)
+		var block *Avail = removeFirst(&pool.avail[k])
+		unhold(pool, block)
+		return reserveBlock(pool, block, size), nil
 	}
 
+	return climbBlock(pool, k, size, usable)
+}
+
+// Climbs from avail[k] to the first non-empty list and splits a block from it down to k.
+// The caller holds the lock for k and has charged usable bytes and the allocation, which are given back on failure
+func climbBlock(pool *BuddyPool, k uint, size uint, usable int64) (unsafe.Pointer, error) {
 	// Declare variable to track the kval of available non-self referenced blocks in the avail[k] list
 	var availableK uint = k
 
-	// Check if availableK is less than pool.kvalM and check if the current avail head node is empty (points to itself)
-	// increment availableK to proceed through avail array in pool
-	for availableK <= pool.kvalM && pool.avail[availableK].next == &pool.avail[availableK] {
+	// Check if the current avail head node is empty (points to itself).
+	// Increment availableK to proceed through avail array in pool, locking each list on the way up
+	for pool.avail[availableK].next == &pool.avail[availableK] {
 		availableK++
+		if availableK > pool.kvalM {
+			break
+		}
+		lockClass(pool, availableK)
 	}
 
 	// Check if availableK is larger than the pool kval and return nil
 	// as no memory can be allocated
 	if availableK > pool.kvalM {
-		var err error = unix.ENOMEM
-		log.Println("ERROR: No memory available to be allocated")
-		return nil, err
+		unlockRange(pool, k, pool.kvalM)
+		pool.reserved.Add(-usable)
+		pool.allocs.Add(-1)
+		logf(pool, "ERROR: No memory available to be allocated")
+		return nil, oomError(pool, unix.ENOMEM, size, k)
 	}
 
+	// Every list the split below touches is locked, release them once the block is handed out
+	defer unlockRange(pool, k, availableK)
+
+	var block *Avail = splitBlock(pool, availableK, k)
+
+	return reserveBlock(pool, block, size), nil
+}
+
+// Removes the first block from avail[availableK] and splits it down to a block of kval k,
+// putting each split off buddy into its avail list. The caller must hold the locks for k through availableK
+func splitBlock(pool *BuddyPool, availableK, k uint) *Avail {
 	// Remove a block from avail if there is a block that can be alloc'd at avail[availableK]
 	var block *Avail = removeFirst(&pool.avail[availableK])
+	unhold(pool, block)
 
 	// While availableK is greater than the correct kval decrement i by one
 	for availableK > k {
+		traceSplit(pool, availableK, block)
 		availableK -= 1
 		// Split the block in avail into two
 		var buddyOffset uintptr = uintptr(unsafe.Pointer(block)) + (uintptr(1) << availableK)
 		var buddy *Avail = (*Avail)(unsafe.Pointer(buddyOffset))
+
+		// Splitting high frees the lower half and carries on with the upper one
+		if pool.splitHigh {
+			buddy, block = block, buddy
+			block.tag = BLOCK_AVAIL
+		}
 		buddy.kval = uint16(availableK)
 		buddy.tag = BLOCK_AVAIL
-		insertBlock(&pool.avail[availableK], buddy)
+		sealHeader(pool, buddy)
+		putBlock(pool, &pool.avail[availableK], buddy)
 
 		block.kval = uint16(availableK)
+		sealHeader(pool, block)
 	}
 
-	// Update block tag
+	return block
+}
+
+// Marks block as handed to the user for a request of size bytes and returns the user pointer.
+// The caller has already charged the block's usable bytes with chargeReserved and counted
+// the allocation with chargeAllocs
+func reserveBlock(pool *BuddyPool, block *Avail, size uint) unsafe.Pointer {
+	// Check nothing wrote to the block while it was free
+	var ptr unsafe.Pointer = blockToPtr(pool, block)
+	if pool.poison {
+		checkPoison(pool, block, ptr)
+		poisonLinks(block)
+	}
+
+	// The list links are the only bytes that were not zeroed on free
+	if pool.secureClear {
+		clearLinks(block)
+	}
+
+	// Update block tag and count the allocation, the live count was charged up front
 	block.tag = BLOCK_RESERVED
+	if pool.prewarmPair.Load() != 0 {
+		leavePrewarm(pool, block)
+	}
+	pool.totalAllocs.Add(1)
+	raisePeak(pool, pool.reserved.Load())
+	if pool.histogram != nil {
+		pool.histogram[block.kval].Add(1)
+	}
+
+	// Write the canary into the slack after the requested size
+	block.size = 0
+	if pool.redzone {
+		armRedzone(pool, block, ptr, size)
+	}
+	sealHeader(pool, block)
+
+	// Remember who asked for this block
+	if pool.sites != nil {
+		pool.siteLock.Lock()
+		pool.sites[uintptr(ptr)] = callers()
+		pool.siteLock.Unlock()
+	}
+
+	return ptr
+}
+
+// Callocs nmemb elements of size bytes each and zeroes the
+// usable region of the returned block before handing it back
+func buddyCalloc(pool *BuddyPool, nmemb, size uint) (unsafe.Pointer, error) {
+	// Check nmemb*size for overflow before multiplying
+	if nmemb != 0 && size > ^uint(0)/nmemb {
+		var err error = unix.ENOMEM
+		logf(pool, "ERROR: Calloc size overflows")
+		return nil, err
+	}
+
+	var ptr unsafe.Pointer
+	var err error
+	ptr, err = buddyMalloc(pool, nmemb*size)
+	if ptr == nil || err != nil {
+		return ptr, err
+	}
+
+	// Zero the usable bytes of the block, leaving the Avail header untouched
+	clear(unsafe.Slice((*byte)(ptr), userSize(pool, ptrToBlock(pool, ptr))))
+
+	return ptr, nil
+}
+
+// Reallocs the block at ptr to hold at least size bytes.
+// The block is kept in place if size still fits in its usable capacity or if
+// free buddies above it can be absorbed to make it large enough,
+// otherwise the contents are moved to a new block and the old one is freed.
+// An aligned pointer keeps its alignment while resized in place, a moved one is a plain allocation
+func buddyRealloc(pool *BuddyPool, ptr unsafe.Pointer, size uint) (unsafe.Pointer, error) {
+	// A nil ptr is a plain malloc
+	if ptr == nil {
+		return buddyMalloc(pool, size)
+	}
+	if pool == nil {
+		return nil, ErrInvalidPointer
+	}
+
+	// A zero size with a live ptr is a free
+	if size == 0 {
+		return nil, buddyFree(pool, ptr)
+	}
+	if pool.state.Load() != poolActive {
+		return nil, ErrPoolClosed
+	}
+	if pool.readOnly {
+		logf(pool, "ERROR: Realloc on a read-only pool")
+		return nil, ErrReadOnly
+	}
+
+	// Validate the pointer like free does before resizing anything.
+	// An aligned pointer resizes the block it was carved from, counting the bytes in front of it
+	block, skew, err := userBlock(pool, ptr)
+	if err != nil {
+		logf(pool, "ERROR: Invalid pointer passed to realloc: %v", err)
+		return nil, misuse(pool, err, ptr)
+	}
+	if block.tag != BLOCK_RESERVED {
+		logf(pool, "ERROR: Realloc of a freed block")
+		return nil, misuse(pool, ErrDoubleFree, ptr)
+	}
+	var raw unsafe.Pointer = blockToPtr(pool, block)
+	if pool.redzone && !checkRedzone(pool, block, raw) {
+		logf(pool, "ERROR: Redzone overwritten on block of kval %d", block.kval)
+		return nil, fmt.Errorf("%w: block kval %d", ErrBufferOverflow, block.kval)
+	}
+	var oldUsable uint = userSize(pool, block) - skew
+
+	// Check if the request still fits in the current block, moving the redzone to the new size
+	if size <= blockUsable(pool, block)-skew {
+		if pool.redzone {
+			armRedzone(pool, block, raw, size+skew)
+		}
+		return ptr, nil
+	}
+
+	// Grow into the free buddies above the block without copying if they are large enough
+	if size <= ^uint(0)-skew && growInPlace(pool, raw, requestK(pool, size+skew)) {
+		if pool.redzone {
+			armRedzone(pool, block, raw, size+skew)
+		}
+		return ptr, nil
+	}
+
+	// Move to a new block. The old block is left untouched if this fails
+	var newPtr unsafe.Pointer
+	newPtr, err = buddyMalloc(pool, size)
+	if newPtr == nil || err != nil {
+		return nil, err
+	}
+
+	// Copy min(oldUsable, newUsable) bytes. Since the new block only gets allocated
+	// when growing, oldUsable is always the smaller of the two
+	var newUsable uint = userSize(pool, ptrToBlock(pool, newPtr))
+	copy(unsafe.Slice((*byte)(newPtr), newUsable), unsafe.Slice((*byte)(ptr), oldUsable))
+
+	// The new block belongs to whoever owned the old one
+	if pool.tagged.Load() {
+		owner, ok := blockOwner(pool, raw)
+		if ok {
+			tagBlock(pool, newPtr, owner)
+		}
+	}
+
+	err = buddyFree(pool, ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPtr, nil
+}
+
+// Grows the reserved block at ptr up to kval k by absorbing its buddies, keeping ptr valid.
+// Every buddy from the block's kval up to k must be free, whole and above the block so the
+// merged block still starts at the same address. Returns false without changing anything otherwise
+func growInPlace(pool *BuddyPool, ptr unsafe.Pointer, k uint) bool {
+	var block *Avail = ptrToBlock(pool, ptr)
+	var from uint = uint(block.kval)
+	if k > pool.kvalM || k <= from {
+		return false
+	}
+
+	// Only the lists the buddies sit in are touched, lock them in ascending order
+	lockRange(pool, from, k-1)
+	defer unlockRange(pool, from, k-1)
+
+	// Check the whole chain before unlinking anything.
+	// A set bit j in the offset means the block is the upper buddy at that level and cannot grow in place
+	var offset uintptr = uintptr(unsafe.Pointer(block)) - pool.base
+	for j := from; j < k; j++ {
+		if offset&(uintptr(1)<<j) != 0 {
+			return false
+		}
+		var buddy *Avail = (*Avail)(unsafe.Pointer(pool.base + offset + uintptr(1)<<j))
+		if buddy.tag != BLOCK_AVAIL || uint(buddy.kval) != j {
+			return false
+		}
+	}
+
+	// Charge the extra usable bytes against the reserved cap
+	var grown uint = uint((uintptr(1) << k) - (uintptr(1) << from))
+	if !chargeReserved(pool, int64(grown)) {
+		return false
+	}
+	raisePeak(pool, pool.reserved.Load())
+
+	// Unlink every buddy, their headers become part of the user region
+	for j := from; j < k; j++ {
+		var buddy *Avail = (*Avail)(unsafe.Pointer(pool.base + offset + uintptr(1)<<j))
+		buddy.prev.next = buddy.next
+		buddy.next.prev = buddy.prev
+		if pool.secureClear {
+			clear(unsafe.Slice((*byte)(unsafe.Pointer(buddy)), AVAIL_HEADER))
+		}
+		traceMerge(pool, j, block)
+	}
+	block.kval = uint16(k)
+	sealHeader(pool, block)
+
+	if pool.tagged.Load() {
+		growOwner(pool, ptr, grown)
+	}
+
+	return true
+}
+
+// Returns how many bytes the caller may use at ptr. This is the full
+// block size 2^kval minus the Avail header, which is >= the requested size.
+// In redzone mode it is the requested size as everything after it is canary.
+// Aligned pointers get the bytes from ptr to the end of their block.
+// Returns 0 for nil and for pointers that are not live allocations of the pool
+func buddyUsableSize(pool *BuddyPool, ptr unsafe.Pointer) uint {
+	if pool == nil || ptr == nil {
+		return 0
+	}
+
+	block, skew, err := userBlock(pool, ptr)
+	if err != nil || block.tag != BLOCK_RESERVED {
+		return 0
+	}
+
+	return userSize(pool, block) - skew
+}
+
+// Returns the bytes usable at the natural user pointer of the live block, the requested
+// size in redzone mode and the whole usable region otherwise
+func userSize(pool *BuddyPool, block *Avail) uint {
+	if pool.redzone && block.size != 0 {
+		return uint(block.size)
+	}
+
+	return blockUsable(pool, block)
+}
+
+// Resolves a user pointer, aligned or not, to the header of its block and how many bytes
+// ptr sits past the block's natural user pointer. Returns the error of validateBlock for
+// pointers that do not lead to a block of the pool
+func userBlock(pool *BuddyPool, ptr unsafe.Pointer) (*Avail, uint, error) {
+	var raw unsafe.Pointer = unalignPtr(pool, ptr)
+	block, err := validateBlock(pool, raw)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return block, uint(uintptr(ptr) - uintptr(raw)), nil
+}
+
+// Returns the alignment every pointer from buddyMalloc is guaranteed to have.
+// A user pointer is header bytes past a block start, which is aligned to at least the smallest block
+// a request can get, so it is the lowest set bit of the header capped by that block size.
+// This is MIN_ALIGN by default and CACHE_LINE when aligning to cache lines. Returns 0 for an uninitialized pool
+func buddyAlignment(pool *BuddyPool) uint {
+	if pool == nil || pool.base == 0 {
+		return 0
+	}
+
+	var headerAlign uintptr = uintptr(1) << bits.TrailingZeros(uint(pool.header))
+	var blockAlign uintptr = uintptr(1) << requestK(pool, 1)
+
+	return uint(min(headerAlign, blockAlign))
+}
+
+// Returns the bytes after the header of block, 2^kval - the pool's header size
+func blockUsable(pool *BuddyPool, block *Avail) uint {
+	return uint((uintptr(1) << block.kval) - pool.header)
+}
+
+// Mallocs size bytes and returns them as a slice over the usable region
+// of the block with len and cap both equal to the usable byte count
+func buddyMallocSlice(pool *BuddyPool, size uint) ([]byte, error) {
+	var ptr unsafe.Pointer
+	var err error
+	ptr, err = buddyMalloc(pool, size)
+	if ptr == nil || err != nil {
+		return nil, err
+	}
+
+	return unsafe.Slice((*byte)(ptr), userSize(pool, ptrToBlock(pool, ptr))), nil
+}
+
+// Frees a slice returned by buddyMallocSlice. The block is recovered from the
+// slice's first element so reslicing the length down, even to zero, is fine
+func buddyFreeSlice(pool *BuddyPool, buf []byte) error {
+	if cap(buf) == 0 {
+		return nil
+	}
+
+	return buddyFree(pool, unsafe.Pointer(unsafe.SliceData(buf)))
+}
+
+// Marks the offset stored in front of an aligned pointer. Real offsets never reach the top bits
+// so a tagged one cannot be mistaken for the header word in front of a plain user pointer
+const alignedTag uintptr = 0xA11C << (bits.UintSize - 16)
+
+// Mallocs size bytes with the returned pointer aligned to alignment, which must be a power of two.
+// The block is over-allocated so an aligned address always fits, and the distance back
+// to the block's natural user pointer is stored, tagged with alignedTag, in the uintptr just
+// before the returned pointer. buddyFree follows it, so aligned pointers free like any other
+func buddyMallocAligned(pool *BuddyPool, size, alignment uint) (unsafe.Pointer, error) {
+	if alignment == 0 || alignment&(alignment-1) != 0 {
+		logf(pool, "ERROR: Alignment is not a power of two")
+		return nil, ErrBadAlignment
+	}
+	if pool == nil || (size == 0 && !pool.uniqueZero) {
+		return nil, nil
+	}
+
+	// The offset slot must itself be aligned so never align to less than a uintptr
+	var slot uint = uint(unsafe.Sizeof(uintptr(0)))
+	if alignment < slot {
+		alignment = slot
+	}
+
+	// Room for the request, worst case padding and the offset slot
+	if size > ^uint(0)-alignment-slot {
+		var err error = unix.ENOMEM
+		logf(pool, "ERROR: Aligned size overflows")
+		return nil, err
+	}
+
+	var raw unsafe.Pointer
+	var err error
+	raw, err = buddyMalloc(pool, size+alignment+slot)
+	if raw == nil || err != nil {
+		return nil, err
+	}
+
+	// Round up past the slot to the next aligned address and record how far we moved
+	var mask uintptr = uintptr(alignment) - 1
+	var aligned uintptr = (uintptr(raw) + uintptr(slot) + mask) &^ mask
+	*(*uintptr)(unsafe.Pointer(aligned - uintptr(slot))) = (aligned - uintptr(raw)) ^ alignedTag
+
+	return unsafe.Pointer(aligned), nil
+}
+
+// Mallocs size bytes starting on an OS page boundary, e.g. for SIMD streaming loads that must not
+// straddle pages. The block header breaks page alignment of plain user pointers even though the
+// mapping itself is page aligned, so this over-allocates like buddyMallocAligned and stores the
+// distance back to the real header just before the returned pointer. Huge page pools still align
+// to the base page size. The pointer is freed with buddyFree like any other
+func buddyMallocPageAligned(pool *BuddyPool, size uint) (unsafe.Pointer, error) {
+	return buddyMallocAligned(pool, size, uint(unix.Getpagesize()))
+}
+
+// Frees a pointer returned by buddyMallocAligned. Kept for callers that pair every aligned
+// malloc with it, buddyFree follows the stored offset itself
+func buddyFreeAligned(pool *BuddyPool, ptr unsafe.Pointer) error {
+	return buddyFree(pool, ptr)
+}
+
+// Returns the natural user pointer of the block an aligned pointer was carved from, or ptr
+// itself if ptr was not returned by buddyMallocAligned. The tagged offset in front of ptr is
+// only followed to a block header that validates and whose usable bytes contain ptr, so user
+// data that happens to look like an offset never redirects a free
+func unalignPtr(pool *BuddyPool, ptr unsafe.Pointer) unsafe.Pointer {
+	var slot uintptr = unsafe.Sizeof(uintptr(0))
+	var addr uintptr = uintptr(ptr)
+	if pool.base == 0 || addr < pool.base+pool.header+slot || addr >= pool.base+pool.numBytes || addr%slot != 0 {
+		return ptr
+	}
+
+	// Cheap checks on the slot first, a plain pointer's header word never passes them
+	var offset uintptr = *(*uintptr)(unsafe.Pointer(addr - slot)) ^ alignedTag
+	if offset < slot || offset%slot != 0 || offset > addr-pool.base-pool.header {
+		return ptr
+	}
+
+	var raw unsafe.Pointer = unsafe.Pointer(addr - offset)
+	block, err := validateBlock(pool, raw)
+	if err != nil || addr >= uintptr(raw)+uintptr(blockUsable(pool, block)) {
+		return ptr
+	}
+
+	return raw
+}
+
+// Checks that ptr was handed out by this pool and returns its header.
+// The pointer must lie within [base + header, base + numBytes) and its header
+// must start an actual block of the pool, not merely sit at an aligned offset
+// inside one. Returns ErrInvalidPointer if either check fails. In checksum mode
+// the pointer's own header is verified first and a mismatch is an ErrCorruptedHeader.
+// The headers above it belong to blocks other goroutines may be splitting or merging
+// without a lock held here, so their checksums are not checked
+func validateBlock(pool *BuddyPool, ptr unsafe.Pointer) (*Avail, error) {
+	var header uintptr = pool.header
+	var addr uintptr = uintptr(ptr)
+
+	// Bounds check against this pool's own mapping
+	if pool.base == 0 || addr < pool.base+header || addr >= pool.base+pool.numBytes {
+		return nil, ErrInvalidPointer
+	}
+
+	// Header must at least be aligned to the smallest block before reading it
+	var offset uintptr = addr - header - pool.base
+	if offset&((uintptr(1)<<pool.smallestK)-1) != 0 {
+		return nil, ErrInvalidPointer
+	}
+
+	// Walk the buddy tree down from the whole pool to the block holding offset.
+	// A node of the tree always starts a real block, so only genuine headers are read
+	// and an interior pointer never gets as far as the fake header in front of it
+	var start uintptr
+	var k uint = pool.kvalM
+	for {
+		var node *Avail = (*Avail)(unsafe.Pointer(pool.base + start))
+		if start == offset && !headerIntact(pool, node) {
+			return nil, fmt.Errorf("%w: block header at offset %#x", ErrCorruptedHeader, start)
+		}
+		if uint(node.kval) > k || uint(node.kval) < pool.smallestK {
+			return nil, ErrInvalidPointer
+		}
+		if uint(node.kval) == k {
+			break
+		}
+
+		// The node is split, move into the half holding offset
+		k--
+		if offset&(uintptr(1)<<k) != 0 {
+			start += uintptr(1) << k
+		}
+	}
+
+	// The pointer must be the user pointer of the block it landed in
+	var leaf *Avail = (*Avail)(unsafe.Pointer(pool.base + start))
+	if start == offset {
+		return leaf, nil
+	}
 
-	return unsafe.Pointer(uintptr(unsafe.Pointer(block)) + uintptr(unsafe.Sizeof(Avail{}))), nil
+	// Inside a free block it is most likely a double free of a block merged away since.
+	// Its old header is free memory nothing has reused, hand it back so the caller sees it is free
+	var stale *Avail = ptrToBlock(pool, ptr)
+	if leaf.tag == BLOCK_AVAIL && stale.tag == BLOCK_AVAIL && uint(stale.kval) >= pool.smallestK && uint(stale.kval) < k &&
+		offset&((uintptr(1)<<stale.kval)-1) == 0 && headerIntact(pool, stale) {
+		return stale, nil
+	}
+
+	return nil, ErrInvalidPointer
+}
 
+// Walks back from a user pointer to the Avail header in front of it
+func ptrToBlock(pool *BuddyPool, ptr unsafe.Pointer) *Avail {
+	return (*Avail)(unsafe.Pointer(uintptr(ptr) - pool.header))
+}
+
+// Returns the user pointer of block, the pool's header size past its start
+func blockToPtr(pool *BuddyPool, block *Avail) unsafe.Pointer {
+	return unsafe.Add(unsafe.Pointer(block), pool.header)
 }
 
 // Removes the first head node of an *Avail list
@@ -203,32 +1174,180 @@ func insertBlock(head *Avail, block *Avail) {
 	head.next = block
 }
 
-// Frees the block and its buddy
-func buddyFree(pool *BuddyPool, ptr unsafe.Pointer) {
-	pool.lock.Lock()
-	defer pool.lock.Unlock()
-
+// Frees the block and its buddy.
+// Returns ErrDoubleFree without touching the avail lists if the block is already free
+func buddyFree(pool *BuddyPool, ptr unsafe.Pointer) error {
 	// If pool and pointer is nil do nothing
 	if pool == nil || ptr == nil {
-		return
+		return nil
 	}
 
-	// Convert pointer to uintptr for pointer math
-	var blockAddr uintptr = uintptr(ptr) - uintptr(unsafe.Sizeof(Avail{}))
-	// Cast block address to ptr using unsafe.Pointer as an intermediary
-	var block *Avail = (*Avail)(unsafe.Pointer(blockAddr))
+	// Aligned pointers are freed through the block's natural user pointer
+	ptr = unalignPtr(pool, ptr)
+
+	var block *Avail
+	var err error
+	block, err = checkFree(pool, ptr)
+	if err != nil {
+		return err
+	}
+
+	err = freeBlock(pool, ptr, block)
+	if err != nil {
+		return err
+	}
+	notifyFree(pool)
+	drainIfFragmented(pool)
+
+	// Catch the free that broke an invariant rather than a symptom much later
+	if pool.verifyFrees {
+		err = buddyVerify(pool)
+		if err != nil {
+			logf(pool, "ERROR: Pool invariant broken by free: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Frees the block behind ptr once checkFree has passed it. Shared by buddyFree and buddyFreeBatch,
+// the caller must not hold any class lock
+func freeBlock(pool *BuddyPool, ptr unsafe.Pointer, block *Avail) error {
+	// Poison or zero the user region before anything else can reuse it
+	scrubBlock(pool, block)
+
+	// Give large blocks' pages back to the OS while the block is still ours
+	releasePages(pool, block)
+
+	// Read the size now, the header may be merged away once the block is released
+	var usable uint = blockUsable(pool, block)
+
+	// Park the block in the free cache if enabled, otherwise give it back to the avail lists
+	if pool.cache != nil {
+		pool.cache.put(pool, block)
+	} else {
+		var err error = releaseBlock(pool, block)
+		if err != nil {
+			return err
+		}
+	}
+
+	forgetBlock(pool, ptr, usable)
+	return nil
+}
+
+// Runs every check needed before ptr can be freed and returns its header
+func checkFree(pool *BuddyPool, ptr unsafe.Pointer) (*Avail, error) {
+	if pool.state.Load() != poolActive {
+		return nil, ErrPoolClosed
+	}
+	if pool.readOnly {
+		logf(pool, "ERROR: Free on a read-only pool")
+		return nil, ErrReadOnly
+	}
+
+	// Validate the pointer before touching any memory it points to.
+	// The header of a live block belongs to the caller so it is safe to read before locking
+	block, err := validateBlock(pool, ptr)
+	if err != nil {
+		logf(pool, "ERROR: Invalid pointer passed to free: %v", err)
+		return nil, misuse(pool, err, ptr)
+	}
+
+	// Check the block is still handed out, freeing it again would corrupt the avail lists or the cache
+	if block.tag == BLOCK_AVAIL || block.tag == BLOCK_CACHED {
+		logf(pool, "ERROR: Double free detected")
+		return nil, misuse(pool, ErrDoubleFree, ptr)
+	}
+
+	// Check the canary is still intact. The block stays reserved so the caller can inspect it
+	if pool.redzone && !checkRedzone(pool, block, ptr) {
+		logf(pool, "ERROR: Redzone overwritten on block of kval %d", block.kval)
+		return nil, fmt.Errorf("%w: block kval %d", ErrBufferOverflow, block.kval)
+	}
+
+	return block, nil
+}
+
+// Returns err for a double free, invalid pointer or corrupted header at ptr,
+// or panics with it when the pool was created with PanicOnError
+func misuse(pool *BuddyPool, err error, ptr unsafe.Pointer) error {
+	if pool.panicOnError {
+		panic(fmt.Errorf("%w: pointer %p", err, ptr))
+	}
+
+	return err
+}
+
+// Drops the bookkeeping for a block that is no longer held by the user
+// usable is the block's usable size, read before the block was released and possibly merged away
+func forgetBlock(pool *BuddyPool, ptr unsafe.Pointer, usable uint) {
+	pool.allocs.Add(-1)
+	pool.totalFrees.Add(1)
+	pool.reserved.Add(-int64(usable))
+	if pool.sites != nil {
+		pool.siteLock.Lock()
+		delete(pool.sites, uintptr(ptr))
+		pool.siteLock.Unlock()
+	}
+	if pool.tagged.Load() {
+		untagBlock(pool, ptr, usable)
+	}
+
+	// A block freed directly while retained takes its extra references with it
+	if pool.retained.Load() {
+		pool.refLock.Lock()
+		delete(pool.refs, uintptr(ptr))
+		pool.refLock.Unlock()
+	}
+}
+
+// Returns a block to the avail lists and coalesces it
+func releaseBlock(pool *BuddyPool, block *Avail) error {
+	// Lock the block's own size class. Coalescing takes the classes above it in order
+	var k uint = uint(block.kval)
+	lockClass(pool, k)
+	var top uint = k
+	defer func() { unlockRange(pool, k, top) }()
+
+	// A racing free may have merged the block away since it was read
+	if uint(block.kval) != k || block.tag == BLOCK_AVAIL {
+		logf(pool, "ERROR: Double free detected")
+		return misuse(pool, ErrDoubleFree, blockToPtr(pool, block))
+	}
 
 	// Update block status and coalesce
 	block.tag = BLOCK_AVAIL
-	coalesce(pool, block)
+	top = coalesce(pool, block, true)
+
+	return nil
 }
 
 // Attempt to merge this block with its buddy.
 // Merging only occurs if both blocks are the same size (kval)
 // and are both marked BLOCK_AVAIL. Coalescing continues
 // recursively to form the largest free block possible.
-func coalesce(pool *BuddyPool, block *Avail) {
+// The caller must hold the lock for block.kval. If lockUp is set each level merged
+// into is locked on the way up and left locked, the returned k is the highest one now held.
+// Callers already holding every lock above block.kval pass lockUp as false
+func coalesce(pool *BuddyPool, block *Avail, lockUp bool) uint {
+	// In deferred mode merging waits for buddyCoalesceAll
+	if pool.deferCoalesce {
+		sealHeader(pool, block)
+		putBlock(pool, &pool.avail[block.kval], block)
+		return uint(block.kval)
+	}
+
+	// Only the freed block's own level may be held back from merging
+	var freedK uint16 = block.kval
 	for {
+		// A block spanning the whole pool has no buddy. Stop before buddyCalc
+		// computes an address outside of this pool's own mapping
+		if uint(block.kval) >= pool.kvalM {
+			break
+		}
+
 		// Locate the buddy
 		var buddy *Avail = buddyCalc(pool, block)
 
@@ -243,6 +1362,17 @@ func coalesce(pool *BuddyPool, block *Avail) {
 			break
 		}
 
+		// A buddy that only looks free because its header was overwritten must not be merged
+		if !headerIntact(pool, buddy) {
+			logf(pool, "ERROR: Corrupted header at offset %#x, not merging", uintptr(unsafe.Pointer(buddy))-pool.base)
+			break
+		}
+
+		// Keep the freed block split from its buddy while there is a slot to hold the pair
+		if pool.holdSplits != 0 && block.kval == freedK && tryHold(pool) {
+			break
+		}
+
 		// Remove buddy from list. This is what ensures you have one larger block when merged
 		// as you are destroying the reference to the buddy which will always be the XOR'd
 		// compliment to the block
@@ -261,44 +1391,219 @@ func coalesce(pool *BuddyPool, block *Avail) {
 			lowerBlock = buddy // continue with buddy
 		}
 
-		// Merge
+		// Merge. Lock the next size class before the merged block claims it
+		if lockUp {
+			lockClass(pool, uint(lowerBlock.kval)+1)
+		}
 		lowerBlock.kval++  // Increment kval up i.e. going from two 512 byte blocks 2^9 to one 1024 byte block 2^10
 		block = lowerBlock // Set the block passed to the function to the merged lowerBlock and updates target block
-	}
+		sealHeader(pool, block)
+		traceMerge(pool, uint(block.kval)-1, block)
 
-	insertBlock(&pool.avail[block.kval], block) // insert coalesced block into its new avail[k] list
-}
+		// The upper half's header is now inside the merged block's user region
+		if pool.poison {
+			poisonHeader(block)
+		}
+	}
 
-// Destroys and unmaps the memory pool
-func buddyDestroy(pool *BuddyPool) error {
-	pool.lock.Lock()
-	defer pool.lock.Unlock()
+	sealHeader(pool, block)
+	putBlock(pool, &pool.avail[block.kval], block) // insert coalesced block into its new avail[k] list
 
-	const maxPoolSize = uintptr(1) << MAX_K
+	return uint(block.kval)
+}
 
-	// If there is no pool or base is 0, nothing can be destroyed
-	if pool == nil || pool.base == 0 {
-		return nil
-	}
+// Rebuilds the byte slice unix.Mmap returned for the pool's mapping
+func poolBytes(pool *BuddyPool) []byte {
+	// Largest pool there can be. An array of 2^MAX_K bytes is too large for a 32-bit address space
+	const maxPoolSize = uintptr(1) << (MAX_K - 1)
 
-	// Get the pointer to the pool base to use for the unmap
+	// Get the pointer to the pool base
 	var dataPtr unsafe.Pointer = unsafe.Pointer(pool.base)
 
-	// Unmaps the memory using byte slice cast as unix.Munmap expects []byte
 	// Cast the dataPointer as a large slice to be trimmed (pretending this is the start of a lare array in memory)
 	// Trims the length of the array to the size and capacity of pool.numBytes
 	// uses go's three index slice syntax a[low : high : max] this means we
 	// use a slice from 0 to pool.numBytes and no more or less than pool.numBytes
 	// making an exact slice the memory range
-	var err error = unix.Munmap((*[maxPoolSize]byte)(dataPtr)[:pool.numBytes:pool.numBytes])
+	return (*[maxPoolSize]byte)(dataPtr)[:pool.numBytes:pool.numBytes]
+}
+
+// Frees every allocation at once by rebuilding the avail lists as a single free block,
+// exactly as init leaves them, while keeping the mapping. Every pointer into the pool is invalid afterwards.
+// Read-only pools and pools that are not active are left as they are
+func buddyReset(pool *BuddyPool) {
+	// Hold off destroy and grow so the cache and mapping stay put for the whole reset
+	if pool == nil {
+		return
+	}
+	pool.lifecycle.Lock()
+	defer pool.lifecycle.Unlock()
+	if pool.state.Load() != poolActive {
+		return
+	}
+
+	// Empty the free cache first, its blocks will be part of the new top block
+	if pool.cache != nil {
+		pool.cache.flush(pool)
+	}
+
+	lockAll(pool)
+
+	if pool.base == 0 || pool.readOnly {
+		unlockAll(pool)
+		return
+	}
+
+	// Drop the bookkeeping of every live allocation, starting a new peak and new counters
+	pool.allocs.Store(0)
+	pool.totalAllocs.Store(0)
+	pool.totalFrees.Store(0)
+	pool.totalSplits.Store(0)
+	pool.totalMerges.Store(0)
+	pool.reserved.Store(0)
+	pool.peak.Store(0)
+	if pool.sites != nil {
+		pool.siteLock.Lock()
+		clear(pool.sites)
+		pool.siteLock.Unlock()
+	}
+	pool.refLock.Lock()
+	pool.refs = nil
+	pool.retained.Store(false)
+	pool.refLock.Unlock()
+	clearOwners(pool)
+
+	resetAvail(pool)
+	unlockAll(pool)
+
+	// Everything is free now so wake anyone blocked in buddyMallocWait
+	notifyFree(pool)
+}
+
+// Counts the blocks handed out by walking every header from base.
+// The caller must hold every lock
+func countReserved(pool *BuddyPool) uint {
+	var count uint
+	var offset uintptr
+	for offset < pool.numBytes {
+		var block *Avail = (*Avail)(unsafe.Pointer(pool.base + offset))
+		if block.tag == BLOCK_RESERVED {
+			count++
+		}
+		offset += uintptr(1) << block.kval
+	}
+	return count
+}
+
+// Destroys and unmaps the memory pool
+func buddyDestroy(pool *BuddyPool) error {
+	// If there is no pool or it is not mapped, nothing can be destroyed
+	if pool == nil {
+		return nil
+	}
+	pool.lifecycle.Lock()
+	defer pool.lifecycle.Unlock()
+	if pool.state.Load() != poolActive {
+		return nil
+	}
+
+	// Hand cached blocks back before taking every lock, flushing needs the class locks
+	if pool.cache != nil {
+		pool.cache.flush(pool)
+	}
+
+	lockAll(pool)
+	defer unlockAll(pool)
+
+	// In strict destroy mode refuse to turn outstanding pointers into dangling ones
+	if pool.strictDestroy {
+		var outstanding uint = countReserved(pool)
+		if outstanding != 0 {
+			logf(pool, "ERROR: Destroy with %d allocations outstanding", outstanding)
+			return fmt.Errorf("%w: %d blocks still reserved", ErrAllocationsOutstanding, outstanding)
+		}
+	}
+
+	// Rebuild the mapped byte slice as unix.Munlock and unix.Munmap expect []byte
+	var data []byte = poolBytes(pool)
+
+	// Flush a file-backed mapping so its contents reach the file
+	var err error
+	if pool.fileBacked {
+		err = unix.Msync(data, unix.MS_SYNC)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Unpin the mapping before it is unmapped
+	if pool.locked {
+		err = unix.Munlock(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = unmapPool(pool, data)
 	if err != nil {
 		return err
 	}
 
-	// Zero the BuddyPool except the mutex lock so the defer can trigger sucessfullyc
+	// Zero the BuddyPool except the mutex locks so the defer can trigger sucessfullyc
+	pool.state.Store(poolDestroyed)
 	pool.base = 0
 	pool.numBytes = 0
 	pool.kvalM = 0
+	pool.smallestK = 0
+	pool.header = 0
+	pool.allocs.Store(0)
+	pool.totalAllocs.Store(0)
+	pool.totalFrees.Store(0)
+	pool.totalSplits.Store(0)
+	pool.totalMerges.Store(0)
+	pool.reserved.Store(0)
+	pool.peak.Store(0)
+	pool.locked = false
+	pool.hugePages = false
+	pool.fileBacked = false
+	pool.readOnly = false
+	pool.region = nil
+	pool.redzone = false
+	pool.checksum = false
+	pool.poison = false
+	pool.secureClear = false
+	pool.onPoison = nil
+	pool.onOOM = nil
+	pool.onSplit = nil
+	pool.onMerge = nil
+	pool.logger = nil
+	pool.histogram = nil
+	pool.lockStats = nil
+	pool.deferCoalesce = false
+	pool.holdSplits = 0
+	pool.held.Store(0)
+	pool.uniqueZero = false
+	pool.strictDestroy = false
+	pool.panicOnError = false
+	pool.verifyFrees = false
+	pool.prewarmK = 0
+	pool.prewarmPair.Store(0)
+	pool.adviseK = 0
+	pool.drainAt = 0
+	pool.drainK = 0
+	pool.drained = false
+	pool.drains = 0
+	pool.strategy = StrategyClimb
+	pool.splitHigh = false
+	pool.maxReserved = 0
+	pool.maxAllocs = 0
+	pool.cache = nil
+	pool.sites = nil
+	pool.refLock.Lock()
+	pool.refs = nil
+	pool.retained.Store(false)
+	pool.refLock.Unlock()
+	clearOwners(pool)
 	for i := range pool.avail {
 		pool.avail[i] = Avail{}
 	}
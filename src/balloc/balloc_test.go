@@ -1,9 +1,14 @@
 package balloc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/bits"
 	"math/rand"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
@@ -59,12 +64,12 @@ func TestBuddyMallocOneLarge(t *testing.T) {
 	size := uintptr(1) << MIN_K
 	_ = buddyInit(&pool, size)
 
-	ask := size - uintptr(unsafe.Sizeof(Avail{}))
+	ask := size - BLOCK_HEADER
 	mem, err := buddyMalloc(&pool, uint(ask))
 	assert.NoError(t, err)
 	assert.NotNil(t, mem)
 
-	tmp := (*Avail)(unsafe.Pointer(uintptr(mem) - uintptr(unsafe.Sizeof(Avail{}))))
+	tmp := (*Avail)(unsafe.Pointer(uintptr(mem) - BLOCK_HEADER))
 	assert.Equal(t, uint16(MIN_K), tmp.kval)
 	assert.Equal(t, BLOCK_RESERVED, tmp.tag)
 	checkBuddyPoolEmpty(t, &pool)
@@ -117,10 +122,11 @@ func TestBuddyInitEdgeCases(t *testing.T) {
 
 	// Test with size larger than MAX_K → should clamp to MAX_K - 1
 	// NOTE: This test no longer tries to allocate > MAX_K. Just a big enough number to trigger clamping.
-	largeSize := uintptr(1 << 36) // would fail if not clamped
+	largeK := min(36, MAX_K-1)        // 32-bit builds cannot address 2^36
+	largeSize := uintptr(1) << largeK // would fail if not clamped
 	err = buddyInit(&pool, largeSize)
 	assert.NoError(t, err)
-	assert.Equal(t, uint(36), pool.kvalM)
+	assert.Equal(t, largeK, pool.kvalM)
 	_ = buddyDestroy(&pool)
 }
 
@@ -139,6 +145,85 @@ func TestBuddyMallocEdgeCases(t *testing.T) {
 	_ = buddyDestroy(&pool)
 }
 
+func TestBuddyMallocK(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing malloc reports the kval backing each block")
+	for _, opts := range []Options{{}, {SmallestK: 10}, {AlignToCacheLine: true}} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+
+		// The kval is the header's and the smallest k holding size plus the header
+		var ptrs []unsafe.Pointer
+		for _, size := range []uint{1, 24, 56, 57, 100, 1000, 4096, 1<<16 - 8} {
+			ptr, k, err := buddyMallocK(&pool, size)
+			assert.NoError(t, err)
+			assert.Equal(t, uint(ptrToBlock(&pool, ptr).kval), k, "size %d", size)
+			assert.Equal(t, max(btok(uintptr(size)+pool.header), pool.smallestK), k, "size %d", size)
+			assert.Equal(t, uint(1)<<k-uint(pool.header), buddyUsableSize(&pool, ptr))
+			ptrs = append(ptrs, ptr)
+		}
+		for _, ptr := range ptrs {
+			assert.NoError(t, buddyFree(&pool, ptr))
+		}
+
+		// Failed and zero size mallocs report no block
+		ptr, k, err := buddyMallocK(&pool, 0)
+		assert.Nil(t, ptr)
+		assert.Equal(t, uint(0), k)
+		assert.NoError(t, err)
+		ptr, k, err = buddyMallocK(&pool, 1<<MIN_K)
+		assert.Nil(t, ptr)
+		assert.Equal(t, uint(0), k)
+		assert.ErrorIs(t, err, unix.ENOMEM)
+
+		checkBuddyPoolFull(t, &pool)
+		_ = buddyDestroy(&pool)
+	}
+}
+
+func TestBuddyMallocUniqueZero(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing zero size mallocs hand out unique freeable pointers")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{UniqueZero: true}))
+
+	// Every zero size malloc gets its own smallest block
+	var seen map[unsafe.Pointer]bool = make(map[unsafe.Pointer]bool)
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 64; i++ {
+		ptr, err := buddyMalloc(&pool, 0)
+		assert.NoError(t, err)
+		assert.NotNil(t, ptr)
+		assert.False(t, seen[ptr], "pointer %p handed out twice", ptr)
+		assert.Equal(t, uint16(SMALLEST_K), ptrToBlock(&pool, ptr).kval)
+		seen[ptr] = true
+		ptrs = append(ptrs, ptr)
+	}
+	assert.True(t, buddyCanAlloc(&pool, 0))
+
+	// They free like any other pointer, and only once
+	for _, ptr := range ptrs {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	assert.ErrorIs(t, buddyFree(&pool, ptrs[0]), ErrDoubleFree)
+	checkBuddyPoolFull(t, &pool)
+
+	// Aligned zero size mallocs follow the same mode
+	ptr, err := buddyMallocAligned(&pool, 0, 256)
+	assert.NoError(t, err)
+	assert.NotNil(t, ptr)
+	assert.Zero(t, uintptr(ptr)%256)
+	assert.NoError(t, buddyFreeAligned(&pool, ptr))
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+
+	// Without the option zero size mallocs stay nil
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	ptr, err = buddyMalloc(&pool, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, ptr)
+	assert.False(t, buddyCanAlloc(&pool, 0))
+	_ = buddyDestroy(&pool)
+}
+
 func TestInsertRemoveBlock(t *testing.T) {
 	var head Avail
 	head.next = &head
@@ -184,6 +269,1483 @@ func TestDestroyTwice(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestStrictDestroy(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing strict destroy refuses to unmap with outstanding allocations")
+	var pool BuddyPool
+	var logger captureLogger
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{StrictDestroy: true, CacheDepth: 2, Logger: &logger}))
+
+	mem, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	cached, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, cached))
+
+	// Only the live block counts, the cached one is flushed back first
+	err = buddyDestroy(&pool)
+	assert.ErrorIs(t, err, ErrAllocationsOutstanding)
+	assert.Contains(t, err.Error(), "1 blocks still reserved")
+	assert.True(t, logger.contains("Destroy with 1 allocations outstanding"))
+
+	// The mapping is untouched and the block still usable
+	assert.NotZero(t, pool.base)
+	unsafe.Slice((*byte)(mem), 100)[99] = 0x5A
+	assert.NoError(t, buddyVerify(&pool))
+
+	// Once the block is freed destroy goes through
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.NoError(t, buddyDestroy(&pool))
+	assert.Zero(t, pool.base)
+	assert.False(t, pool.strictDestroy)
+}
+
+func TestPoolLifecycle(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the init and destroy state machine")
+	var pool BuddyPool
+	var stray int
+
+	// A pool that was never initialized refuses to allocate or free
+	_, err := buddyMalloc(&pool, 100)
+	assert.ErrorIs(t, err, ErrPoolClosed)
+	assert.ErrorIs(t, buddyFree(&pool, unsafe.Pointer(&stray)), ErrPoolClosed)
+	_, err = buddyMallocBatch(&pool, 100, 2)
+	assert.ErrorIs(t, err, ErrPoolClosed)
+
+	// Initializing twice fails and leaves the first mapping in use
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	mem, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	var base uintptr = pool.base
+	assert.ErrorIs(t, buddyInit(&pool, 1<<(MIN_K+1)), ErrAlreadyInitialized)
+	assert.Equal(t, base, pool.base)
+	assert.Equal(t, MIN_K, pool.kvalM)
+	assert.NoError(t, buddyFree(&pool, mem))
+
+	// After destroy the pool is closed until it is initialized again
+	mem, err = buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyDestroy(&pool))
+	_, err = buddyMalloc(&pool, 100)
+	assert.ErrorIs(t, err, ErrPoolClosed)
+	assert.ErrorIs(t, buddyFree(&pool, mem), ErrPoolClosed)
+	assert.NoError(t, buddyDestroy(&pool))
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	mem, err = buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	_ = buddyDestroy(&pool)
+}
+
+func TestPoolLifecycleConcurrent(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing racing inits and destroys of one pool")
+	var pool BuddyPool
+
+	// Exactly one of many racing inits maps the pool
+	var wg sync.WaitGroup
+	var inited atomic.Int32
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error = buddyInit(&pool, 1<<MIN_K)
+			if err == nil {
+				inited.Add(1)
+				return
+			}
+			assert.ErrorIs(t, err, ErrAlreadyInitialized)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), inited.Load())
+
+	// Inits and destroys interleave without ever seeing the other halfway through
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				var err error = buddyInit(&pool, 1<<MIN_K)
+				if err != nil {
+					assert.ErrorIs(t, err, ErrAlreadyInitialized)
+				}
+				assert.NoError(t, buddyDestroy(&pool))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Zero(t, pool.base)
+	assert.Equal(t, poolDestroyed, pool.state.Load())
+	_, err := buddyMalloc(&pool, 100)
+	assert.ErrorIs(t, err, ErrPoolClosed)
+}
+
+func TestBuddyCallocZeroesRecycledBlock(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing calloc zeroes a recycled block")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Dirty the block with a sentinel pattern then hand it back
+	mem, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	tmp := (*Avail)(unsafe.Pointer(uintptr(mem) - BLOCK_HEADER))
+	usable := (uintptr(1) << tmp.kval) - BLOCK_HEADER
+	dirty := unsafe.Slice((*byte)(mem), usable)
+	for i := range dirty {
+		dirty[i] = 0xAB
+	}
+	buddyFree(&pool, mem)
+
+	mem, err = buddyCalloc(&pool, 10, 10)
+	assert.NoError(t, err)
+	assert.NotNil(t, mem)
+	for i, b := range unsafe.Slice((*byte)(mem), usable) {
+		assert.Equal(t, byte(0), b, "byte %d not zeroed", i)
+	}
+
+	buddyFree(&pool, mem)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyCallocOverflow(t *testing.T) {
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	ptr, err := buddyCalloc(&pool, ^uint(0), 2)
+	assert.Nil(t, ptr)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyReallocShrinkInPlace(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing realloc shrink in place")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	mem, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+
+	shrunk, err := buddyRealloc(&pool, mem, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, mem, shrunk)
+
+	buddyFree(&pool, shrunk)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyReallocGrowMoves(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing realloc grow requiring a move")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	mem, err := buddyMalloc(&pool, 16)
+	assert.NoError(t, err)
+	tmp := (*Avail)(unsafe.Pointer(uintptr(mem) - BLOCK_HEADER))
+	usable := (uintptr(1) << tmp.kval) - BLOCK_HEADER
+	src := unsafe.Slice((*byte)(mem), usable)
+	for i := range src {
+		src[i] = byte(i)
+	}
+
+	// Reserve the buddy so the block cannot grow in place
+	neighbour, err := buddyMalloc(&pool, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(buddyCalc(&pool, tmp)), unsafe.Pointer(ptrToBlock(&pool, neighbour)))
+
+	grown, err := buddyRealloc(&pool, mem, 4096)
+	assert.NoError(t, err)
+	assert.NotNil(t, grown)
+	assert.NotEqual(t, mem, grown)
+	for i, b := range unsafe.Slice((*byte)(grown), usable) {
+		assert.Equal(t, byte(i), b, "byte %d not copied", i)
+	}
+
+	buddyFree(&pool, grown)
+	buddyFree(&pool, neighbour)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyReallocGrowInPlace(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing realloc grow absorbing free buddies in place")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{MaxReserved: 8192}))
+
+	mem, err := buddyMalloc(&pool, 16)
+	assert.NoError(t, err)
+	src := unsafe.Slice((*byte)(mem), buddyUsableSize(&pool, mem))
+	for i := range src {
+		src[i] = byte(i)
+	}
+
+	// Every buddy above the block is free so it grows without moving
+	grown, err := buddyRealloc(&pool, mem, 4096)
+	assert.NoError(t, err)
+	assert.Equal(t, mem, grown)
+	assert.Equal(t, uint16(btok(4096+BLOCK_HEADER)), ptrToBlock(&pool, grown).kval)
+	for i, b := range src {
+		assert.Equal(t, byte(i), b, "byte %d changed", i)
+	}
+	assert.Equal(t, int64(buddyUsableSize(&pool, grown)), pool.reserved.Load())
+	assert.Equal(t, int64(1), pool.allocs.Load())
+	assert.NoError(t, buddyVerify(&pool))
+
+	// Freeing the grown block coalesces the pool back up
+	assert.NoError(t, buddyFree(&pool, grown))
+	checkBuddyPoolFull(t, &pool)
+
+	// An upper buddy cannot grow in place since the merged block would start below it
+	lower, err := buddyMalloc(&pool, 16)
+	assert.NoError(t, err)
+	upper, err := buddyMalloc(&pool, 16)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, lower))
+	moved, err := buddyRealloc(&pool, upper, 100)
+	assert.NoError(t, err)
+	assert.NotEqual(t, upper, moved)
+	assert.NoError(t, buddyFree(&pool, moved))
+	checkBuddyPoolFull(t, &pool)
+
+	// Growing past the reserved cap falls back to the copy, which fails the same way
+	mem, err = buddyMalloc(&pool, 16)
+	assert.NoError(t, err)
+	_, err = buddyRealloc(&pool, mem, 8192)
+	assert.Error(t, err)
+	assert.Equal(t, uint16(SMALLEST_K), ptrToBlock(&pool, mem).kval)
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyReallocEdgeCases(t *testing.T) {
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// nil ptr behaves like malloc
+	mem, err := buddyRealloc(&pool, nil, 32)
+	assert.NoError(t, err)
+	assert.NotNil(t, mem)
+
+	// zero size frees
+	mem, err = buddyRealloc(&pool, mem, 0)
+	assert.NoError(t, err)
+	assert.Nil(t, mem)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyReallocInvalid(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing realloc rejects pointers free would reject")
+	var x int
+	_, err := buddyRealloc(nil, unsafe.Pointer(&x), 32)
+	assert.ErrorIs(t, err, ErrInvalidPointer)
+
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// A freed pointer is not resized in place, even to a size its old block would hold
+	mem, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	again, err := buddyRealloc(&pool, mem, 50)
+	assert.Nil(t, again)
+	assert.ErrorIs(t, err, ErrDoubleFree)
+
+	// Neither is an interior pointer of a live block
+	mem, err = buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	_, err = buddyRealloc(&pool, unsafe.Add(mem, 8), 50)
+	assert.ErrorIs(t, err, ErrInvalidPointer)
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	// A destroyed pool resizes nothing
+	_ = buddyDestroy(&pool)
+	_, err = buddyRealloc(&pool, mem, 50)
+	assert.ErrorIs(t, err, ErrPoolClosed)
+}
+
+func TestBuddyUsableSize(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing usable size of allocations")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	assert.Equal(t, uint(0), buddyUsableSize(&pool, nil))
+
+	for _, ask := range []uint{1, 7, 32, 33, 100, 1000, 4096, 50000} {
+		mem, err := buddyMalloc(&pool, ask)
+		assert.NoError(t, err)
+
+		usable := buddyUsableSize(&pool, mem)
+		tmp := (*Avail)(unsafe.Pointer(uintptr(mem) - BLOCK_HEADER))
+		assert.GreaterOrEqual(t, usable, ask)
+		assert.Equal(t, uint(1)<<tmp.kval-uint(BLOCK_HEADER), usable)
+
+		buddyFree(&pool, mem)
+	}
+
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyDoubleFree(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing double free is rejected")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	mem, err := buddyMalloc(&pool, 1)
+	assert.NoError(t, err)
+	keep, err := buddyMalloc(&pool, 1)
+	assert.NoError(t, err)
+
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.ErrorIs(t, buddyFree(&pool, mem), ErrDoubleFree)
+
+	// The pool must still be intact after the rejected free
+	assert.NoError(t, buddyFree(&pool, keep))
+	assert.ErrorIs(t, buddyFree(&pool, keep), ErrDoubleFree)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyFreeInvalidPointer(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing free rejects pointers outside the pool")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	mem, err := buddyMalloc(&pool, 1)
+	assert.NoError(t, err)
+
+	header := BLOCK_HEADER
+	below := unsafe.Pointer(pool.base + header - 1)
+	past := unsafe.Pointer(pool.base + pool.numBytes)
+	misaligned := unsafe.Pointer(uintptr(mem) + 1)
+
+	assert.ErrorIs(t, buddyFree(&pool, below), ErrInvalidPointer)
+	assert.ErrorIs(t, buddyFree(&pool, past), ErrInvalidPointer)
+	assert.ErrorIs(t, buddyFree(&pool, misaligned), ErrInvalidPointer)
+
+	// The real pointer still frees cleanly
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestPanicOnError(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing misuse panics or returns an error depending on PanicOnError")
+	for _, panics := range []bool{false, true} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{PanicOnError: panics, Checksum: true}))
+		mem, err := buddyMalloc(&pool, 100)
+		assert.NoError(t, err)
+		assert.NoError(t, buddyFree(&pool, mem))
+
+		// A double free, an invalid pointer and an overwritten header are all misuse
+		for _, misuse := range []struct {
+			err  error
+			free func() error
+		}{
+			{ErrDoubleFree, func() error { return buddyFree(&pool, mem) }},
+			{ErrInvalidPointer, func() error { return buddyFree(&pool, unsafe.Add(mem, 1)) }},
+			{ErrCorruptedHeader, func() error {
+				live, _ := buddyMalloc(&pool, 100)
+				ptrToBlock(&pool, live).kval++
+				defer func() { ptrToBlock(&pool, live).kval--; _ = buddyFree(&pool, live) }()
+				return buddyFree(&pool, live)
+			}},
+		} {
+			if !panics {
+				assert.ErrorIs(t, misuse.free(), misuse.err)
+				continue
+			}
+
+			// The panic value is the error itself, naming the pointer
+			var recovered any
+			func() {
+				defer func() { recovered = recover() }()
+				_ = misuse.free()
+			}()
+			err, ok := recovered.(error)
+			if assert.True(t, ok, "expected a panic for %v", misuse.err) {
+				assert.ErrorIs(t, err, misuse.err)
+				assert.Contains(t, err.Error(), "pointer 0x")
+			}
+		}
+
+		// Nothing was touched on the way so the pool is whole again
+		checkBuddyPoolFull(t, &pool)
+		assert.NoError(t, buddyVerify(&pool))
+		_ = buddyDestroy(&pool)
+	}
+}
+
+func TestBuddyFreeInteriorPointer(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing free rejects pointers into the middle of an allocation")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	var size uint = 1<<10 - uint(BLOCK_HEADER)
+	mem, err := buddyMalloc(&pool, size)
+	assert.NoError(t, err)
+	var neighbour unsafe.Pointer
+	neighbour, err = buddyMalloc(&pool, 1)
+	assert.NoError(t, err)
+
+	// A few bytes in
+	for _, off := range []int{1, 3, int(BLOCK_HEADER), 60} {
+		assert.ErrorIs(t, buddyFree(&pool, unsafe.Add(mem, off)), ErrInvalidPointer, "offset %d", off)
+	}
+
+	// Interior pointers whose header slot lands on a block boundary, even over
+	// user data that looks exactly like the header of a reserved block
+	for _, off := range []uintptr{1 << SMALLEST_K, 1 << 8, 1 << 9} {
+		var fake *Avail = (*Avail)(unsafe.Add(mem, off-BLOCK_HEADER))
+		fake.tag = BLOCK_RESERVED
+		fake.kval = uint16(SMALLEST_K)
+		fake.size = 0
+		assert.ErrorIs(t, buddyFree(&pool, unsafe.Add(mem, off)), ErrInvalidPointer, "offset %d", off)
+		assert.ErrorIs(t, buddyRetain(&pool, unsafe.Add(mem, off)), ErrInvalidPointer, "offset %d", off)
+	}
+
+	// Nothing was corrupted and both real pointers still free
+	assert.NoError(t, buddyVerify(&pool))
+	assert.Equal(t, uint16(10), ptrToBlock(&pool, mem).kval)
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.NoError(t, buddyFree(&pool, neighbour))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+// Asserts every node in the avail lists of pool is either one of its own
+// sentinels or a block inside its own mmap region
+func checkBuddyPoolIsolated(t *testing.T, pool *BuddyPool) {
+	inPool := func(a *Avail) bool {
+		addr := uintptr(unsafe.Pointer(a))
+		if addr >= pool.base && addr < pool.base+pool.numBytes {
+			return true
+		}
+		return addr >= uintptr(unsafe.Pointer(&pool.avail[0])) && addr <= uintptr(unsafe.Pointer(&pool.avail[MAX_K-1]))
+	}
+
+	for i := 0; i <= int(pool.kvalM); i++ {
+		head := &pool.avail[i]
+		for block := head.next; block != head; block = block.next {
+			assert.True(t, inPool(block), "avail[%d] block outside pool", i)
+			assert.True(t, inPool(block.next), "avail[%d] next outside pool", i)
+			assert.True(t, inPool(block.prev), "avail[%d] prev outside pool", i)
+		}
+	}
+}
+
+func TestMultiplePoolsIsolated(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing independent pools on separate goroutines")
+	var small, large BuddyPool
+	_ = buddyInit(&small, 1<<MIN_K)
+	_ = buddyInit(&large, 1<<(MIN_K+2))
+
+	var wg sync.WaitGroup
+	var smallPtrs, largePtrs []unsafe.Pointer
+	run := func(pool *BuddyPool, seed int64, out *[]unsafe.Pointer) {
+		defer wg.Done()
+		r := rand.New(rand.NewSource(seed))
+		var ptrs []unsafe.Pointer
+		for i := 0; i < 2000; i++ {
+			if len(ptrs) > 0 && r.Intn(3) == 0 {
+				j := r.Intn(len(ptrs))
+				assert.NoError(t, buddyFree(pool, ptrs[j]))
+				ptrs = append(ptrs[:j], ptrs[j+1:]...)
+				continue
+			}
+			p, err := buddyMalloc(pool, uint(r.Intn(2048)+1))
+			if err != nil {
+				continue
+			}
+			addr := uintptr(p)
+			assert.True(t, addr >= pool.base && addr < pool.base+pool.numBytes, "pointer outside its own pool")
+			ptrs = append(ptrs, p)
+		}
+		*out = ptrs
+	}
+
+	wg.Add(2)
+	go run(&small, 1, &smallPtrs)
+	go run(&large, 2, &largePtrs)
+	wg.Wait()
+
+	// Check while both pools still hold live allocations
+	checkBuddyPoolIsolated(t, &small)
+	checkBuddyPoolIsolated(t, &large)
+
+	for _, p := range smallPtrs {
+		assert.NoError(t, buddyFree(&small, p))
+	}
+	for _, p := range largePtrs {
+		assert.NoError(t, buddyFree(&large, p))
+	}
+	checkBuddyPoolFull(t, &small)
+	checkBuddyPoolFull(t, &large)
+
+	_ = buddyDestroy(&small)
+	_ = buddyDestroy(&large)
+}
+
+func TestBuddyInitSmallestK(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing configurable smallest block size")
+	for _, minK := range []uint{headerK(), SMALLEST_K, 10, 16} {
+		var pool BuddyPool
+		err := buddyInitWithOptions(&pool, 1<<MIN_K, Options{SmallestK: minK})
+		assert.NoError(t, err)
+		assert.Equal(t, minK, pool.smallestK)
+
+		// A 1 byte request must be rounded up to the configured floor
+		mem, err := buddyMalloc(&pool, 1)
+		assert.NoError(t, err)
+		tmp := (*Avail)(unsafe.Pointer(uintptr(mem) - BLOCK_HEADER))
+		assert.Equal(t, uint16(minK), tmp.kval)
+
+		assert.NoError(t, buddyFree(&pool, mem))
+		checkBuddyPoolFull(t, &pool)
+		_ = buddyDestroy(&pool)
+	}
+
+	// Default options keep SMALLEST_K
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	assert.Equal(t, SMALLEST_K, pool.smallestK)
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyInitSmallestKInvalid(t *testing.T) {
+	var pool BuddyPool
+
+	// Too small to hold the Avail header, with the error naming the sizes involved
+	for k := uint(1); k < headerK(); k++ {
+		err := buddyInitWithOptions(&pool, 1<<MIN_K, Options{SmallestK: k})
+		assert.ErrorIs(t, err, ErrInvalidOptions)
+		assert.ErrorContains(t, err, fmt.Sprintf("too small for the %d byte Avail header", AVAIL_HEADER))
+		assert.Equal(t, uintptr(0), pool.base)
+	}
+	err := buddyInitWithOptions(&pool, 1<<MIN_K, Options{SmallestK: headerK()})
+	assert.NoError(t, err)
+	_ = buddyDestroy(&pool)
+
+	// Larger than the pool itself
+	err = buddyInitWithOptions(&pool, 1<<MIN_K, Options{SmallestK: MIN_K + 1})
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+}
+
+func TestBuddyInitStrict(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing strict and clamping init modes")
+	tooSmall := uintptr(1) << (MIN_K - 5)
+	tooLarge := uintptr(1) << MAX_K
+
+	// Default mode clamps without an error
+	var pool BuddyPool
+	err := buddyInitWithOptions(&pool, tooSmall, Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, MIN_K, pool.kvalM)
+	_ = buddyDestroy(&pool)
+
+	// Mapping 2^(MAX_K-1) bytes is not practical here so check the clamp directly
+	kval, err := poolKval(tooLarge, false)
+	assert.NoError(t, err)
+	assert.Equal(t, MAX_K-1, kval)
+
+	// Strict mode reports both instead of clamping
+	err = buddyInitWithOptions(&pool, tooSmall, Options{Strict: true})
+	assert.ErrorIs(t, err, ErrSizeOutOfRange)
+	assert.Equal(t, uintptr(0), pool.base)
+
+	err = buddyInitWithOptions(&pool, tooLarge, Options{Strict: true})
+	assert.ErrorIs(t, err, ErrSizeOutOfRange)
+	assert.Equal(t, uintptr(0), pool.base)
+
+	// In range sizes are fine in strict mode
+	err = buddyInitWithOptions(&pool, 1<<MIN_K, Options{Strict: true})
+	assert.NoError(t, err)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyInitMlock(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing mlock'd pool")
+	var pool BuddyPool
+	err := buddyInitWithOptions(&pool, 1<<MIN_K, Options{Mlock: true})
+	if errors.Is(err, unix.ENOMEM) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EAGAIN) {
+		t.Skipf("mlock not permitted: %v", err)
+	}
+	assert.NoError(t, err)
+	assert.True(t, pool.locked)
+
+	mem, err := buddyMalloc(&pool, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	// The grown half is usable in a locked pool too
+	assert.NoError(t, buddyGrow(&pool, 1<<(MIN_K+1)))
+	mem, err = buddyMalloc(&pool, 1<<MIN_K)
+	assert.NoError(t, err)
+	fillBytes(mem, 1<<MIN_K, 0x27)
+	assert.NoError(t, buddyFree(&pool, mem))
+
+	assert.NoError(t, buddyDestroy(&pool))
+	assert.False(t, pool.locked)
+}
+
+func TestBuddyInitNuma(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing NUMA bound pool")
+	var pool BuddyPool
+	err := buddyInitWithOptions(&pool, 1<<MIN_K, Options{NumaBind: true, NumaNode: 0, Populate: true})
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) {
+		t.Skipf("mbind not available: %v", err)
+	}
+	assert.NoError(t, err)
+
+	mem, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	unsafe.Slice((*byte)(mem), 1000)[999] = 1
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	assert.NoError(t, buddyDestroy(&pool))
+}
+
+func TestBuddyInitNumaInvalid(t *testing.T) {
+	var pool BuddyPool
+
+	// Negative node ids are rejected before mapping anything
+	err := buddyInitWithOptions(&pool, 1<<MIN_K, Options{NumaBind: true, NumaNode: -1})
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+	assert.Equal(t, uintptr(0), pool.base)
+
+	// A node that does not exist returns the syscall error
+	err = buddyInitWithOptions(&pool, 1<<MIN_K, Options{NumaBind: true, NumaNode: 1000})
+	var errno unix.Errno
+	assert.ErrorAs(t, err, &errno)
+	assert.Equal(t, uintptr(0), pool.base)
+
+	// Best effort carries on with the unbound mapping
+	err = buddyInitWithOptions(&pool, 1<<MIN_K, Options{NumaBind: true, NumaNode: 1000, NumaBestEffort: true})
+	assert.NoError(t, err)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyInitHugePages(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing huge page backed pool")
+	var pool BuddyPool
+	err := buddyInitWithOptions(&pool, 1<<MIN_K, Options{HugePages: true})
+	assert.NoError(t, err)
+	t.Logf("huge pages granted: %v", pool.hugePages)
+
+	// Rounded up to a whole huge page whether or not the kernel granted them
+	assert.Equal(t, HUGE_PAGE_K, pool.kvalM)
+	assert.Equal(t, uintptr(0), pool.numBytes%(uintptr(1)<<HUGE_PAGE_K))
+
+	mem, err := buddyMalloc(&pool, 4096)
+	assert.NoError(t, err)
+	assert.NotNil(t, mem)
+	unsafe.Slice((*byte)(mem), 4096)[4095] = 1
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	assert.NoError(t, buddyDestroy(&pool))
+	assert.False(t, pool.hugePages)
+}
+
+func TestBuddyInitPopulate(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing prefaulted pool")
+	for _, opts := range []Options{{Populate: true}, {Populate: true, TouchPages: true}, {TouchPages: true}} {
+		var pool BuddyPool
+		err := buddyInitWithOptions(&pool, 1<<MIN_K, opts)
+		assert.NoError(t, err)
+		checkBuddyPoolFull(t, &pool)
+
+		mem, err := buddyMalloc(&pool, 1000)
+		assert.NoError(t, err)
+		assert.NotNil(t, mem)
+		assert.NoError(t, buddyFree(&pool, mem))
+		checkBuddyPoolFull(t, &pool)
+
+		_ = buddyDestroy(&pool)
+	}
+}
+
+func TestBuddyInitFromFd(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing file-backed pool")
+	f, err := os.CreateTemp(t.TempDir(), "balloc")
+	assert.NoError(t, err)
+	defer f.Close()
+
+	size := uintptr(1) << MIN_K
+	assert.NoError(t, unix.Ftruncate(int(f.Fd()), int64(size)))
+
+	var pool BuddyPool
+	assert.NoError(t, buddyInitFromFd(&pool, int(f.Fd()), size))
+	assert.True(t, pool.fileBacked)
+	checkBuddyPoolFull(t, &pool)
+
+	// Write through an allocation and check it lands in the file
+	mem, err := buddyMalloc(&pool, 5)
+	assert.NoError(t, err)
+	copy(unsafe.Slice((*byte)(mem), 5), "hello")
+	offset := int64(uintptr(mem) - pool.base)
+
+	assert.NoError(t, buddyDestroy(&pool))
+	assert.False(t, pool.fileBacked)
+
+	got := make([]byte, 5)
+	_, err = f.ReadAt(got, offset)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+
+	// Negative descriptors are rejected up front
+	assert.ErrorIs(t, buddyInitFromFd(&pool, -1, size), ErrInvalidOptions)
+}
+
+func TestBuddyMallocSlice(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing slice allocation")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	buf, err := buddyMallocSlice(&pool, 100)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(buf), 100)
+	assert.Equal(t, len(buf), cap(buf))
+	assert.Equal(t, buddyUsableSize(&pool, unsafe.Pointer(&buf[0])), uint(len(buf)))
+
+	// Write through the slice and read it back
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	for i, b := range buf {
+		assert.Equal(t, byte(i), b)
+	}
+
+	// Free through a zero length reslice of the same block
+	assert.NoError(t, buddyFreeSlice(&pool, buf[:0]))
+	checkBuddyPoolFull(t, &pool)
+
+	// Zero size gives an empty slice that frees as a no-op
+	empty, err := buddyMallocSlice(&pool, 0)
+	assert.NoError(t, err)
+	assert.Len(t, empty, 0)
+	assert.NoError(t, buddyFreeSlice(&pool, empty))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyMallocAligned(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing aligned allocation")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	for _, align := range []uint{1, 2, 8, 16, 64, 256, 4096, 65536} {
+		mem, err := buddyMallocAligned(&pool, 100, align)
+		assert.NoError(t, err)
+		assert.NotNil(t, mem)
+		assert.Equal(t, uintptr(0), uintptr(mem)%uintptr(align), "pointer not aligned to %d", align)
+
+		// The requested bytes must fit inside the block
+		unsafe.Slice((*byte)(mem), 100)[99] = 1
+
+		assert.NoError(t, buddyFreeAligned(&pool, mem))
+		checkBuddyPoolFull(t, &pool)
+	}
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyMallocPageAligned(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing page aligned allocation")
+	var page uintptr = uintptr(unix.Getpagesize())
+	var sizes []uint = []uint{1, 100, uint(page) - 8, uint(page), 3*uint(page) + 1}
+	for _, opts := range []Options{{}, {AlignToCacheLine: true}, {Redzone: true}} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+
+		// Every size starts on a page, and the whole request fits in the block behind it
+		var ptrs []unsafe.Pointer
+		for i, size := range sizes {
+			mem, err := buddyMallocPageAligned(&pool, size)
+			assert.NoError(t, err)
+			assert.Zero(t, uintptr(mem)%page, "size %d not page aligned", size)
+			fillBytes(mem, size, byte(i))
+			ptrs = append(ptrs, mem)
+		}
+		for i, mem := range ptrs {
+			assert.True(t, checkBytes(mem, sizes[i], byte(i)))
+		}
+
+		// Free finds the real header again and the whole block coalesces back
+		for _, mem := range ptrs {
+			assert.NoError(t, buddyFreeAligned(&pool, mem))
+		}
+		checkBuddyPoolFull(t, &pool)
+		assert.NoError(t, buddyVerify(&pool))
+		_ = buddyDestroy(&pool)
+	}
+}
+
+func TestBuddyFreeMixedAligned(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing aligned and plain allocations all free through buddyFree")
+	for _, opts := range []Options{{}, {AlignToCacheLine: true}, {Checksum: true}, {CacheDepth: 4}} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<(MIN_K+2), opts))
+
+		// Interleave plain, aligned and page aligned pointers of random sizes
+		var rng *rand.Rand = rand.New(rand.NewSource(97))
+		var ptrs []unsafe.Pointer
+		for i := 0; i < 300; i++ {
+			var size uint = uint(1 + rng.Intn(2000))
+			var mem unsafe.Pointer
+			var err error
+			switch i % 3 {
+			case 0:
+				mem, err = buddyMalloc(&pool, size)
+			case 1:
+				mem, err = buddyMallocAligned(&pool, size, 1<<(4+rng.Intn(9)))
+			case 2:
+				mem, err = buddyMallocPageAligned(&pool, size)
+			}
+			assert.NoError(t, err)
+			fillBytes(mem, size, byte(i))
+			ptrs = append(ptrs, mem)
+		}
+
+		// Free them in random order, the last few in one batch
+		rng.Shuffle(len(ptrs), func(i, j int) { ptrs[i], ptrs[j] = ptrs[j], ptrs[i] })
+		for _, mem := range ptrs[:len(ptrs)-10] {
+			assert.NoError(t, buddyFree(&pool, mem))
+		}
+		assert.NoError(t, buddyFreeBatch(&pool, ptrs[len(ptrs)-10:]))
+		if pool.cache != nil {
+			pool.cache.flush(&pool)
+		}
+		checkBuddyPoolFull(t, &pool)
+		assert.NoError(t, buddyVerify(&pool))
+		_ = buddyDestroy(&pool)
+	}
+}
+
+func TestBuddyFreeAlignedMisuse(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing aligned pointers are still checked by buddyFree")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// Freeing an aligned pointer twice is a double free of its block
+	mem, err := buddyMallocAligned(&pool, 100, 256)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.ErrorIs(t, buddyFree(&pool, mem), ErrDoubleFree)
+
+	// So is a batch naming the block through both of its pointers
+	mem, err = buddyMallocAligned(&pool, 100, 256)
+	assert.NoError(t, err)
+	var raw unsafe.Pointer = unalignPtr(&pool, mem)
+	assert.NotEqual(t, mem, raw)
+	assert.ErrorIs(t, buddyFreeBatch(&pool, []unsafe.Pointer{mem, raw}), ErrDoubleFree)
+	assert.NoError(t, buddyFreeBatch(&pool, []unsafe.Pointer{mem}))
+
+	// A tagged offset written by the user into a plain block is only followed into the same block
+	plain, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	var slots []uintptr = unsafe.Slice((*uintptr)(plain), 4)
+	slots[1] = (2 * unsafe.Sizeof(uintptr(0))) ^ alignedTag
+	assert.Equal(t, plain, unalignPtr(&pool, unsafe.Pointer(&slots[2])))
+	slots[1] = (uintptr(unsafe.Pointer(&slots[2])) - pool.base) ^ alignedTag
+	assert.ErrorIs(t, buddyFree(&pool, unsafe.Pointer(&slots[2])), ErrInvalidPointer)
+	assert.NoError(t, buddyFree(&pool, plain))
+
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyAlignedUsableSize(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing usable size of aligned pointers")
+	for _, opts := range []Options{{}, {AlignToCacheLine: true}, {Redzone: true}} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+
+		// The usable bytes run from the aligned pointer to the end of the block
+		mem, err := buddyMallocAligned(&pool, 100, 256)
+		assert.NoError(t, err)
+		var raw unsafe.Pointer = unalignPtr(&pool, mem)
+		var want uint = buddyUsableSize(&pool, raw) - uint(uintptr(mem)-uintptr(raw))
+		assert.Equal(t, want, buddyUsableSize(&pool, mem))
+		assert.GreaterOrEqual(t, buddyUsableSize(&pool, mem), uint(100))
+		fillBytes(mem, buddyUsableSize(&pool, mem), 0x97)
+
+		// Pointers that are not live allocations have nothing usable
+		assert.Zero(t, buddyUsableSize(&pool, unsafe.Add(mem, 8)))
+		assert.NoError(t, buddyFree(&pool, mem))
+		assert.Zero(t, buddyUsableSize(&pool, mem))
+		checkBuddyPoolFull(t, &pool)
+		_ = buddyDestroy(&pool)
+	}
+}
+
+func TestBuddyReallocAligned(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing realloc of aligned pointers")
+	for _, opts := range []Options{{}, {AlignToCacheLine: true}, {Redzone: true}} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+		mem, err := buddyMallocAligned(&pool, 100, 256)
+		assert.NoError(t, err)
+		fillBytes(mem, 100, 0x5A)
+
+		// Shrinking and growing within the block keep the aligned pointer
+		shrunk, err := buddyRealloc(&pool, mem, 50)
+		assert.NoError(t, err)
+		assert.Equal(t, mem, shrunk)
+		grown, err := buddyRealloc(&pool, mem, 200)
+		assert.NoError(t, err)
+		assert.Equal(t, mem, grown)
+		assert.GreaterOrEqual(t, buddyUsableSize(&pool, mem), uint(200))
+
+		// Growing into the free buddies above keeps it too, and all of the new size is the caller's
+		grown, err = buddyRealloc(&pool, mem, 5000)
+		assert.NoError(t, err)
+		assert.Equal(t, mem, grown)
+		assert.GreaterOrEqual(t, buddyUsableSize(&pool, mem), uint(5000))
+		assert.True(t, checkBytes(mem, 50, 0x5A))
+		fillBytes(mem, 5000, 0x5B)
+		assert.NoError(t, buddyVerify(&pool))
+
+		// With a live block in the way the bytes move to a new block
+		blocker, err := buddyMalloc(&pool, 1<<13)
+		assert.NoError(t, err)
+		moved, err := buddyRealloc(&pool, mem, 1<<14)
+		assert.NoError(t, err)
+		assert.NotEqual(t, mem, moved)
+		assert.True(t, checkBytes(moved, 5000, 0x5B))
+		assert.GreaterOrEqual(t, buddyUsableSize(&pool, moved), uint(1<<14))
+		assert.ErrorIs(t, buddyFree(&pool, mem), ErrDoubleFree)
+
+		assert.NoError(t, buddyFree(&pool, moved))
+		assert.NoError(t, buddyFree(&pool, blocker))
+		checkBuddyPoolFull(t, &pool)
+		_ = buddyDestroy(&pool)
+	}
+}
+
+func TestBuddyMallocAlignedInvalid(t *testing.T) {
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	for _, align := range []uint{0, 3, 24, 100} {
+		mem, err := buddyMallocAligned(&pool, 10, align)
+		assert.Nil(t, mem)
+		assert.ErrorIs(t, err, ErrBadAlignment)
+	}
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyMallocOOMCallbackRetry(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing OOM callback freeing memory for a retry")
+	var reserved unsafe.Pointer
+	var requested []uint
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{
+		OnOOM: func(size uint) {
+			requested = append(requested, size)
+			_ = buddyFree(&pool, reserved)
+		},
+	}))
+
+	// Fill the pool, then ask for more, the callback frees the held block
+	var err error
+	reserved, err = buddyMalloc(&pool, uint(uintptr(1)<<MIN_K-BLOCK_HEADER))
+	assert.NoError(t, err)
+	mem, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	assert.NotNil(t, mem)
+	assert.Equal(t, []uint{1000}, requested)
+
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyMallocOOMCallbackNoop(t *testing.T) {
+	var calls int
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{
+		OnOOM: func(size uint) { calls++ },
+	}))
+
+	// Nothing is freed so the retry fails too and ENOMEM propagates
+	full, _ := buddyMalloc(&pool, uint(uintptr(1)<<MIN_K-BLOCK_HEADER))
+	mem, err := buddyMalloc(&pool, 1000)
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.Equal(t, 1, calls)
+
+	// Requests larger than the pool also report the OOM
+	mem, err = buddyMalloc(&pool, 1<<(MIN_K+1))
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.Equal(t, 2, calls)
+
+	assert.NoError(t, buddyFree(&pool, full))
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyReset(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing reset frees everything without unmapping")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+	var base uintptr = pool.base
+
+	// Leave a mix of live blocks behind
+	for _, size := range []uint{1, 100, 1000, 10000, 100000} {
+		_, err := buddyMalloc(&pool, size)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, uint(5), buddyStats(&pool).LiveAllocations)
+
+	buddyReset(&pool)
+	assert.Equal(t, base, pool.base)
+	assert.Equal(t, uint(0), buddyStats(&pool).LiveAllocations)
+	checkBuddyPoolFull(t, &pool)
+
+	// The whole pool is allocatable in one piece from the same mapping
+	big, err := buddyMalloc(&pool, uint(pool.numBytes-BLOCK_HEADER))
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(base+BLOCK_HEADER), big)
+	buddyReset(&pool)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+
+	// Resetting a destroyed pool is a no-op
+	buddyReset(&pool)
+	assert.Equal(t, uintptr(0), pool.base)
+	buddyReset(nil)
+}
+
+func TestBuddyResetRacingDestroy(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing reset racing destroy never touches a torn down cache")
+	for i := 0; i < 50; i++ {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{CacheDepth: 4}))
+		ptr, err := buddyMalloc(&pool, 100)
+		assert.NoError(t, err)
+		assert.NoError(t, buddyFree(&pool, ptr))
+
+		// Whichever runs second sees the other one finished
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			buddyReset(&pool)
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, buddyDestroy(&pool))
+		}()
+		wg.Wait()
+		assert.Equal(t, uintptr(0), pool.base)
+		assert.Equal(t, poolDestroyed, pool.state.Load())
+	}
+}
+
+func TestBuddyMallocSizeOverflow(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing sizes near the integer limit")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+	var header uint = uint(BLOCK_HEADER)
+
+	// size+header wraps, would a naive btok hand out a tiny block
+	for _, size := range []uint{^uint(0), ^uint(0) - header + 1, ^uint(0) - header, 1 << (bits.UintSize - 1), 1<<(bits.UintSize-1) + 1} {
+		mem, err := buddyMalloc(&pool, size)
+		assert.Nil(t, mem, "size %d", size)
+		assert.ErrorIs(t, err, unix.ENOMEM, "size %d", size)
+	}
+
+	// One byte more than the whole pool can hold
+	mem, err := buddyMalloc(&pool, uint(pool.numBytes)-header+1)
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+
+	// Batch and blocking malloc get the same clean rejection
+	ptrs, err := buddyMallocBatch(&pool, ^uint(0), 2)
+	assert.Nil(t, ptrs)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	mem, err = buddyMallocWait(context.Background(), &pool, ^uint(0))
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+
+	// Exactly the pool still fits
+	mem, err = buddyMalloc(&pool, uint(pool.numBytes)-header)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyMallocWholePool(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing a request for the whole usable pool")
+	for kvalM := uint(MIN_K); kvalM <= MIN_K+3; kvalM++ {
+		for _, opts := range []Options{{}, {AlignToCacheLine: true}, {Checksum: true}, {Redzone: true}, {PrewarmK: SMALLEST_K}, {PrewarmK: kvalM - 1, HoldSplits: 1}, {CacheDepth: 4}, {DeferCoalesce: true}} {
+			var pool BuddyPool
+			assert.NoError(t, buddyInitWithOptions(&pool, uintptr(1)<<kvalM, opts))
+
+			// Room for a free header and exactly the usable capacity both fit the kvalM block
+			for _, size := range []uintptr{(uintptr(1) << kvalM) - max(AVAIL_HEADER, pool.header), (uintptr(1) << kvalM) - pool.header} {
+				mem, err := buddyMalloc(&pool, uint(size))
+				if !assert.NoError(t, err, "kvalM %d size %d opts %+v", kvalM, size, opts) {
+					continue
+				}
+				assert.Equal(t, uint16(kvalM), ptrToBlock(&pool, mem).kval)
+				if opts.Redzone {
+					assert.Equal(t, uint(size), buddyUsableSize(&pool, mem))
+				} else {
+					assert.Equal(t, uint((uintptr(1)<<kvalM)-pool.header), buddyUsableSize(&pool, mem))
+				}
+				assert.NoError(t, buddyFree(&pool, mem))
+				if pool.cache == nil && !pool.deferCoalesce {
+					checkBuddyPoolFull(t, &pool)
+				}
+			}
+
+			// A single byte more needs a block the pool does not have, even after reclaiming everything parked
+			mem, err := buddyMalloc(&pool, uint((uintptr(1)<<kvalM)-pool.header+1))
+			assert.Nil(t, mem)
+			assert.ErrorIs(t, err, unix.ENOMEM)
+			checkBuddyPoolFull(t, &pool)
+			_ = buddyDestroy(&pool)
+		}
+	}
+}
+
+func TestBtokLimit(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing btok clamps sizes past the largest pool")
+	// The largest pool size itself is still representable
+	var largest uintptr = uintptr(1) << (MAX_K - 1)
+	assert.Equal(t, MAX_K-1, btok(largest))
+	assert.Equal(t, MAX_K-1, btok(largest-1))
+	assert.Equal(t, MAX_K-1, btokMin(largest, MAX_K-1))
+
+	// Anything beyond clamps to MAX_K instead of searching up to the address width
+	for _, bytes := range []uintptr{largest + 1, largest << 1, uintptr(1) << (bits.UintSize - 1), ^uintptr(0)} {
+		assert.Equal(t, MAX_K, btok(bytes), "bytes %#x", bytes)
+		assert.Equal(t, MAX_K, btokMin(bytes, 0), "bytes %#x", bytes)
+	}
+
+	// The clamp is larger than any pool so allocation fails cleanly
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	assert.Equal(t, MAX_K, requestK(&pool, ^uint(0)))
+	assert.Equal(t, MAX_K, requestK(&pool, uint(largest)))
+	mem, err := buddyMalloc(&pool, uint(largest))
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestReservedHeader(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing reserved blocks only keep tag, kval and size")
+	assert.Equal(t, uintptr(8), BLOCK_HEADER)
+	assert.Equal(t, BLOCK_HEADER+2*unsafe.Sizeof(uintptr(0)), AVAIL_HEADER)
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// The list links are handed to the user, a 56 byte request now fits the smallest block
+	mem, err := buddyMalloc(&pool, 1<<SMALLEST_K-uint(BLOCK_HEADER))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(SMALLEST_K), ptrToBlock(&pool, mem).kval)
+	assert.Equal(t, uint(1)<<SMALLEST_K-uint(BLOCK_HEADER), buddyUsableSize(&pool, mem))
+	assert.Greater(t, buddyUsableSize(&pool, mem), uint(1)<<SMALLEST_K-uint(AVAIL_HEADER))
+
+	// Fill every usable byte of both buddies, overwriting where next and prev would be
+	buddy, err := buddyMalloc(&pool, 1<<SMALLEST_K-uint(BLOCK_HEADER))
+	assert.NoError(t, err)
+	assert.Equal(t, uintptr(mem)+1<<SMALLEST_K, uintptr(buddy))
+	for _, ptr := range []unsafe.Pointer{mem, buddy} {
+		region := unsafe.Slice((*byte)(ptr), buddyUsableSize(&pool, ptr))
+		for i := range region {
+			region[i] = 0xAB
+		}
+	}
+
+	// Free rebuilds the links so the buddies coalesce all the way back up
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.NoError(t, buddyFree(&pool, buddy))
+	assert.NoError(t, buddyVerify(&pool))
+	checkBuddyPoolFull(t, &pool)
+
+	// The whole pool can be handed out as one block
+	all, err := buddyMalloc(&pool, uint(pool.numBytes-BLOCK_HEADER))
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(pool.base+BLOCK_HEADER), all)
+	assert.NoError(t, buddyFree(&pool, all))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestAlignToCacheLine(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing AlignToCacheLine puts every user pointer on a cache line")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{AlignToCacheLine: true, Redzone: true, Poison: true}))
+
+	// Tiny requests are bumped up to a block with room for the cache line header
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 256; i++ {
+		mem, err := buddyMalloc(&pool, uint(1+i%48))
+		assert.NoError(t, err)
+		assert.Zero(t, uintptr(mem)%CACHE_LINE)
+		assert.GreaterOrEqual(t, uint(ptrToBlock(&pool, mem).kval), uint(7))
+		assert.Equal(t, uint(1+i%48), buddyUsableSize(&pool, mem))
+		ptrs = append(ptrs, mem)
+	}
+	assert.Equal(t, uintptr(len(ptrs))*CACHE_LINE, buddyStats(&pool).OverheadBytes)
+
+	// Frees find the header a whole cache line back and coalesce the pool back up
+	for _, ptr := range ptrs {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	assert.NoError(t, buddyVerify(&pool))
+	checkBuddyPoolFull(t, &pool)
+
+	// Reused blocks after the poison pass are still aligned
+	mem, err := buddyMalloc(&pool, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, unsafe.Pointer(pool.base+CACHE_LINE), mem)
+	assert.Equal(t, ErrInvalidPointer, buddyFree(&pool, unsafe.Add(mem, -int(BLOCK_HEADER))))
+	assert.NoError(t, buddyFree(&pool, mem))
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyAlignment(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing every returned pointer meets the advertised alignment")
+	var pool BuddyPool
+	assert.Equal(t, uint(0), buddyAlignment(&pool))
+
+	for _, opts := range []Options{{}, {SmallestK: 5}, {AlignToCacheLine: true}, {AlignToCacheLine: true, SmallestK: 5}} {
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+		var align uint = buddyAlignment(&pool)
+		if opts.AlignToCacheLine {
+			assert.Equal(t, uint(CACHE_LINE), align)
+		} else {
+			assert.Equal(t, uint(MIN_ALIGN), align)
+		}
+
+		// Sizes on and around every small power of two land in every small class
+		var ptrs []unsafe.Pointer
+		for shift := 0; shift < 13; shift++ {
+			for _, size := range []uint{1<<shift - 1, 1 << shift, 1<<shift + 1} {
+				if size == 0 {
+					continue
+				}
+				mem, err := buddyMalloc(&pool, size)
+				assert.NoError(t, err)
+				assert.Zero(t, uintptr(mem)%uintptr(align), "size %d", size)
+				ptrs = append(ptrs, mem)
+			}
+		}
+		for _, ptr := range ptrs {
+			assert.NoError(t, buddyFree(&pool, ptr))
+		}
+		checkBuddyPoolFull(t, &pool)
+		_ = buddyDestroy(&pool)
+	}
+}
+
+func TestConcurrentMallocFree(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing concurrent malloc and free across size classes")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<(MIN_K+2))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			var ptrs []unsafe.Pointer
+			for i := 0; i < 1000; i++ {
+				if len(ptrs) > 0 && r.Intn(2) == 0 {
+					j := r.Intn(len(ptrs))
+					assert.NoError(t, buddyFree(&pool, ptrs[j]))
+					ptrs = append(ptrs[:j], ptrs[j+1:]...)
+					continue
+				}
+				p, err := buddyMalloc(&pool, uint(1)<<r.Intn(12))
+				if err != nil {
+					continue
+				}
+				// Scribble over the whole block to shake out overlapping handouts
+				buf := unsafe.Slice((*byte)(p), buddyUsableSize(&pool, p))
+				for b := range buf {
+					buf[b] = byte(seed)
+				}
+				ptrs = append(ptrs, p)
+			}
+			for _, p := range ptrs {
+				assert.NoError(t, buddyFree(&pool, p))
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	checkBuddyPoolFull(t, &pool)
+	assert.Equal(t, uint(0), buddyStats(&pool).LiveAllocations)
+	_ = buddyDestroy(&pool)
+}
+
+// Each goroutine hammers its own size class. The single-lock case serializes
+// every call through one mutex to compare against the old pool-wide lock
+func BenchmarkConcurrentMallocFree(b *testing.B) {
+	for _, mode := range []string{"per-class", "single-lock"} {
+		b.Run(mode, func(b *testing.B) {
+			var pool BuddyPool
+			_ = buddyInit(&pool, 1<<(MIN_K+4))
+			var global sync.Mutex
+			var next atomic.Int64
+
+			b.RunParallel(func(pb *testing.PB) {
+				size := uint(1) << (next.Add(1) % 8)
+				for pb.Next() {
+					if mode == "single-lock" {
+						global.Lock()
+					}
+					p, _ := buddyMalloc(&pool, size)
+					if mode == "single-lock" {
+						global.Unlock()
+						global.Lock()
+					}
+					_ = buddyFree(&pool, p)
+					if mode == "single-lock" {
+						global.Unlock()
+					}
+				}
+			})
+
+			_ = buddyDestroy(&pool)
+		})
+	}
+}
+
+func TestMallocFastPath(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the exact class fast path matches climbing")
+	var fast, climb BuddyPool
+	assert.NoError(t, buddyInit(&fast, 1<<MIN_K))
+	assert.NoError(t, buddyInit(&climb, 1<<MIN_K))
+
+	// Replay the same mallocs and frees on both pools, half of them exact powers of two minus the header
+	var r *rand.Rand = rand.New(rand.NewSource(86))
+	var live [2][]unsafe.Pointer
+	for i := 0; i < 4000; i++ {
+		if len(live[0]) > 0 && r.Intn(3) == 0 {
+			var j int = r.Intn(len(live[0]))
+			assert.NoError(t, buddyFree(&fast, live[0][j]))
+			assert.NoError(t, buddyFree(&climb, live[1][j]))
+			for p := range live {
+				live[p] = append(live[p][:j], live[p][j+1:]...)
+			}
+			continue
+		}
+
+		var size uint = 1 + uint(r.Intn(1<<12))>>r.Intn(6)
+		if r.Intn(2) == 0 {
+			size = uint((uintptr(1) << (SMALLEST_K + uint(r.Intn(8)))) - BLOCK_HEADER)
+		}
+		a, errFast := buddyMalloc(&fast, size)
+		b, errClimb := mallocClimb(&climb, size)
+		assert.Equal(t, errFast == nil, errClimb == nil)
+		if errFast != nil || errClimb != nil {
+			continue
+		}
+		assert.Equal(t, uintptr(a)-fast.base, uintptr(b)-climb.base, "malloc %d of %d bytes", i, size)
+		live[0] = append(live[0], a)
+		live[1] = append(live[1], b)
+	}
+	assert.Equal(t, buddyStats(&fast).FreeBytes, buddyStats(&climb).FreeBytes)
+	assert.Equal(t, buddyHistogram(&fast), buddyHistogram(&climb))
+	assert.NoError(t, buddyVerify(&fast))
+	assert.NoError(t, buddyVerify(&climb))
+
+	_ = buddyDestroy(&fast)
+	_ = buddyDestroy(&climb)
+}
+
+// Allocates through the climbing path even when the request's own class has a free block
+func mallocClimb(pool *BuddyPool, size uint) (unsafe.Pointer, error) {
+	var k uint = requestK(pool, size)
+	var usable int64 = int64((uintptr(1) << k) - pool.header)
+	if k > pool.kvalM || !chargeReserved(pool, usable) {
+		return nil, unix.ENOMEM
+	}
+	lockClass(pool, k)
+	return climbBlock(pool, k, size, usable)
+}
+
+// Mallocs a power of two minus the header from a class whose list holds every other block
+// of the pool, each with its buddy allocated. Only the mallocs are timed
+func BenchmarkMallocFastPath(b *testing.B) {
+	for _, path := range []string{"fast", "climb"} {
+		b.Run(path, func(b *testing.B) {
+			var pool BuddyPool
+			_ = buddyInit(&pool, 1<<MIN_K)
+			var size uint = uint((uintptr(1) << 10) - BLOCK_HEADER)
+			var ptrs []unsafe.Pointer
+			for {
+				p, err := buddyMalloc(&pool, size)
+				if err != nil {
+					break
+				}
+				ptrs = append(ptrs, p)
+			}
+			var batch []unsafe.Pointer = make([]unsafe.Pointer, 0, len(ptrs)/2)
+			for i := 1; i < len(ptrs); i += 2 {
+				_ = buddyFree(&pool, ptrs[i])
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var p unsafe.Pointer
+				if path == "fast" {
+					p, _ = buddyMalloc(&pool, size)
+				} else {
+					p, _ = mallocClimb(&pool, size)
+				}
+				batch = append(batch, p)
+
+				// Refill the list once it runs dry
+				if len(batch) == cap(batch) {
+					b.StopTimer()
+					_ = buddyFreeBatch(&pool, batch)
+					batch = batch[:0]
+					b.StartTimer()
+				}
+			}
+			b.StopTimer()
+
+			_ = buddyDestroy(&pool)
+		})
+	}
+}
+
 func TestMain(m *testing.M) {
 	rand.Seed(time.Now().UnixNano())
 	fmt.Println("Running memory tests.")
@@ -0,0 +1,50 @@
+// Package ballocprom exports balloc pool state as Prometheus metrics.
+// It lives in its own package so the allocator itself does not depend on Prometheus
+package ballocprom
+
+import (
+	"github.com/alexlewtschuk/balloc/src/balloc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements prometheus.Collector for a single pool.
+// Stats are read from the pool on every scrape
+type Collector struct {
+	pool              *balloc.Pool     // the pool being exported
+	bytesTotalDesc    *prometheus.Desc // balloc_pool_bytes_total
+	bytesReservedDesc *prometheus.Desc // balloc_pool_bytes_reserved
+	bytesFreeDesc     *prometheus.Desc // balloc_pool_bytes_free
+	fragmentationDesc *prometheus.Desc // balloc_fragmentation_ratio
+}
+
+// Creates a collector exporting pool with the pool label set to name.
+// Collectors for several pools can share a registry as long as their names differ
+func NewCollector(name string, pool *balloc.Pool) *Collector {
+	var labels prometheus.Labels = prometheus.Labels{"pool": name}
+	return &Collector{
+		pool:              pool,
+		bytesTotalDesc:    prometheus.NewDesc("balloc_pool_bytes_total", "Total number of bytes the pool manages", nil, labels),
+		bytesReservedDesc: prometheus.NewDesc("balloc_pool_bytes_reserved", "Usable bytes handed out to the user", nil, labels),
+		bytesFreeDesc:     prometheus.NewDesc("balloc_pool_bytes_free", "Bytes sitting in the avail lists", nil, labels),
+		fragmentationDesc: prometheus.NewDesc("balloc_fragmentation_ratio", "External fragmentation of the free memory from 0.0 to 1.0", nil, labels),
+	}
+}
+
+// Sends the descriptors of every metric the collector exports
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.bytesTotalDesc
+	ch <- c.bytesReservedDesc
+	ch <- c.bytesFreeDesc
+	ch <- c.fragmentationDesc
+}
+
+// Snapshots the pool and sends the current value of every metric. The byte gauges and the
+// fragmentation ratio come from one locked read so a scrape never mixes two states of the pool
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats, fragmentation := c.pool.Metrics()
+
+	ch <- prometheus.MustNewConstMetric(c.bytesTotalDesc, prometheus.GaugeValue, float64(stats.TotalBytes))
+	ch <- prometheus.MustNewConstMetric(c.bytesReservedDesc, prometheus.GaugeValue, float64(stats.ReservedBytes))
+	ch <- prometheus.MustNewConstMetric(c.bytesFreeDesc, prometheus.GaugeValue, float64(stats.FreeBytes))
+	ch <- prometheus.MustNewConstMetric(c.fragmentationDesc, prometheus.GaugeValue, fragmentation)
+}
@@ -0,0 +1,146 @@
+package ballocprom
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alexlewtschuk/balloc/src/balloc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Gathers the registry and returns the value of the named single series gauge
+func gaugeValue(t *testing.T, registry *prometheus.Registry, name string) float64 {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not gathered", name)
+	return 0
+}
+
+// Gathers the registry once and returns the value of every single series gauge by name
+func gatherGauges(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	var gauges map[string]float64 = make(map[string]float64)
+	for _, family := range families {
+		gauges[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+	}
+	return gauges
+}
+
+func TestCollector(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing prometheus collector")
+	pool, err := balloc.New(1 << balloc.MIN_K)
+	assert.NoError(t, err)
+	defer pool.Destroy()
+
+	var registry *prometheus.Registry = prometheus.NewRegistry()
+	assert.NoError(t, registry.Register(NewCollector("test", pool)))
+	assert.Equal(t, 4, testutil.CollectAndCount(registry))
+
+	// Fresh pool is one free block
+	expected := `
+# HELP balloc_pool_bytes_free Bytes sitting in the avail lists
+# TYPE balloc_pool_bytes_free gauge
+balloc_pool_bytes_free{pool="test"} 1.048576e+06
+# HELP balloc_pool_bytes_reserved Usable bytes handed out to the user
+# TYPE balloc_pool_bytes_reserved gauge
+balloc_pool_bytes_reserved{pool="test"} 0
+# HELP balloc_pool_bytes_total Total number of bytes the pool manages
+# TYPE balloc_pool_bytes_total gauge
+balloc_pool_bytes_total{pool="test"} 1.048576e+06
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"balloc_pool_bytes_free", "balloc_pool_bytes_reserved", "balloc_pool_bytes_total"))
+
+	// A 64 byte block and a 1024 byte block are taken out of the free memory
+	a, _ := pool.Alloc(1)
+	b, _ := pool.Alloc(1000)
+	var stats balloc.Stats = pool.Stats()
+	expected = fmt.Sprintf(`
+# HELP balloc_pool_bytes_free Bytes sitting in the avail lists
+# TYPE balloc_pool_bytes_free gauge
+balloc_pool_bytes_free{pool="test"} %d
+# HELP balloc_pool_bytes_reserved Usable bytes handed out to the user
+# TYPE balloc_pool_bytes_reserved gauge
+balloc_pool_bytes_reserved{pool="test"} %d
+`, stats.FreeBytes, stats.ReservedBytes)
+	assert.Equal(t, uintptr(1<<balloc.MIN_K-64-1024), stats.FreeBytes)
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"balloc_pool_bytes_free", "balloc_pool_bytes_reserved"))
+	assert.InDelta(t, pool.Fragmentation(), gaugeValue(t, registry, "balloc_fragmentation_ratio"), 1e-9)
+
+	_ = pool.Free(a)
+	_ = pool.Free(b)
+}
+
+func TestCollectorConsistent(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing every scrape is one consistent snapshot")
+	pool, err := balloc.New(1 << balloc.MIN_K)
+	assert.NoError(t, err)
+	defer pool.Destroy()
+	var registry *prometheus.Registry = prometheus.NewRegistry()
+	assert.NoError(t, registry.Register(NewCollector("test", pool)))
+
+	// Churn the pool until the scrapes are done
+	var stop atomic.Bool
+	var done chan struct{} = make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; !stop.Load(); i++ {
+			ptr, err := pool.Alloc(uint(1 + i%3000))
+			if err == nil {
+				_ = pool.Free(ptr)
+			}
+		}
+	}()
+	for i := 0; i < 300; i++ {
+		// The ratio is 1 - largest / free, so against the free bytes of the same scrape
+		// it gives back the size of a single block, a power of two
+		var gauges map[string]float64 = gatherGauges(t, registry)
+		var free float64 = gauges["balloc_pool_bytes_free"]
+		var largest uint64 = uint64(math.Round((1 - gauges["balloc_fragmentation_ratio"]) * free))
+		assert.LessOrEqual(t, free+gauges["balloc_pool_bytes_reserved"], gauges["balloc_pool_bytes_total"])
+		if free != 0 {
+			assert.Equal(t, 1, bits.OnesCount64(largest), "free %v fragmentation %v", free, gauges["balloc_fragmentation_ratio"])
+		}
+	}
+	stop.Store(true)
+	<-done
+
+	// Once quiet everything is free again
+	var gauges map[string]float64 = gatherGauges(t, registry)
+	assert.Equal(t, gauges["balloc_pool_bytes_total"], gauges["balloc_pool_bytes_free"])
+	assert.Zero(t, gauges["balloc_fragmentation_ratio"])
+}
+
+func TestCollectorMultiplePools(t *testing.T) {
+	first, _ := balloc.New(1 << balloc.MIN_K)
+	second, _ := balloc.New(1 << (balloc.MIN_K + 1))
+	defer first.Destroy()
+	defer second.Destroy()
+
+	// Pools are told apart by the pool label
+	var registry *prometheus.Registry = prometheus.NewRegistry()
+	assert.NoError(t, registry.Register(NewCollector("first", first)))
+	assert.NoError(t, registry.Register(NewCollector("second", second)))
+
+	expected := `
+# HELP balloc_pool_bytes_total Total number of bytes the pool manages
+# TYPE balloc_pool_bytes_total gauge
+balloc_pool_bytes_total{pool="first"} 1.048576e+06
+balloc_pool_bytes_total{pool="second"} 2.097152e+06
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "balloc_pool_bytes_total"))
+}
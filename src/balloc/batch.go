@@ -0,0 +1,153 @@
+package balloc
+
+import (
+	"math"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mallocs count blocks of at least size bytes each while holding the locks once.
+// The request is all-or-nothing: if the pool cannot fit every block nothing is
+// allocated and ENOMEM is returned
+func buddyMallocBatch(pool *BuddyPool, size uint, count int) ([]unsafe.Pointer, error) {
+	if pool == nil || size == 0 || count <= 0 {
+		return nil, nil
+	}
+	if pool.state.Load() != poolActive {
+		return nil, ErrPoolClosed
+	}
+	if pool.readOnly {
+		logf(pool, "ERROR: Batch malloc on a read-only pool")
+		return nil, ErrReadOnly
+	}
+
+	var k uint = requestK(pool, size)
+	if k > pool.kvalM {
+		var err error = unix.ENOMEM
+		logf(pool, "ERROR: No memory available to be allocated")
+		return nil, err
+	}
+
+	// Every split for the batch happens between k and kvalM
+	lockRange(pool, k, pool.kvalM)
+	defer unlockRange(pool, k, pool.kvalM)
+
+	// Count how many k sized blocks the free lists could be split into before touching any of them
+	var fits uintptr
+	for j := k; j <= pool.kvalM && fits < uintptr(count); j++ {
+		var head *Avail = &pool.avail[j]
+		for block := head.next; block != head && fits < uintptr(count); block = block.next {
+			fits += uintptr(1) << (j - k)
+		}
+	}
+	if fits < uintptr(count) {
+		var err error = unix.ENOMEM
+		logf(pool, "ERROR: Not enough memory for batch allocation")
+		return nil, err
+	}
+
+	// The whole batch has to fit under the reserved cap
+	var usable uintptr = (uintptr(1) << k) - pool.header
+	if uint64(count) > math.MaxInt64/uint64(usable) || !chargeReserved(pool, int64(usable)*int64(count)) {
+		var err error = unix.ENOMEM
+		logf(pool, "ERROR: Batch allocation would exceed the reserved byte cap")
+		return nil, err
+	}
+	if !chargeAllocs(pool, int64(count)) {
+		pool.reserved.Add(-int64(usable) * int64(count))
+		var err error = unix.ENOMEM
+		logf(pool, "ERROR: Batch allocation would exceed the allocation count cap")
+		return nil, err
+	}
+
+	var ptrs []unsafe.Pointer = make([]unsafe.Pointer, 0, count)
+	for i := 0; i < count; i++ {
+		// Smallest non-empty list at or above k
+		var availableK uint = k
+		for pool.avail[availableK].next == &pool.avail[availableK] {
+			availableK++
+		}
+
+		var block *Avail = splitBlock(pool, availableK, k)
+		ptrs = append(ptrs, reserveBlock(pool, block, size))
+	}
+
+	return ptrs, nil
+}
+
+// Frees every pointer in ptrs. All pointers are checked under the locks before any is freed
+// so a bad pointer leaves the whole batch untouched. Aligned pointers are followed back to their
+// block like in buddyFree, and each block then takes the same path as a buddyFree, through the
+// free cache if there is one. The pool is verified once at the end when VerifyFrees is set
+func buddyFreeBatch(pool *BuddyPool, ptrs []unsafe.Pointer) error {
+	if pool == nil || len(ptrs) == 0 {
+		return nil
+	}
+
+	// Registered first so it runs once every block is released
+	defer drainIfFragmented(pool)
+
+	blocks, raws, err := checkBatch(pool, ptrs)
+	if err != nil {
+		return err
+	}
+
+	// Wake waiters once the blocks are back
+	defer notifyFree(pool)
+
+	for i, block := range blocks {
+		if block == nil {
+			continue
+		}
+		err = freeBlock(pool, raws[i], block)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Catch a batch that broke an invariant like buddyFree does for a single block
+	if pool.verifyFrees {
+		err = buddyVerify(pool)
+		if err != nil {
+			logf(pool, "ERROR: Pool invariant broken by batch free: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validates every pointer of a batch under every lock, returning the headers and the
+// natural user pointers of the blocks to free, nil for nil entries
+func checkBatch(pool *BuddyPool, ptrs []unsafe.Pointer) ([]*Avail, []unsafe.Pointer, error) {
+	lockAll(pool)
+	defer unlockAll(pool)
+
+	// Validate the whole batch up front, including pointers repeated within it
+	var blocks []*Avail = make([]*Avail, len(ptrs))
+	var seen map[unsafe.Pointer]bool = make(map[unsafe.Pointer]bool, len(ptrs))
+	var raws []unsafe.Pointer = make([]unsafe.Pointer, len(ptrs))
+	for i, ptr := range ptrs {
+		if ptr == nil {
+			continue
+		}
+
+		// An aligned pointer counts as its block's natural one, so both in a batch is a double free
+		ptr = unalignPtr(pool, ptr)
+		raws[i] = ptr
+		if seen[ptr] {
+			logf(pool, "ERROR: Double free detected")
+			return nil, nil, misuse(pool, ErrDoubleFree, ptr)
+		}
+		seen[ptr] = true
+
+		var err error
+		blocks[i], err = checkFree(pool, ptr)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return blocks, raws, nil
+}
@@ -0,0 +1,116 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestBuddyMallocBatch(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing batch allocation")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	ptrs, err := buddyMallocBatch(&pool, 100, 50)
+	assert.NoError(t, err)
+	assert.Len(t, ptrs, 50)
+
+	// Every block is distinct and usable
+	seen := make(map[unsafe.Pointer]bool)
+	for _, p := range ptrs {
+		assert.NotNil(t, p)
+		assert.False(t, seen[p])
+		seen[p] = true
+		assert.GreaterOrEqual(t, buddyUsableSize(&pool, p), uint(100))
+	}
+	assert.Equal(t, uint(50), buddyStats(&pool).LiveAllocations)
+	assert.NoError(t, buddyVerify(&pool))
+
+	assert.NoError(t, buddyFreeBatch(&pool, ptrs))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyMallocBatchAllOrNothing(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing batch allocation rolls back when the pool is too small")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Only 1024 blocks of 1KiB fit in a 1MiB pool
+	ptrs, err := buddyMallocBatch(&pool, 1000, 1025)
+	assert.Nil(t, ptrs)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	checkBuddyPoolFull(t, &pool)
+
+	// Partially used pool still rolls back
+	keep, _ := buddyMalloc(&pool, 1000)
+	ptrs, err = buddyMallocBatch(&pool, 1000, 1024)
+	assert.Nil(t, ptrs)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.Equal(t, uint(1), buddyStats(&pool).LiveAllocations)
+
+	// Exactly what is left succeeds
+	ptrs, err = buddyMallocBatch(&pool, 1000, 1023)
+	assert.NoError(t, err)
+	assert.Len(t, ptrs, 1023)
+
+	assert.NoError(t, buddyFreeBatch(&pool, append(ptrs, keep)))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyFreeBatchInvalid(t *testing.T) {
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	ptrs, _ := buddyMallocBatch(&pool, 8, 4)
+
+	// A repeated pointer rejects the whole batch
+	assert.ErrorIs(t, buddyFreeBatch(&pool, []unsafe.Pointer{ptrs[0], ptrs[1], ptrs[0]}), ErrDoubleFree)
+	assert.Equal(t, uint(4), buddyStats(&pool).LiveAllocations)
+
+	assert.NoError(t, buddyFreeBatch(&pool, ptrs))
+	assert.ErrorIs(t, buddyFreeBatch(&pool, ptrs), ErrDoubleFree)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyFreeBatchSharedPath(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing batch free goes through the free cache and VerifyFrees like buddyFree")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{CacheDepth: 4}))
+
+	// Small blocks are parked in the cache rather than merged straight away
+	ptrs, err := buddyMallocBatch(&pool, 100, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFreeBatch(&pool, ptrs))
+	assert.Equal(t, 2*(uintptr(1)<<ptrToBlock(&pool, ptrs[0]).kval), buddyStats(&pool).CachedBytes)
+	assert.Zero(t, buddyStats(&pool).LiveAllocations)
+	pool.cache.flush(&pool)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+
+	// A stray write over a free block's tag is caught by the batch that follows it
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{VerifyFrees: true}))
+	a, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	ptrs, err = buddyMallocBatch(&pool, 100, 3)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFreeBatch(&pool, []unsafe.Pointer{a}))
+	var block *Avail = ptrToBlock(&pool, a)
+	block.tag = BLOCK_UNUSED
+	assert.ErrorIs(t, buddyFreeBatch(&pool, ptrs), ErrCorruptPool)
+
+	// With the tag put back the unmerged buddies can be repaired
+	block.tag = BLOCK_AVAIL
+	assert.Positive(t, buddyRecoalesce(&pool))
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
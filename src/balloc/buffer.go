@@ -0,0 +1,99 @@
+package balloc
+
+import (
+	"io"
+	"unsafe"
+)
+
+// Fixed capacity byte buffer over one pool block, implementing io.Reader, io.Writer and io.Closer.
+// Writes append after the written bytes and reads consume them from the front. Close gives the
+// block back to the pool. Like bytes.Buffer it is not safe for concurrent use
+type Buffer struct {
+	pool *BuddyPool     // the pool the block belongs to
+	ptr  unsafe.Pointer // user pointer of the block, nil once closed
+	buf  []byte         // the usable region of the block. len is the capacity
+	w    int            // bytes written so far
+	r    int            // bytes read so far, never past w
+}
+
+// Allocates a buffer able to hold at least size bytes from pool.
+// A zero size still takes the smallest block so the buffer is always usable
+func newBuffer(pool *BuddyPool, size uint) (*Buffer, error) {
+	ptr, err := buddyMalloc(pool, max(size, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Buffer{
+		pool: pool,
+		ptr:  ptr,
+		buf:  unsafe.Slice((*byte)(ptr), userSize(pool, ptrToBlock(pool, ptr))),
+	}, nil
+}
+
+// Appends p to the buffer. If p does not fit the part that does is written
+// and io.ErrShortWrite is returned, nothing is ever written past the capacity
+func (b *Buffer) Write(p []byte) (int, error) {
+	if b.ptr == nil {
+		return 0, ErrBufferClosed
+	}
+
+	var n int = copy(b.buf[b.w:], p)
+	b.w += n
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+// Reads the oldest unread bytes into p. Returns io.EOF once every written byte has been read
+func (b *Buffer) Read(p []byte) (int, error) {
+	if b.ptr == nil {
+		return 0, ErrBufferClosed
+	}
+	if b.r == b.w {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+
+	var n int = copy(p, b.buf[b.r:b.w])
+	b.r += n
+
+	return n, nil
+}
+
+// Returns the unread bytes. The slice aliases pool memory and is only valid until Close
+func (b *Buffer) Bytes() []byte {
+	return b.buf[b.r:b.w]
+}
+
+// Returns the number of unread bytes
+func (b *Buffer) Len() int {
+	return b.w - b.r
+}
+
+// Returns the total bytes the buffer can hold, 0 once closed
+func (b *Buffer) Cap() int {
+	return len(b.buf)
+}
+
+// Frees the block back to the pool. Closing an already closed buffer does nothing
+func (b *Buffer) Close() error {
+	if b.ptr == nil {
+		return nil
+	}
+
+	var err error = buddyFree(b.pool, b.ptr)
+	if err != nil {
+		return err
+	}
+	b.ptr = nil
+	b.buf = nil
+	b.w = 0
+	b.r = 0
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package balloc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferWriteReadClose(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing pool backed buffers read, write and close")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	var buf *Buffer
+	var err error
+	buf, err = newBuffer(&pool, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int(buddyUsableSize(&pool, buf.ptr)), buf.Cap())
+	assert.GreaterOrEqual(t, buf.Cap(), 100)
+
+	// Write until full, the last write is cut short at the capacity
+	var chunk []byte = []byte("0123456789")
+	var written int
+	for {
+		n, err := buf.Write(chunk)
+		written += n
+		if err != nil {
+			assert.ErrorIs(t, err, io.ErrShortWrite)
+			assert.Less(t, n, len(chunk))
+			break
+		}
+	}
+	assert.Equal(t, buf.Cap(), written)
+	n, err := buf.Write([]byte("x"))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.ErrShortWrite)
+
+	// Read everything back through io utilities
+	var want []byte = bytes.Repeat(chunk, written/len(chunk)+1)[:written]
+	assert.Equal(t, want, buf.Bytes())
+	var got []byte
+	got, err = io.ReadAll(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+	assert.Equal(t, 0, buf.Len())
+	n, err = buf.Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Close gives the block back and the buffer is unusable afterwards
+	assert.NoError(t, buf.Close())
+	checkBuddyPoolFull(t, &pool)
+	assert.NoError(t, buf.Close())
+	_, err = buf.Write(chunk)
+	assert.ErrorIs(t, err, ErrBufferClosed)
+	_, err = buf.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrBufferClosed)
+	assert.Equal(t, 0, buf.Cap())
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBufferCopy(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing buffers work with io.Copy")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	var src []byte = bytes.Repeat([]byte("balloc"), 1000)
+	buf, err := newBuffer(&pool, uint(len(src)))
+	assert.NoError(t, err)
+	n, err := io.Copy(buf, bytes.NewReader(src))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(src)), n)
+
+	var out bytes.Buffer
+	_, err = io.Copy(&out, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, src, out.Bytes())
+	assert.NoError(t, buf.Close())
+
+	// A zero size buffer still holds the smallest block
+	buf, err = newBuffer(&pool, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int(uintptr(1)<<SMALLEST_K-BLOCK_HEADER), buf.Cap())
+	assert.NoError(t, buf.Close())
+
+	// Buffers larger than the pool fail like malloc
+	_, err = newBuffer(&pool, 1<<MIN_K)
+	assert.Error(t, err)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,130 @@
+package balloc
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Front-end cache of recently freed blocks.
+// Blocks are kept in a LIFO per size class, sharded so concurrent goroutines
+// rarely contend on the same shard. Cached blocks stay tagged BLOCK_CACHED and
+// are never linked into the avail lists until flushed
+type freeCache struct {
+	shards []cacheShard // one shard per P so goroutines spread out
+	depth  int          // max blocks each shard keeps per size class
+	hits   atomic.Int64 // number of mallocs served from the cache
+}
+
+// One shard of the free cache
+type cacheShard struct {
+	lock   sync.Mutex      // guards blocks
+	blocks [MAX_K][]*Avail // LIFO of cached blocks per size class
+}
+
+// Creates a free cache keeping up to depth blocks per size class in each shard.
+// A deterministic cache has a single shard so the block a malloc gets does not depend on a random pick
+func newFreeCache(depth int, deterministic bool) *freeCache {
+	var shards int = runtime.GOMAXPROCS(0)
+	if deterministic {
+		shards = 1
+	}
+
+	return &freeCache{
+		shards: make([]cacheShard, shards),
+		depth:  depth,
+	}
+}
+
+// Picks a shard for the calling goroutine
+func (c *freeCache) shard() *cacheShard {
+	return &c.shards[rand.Uint32N(uint32(len(c.shards)))]
+}
+
+// Pops a cached block of size class k, returning nil if the shard has none
+func (c *freeCache) get(k uint) *Avail {
+	var s *cacheShard = c.shard()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int = len(s.blocks[k])
+	if n == 0 {
+		return nil
+	}
+
+	var block *Avail = s.blocks[k][n-1]
+	s.blocks[k] = s.blocks[k][:n-1]
+	c.hits.Add(1)
+
+	return block
+}
+
+// Pushes a freed block into the cache. When the shard's list for the block's
+// size class is full, half of it is flushed back to the avail lists first
+func (c *freeCache) put(pool *BuddyPool, block *Avail) {
+	var k uint = uint(block.kval)
+	var s *cacheShard = c.shard()
+	s.lock.Lock()
+
+	// Take the older half of a full list out to flush once the shard is unlocked
+	var spill []*Avail
+	if len(s.blocks[k]) >= c.depth {
+		var half int = (len(s.blocks[k]) + 1) / 2
+		spill = append(spill, s.blocks[k][:half]...)
+		s.blocks[k] = append(s.blocks[k][:0], s.blocks[k][half:]...)
+	}
+
+	block.tag = BLOCK_CACHED
+	sealHeader(pool, block)
+	s.blocks[k] = append(s.blocks[k], block)
+	s.lock.Unlock()
+
+	for _, b := range spill {
+		_ = releaseBlock(pool, b)
+	}
+}
+
+// Returns the total size of every cached block, taking each shard's lock in turn
+func (c *freeCache) bytes() uintptr {
+	var total uintptr
+	for i := range c.shards {
+		var s *cacheShard = &c.shards[i]
+		s.lock.Lock()
+		for k := range s.blocks {
+			total += uintptr(len(s.blocks[k])) << k
+		}
+		s.lock.Unlock()
+	}
+
+	return total
+}
+
+// Hands every cached block back to the avail lists and returns how many there were
+func (c *freeCache) flush(pool *BuddyPool) int {
+	var flushed int
+	for i := range c.shards {
+		var s *cacheShard = &c.shards[i]
+		s.lock.Lock()
+		var spill []*Avail
+		for k := range s.blocks {
+			spill = append(spill, s.blocks[k]...)
+			s.blocks[k] = nil
+		}
+		s.lock.Unlock()
+
+		for _, b := range spill {
+			_ = releaseBlock(pool, b)
+		}
+		flushed += len(spill)
+	}
+
+	return flushed
+}
+
+// Hands every cached block back to the avail lists so the space can coalesce
+func buddyFlushCache(pool *BuddyPool) {
+	if pool.cache != nil {
+		pool.cache.flush(pool)
+	}
+}
@@ -0,0 +1,160 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreeCacheReuse(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing free cache reuses blocks without double handouts")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{CacheDepth: 8}))
+
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 32; i++ {
+		p, err := buddyMalloc(&pool, 16)
+		assert.NoError(t, err)
+		ptrs = append(ptrs, p)
+	}
+	for _, p := range ptrs {
+		assert.NoError(t, buddyFree(&pool, p))
+	}
+
+	// Cached blocks are rejected as double frees
+	assert.ErrorIs(t, buddyFree(&pool, ptrs[len(ptrs)-1]), ErrDoubleFree)
+
+	// Every pointer handed out is unique while live
+	seen := make(map[unsafe.Pointer]bool)
+	ptrs = ptrs[:0]
+	for i := 0; i < 32; i++ {
+		p, err := buddyMalloc(&pool, 16)
+		assert.NoError(t, err)
+		assert.False(t, seen[p], "block handed out twice")
+		seen[p] = true
+		ptrs = append(ptrs, p)
+	}
+	assert.Greater(t, pool.cache.hits.Load(), int64(0))
+
+	for _, p := range ptrs {
+		assert.NoError(t, buddyFree(&pool, p))
+	}
+
+	// Flushing hands everything back so the pool coalesces to full
+	buddyFlushCache(&pool)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+	assert.Nil(t, pool.cache)
+}
+
+func TestFreeCacheWholePool(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing an empty pool serves a whole-pool request with blocks still cached")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{CacheDepth: 8}))
+
+	// The freed block sits in the cache, splitting the pool, until the request flushes it
+	mem, err := buddyMalloc(&pool, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.Less(t, buddyStats(&pool).LargestFreeBlock, uintptr(1)<<MIN_K)
+
+	mem, err = buddyMalloc(&pool, uint(uintptr(1)<<MIN_K-pool.header))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(MIN_K), ptrToBlock(&pool, mem).kval)
+	assert.NoError(t, buddyFree(&pool, mem))
+
+	buddyFlushCache(&pool)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestFreeCacheConcurrent(t *testing.T) {
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<(MIN_K+2), Options{CacheDepth: 4}))
+
+	var mu sync.Mutex
+	live := make(map[unsafe.Pointer]bool)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var held []unsafe.Pointer
+			for i := 0; i < 2000; i++ {
+				p, err := buddyMalloc(&pool, uint(8<<(i%4)))
+				if err == nil {
+					mu.Lock()
+					assert.False(t, live[p], "block handed out twice")
+					live[p] = true
+					mu.Unlock()
+					held = append(held, p)
+				}
+
+				// Keep a few blocks live so reuse overlaps with other goroutines
+				if len(held) > 4 || (err != nil && len(held) > 0) {
+					p = held[0]
+					held = held[1:]
+					mu.Lock()
+					delete(live, p)
+					mu.Unlock()
+					assert.NoError(t, buddyFree(&pool, p))
+				}
+			}
+			for _, p := range held {
+				mu.Lock()
+				delete(live, p)
+				mu.Unlock()
+				assert.NoError(t, buddyFree(&pool, p))
+			}
+		}()
+	}
+	wg.Wait()
+
+	buddyFlushCache(&pool)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestFreeCacheDestroyReclaims(t *testing.T) {
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{CacheDepth: 16}))
+
+	for i := 0; i < 10; i++ {
+		p, _ := buddyMalloc(&pool, 100)
+		assert.NoError(t, buddyFree(&pool, p))
+	}
+
+	// Destroy flushes before unmapping, so the lists are whole right up until the unmap
+	pool.cache.flush(&pool)
+	checkBuddyPoolFull(t, &pool)
+	assert.NoError(t, buddyDestroy(&pool))
+	assert.Nil(t, pool.cache)
+}
+
+// A tight alloc/free loop of one size. cache-hits/op is the share of mallocs
+// that never touched the class locks
+func BenchmarkFreeCache(b *testing.B) {
+	for _, depth := range []int{0, 64} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			var pool BuddyPool
+			_ = buddyInitWithOptions(&pool, 1<<(MIN_K+4), Options{CacheDepth: depth})
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					p, _ := buddyMalloc(&pool, 64)
+					_ = buddyFree(&pool, p)
+				}
+			})
+
+			if pool.cache != nil {
+				b.ReportMetric(float64(pool.cache.hits.Load())/float64(b.N), "cache-hits/op")
+			}
+			_ = buddyDestroy(&pool)
+		})
+	}
+}
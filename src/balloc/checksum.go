@@ -0,0 +1,25 @@
+package balloc
+
+import "unsafe"
+
+// Mixed into every header checksum so a zeroed header never checks out
+const checksumSeed uint32 = 0xB10C5EED
+
+// Checksum of the tag and kval of block, mixed with its offset so a header
+// copied over another block does not check out either
+func headerSum(pool *BuddyPool, block *Avail) uint32 {
+	var offset uint64 = uint64(uintptr(unsafe.Pointer(block)) - pool.base)
+	return (uint32(block.tag) | uint32(block.kval)<<16) ^ uint32(offset) ^ uint32(offset>>32) ^ checksumSeed
+}
+
+// Stores the checksum of block's header in its size field. Does nothing unless checksum mode is on
+func sealHeader(pool *BuddyPool, block *Avail) {
+	if pool.checksum {
+		block.size = headerSum(pool, block)
+	}
+}
+
+// Reports whether block's header still matches its checksum. Always true outside checksum mode
+func headerIntact(pool *BuddyPool, block *Avail) bool {
+	return !pool.checksum || block.size == headerSum(pool, block)
+}
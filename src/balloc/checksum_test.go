@@ -0,0 +1,127 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumCorruptedHeader(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing checksum mode rejects a free through an overwritten header")
+	var pool BuddyPool
+	var logger captureLogger
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Checksum: true, Logger: &logger}))
+
+	a, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	b, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyVerify(&pool))
+
+	// An underrun into b's header changes its kval but cannot fix up the checksum
+	var block *Avail = ptrToBlock(&pool, b)
+	var offset uintptr = uintptr(b) - pool.header - pool.base
+	block.kval++
+	err = buddyFree(&pool, b)
+	assert.ErrorIs(t, err, ErrCorruptedHeader)
+	assert.Contains(t, err.Error(), fmt.Sprintf("offset %#x", offset))
+	assert.True(t, logger.contains("Invalid pointer passed to free"))
+
+	// Verify spots the same header
+	err = buddyVerify(&pool)
+	assert.ErrorIs(t, err, ErrCorruptPool)
+	assert.ErrorIs(t, err, ErrCorruptedHeader)
+
+	// With the header put back the block frees as usual
+	block.kval--
+	assert.NoError(t, buddyFree(&pool, b))
+	assert.NoError(t, buddyFree(&pool, a))
+	assert.NoError(t, buddyVerify(&pool))
+	assert.Equal(t, 1, availCount(&pool, pool.kvalM))
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestChecksumCorruptedBuddy(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing checksum mode does not merge a buddy with an overwritten header")
+	var pool BuddyPool
+	var logger captureLogger
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Checksum: true, Logger: &logger}))
+
+	a, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	b, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, b))
+
+	// b still looks like a free buddy of a but its checksum no longer matches
+	var block *Avail = ptrToBlock(&pool, b)
+	block.size ^= 1
+	assert.NoError(t, buddyFree(&pool, a))
+	assert.True(t, logger.contains("not merging"))
+	assert.Equal(t, 2, availCount(&pool, uint(block.kval)))
+	assert.ErrorIs(t, buddyVerify(&pool), ErrCorruptPool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestChecksumChurn(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing checksum mode keeps every header sealed under churn")
+	for _, opts := range []Options{{Checksum: true}, {Checksum: true, CacheDepth: 4}, {Checksum: true, PrewarmK: MIN_K - 4}, {Checksum: true, DeferCoalesce: true}, {Checksum: true, HoldSplits: 2}} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+		assert.NoError(t, Stress(&pool, 2000, 7))
+		assert.NoError(t, buddyVerify(&pool))
+		if opts.DeferCoalesce {
+			buddyCoalesceAll(&pool)
+			assert.NoError(t, buddyVerify(&pool))
+		}
+		_ = buddyDestroy(&pool)
+	}
+}
+
+func TestChecksumConcurrentFree(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing checksum mode does not reject valid frees racing splits and merges")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Checksum: true}))
+
+	// The window between a merge's kval write and its seal is narrow, it takes many rounds to hit
+	var rounds int = 100000
+	if raceEnabled {
+		rounds = 10000
+	}
+	var wg sync.WaitGroup
+	var failures atomic.Int32
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				ptr, err := buddyMalloc(&pool, uint(16+(g*131+i*17)%2000))
+				if err != nil {
+					continue
+				}
+				if buddyFree(&pool, ptr) != nil {
+					failures.Add(1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	assert.Zero(t, failures.Load())
+	assert.NoError(t, buddyVerify(&pool))
+	assert.Equal(t, 1, availCount(&pool, pool.kvalM))
+	_ = buddyDestroy(&pool)
+}
+
+func TestChecksumInvalid(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing checksum option validation")
+	var pool BuddyPool
+	assert.ErrorIs(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Checksum: true, Redzone: true}), ErrInvalidOptions)
+	assert.Equal(t, uintptr(0), pool.base)
+}
@@ -0,0 +1,82 @@
+package balloc
+
+import "unsafe"
+
+// Merges every pair of free buddies in the pool, from the smallest size class up
+// so merged blocks keep merging. Deferred coalescing mode relies on this to
+// rebuild large blocks, in normal mode the pool is always fully merged already
+func buddyCoalesceAll(pool *BuddyPool) {
+	_ = buddyRecoalesce(pool)
+}
+
+// Gives every free block parked outside the avail lists back to them: the free cache is flushed and
+// buddies left unmerged, by deferred coalescing, held splits or prewarming, are merged. Returns
+// whether anything was reclaimed, only then can a malloc that just failed succeed when retried
+func reclaimParked(pool *BuddyPool) bool {
+	var flushed int
+	if pool.cache != nil {
+		flushed = pool.cache.flush(pool)
+	}
+
+	return buddyRecoalesce(pool) != 0 || flushed != 0
+}
+
+// Does the same full sweep as buddyCoalesceAll and returns the number of merges made.
+// Afterwards no two free buddies of the same size are left, whatever left them unmerged,
+// so it also repairs free lists that were manipulated from outside the allocator
+func buddyRecoalesce(pool *BuddyPool) int {
+	lockAll(pool)
+	defer unlockAll(pool)
+
+	if pool.base == 0 || pool.readOnly {
+		return 0
+	}
+
+	var merges int
+	for k := pool.smallestK; k < pool.kvalM; k++ {
+		var head *Avail = &pool.avail[k]
+		var block *Avail = head.next
+		for block != head {
+			var next *Avail = block.next
+
+			// Only merge with a buddy that is free at the same size
+			var buddy *Avail = buddyCalc(pool, block)
+			if buddy.tag != BLOCK_AVAIL || buddy.kval != block.kval {
+				block = next
+				continue
+			}
+
+			// The buddy may be the next node in this same list
+			if buddy == next {
+				next = next.next
+			}
+
+			// Unlink both halves
+			block.prev.next = block.next
+			block.next.prev = block.prev
+			buddy.prev.next = buddy.next
+			buddy.next.prev = buddy.prev
+
+			// Lower address becomes the larger block, moved up to the next list
+			var lowerBlock *Avail = block
+			if uintptr(unsafe.Pointer(buddy)) < uintptr(unsafe.Pointer(block)) {
+				lowerBlock = buddy
+			}
+			lowerBlock.kval++
+			sealHeader(pool, lowerBlock)
+			traceMerge(pool, uint(lowerBlock.kval)-1, lowerBlock)
+			if pool.poison {
+				poisonHeader(lowerBlock)
+			}
+			putBlock(pool, &pool.avail[lowerBlock.kval], lowerBlock)
+			merges++
+
+			block = next
+		}
+	}
+
+	// Nothing is left unmerged, including pairs held back from merging
+	pool.held.Store(0)
+
+	return merges
+}
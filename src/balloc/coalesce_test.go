@@ -0,0 +1,131 @@
+package balloc
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Offsets of the free blocks of each k in address order, ignoring avail list order
+func freeLayout(pool *BuddyPool) [MAX_K][]uintptr {
+	var layout [MAX_K][]uintptr = buddySnapshot(pool).Free
+	for k := range layout {
+		sort.Slice(layout[k], func(i, j int) bool { return layout[k][i] < layout[k][j] })
+	}
+	return layout
+}
+
+func TestBuddyCoalesceAllMatchesImmediate(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing deferred coalescing ends with the immediate layout")
+	var immediate, deferred BuddyPool
+	_ = buddyInit(&immediate, 1<<MIN_K)
+	_ = buddyInitWithOptions(&deferred, 1<<MIN_K, Options{DeferCoalesce: true})
+
+	// The same allocations land at the same offsets in both pools
+	var rng *rand.Rand = rand.New(rand.NewSource(39))
+	var a, b []unsafe.Pointer
+	for i := 0; i < 300; i++ {
+		var size uint = uint(rng.Intn(2000) + 1)
+		p, err := buddyMalloc(&immediate, size)
+		assert.NoError(t, err)
+		q, err := buddyMalloc(&deferred, size)
+		assert.NoError(t, err)
+		assert.Equal(t, uintptr(p)-immediate.base, uintptr(q)-deferred.base)
+		a = append(a, p)
+		b = append(b, q)
+	}
+
+	// Free most of them in a random order
+	for _, i := range rng.Perm(len(a))[:250] {
+		assert.NoError(t, buddyFree(&immediate, a[i]))
+		assert.NoError(t, buddyFree(&deferred, b[i]))
+	}
+	assert.NotEqual(t, freeLayout(&immediate), freeLayout(&deferred))
+	assert.NoError(t, buddyVerify(&deferred))
+
+	// A full merge pass reaches the same layout
+	buddyCoalesceAll(&deferred)
+	assert.Equal(t, freeLayout(&immediate), freeLayout(&deferred))
+	deferred.deferCoalesce = false
+	assert.NoError(t, buddyVerify(&deferred))
+
+	_ = buddyDestroy(&immediate)
+	_ = buddyDestroy(&deferred)
+}
+
+func TestBuddyDeferredMallocCoalesces(t *testing.T) {
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{DeferCoalesce: true}))
+
+	// Free memory scattered over unmerged buddies
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 64; i++ {
+		ptr, _ := buddyMalloc(&pool, 1000)
+		ptrs = append(ptrs, ptr)
+	}
+	for _, ptr := range ptrs {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	assert.Less(t, buddyStats(&pool).LargestFreeBlock, pool.numBytes)
+
+	// A request only the whole pool fits merges everything first
+	big, err := buddyMalloc(&pool, uint(pool.numBytes-BLOCK_HEADER))
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, big))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyRecoalesce(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing a sweep repairs unmerged buddies")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	assert.Equal(t, 0, buddyRecoalesce(&pool))
+
+	// Link two buddies back into avail[SMALLEST_K] by hand, as if freed without coalescing
+	first, _ := buddyMalloc(&pool, 1)
+	second, _ := buddyMalloc(&pool, 1)
+	for _, ptr := range []unsafe.Pointer{first, second} {
+		var block *Avail = ptrToBlock(&pool, ptr)
+		block.tag = BLOCK_AVAIL
+		insertBlock(&pool.avail[block.kval], block)
+		forgetBlock(&pool, ptr, blockUsable(&pool, block))
+	}
+	assert.ErrorIs(t, buddyVerify(&pool), ErrCorruptPool)
+
+	// The two merge, and the result keeps merging with the halves split off for them
+	assert.Equal(t, int(MIN_K-SMALLEST_K), buddyRecoalesce(&pool))
+	assert.NoError(t, buddyVerify(&pool))
+	checkBuddyPoolFull(t, &pool)
+	assert.Equal(t, 0, buddyRecoalesce(&pool))
+
+	_ = buddyDestroy(&pool)
+}
+
+func BenchmarkCoalesce(b *testing.B) {
+	for _, deferCoalesce := range []bool{false, true} {
+		b.Run(fmt.Sprintf("deferred=%t", deferCoalesce), func(b *testing.B) {
+			var pool BuddyPool
+			_ = buddyInitWithOptions(&pool, 1<<MIN_K, Options{DeferCoalesce: deferCoalesce})
+			var ptrs []unsafe.Pointer = make([]unsafe.Pointer, 256)
+
+			// Bursts of frees of neighbouring blocks that are split again straight away
+			for i := 0; i < b.N; i++ {
+				for j := range ptrs {
+					ptrs[j], _ = buddyMalloc(&pool, 64)
+				}
+				for _, p := range ptrs {
+					_ = buddyFree(&pool, p)
+				}
+			}
+
+			_ = buddyDestroy(&pool)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package balloc
+
+// Running allocation counts of a pool, read without taking any lock.
+// Each field is loaded on its own so a read racing a malloc or free may be off by a few
+type Counters struct {
+	Allocs      uint64 // blocks handed out since init or the last reset
+	Frees       uint64 // blocks given back since init or the last reset
+	Outstanding int64  // blocks currently handed out to the user
+}
+
+// Returns the pool's allocation counters. Cheap enough for a monitoring loop polling
+// far more often than buddyStats, which locks every size class
+func buddyCounters(pool *BuddyPool) Counters {
+	return Counters{
+		Allocs:      pool.totalAllocs.Load(),
+		Frees:       pool.totalFrees.Load(),
+		Outstanding: pool.allocs.Load(),
+	}
+}
+
+// Structural operation counts of a pool, read without taking any lock like Counters.
+// Splits and merges far above Counters.Allocs mean most allocations re-split blocks that frees
+// merge straight back, a churning workload that CacheDepth or HoldSplits would help
+type OpStats struct {
+	Splits uint64 // blocks split in two since init or the last reset, by malloc, batches and prewarming
+	Merges uint64 // buddy pairs merged since init or the last reset, by free, CoalesceAll and growing in place
+}
+
+// Returns the pool's split and merge counts
+func buddyOpStats(pool *BuddyPool) OpStats {
+	return OpStats{
+		Splits: pool.totalSplits.Load(),
+		Merges: pool.totalMerges.Load(),
+	}
+}
@@ -0,0 +1,139 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuddyCounters(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing lock free allocation counters")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	assert.Equal(t, Counters{}, buddyCounters(&pool))
+
+	// N allocs then M frees
+	const n, m = 40, 25
+	var ptrs []unsafe.Pointer
+	for i := 0; i < n; i++ {
+		mem, err := buddyMalloc(&pool, 64)
+		assert.NoError(t, err)
+		ptrs = append(ptrs, mem)
+	}
+	for _, ptr := range ptrs[:m] {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	assert.Equal(t, Counters{Allocs: n, Frees: m, Outstanding: n - m}, buddyCounters(&pool))
+
+	// Failed frees and mallocs are not counted
+	assert.Error(t, buddyFree(&pool, ptrs[0]))
+	_, err := buddyMalloc(&pool, 1<<MIN_K)
+	assert.Error(t, err)
+	assert.Equal(t, Counters{Allocs: n, Frees: m, Outstanding: n - m}, buddyCounters(&pool))
+
+	// Reset starts the counters over
+	buddyReset(&pool)
+	assert.Equal(t, Counters{}, buddyCounters(&pool))
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyCountersConcurrent(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing allocation counters under concurrent mallocs, frees and reads")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{CacheDepth: 4}))
+
+	// Monitor polls the counters while workers churn
+	var done chan struct{} = make(chan struct{})
+	var monitor sync.WaitGroup
+	monitor.Add(1)
+	go func() {
+		defer monitor.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				var c Counters = buddyCounters(&pool)
+				assert.GreaterOrEqual(t, c.Outstanding, int64(0))
+			}
+		}
+	}()
+
+	// Each worker keeps every other block so frees lag allocs
+	const workers, rounds = 8, 100
+	var wg sync.WaitGroup
+	var kept [workers][]unsafe.Pointer
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				mem, err := buddyMalloc(&pool, 32)
+				if !assert.NoError(t, err) {
+					return
+				}
+				if i%2 == 0 {
+					kept[w] = append(kept[w], mem)
+					continue
+				}
+				assert.NoError(t, buddyFree(&pool, mem))
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	monitor.Wait()
+
+	assert.Equal(t, Counters{Allocs: workers * rounds, Frees: workers * rounds / 2, Outstanding: workers * rounds / 2}, buddyCounters(&pool))
+	for _, ptrs := range kept {
+		for _, ptr := range ptrs {
+			assert.NoError(t, buddyFree(&pool, ptr))
+		}
+	}
+	assert.Equal(t, int64(0), buddyCounters(&pool).Outstanding)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyOpStats(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing split and merge counters")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<20, Options{SmallestK: 6}))
+	assert.Equal(t, OpStats{}, buddyOpStats(&pool))
+
+	// The smallest block splits the whole pool all the way down and merges all the way back up
+	mem, err := buddyMalloc(&pool, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, OpStats{Splits: 14}, buddyOpStats(&pool))
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.Equal(t, OpStats{Splits: 14, Merges: 14}, buddyOpStats(&pool))
+
+	// The second of two buddies takes the half left by the first without splitting
+	a, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	b, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, OpStats{Splits: 27, Merges: 14}, buddyOpStats(&pool))
+
+	// Freeing one buddy while the other is live merges nothing
+	assert.NoError(t, buddyFree(&pool, a))
+	assert.Equal(t, OpStats{Splits: 27, Merges: 14}, buddyOpStats(&pool))
+	assert.NoError(t, buddyFree(&pool, b))
+	assert.Equal(t, OpStats{Splits: 27, Merges: 27}, buddyOpStats(&pool))
+	checkBuddyPoolFull(t, &pool)
+
+	// Reset starts the counts over
+	buddyReset(&pool)
+	assert.Equal(t, OpStats{}, buddyOpStats(&pool))
+	_ = buddyDestroy(&pool)
+
+	// Prewarming splits at init are counted
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<20, Options{SmallestK: 6, PrewarmK: 10}))
+	assert.Equal(t, OpStats{Splits: 10}, buddyOpStats(&pool))
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,384 @@
+package balloc
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// Max number of stack frames recorded per allocation in leak tracking mode
+const maxLeakFrames = 16
+
+// Function name prefix shared by everything in this package, used to find the
+// first caller outside the allocator when resolving leak sites
+var pkgPrefix string = strings.TrimSuffix(runtime.FuncForPC(reflect.ValueOf(buddyMalloc).Pointer()).Name(), "buddyMalloc")
+
+// An allocation that is still outstanding in leak tracking mode
+type LeakInfo struct {
+	Ptr      unsafe.Pointer // pointer handed to the caller
+	Size     uint           // usable bytes at Ptr
+	Function string         // function that made the allocation
+	File     string         // source file of the allocation
+	Line     int            // source line of the allocation
+}
+
+// Returns the user pointer the buddy of ptr's block would have, found with the same XOR as buddyCalc,
+// to help reason about why two frees did or did not coalesce. The buddy is only a block in its own
+// right if it has not been split further. Returns nil for pointers outside the pool and for a
+// block spanning the whole pool, which has no buddy
+func buddyOf(pool *BuddyPool, ptr unsafe.Pointer) unsafe.Pointer {
+	if pool == nil || pool.base == 0 {
+		return nil
+	}
+	ptr = unalignPtr(pool, ptr)
+	if uintptr(ptr) < pool.base+pool.header || uintptr(ptr) >= pool.base+pool.numBytes {
+		return nil
+	}
+
+	var block *Avail = ptrToBlock(pool, ptr)
+	if uint(block.kval) >= pool.kvalM {
+		return nil
+	}
+
+	// A misaligned or corrupted block could put the buddy outside of the pool
+	var buddy *Avail = buddyCalc(pool, block)
+	if uintptr(unsafe.Pointer(buddy)) < pool.base || uintptr(unsafe.Pointer(buddy)) >= pool.base+pool.numBytes {
+		return nil
+	}
+
+	return blockToPtr(pool, buddy)
+}
+
+// Reports whether the block behind the user pointer ptr is free, for test oracles and debugging.
+// Cached blocks count as free, the user has released them. A block merged into a larger free block
+// since it was freed is still reported free, as the memory at ptr is. Returns ErrInvalidPointer
+// for pointers outside the pool, not on a block boundary of the smallest size, or inside a live
+// block without being its user pointer, and ErrCorruptedHeader in checksum mode if the header in
+// front of ptr does not check out. Like validateBlock the headers above it are not checked
+func buddyIsFree(pool *BuddyPool, ptr unsafe.Pointer) (bool, error) {
+	if pool == nil {
+		return false, ErrInvalidPointer
+	}
+
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	// Aligned pointers are looked up through the block's natural user pointer
+	ptr = unalignPtr(pool, ptr)
+	var addr uintptr = uintptr(ptr)
+	if pool.base == 0 || addr < pool.base+pool.header || addr >= pool.base+pool.numBytes {
+		return false, ErrInvalidPointer
+	}
+	var offset uintptr = addr - pool.header - pool.base
+	if offset&((uintptr(1)<<pool.smallestK)-1) != 0 {
+		return false, ErrInvalidPointer
+	}
+
+	// Descend the buddy tree like validateBlock to the block holding offset
+	var start uintptr
+	var k uint = pool.kvalM
+	var node *Avail = (*Avail)(unsafe.Pointer(pool.base))
+	for {
+		if start == offset && !headerIntact(pool, node) {
+			return false, fmt.Errorf("%w: block header at offset %#x", ErrCorruptedHeader, start)
+		}
+		if uint(node.kval) > k || uint(node.kval) < pool.smallestK {
+			return false, ErrInvalidPointer
+		}
+		if uint(node.kval) == k {
+			break
+		}
+		k--
+		if offset&(uintptr(1)<<k) != 0 {
+			start += uintptr(1) << k
+		}
+		node = (*Avail)(unsafe.Pointer(pool.base + start))
+	}
+
+	// Any pointer into free memory is free, a live block only answers for its own user pointer
+	if node.tag == BLOCK_AVAIL || node.tag == BLOCK_CACHED {
+		return true, nil
+	}
+	if start != offset {
+		return false, ErrInvalidPointer
+	}
+
+	return false, nil
+}
+
+// Writes a human readable report of the avail lists to w.
+// One line per k from the pool's smallest block up to kvalM, followed by a totals line:
+//
+//	k=6 size=64 free=1
+//	...
+//	total free_blocks=14 free_bytes=1048512
+func buddyDump(pool *BuddyPool, w io.Writer) {
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	// A destroyed or uninitialized pool has nothing to walk
+	if pool.base == 0 {
+		fmt.Fprintf(w, "total free_blocks=0 free_bytes=0\n")
+		return
+	}
+
+	var totalBlocks uint
+	var totalBytes uintptr
+	for k := pool.smallestK; k <= pool.kvalM; k++ {
+		// Count the free blocks in avail[k]
+		var count uint
+		var head *Avail = &pool.avail[k]
+		for block := head.next; block != head; block = block.next {
+			count++
+		}
+
+		fmt.Fprintf(w, "k=%d size=%d free=%d\n", k, uintptr(1)<<k, count)
+		totalBlocks += count
+		totalBytes += uintptr(count) << k
+	}
+
+	fmt.Fprintf(w, "total free_blocks=%d free_bytes=%d\n", totalBlocks, totalBytes)
+}
+
+// Records the requested size in the header and fills the slack between it
+// and the end of the block with REDZONE_BYTE. Sizes too large for the header
+// field are left unguarded
+func armRedzone(pool *BuddyPool, block *Avail, ptr unsafe.Pointer, size uint) {
+	if size > math.MaxUint32 {
+		block.size = 0
+		return
+	}
+
+	block.size = uint32(size)
+	var slack []byte = unsafe.Slice((*byte)(ptr), blockUsable(pool, block))[size:]
+	for i := range slack {
+		slack[i] = REDZONE_BYTE
+	}
+}
+
+// Reports whether the canary after the requested size of block is intact
+func checkRedzone(pool *BuddyPool, block *Avail, ptr unsafe.Pointer) bool {
+	if block.size == 0 {
+		return true
+	}
+
+	var slack []byte = unsafe.Slice((*byte)(ptr), blockUsable(pool, block))[block.size:]
+	for _, b := range slack {
+		if b != REDZONE_BYTE {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the bytes of block after its full Avail header. These are the only
+// user bytes left untouched while the block sits in an avail list
+func poisonRegion(block *Avail) []byte {
+	var ptr unsafe.Pointer = unsafe.Add(unsafe.Pointer(block), AVAIL_HEADER)
+	return unsafe.Slice((*byte)(ptr), (uintptr(1)<<block.kval)-AVAIL_HEADER)
+}
+
+// Fills the user region of block with POISON_BYTE
+func poisonBlock(block *Avail) {
+	var region []byte = poisonRegion(block)
+	for i := range region {
+		region[i] = POISON_BYTE
+	}
+}
+
+// Poisons the next and prev links of a block leaving the avail lists, they are user data from now on
+func poisonLinks(block *Avail) {
+	var links unsafe.Pointer = unsafe.Add(unsafe.Pointer(block), BLOCK_HEADER)
+	var region []byte = unsafe.Slice((*byte)(links), AVAIL_HEADER-BLOCK_HEADER)
+	for i := range region {
+		region[i] = POISON_BYTE
+	}
+}
+
+// Poisons the header of the upper half of a just merged block, which now lies in its user region
+func poisonHeader(block *Avail) {
+	var upper unsafe.Pointer = unsafe.Add(unsafe.Pointer(block), uintptr(1)<<(block.kval-1))
+	var header []byte = unsafe.Slice((*byte)(upper), AVAIL_HEADER)
+	for i := range header {
+		header[i] = POISON_BYTE
+	}
+}
+
+// Checks the user region of a block about to be reused still holds only POISON_BYTE.
+// A mismatch means something wrote through a stale pointer after the block was freed.
+// It is logged and passed to the pool's OnPoison callback, the allocation still goes ahead
+func checkPoison(pool *BuddyPool, block *Avail, ptr unsafe.Pointer) {
+	// Padding in front of the user pointer is never handed out so only check from the later of the two
+	var start uintptr = max(AVAIL_HEADER, pool.header)
+	var skip uint = uint(start - pool.header)
+	for i, b := range poisonRegion(block)[start-AVAIL_HEADER:] {
+		if b != POISON_BYTE {
+			logf(pool, "WARNING: Poison overwritten at offset %d of reused block of kval %d", uint(i)+skip, block.kval)
+			if pool.onPoison != nil {
+				pool.onPoison(ptr, uint(i)+skip)
+			}
+			return
+		}
+	}
+}
+
+// Captures the call stack above the allocator entry point
+func callers() []uintptr {
+	var pcs [maxLeakFrames]uintptr
+	var n int = runtime.Callers(3, pcs[:]) // skip runtime.Callers, callers and buddyMalloc
+	return append([]uintptr(nil), pcs[:n]...)
+}
+
+// Resolves a recorded stack to the first frame outside the allocator's own source.
+// Frames from this package's tests still count as callers
+func resolveSite(pcs []uintptr, leak *LeakInfo) {
+	var frames *runtime.Frames = runtime.CallersFrames(pcs)
+	for {
+		var frame runtime.Frame
+		var more bool
+		frame, more = frames.Next()
+		var internal bool = strings.HasPrefix(frame.Function, pkgPrefix) && !strings.HasSuffix(frame.File, "_test.go")
+		if !internal || !more {
+			leak.Function = frame.Function
+			leak.File = frame.File
+			leak.Line = frame.Line
+			return
+		}
+	}
+}
+
+// Returns every allocation still outstanding in leak tracking mode ordered by address.
+// Returns nil if the pool was not initialized with TrackLeaks
+func buddyLeaks(pool *BuddyPool) []LeakInfo {
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	if pool.sites == nil {
+		return nil
+	}
+
+	// Cached blocks are handed out without the class locks, only siteLock keeps sites still
+	pool.siteLock.Lock()
+	defer pool.siteLock.Unlock()
+	var leaks []LeakInfo = make([]LeakInfo, 0, len(pool.sites))
+	for addr, pcs := range pool.sites {
+		var leak LeakInfo = LeakInfo{
+			Ptr:  unsafe.Pointer(addr),
+			Size: blockUsable(pool, ptrToBlock(pool, unsafe.Pointer(addr))),
+		}
+		resolveSite(pcs, &leak)
+		leaks = append(leaks, leak)
+	}
+
+	sort.Slice(leaks, func(i, j int) bool {
+		return uintptr(leaks[i].Ptr) < uintptr(leaks[j].Ptr)
+	})
+
+	return leaks
+}
+
+// Walks the whole pool and checks its invariants, returning an ErrCorruptPool
+// describing the first violation found:
+//   - every avail[k] list is a valid circular list of BLOCK_AVAIL blocks of kval k inside the pool
+//   - walking from base by block size visits blocks that are aligned to their size and sum to numBytes
+//   - every BLOCK_AVAIL block found by the walk is linked into its avail[kval] list
+//   - no two free buddies of the same size are left un-coalesced, outside deferred coalescing mode.
+//     When holding splits the unmerged pairs must instead match the held count
+func buddyVerify(pool *BuddyPool) error {
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	if pool.base == 0 {
+		return nil
+	}
+
+	// Check every free list and remember which blocks are linked in
+	var linked map[uintptr]bool = make(map[uintptr]bool)
+	var maxNodes uintptr = pool.numBytes >> pool.smallestK
+	for k := uint(0); k <= pool.kvalM; k++ {
+		var head *Avail = &pool.avail[k]
+		var prev *Avail = head
+		var count uintptr
+		for block := head.next; block != head; block = block.next {
+			var addr uintptr = uintptr(unsafe.Pointer(block))
+			if block == nil || addr < pool.base || addr >= pool.base+pool.numBytes {
+				return fmt.Errorf("%w: avail[%d] links to %#x outside the pool", ErrCorruptPool, k, addr)
+			}
+			if block.prev != prev {
+				return fmt.Errorf("%w: avail[%d] block at offset %#x has a broken prev link", ErrCorruptPool, k, addr-pool.base)
+			}
+			if block.tag != BLOCK_AVAIL || uint(block.kval) != k {
+				return fmt.Errorf("%w: avail[%d] holds block at offset %#x with tag %d kval %d", ErrCorruptPool, k, addr-pool.base, block.tag, block.kval)
+			}
+			if linked[addr] {
+				return fmt.Errorf("%w: block at offset %#x linked into the free lists twice", ErrCorruptPool, addr-pool.base)
+			}
+			if pool.strategy == StrategyAddressOrdered && prev != head && addr < uintptr(unsafe.Pointer(prev)) {
+				return fmt.Errorf("%w: avail[%d] block at offset %#x is out of address order", ErrCorruptPool, k, addr-pool.base)
+			}
+			count++
+			if count > maxNodes {
+				return fmt.Errorf("%w: avail[%d] does not loop back to its head", ErrCorruptPool, k)
+			}
+			linked[addr] = true
+			prev = block
+		}
+		if head.prev != prev {
+			return fmt.Errorf("%w: avail[%d] head has a broken prev link", ErrCorruptPool, k)
+		}
+	}
+
+	// Walk the pool block by block from base
+	var offset uintptr
+	for offset < pool.numBytes {
+		var block *Avail = (*Avail)(unsafe.Pointer(pool.base + offset))
+		if !headerIntact(pool, block) {
+			return fmt.Errorf("%w: %w: block at offset %#x", ErrCorruptPool, ErrCorruptedHeader, offset)
+		}
+		var k uint = uint(block.kval)
+		if k < pool.smallestK || k > pool.kvalM {
+			return fmt.Errorf("%w: block at offset %#x has kval %d outside [%d, %d]", ErrCorruptPool, offset, k, pool.smallestK, pool.kvalM)
+		}
+		if offset&((uintptr(1)<<k)-1) != 0 {
+			return fmt.Errorf("%w: block at offset %#x is not aligned to its size 2^%d", ErrCorruptPool, offset, k)
+		}
+
+		switch block.tag {
+		case BLOCK_AVAIL:
+			if !linked[pool.base+offset] {
+				return fmt.Errorf("%w: free block at offset %#x is not in avail[%d]", ErrCorruptPool, offset, k)
+			}
+			// Free buddies of the same size should have been merged, unless merging is deferred.
+			// Prewarming leaves one pair at its k until either half is allocated, and holding splits counts its pairs
+			if k < pool.kvalM && !pool.deferCoalesce && pool.holdSplits == 0 && !prewarmedHalf(pool, offset, k) {
+				var buddy *Avail = buddyCalc(pool, block)
+				if buddy.tag == BLOCK_AVAIL && buddy.kval == block.kval && linked[uintptr(unsafe.Pointer(buddy))] {
+					return fmt.Errorf("%w: free buddies at offsets %#x and %#x were not coalesced", ErrCorruptPool, offset, uintptr(unsafe.Pointer(buddy))-pool.base)
+				}
+			}
+		case BLOCK_RESERVED, BLOCK_CACHED:
+		default:
+			return fmt.Errorf("%w: block at offset %#x has unknown tag %d", ErrCorruptPool, offset, block.tag)
+		}
+
+		offset += uintptr(1) << k
+	}
+
+	// The walk can only overshoot if a block runs past the end
+	if offset != pool.numBytes {
+		return fmt.Errorf("%w: block sizes sum to %d bytes, pool has %d", ErrCorruptPool, offset, pool.numBytes)
+	}
+
+	// Every pair held back from merging must be accounted for
+	if pool.holdSplits != 0 && countHeld(pool) != pool.held.Load() {
+		return fmt.Errorf("%w: %d pairs of free buddies are unmerged, %d are held", ErrCorruptPool, countHeld(pool), pool.held.Load())
+	}
+
+	return nil
+}
@@ -0,0 +1,395 @@
+package balloc
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Parses buddyDump output into a map of k to free block count
+func parseDump(t *testing.T, out string) map[uint]uint {
+	counts := make(map[uint]uint)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.HasPrefix(line, "total") {
+			continue
+		}
+		var k, size, free uint
+		_, err := fmt.Sscanf(line, "k=%d size=%d free=%d", &k, &size, &free)
+		assert.NoError(t, err, "unparseable line %q", line)
+		assert.Equal(t, uint(1)<<k, size)
+		counts[k] = free
+	}
+	return counts
+}
+
+func TestBuddyDump(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing avail list dump")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Fresh pool has a single block at kvalM
+	var buf bytes.Buffer
+	buddyDump(&pool, &buf)
+	counts := parseDump(t, buf.String())
+	assert.Len(t, counts, int(MIN_K-SMALLEST_K+1))
+	for k := SMALLEST_K; k < MIN_K; k++ {
+		assert.Equal(t, uint(0), counts[k], "k=%d", k)
+	}
+	assert.Equal(t, uint(1), counts[MIN_K])
+
+	// A single smallest block leaves one free buddy at every level below kvalM
+	mem, _ := buddyMalloc(&pool, 1)
+	buf.Reset()
+	buddyDump(&pool, &buf)
+	counts = parseDump(t, buf.String())
+	for k := SMALLEST_K; k < MIN_K; k++ {
+		assert.Equal(t, uint(1), counts[k], "k=%d", k)
+	}
+	assert.Equal(t, uint(0), counts[MIN_K])
+	assert.Contains(t, buf.String(), fmt.Sprintf("total free_blocks=%d free_bytes=%d\n", MIN_K-SMALLEST_K, (uintptr(1)<<MIN_K)-(uintptr(1)<<SMALLEST_K)))
+
+	_ = buddyFree(&pool, mem)
+	_ = buddyDestroy(&pool)
+}
+
+func TestRedzoneDetectsOverflow(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing redzone detects a buffer overrun")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Redzone: true}))
+
+	// Writing inside the requested size is fine
+	clean, err := buddyMalloc(&pool, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(10), buddyUsableSize(&pool, clean))
+	copy(unsafe.Slice((*byte)(clean), 10), "0123456789")
+	assert.NoError(t, buddyFree(&pool, clean))
+
+	// One byte past the end trips the canary
+	mem, err := buddyMalloc(&pool, 10)
+	assert.NoError(t, err)
+	unsafe.Slice((*byte)(mem), 11)[10] = 'X'
+	err = buddyFree(&pool, mem)
+	assert.ErrorIs(t, err, ErrBufferOverflow)
+	assert.Contains(t, err.Error(), fmt.Sprintf("kval %d", SMALLEST_K))
+
+	// The block is still reserved, repairing the canary lets it be freed
+	unsafe.Slice((*byte)(mem), 11)[10] = REDZONE_BYTE
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestRedzoneRealloc(t *testing.T) {
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Redzone: true}))
+
+	// Growing in place moves the canary out of the way
+	mem, err := buddyMalloc(&pool, 10)
+	assert.NoError(t, err)
+	grown, err := buddyRealloc(&pool, mem, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, mem, grown)
+	copy(unsafe.Slice((*byte)(grown), 30), "012345678901234567890123456789")
+	assert.NoError(t, buddyFree(&pool, grown))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+// Reports whether every byte of the usable region at ptr past the list links is POISON_BYTE.
+// The links hold avail list pointers while the block is free
+func isPoisoned(pool *BuddyPool, ptr unsafe.Pointer) bool {
+	for _, b := range poisonRegion(ptrToBlock(pool, ptr)) {
+		if b != POISON_BYTE {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPoisonOnFree(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing freed memory is poisoned")
+	var mismatches int
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{
+		Poison:   true,
+		OnPoison: func(ptr unsafe.Pointer, offset uint) { mismatches++ },
+	}))
+
+	// Fresh allocations start poisoned
+	mem, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.True(t, isPoisoned(&pool, mem))
+	assert.Equal(t, bytes.Repeat([]byte{POISON_BYTE}, 16), unsafe.Slice((*byte)(mem), 16))
+
+	// Writes are overwritten with poison on free
+	copy(unsafe.Slice((*byte)(mem), 100), strings.Repeat("x", 100))
+	assert.False(t, isPoisoned(&pool, mem))
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.True(t, isPoisoned(&pool, mem))
+
+	// Calloc zeroes over the poison
+	zeroed, err := buddyCalloc(&pool, 10, 10)
+	assert.NoError(t, err)
+	for _, b := range unsafe.Slice((*byte)(zeroed), 100) {
+		assert.Equal(t, byte(0), b)
+	}
+	assert.NoError(t, buddyFree(&pool, zeroed))
+
+	// Splitting and merging keep the free memory poisoned, so a large block built from
+	// many freed small ones reuses cleanly
+	var small []unsafe.Pointer
+	for i := 0; i < 64; i++ {
+		ptr, _ := buddyMalloc(&pool, 40)
+		small = append(small, ptr)
+	}
+	for _, ptr := range small {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	big, err := buddyMalloc(&pool, 1<<(MIN_K-1))
+	assert.NoError(t, err)
+	assert.True(t, isPoisoned(&pool, big))
+	assert.NoError(t, buddyFree(&pool, big))
+	assert.Equal(t, 0, mismatches)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestPoisonDetectsUseAfterFree(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing poison detects a write after free")
+	var gotPtr unsafe.Pointer
+	var gotOffset uint
+	var mismatches int
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{
+		Poison: true,
+		OnPoison: func(ptr unsafe.Pointer, offset uint) {
+			gotPtr, gotOffset = ptr, offset
+			mismatches++
+		},
+	}))
+
+	// Write through a stale pointer between free and reuse, past the list links the free block still needs
+	mem, _ := buddyMalloc(&pool, 100)
+	assert.NoError(t, buddyFree(&pool, mem))
+	unsafe.Slice((*byte)(mem), 100)[40] = 'X'
+
+	// The same block comes back first, the mismatch is reported but the allocation succeeds
+	reused, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, mem, reused)
+	assert.Equal(t, 1, mismatches)
+	assert.Equal(t, mem, gotPtr)
+	assert.Equal(t, uint(40), gotOffset)
+	assert.NoError(t, buddyFree(&pool, reused))
+
+	// Blocks parked in the free cache are checked too. One shard makes the cached block come straight back
+	_ = buddyDestroy(&pool)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{
+		Poison:     true,
+		CacheDepth: 4,
+		OnPoison:   func(ptr unsafe.Pointer, offset uint) { mismatches++ },
+	}))
+	mem, _ = buddyMalloc(&pool, 100)
+	assert.NoError(t, buddyFree(&pool, mem))
+	unsafe.Slice((*byte)(mem), 100)[40] = 'X'
+	reused, _ = buddyMalloc(&pool, 100)
+	assert.Equal(t, mem, reused)
+	assert.Equal(t, 2, mismatches)
+	assert.NoError(t, buddyFree(&pool, reused))
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyLeaks(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing leak tracking")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{TrackLeaks: true}))
+
+	freed, _ := buddyMalloc(&pool, 1)
+	_, file, line, _ := runtime.Caller(0)
+	leaked, _ := buddyMalloc(&pool, 100) // reported leak site is line+1
+	assert.NoError(t, buddyFree(&pool, freed))
+
+	leaks := buddyLeaks(&pool)
+	assert.Len(t, leaks, 1)
+	assert.Equal(t, leaked, leaks[0].Ptr)
+	assert.Equal(t, buddyUsableSize(&pool, leaked), leaks[0].Size)
+	assert.Equal(t, file, leaks[0].File)
+	assert.Equal(t, line+1, leaks[0].Line)
+	assert.True(t, strings.HasSuffix(leaks[0].Function, "TestBuddyLeaks"))
+
+	// Going through the exported wrapper still reports the caller, not pool.go
+	p := &Pool{}
+	assert.NoError(t, buddyInitWithOptions(&p.buddy, 1<<MIN_K, Options{TrackLeaks: true}))
+	_, _, line, _ = runtime.Caller(0)
+	_, _ = p.Alloc(8)
+	leaks = buddyLeaks(&p.buddy)
+	assert.Len(t, leaks, 1)
+	assert.Equal(t, line+1, leaks[0].Line)
+
+	assert.NoError(t, buddyFree(&pool, leaked))
+	assert.Empty(t, buddyLeaks(&pool))
+
+	_ = buddyDestroy(&pool)
+	_ = p.Destroy()
+
+	// Off by default
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	_, _ = buddyMalloc(&pool, 1)
+	assert.Nil(t, buddyLeaks(&pool))
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyVerifyRandomized(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing pool invariants over random malloc/free sequences")
+	for seed := int64(0); seed < 20; seed++ {
+		var pool BuddyPool
+		_ = buddyInit(&pool, 1<<MIN_K)
+		assert.NoError(t, buddyVerify(&pool))
+
+		r := rand.New(rand.NewSource(seed))
+		var ptrs []unsafe.Pointer
+		for i := 0; i < 500; i++ {
+			if len(ptrs) > 0 && r.Intn(2) == 0 {
+				j := r.Intn(len(ptrs))
+				assert.NoError(t, buddyFree(&pool, ptrs[j]))
+				ptrs = append(ptrs[:j], ptrs[j+1:]...)
+			} else if p, err := buddyMalloc(&pool, uint(r.Intn(8192)+1)); err == nil {
+				ptrs = append(ptrs, p)
+			}
+			if !assert.NoError(t, buddyVerify(&pool), "seed %d step %d", seed, i) {
+				break
+			}
+		}
+
+		for _, p := range ptrs {
+			assert.NoError(t, buddyFree(&pool, p))
+		}
+		assert.NoError(t, buddyVerify(&pool))
+		checkBuddyPoolFull(t, &pool)
+		_ = buddyDestroy(&pool)
+	}
+}
+
+func TestBuddyVerifyDetectsCorruption(t *testing.T) {
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	mem, _ := buddyMalloc(&pool, 1)
+	assert.NoError(t, buddyVerify(&pool))
+
+	// Scribble the header of the block handed out
+	block := (*Avail)(unsafe.Pointer(uintptr(mem) - BLOCK_HEADER))
+	block.kval = uint16(MIN_K + 5)
+	assert.ErrorIs(t, buddyVerify(&pool), ErrCorruptPool)
+	block.kval = uint16(SMALLEST_K)
+
+	// Unlink a free block from its list without marking it reserved
+	free := pool.avail[SMALLEST_K].next
+	removeFirst(&pool.avail[SMALLEST_K])
+	assert.ErrorIs(t, buddyVerify(&pool), ErrCorruptPool)
+	insertBlock(&pool.avail[SMALLEST_K], free)
+
+	assert.NoError(t, buddyVerify(&pool))
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.NoError(t, buddyVerify(&pool))
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyOf(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing buddy lookup from user pointers")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// Two blocks split off the same parent are each other's buddy
+	a, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	b, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	var k uint = uint(ptrToBlock(&pool, a).kval)
+	assert.Equal(t, b, buddyOf(&pool, a))
+	assert.Equal(t, a, buddyOf(&pool, b))
+
+	// Their offsets differ in exactly the kval bit
+	var offsetA uintptr = uintptr(a) - pool.header - pool.base
+	var offsetB uintptr = uintptr(buddyOf(&pool, a)) - pool.header - pool.base
+	assert.Equal(t, uintptr(1)<<k, offsetA^offsetB)
+
+	// A larger block's buddy is the region a and b were split from, so it cannot merge while either is live
+	c, err := buddyMalloc(&pool, 10000)
+	assert.NoError(t, err)
+	var buddy unsafe.Pointer = buddyOf(&pool, c)
+	var offsetC uintptr = uintptr(c) - pool.header - pool.base
+	assert.Equal(t, uintptr(1)<<ptrToBlock(&pool, c).kval, offsetC^(uintptr(buddy)-pool.header-pool.base))
+	assert.Equal(t, a, buddy)
+
+	// Pointers outside the pool and the whole pool block have no buddy
+	assert.Nil(t, buddyOf(&pool, nil))
+	assert.Nil(t, buddyOf(&pool, unsafe.Pointer(pool.base)))
+	assert.Nil(t, buddyOf(&pool, unsafe.Add(unsafe.Pointer(pool.base), pool.numBytes)))
+	for _, p := range []unsafe.Pointer{a, b, c} {
+		assert.NoError(t, buddyFree(&pool, p))
+	}
+	whole, err := buddyMalloc(&pool, 1<<MIN_K-uint(BLOCK_HEADER))
+	assert.NoError(t, err)
+	assert.Nil(t, buddyOf(&pool, whole))
+	assert.NoError(t, buddyFree(&pool, whole))
+
+	_ = buddyDestroy(&pool)
+	assert.Nil(t, buddyOf(&pool, a))
+}
+
+func TestBuddyIsFree(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing whether a block is free from its user pointer")
+	for _, opts := range []Options{{}, {Checksum: true}, {Poison: true}, {CacheDepth: 4}} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+
+		// Live blocks are not free, freed ones are even once merged into their buddy
+		a, err := buddyMalloc(&pool, 100)
+		assert.NoError(t, err)
+		b, err := buddyMalloc(&pool, 100)
+		assert.NoError(t, err)
+		for _, ptr := range []unsafe.Pointer{a, b} {
+			free, err := buddyIsFree(&pool, ptr)
+			assert.NoError(t, err)
+			assert.False(t, free)
+		}
+		assert.NoError(t, buddyFree(&pool, b))
+		assert.NoError(t, buddyFree(&pool, a))
+		for _, ptr := range []unsafe.Pointer{a, b} {
+			free, err := buddyIsFree(&pool, ptr)
+			assert.NoError(t, err)
+			assert.True(t, free, "opts %+v", opts)
+		}
+
+		// Bogus pointers are errors rather than a guess
+		c, err := buddyMalloc(&pool, 1000)
+		assert.NoError(t, err)
+		for _, bogus := range []unsafe.Pointer{nil, unsafe.Pointer(pool.base), unsafe.Pointer(pool.base + pool.numBytes), unsafe.Add(c, 1), unsafe.Add(c, 1<<SMALLEST_K)} {
+			free, err := buddyIsFree(&pool, bogus)
+			assert.False(t, free)
+			assert.ErrorIs(t, err, ErrInvalidPointer, "pointer %p", bogus)
+		}
+		assert.NoError(t, buddyFree(&pool, c))
+		_ = buddyDestroy(&pool)
+	}
+
+	// An uninitialized pool has no blocks to ask about
+	var pool BuddyPool
+	free, err := buddyIsFree(&pool, unsafe.Pointer(&pool))
+	assert.False(t, free)
+	assert.ErrorIs(t, err, ErrInvalidPointer)
+}
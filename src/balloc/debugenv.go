@@ -0,0 +1,53 @@
+package balloc
+
+import (
+	"os"
+	"strings"
+)
+
+// Environment variable holding comma separated debug flags applied to every pool created
+// while it is set, in the spirit of GODEBUG: "redzone", "poison", "checksum" and "verify".
+// A flag may also be written name=1, or name=0 to leave it as the options set it
+const DEBUG_ENV string = "BALLOC_DEBUG"
+
+// Turns on the debug options named in value, a BALLOC_DEBUG list. Flags are matched case
+// insensitively with surrounding spaces and empty entries ignored, unknown flags are skipped
+// like GODEBUG does. Redzone is left off when checksum mode ends up on, the two cannot combine
+func debugOptions(opts Options, value string) Options {
+	var redzone bool
+	for _, flag := range strings.Split(value, ",") {
+		var name, setting string
+		var found bool
+		name, setting, found = strings.Cut(strings.ToLower(strings.TrimSpace(flag)), "=")
+		if found && strings.TrimSpace(setting) != "1" {
+			continue
+		}
+
+		switch strings.TrimSpace(name) {
+		case "redzone":
+			redzone = true
+		case "poison":
+			opts.Poison = true
+		case "checksum":
+			opts.Checksum = true
+		case "verify":
+			opts.VerifyFrees = true
+		}
+	}
+	if redzone && !opts.Checksum {
+		opts.Redzone = true
+	}
+
+	return opts
+}
+
+// Applies the debug flags in the environment to opts. Read-only pools never write
+// to their blocks so they are left as they are
+func envOptions(opts Options) Options {
+	var value string = os.Getenv(DEBUG_ENV)
+	if value == "" || opts.readOnly {
+		return opts
+	}
+
+	return debugOptions(opts, value)
+}
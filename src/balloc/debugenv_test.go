@@ -0,0 +1,103 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugOptions(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing BALLOC_DEBUG flag parsing")
+	var logger captureLogger
+	var base Options = Options{Logger: &logger, CacheDepth: 4}
+	for value, want := range map[string]Options{
+		"":                   base,
+		"redzone":            {Logger: &logger, CacheDepth: 4, Redzone: true},
+		" Poison , ,VERIFY":  {Logger: &logger, CacheDepth: 4, Poison: true, VerifyFrees: true},
+		"redzone=0,poison=1": {Logger: &logger, CacheDepth: 4, Poison: true},
+		"bogus,checksum":     {Logger: &logger, CacheDepth: 4, Checksum: true},
+		"redzone,checksum":   {Logger: &logger, CacheDepth: 4, Checksum: true},
+	} {
+		assert.Equal(t, want, debugOptions(base, value), "BALLOC_DEBUG=%q", value)
+	}
+
+	// Flags only ever turn options on
+	assert.True(t, debugOptions(Options{Poison: true}, "poison=0").Poison)
+}
+
+func TestDebugEnv(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing BALLOC_DEBUG turns on debug checks for new pools")
+	t.Setenv(DEBUG_ENV, "redzone,verify")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	assert.True(t, pool.redzone)
+	assert.True(t, pool.verifyFrees)
+
+	// An overrun by one byte is caught without the caller asking for redzones
+	mem, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	unsafe.Slice((*byte)(mem), 101)[100] = 0
+	assert.ErrorIs(t, buddyFree(&pool, mem), ErrBufferOverflow)
+	unsafe.Slice((*byte)(mem), 101)[100] = REDZONE_BYTE
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+
+	// Pools created once the variable is gone are back to normal
+	os.Unsetenv(DEBUG_ENV)
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	assert.False(t, pool.redzone)
+	_ = buddyDestroy(&pool)
+}
+
+func TestDebugEnvVerify(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing BALLOC_DEBUG=verify reports the free that broke the pool")
+	t.Setenv(DEBUG_ENV, "verify")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	a, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	b, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, a))
+
+	// A stray write over the free block's tag behind the allocator's back is caught by the next free
+	var block *Avail = ptrToBlock(&pool, a)
+	block.tag = BLOCK_UNUSED
+	assert.ErrorIs(t, buddyFree(&pool, b), ErrCorruptPool)
+
+	// With the tag put back the unmerged buddies can be repaired
+	block.tag = BLOCK_AVAIL
+	assert.Positive(t, buddyRecoalesce(&pool))
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestDebugEnvSlab(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing a slab keeps working with every BALLOC_DEBUG flag")
+	for _, value := range []string{"checksum", "redzone", "poison", "verify", "checksum,poison,verify"} {
+		t.Setenv(DEBUG_ENV, value)
+		s, err := NewSlab(32, 4)
+		if !assert.NoError(t, err, value) {
+			continue
+		}
+
+		// Every slot goes out and comes back with its header still trusted
+		var slots []unsafe.Pointer
+		for i := 0; i < s.Len(); i++ {
+			ptr, err := s.Alloc()
+			assert.NoError(t, err, value)
+			slots = append(slots, ptr)
+		}
+		for _, ptr := range slots {
+			assert.NoError(t, s.Free(ptr), value)
+		}
+		assert.ErrorIs(t, s.Free(slots[0]), ErrDoubleFree, value)
+		assert.Equal(t, s.Len(), s.Available(), value)
+		assert.NoError(t, buddyVerify(&s.pool), value)
+		assert.NoError(t, s.Destroy())
+	}
+}
@@ -0,0 +1,16 @@
+package balloc
+
+import "unsafe"
+
+// Returns how far into the pool the user pointer ptr lies.
+// Without a free cache every allocator decision only depends on the avail lists, so
+// the same sequence of calls made one at a time on a fresh pool always yields the same
+// offsets. Options.Deterministic extends this to pools with a free cache.
+// Returns ErrInvalidPointer for pointers outside the pool
+func buddyOffset(pool *BuddyPool, ptr unsafe.Pointer) (uintptr, error) {
+	if pool == nil || pool.base == 0 || uintptr(ptr) < pool.base || uintptr(ptr) >= pool.base+pool.numBytes {
+		return 0, ErrInvalidPointer
+	}
+
+	return uintptr(ptr) - pool.base, nil
+}
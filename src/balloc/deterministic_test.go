@@ -0,0 +1,79 @@
+package balloc
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs a fixed mix of mallocs, reallocs and frees on a fresh pool and returns the offset of every pointer handed out
+func deterministicRun(t *testing.T, opts Options) []uintptr {
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+	defer func() { _ = buddyDestroy(&pool) }()
+
+	var r *rand.Rand = rand.New(rand.NewSource(7))
+	var live []unsafe.Pointer
+	var offsets []uintptr
+	for i := 0; i < 2000; i++ {
+		switch op := r.Intn(4); {
+		case op == 0 || len(live) < 50:
+			ptr, err := buddyMalloc(&pool, uint(r.Intn(4096)+1))
+			assert.NoError(t, err)
+			live = append(live, ptr)
+		case op == 1:
+			j := r.Intn(len(live))
+			ptr, err := buddyRealloc(&pool, live[j], uint(r.Intn(4096)+1))
+			assert.NoError(t, err)
+			live[j] = ptr
+		default:
+			j := r.Intn(len(live))
+			assert.NoError(t, buddyFree(&pool, live[j]))
+			live = append(live[:j], live[j+1:]...)
+			continue
+		}
+
+		offset, err := buddyOffset(&pool, live[len(live)-1])
+		assert.NoError(t, err)
+		offsets = append(offsets, offset)
+	}
+
+	return offsets
+}
+
+func TestDeterministicOffsets(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the same call sequence yields the same offsets")
+	for _, opts := range []Options{{}, {Strategy: StrategyAddressOrdered}, {CacheDepth: 8, Deterministic: true}} {
+		first := deterministicRun(t, opts)
+		second := deterministicRun(t, opts)
+		assert.Equal(t, first, second, "options %+v", opts)
+	}
+}
+
+func TestBuddyOffset(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing pointer offsets from the pool base")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// The first block always comes from the start of the pool
+	mem, _ := buddyMalloc(&pool, 100)
+	offset, err := buddyOffset(&pool, mem)
+	assert.NoError(t, err)
+	assert.Equal(t, BLOCK_HEADER, offset)
+	second, _ := buddyMalloc(&pool, 100)
+	offset, _ = buddyOffset(&pool, second)
+	assert.Equal(t, 128+BLOCK_HEADER, offset)
+
+	// Pointers from elsewhere have no offset
+	var x int
+	_, err = buddyOffset(&pool, unsafe.Pointer(&x))
+	assert.ErrorIs(t, err, ErrInvalidPointer)
+	_, err = buddyOffset(nil, mem)
+	assert.ErrorIs(t, err, ErrInvalidPointer)
+
+	_ = buddyDestroy(&pool)
+}
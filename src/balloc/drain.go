@@ -0,0 +1,49 @@
+package balloc
+
+// Drains the pool's large free blocks to the OS the first time a free takes fragmentation above drainAt.
+// Staying above it does nothing more, fragmentation has to fall back to drainAt or below to re-arm the drain.
+// Every class lock is taken to measure fragmentation, so this costs a full lock sweep per free when enabled
+func drainIfFragmented(pool *BuddyPool) {
+	if pool.drainAt == 0 {
+		return
+	}
+
+	lockAll(pool)
+	defer unlockAll(pool)
+
+	if pool.base == 0 {
+		return
+	}
+
+	// Re-arm once fragmentation falls back, and only drain on the crossing itself
+	if fragmentation(pool) <= pool.drainAt {
+		pool.drained = false
+		return
+	}
+	if pool.drained {
+		return
+	}
+	pool.drained = true
+	pool.drains++
+
+	drainFree(pool, pool.drainK)
+}
+
+// Advises MADV_DONTNEED on every free block of at least 2^k bytes. Their headers and
+// links stay resident so the avail lists are untouched. Poison mode keeps freed memory
+// intact so it never drains. The caller must hold every class lock
+func drainFree(pool *BuddyPool, k uint) {
+	if pool.poison {
+		return
+	}
+
+	for ; k <= pool.kvalM; k++ {
+		var head *Avail = &pool.avail[k]
+		for block := head.next; block != head; block = block.next {
+			var err error = adviseFree(pool, block)
+			if err != nil {
+				logf(pool, "WARNING: madvise failed draining block of kval %d: %v", k, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainAtFragmentation(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing large free blocks are drained once per fragmentation crossing")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{DrainAt: 0.5, DrainK: 16}))
+
+	for crossing := uint64(1); crossing <= 2; crossing++ {
+		// Fill the pool with 2^16 blocks, marking the last byte of each
+		var size uint = 1<<16 - uint(BLOCK_HEADER)
+		var ptrs []unsafe.Pointer
+		for i := 0; i < 1<<(MIN_K-16); i++ {
+			mem, err := buddyMalloc(&pool, size)
+			assert.NoError(t, err)
+			unsafe.Slice((*byte)(mem), size)[size-1] = 0xAB
+			ptrs = append(ptrs, mem)
+		}
+
+		// Freeing every other block leaves isolated free blocks. The third free
+		// takes fragmentation from 0.5 to 2/3 and drains the three free blocks
+		for i := 0; i < len(ptrs); i += 2 {
+			assert.NoError(t, buddyFree(&pool, ptrs[i]))
+			var want uint64 = crossing - 1
+			if i >= 4 {
+				want = crossing
+			}
+			assert.Equal(t, want, pool.drains, "free %d", i)
+		}
+		for i := 0; i < len(ptrs); i += 2 {
+			var drained bool = unsafe.Slice((*byte)(ptrs[i]), size)[size-1] == 0
+			assert.Equal(t, i <= 4, drained, "block %d", i)
+		}
+		assert.NoError(t, buddyVerify(&pool))
+
+		// Freeing the rest coalesces the pool back to one block, re-arming the drain
+		for i := 1; i < len(ptrs); i += 2 {
+			assert.NoError(t, buddyFree(&pool, ptrs[i]))
+		}
+		assert.Equal(t, crossing, pool.drains)
+		assert.False(t, pool.drained)
+		checkBuddyPoolFull(t, &pool)
+	}
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestDrainOptions(t *testing.T) {
+	var pool BuddyPool
+	assert.ErrorIs(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{DrainAt: 1}), ErrInvalidOptions)
+	assert.ErrorIs(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{DrainAt: -0.1}), ErrInvalidOptions)
+	assert.ErrorIs(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{DrainAt: 0.5, DrainK: MIN_K + 1}), ErrInvalidOptions)
+
+	// The default drain k is the smallest with a whole page past its header
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{DrainAt: 0.5}))
+	assert.Equal(t, btokMin(uintptr(os.Getpagesize()), 0)+1, pool.drainK)
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,35 @@
+package balloc
+
+import "fmt"
+
+// BallocError describes a failed allocation. It wraps the underlying errno,
+// so errors.Is(err, unix.ENOMEM) keeps working
+type BallocError struct {
+	Err               error // underlying error, unix.ENOMEM for an exhausted pool
+	RequestedSize     uint  // bytes the caller asked for
+	RequiredK         uint  // k of the block the request needed, including the header. MAX_K if size+header overflows
+	LargestAvailableK uint  // k of the largest free block when the request failed, 0 if nothing was free
+}
+
+// Formats the failed request with the sizes involved
+func (e *BallocError) Error() string {
+	if e.LargestAvailableK == 0 {
+		return fmt.Sprintf("balloc: %d byte request needs a 2^%d block, no free blocks: %v", e.RequestedSize, e.RequiredK, e.Err)
+	}
+	return fmt.Sprintf("balloc: %d byte request needs a 2^%d block, largest free is 2^%d: %v", e.RequestedSize, e.RequiredK, e.LargestAvailableK, e.Err)
+}
+
+// Returns the underlying errno
+func (e *BallocError) Unwrap() error {
+	return e.Err
+}
+
+// Builds the error for a malloc of size that needed a block of k.
+// The caller must not hold any class locks
+func oomError(pool *BuddyPool, err error, size uint, k uint) error {
+	rlockAll(pool)
+	var largest uint = largestFreeK(pool)
+	runlockAll(pool)
+
+	return &BallocError{Err: err, RequestedSize: size, RequiredK: k, LargestAvailableK: largest}
+}
@@ -0,0 +1,58 @@
+package balloc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestBallocErrorContext(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing malloc errors carry the request context")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Leave only the lower half of the pool free
+	half, _ := buddyMalloc(&pool, uint(uintptr(1)<<(MIN_K-1)-BLOCK_HEADER))
+	mem, err := buddyMalloc(&pool, 1<<(MIN_K-1))
+	assert.Nil(t, mem)
+
+	// Existing errno checks still match
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.True(t, errors.Is(err, unix.ENOMEM))
+
+	var berr *BallocError
+	assert.ErrorAs(t, err, &berr)
+	assert.Equal(t, uint(1<<(MIN_K-1)), berr.RequestedSize)
+	assert.Equal(t, MIN_K, berr.RequiredK)
+	assert.Equal(t, MIN_K-1, berr.LargestAvailableK)
+	assert.Equal(t, unix.ENOMEM, berr.Unwrap())
+	assert.Contains(t, err.Error(), "largest free is 2^19")
+
+	// A request larger than the whole pool reports its sizes the same way
+	_, err = buddyMalloc(&pool, 1<<(MIN_K+3))
+	assert.ErrorAs(t, err, &berr)
+	assert.Equal(t, MIN_K+4, berr.RequiredK)
+	assert.Equal(t, MIN_K-1, berr.LargestAvailableK)
+
+	// A size that overflows once the header is added needs MAX_K, past any pool
+	_, err = buddyMalloc(&pool, ^uint(0))
+	assert.ErrorAs(t, err, &berr)
+	assert.Equal(t, ^uint(0), berr.RequestedSize)
+	assert.Equal(t, MAX_K, berr.RequiredK)
+
+	// Nothing free at all
+	rest, _ := buddyMalloc(&pool, uint(uintptr(1)<<(MIN_K-1)-BLOCK_HEADER))
+	_, err = buddyMalloc(&pool, 1)
+	assert.ErrorAs(t, err, &berr)
+	assert.Equal(t, SMALLEST_K, berr.RequiredK)
+	assert.Equal(t, uint(0), berr.LargestAvailableK)
+	assert.Contains(t, err.Error(), "no free blocks")
+
+	_ = buddyFree(&pool, half)
+	_ = buddyFree(&pool, rest)
+	_ = buddyDestroy(&pool)
+}
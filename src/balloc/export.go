@@ -0,0 +1,264 @@
+package balloc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"unsafe"
+)
+
+// Identifies a pool export, "BALX" in little endian
+const exportMagic uint32 = 0x584C4142
+
+// Version of the export format written by buddyExport
+const exportVersion uint8 = 2
+
+// Bits of exportHeader.Flags recording options that change how headers are laid out
+// or which free buddies may be left unmerged
+const (
+	exportCacheLine     uint8 = 1 << iota // user pointers sit CACHE_LINE bytes into their block
+	exportChecksum                        // block headers are sealed with a checksum
+	exportRedzone                         // reserved headers hold the requested size for a redzone
+	exportDeferCoalesce                   // frees leave merging to buddyCoalesceAll
+	exportPrewarmed                       // the prewarmed pair at PrewarmPair is still untouched
+)
+
+// Fixed size little endian header written ahead of the raw pool bytes
+type exportHeader struct {
+	Magic       uint32  // always exportMagic
+	Version     uint8   // exportVersion of the writer
+	KvalM       uint8   // k of the whole pool
+	SmallestK   uint8   // smallest block k the pool hands out
+	Flags       uint8   // exportCacheLine through exportPrewarmed
+	Strategy    uint8   // Strategy the free lists are ordered for
+	PrewarmK    uint8   // k of the pair prewarming splits the pool into, 0 if it is off
+	_           [6]byte // padding to keep the addresses below 8 byte aligned
+	NumBytes    uint64  // bytes of pool memory following the header
+	Base        uint64  // address of the exporting mapping, the free list links point into it
+	Avail       uint64  // address of the exporting pool's avail[0] sentinel, the ends of every free list point at one
+	HoldSplits  uint64  // most pairs of free buddies a free may leave unmerged, 0 if it is off
+	PrewarmPair uint64  // offset of the lower half of the untouched prewarmed pair, only meaningful with exportPrewarmed
+}
+
+// Writes the whole pool to w as an exportHeader followed by the raw bytes of the mapping.
+// The cache is flushed first so free blocks are in the avail lists. It cannot be flushed under
+// the locks the copy holds, so a racing free may still cache a block in between. Such blocks
+// are exported tagged BLOCK_CACHED and the import hands them back to the avail lists.
+// Pointers stored inside allocations are copied as they are, so data meant to survive an
+// import should hold offsets
+func buddyExport(pool *BuddyPool, w io.Writer) error {
+	if pool.state.Load() != poolActive {
+		return ErrPoolClosed
+	}
+	if pool.cache != nil {
+		pool.cache.flush(pool)
+	}
+
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	// Describe the layout so the importer can map the same pool and translate its links
+	var hdr exportHeader = exportHeader{
+		Magic:      exportMagic,
+		Version:    exportVersion,
+		KvalM:      uint8(pool.kvalM),
+		SmallestK:  uint8(pool.smallestK),
+		Strategy:   uint8(pool.strategy),
+		PrewarmK:   uint8(pool.prewarmK),
+		NumBytes:   uint64(pool.numBytes),
+		Base:       uint64(pool.base),
+		Avail:      uint64(uintptr(unsafe.Pointer(&pool.avail[0]))),
+		HoldSplits: uint64(pool.holdSplits),
+	}
+	if pool.header == CACHE_LINE {
+		hdr.Flags |= exportCacheLine
+	}
+	if pool.checksum {
+		hdr.Flags |= exportChecksum
+	}
+	if pool.redzone {
+		hdr.Flags |= exportRedzone
+	}
+	if pool.deferCoalesce {
+		hdr.Flags |= exportDeferCoalesce
+	}
+	var pair uintptr = pool.prewarmPair.Load()
+	if pair != 0 {
+		hdr.Flags |= exportPrewarmed
+		hdr.PrewarmPair = uint64(pair - pool.base)
+	}
+
+	var err error = binary.Write(w, binary.LittleEndian, &hdr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(unsafe.Slice((*byte)(unsafe.Pointer(pool.base)), pool.numBytes))
+
+	return err
+}
+
+// Maps a fresh pool and loads an export written by buddyExport into it. Every free list link
+// stored in the export is relocated from the exporting mapping to the new one so the lists keep
+// their order, and the avail sentinels are relinked to the blocks that pointed at the old ones.
+// Blocks reserved in the export are live allocations of the new pool at the same offsets,
+// blocks that were cached are freed into the avail lists. DeferCoalesce, HoldSplits and PrewarmK
+// are carried over with the layout options, they decide which free buddies may sit unmerged. Returns ErrInvalidExport for a stream that is not an export or whose blocks do not verify
+func buddyImport(r io.Reader) (*BuddyPool, error) {
+	var pool *BuddyPool = &BuddyPool{}
+	var err error = importPool(pool, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+// Initializes pool from the export read from r, shared by buddyImport and Import.
+// pool is left uninitialized if the export cannot be loaded
+func importPool(pool *BuddyPool, r io.Reader) error {
+	var hdr exportHeader
+	var err error = binary.Read(r, binary.LittleEndian, &hdr)
+	if err != nil {
+		return fmt.Errorf("%w: reading header: %w", ErrInvalidExport, err)
+	}
+	if hdr.Magic != exportMagic || hdr.Version != exportVersion {
+		return fmt.Errorf("%w: magic %#x version %d", ErrInvalidExport, hdr.Magic, hdr.Version)
+	}
+	if uint(hdr.KvalM) < MIN_K || uint(hdr.KvalM) >= MAX_K || hdr.NumBytes != uint64(1)<<hdr.KvalM {
+		return fmt.Errorf("%w: %d bytes for a pool of kval %d", ErrInvalidExport, hdr.NumBytes, hdr.KvalM)
+	}
+	var prewarmed bool = hdr.Flags&exportPrewarmed != 0
+	if prewarmed && (hdr.PrewarmK == 0 || hdr.PrewarmPair >= hdr.NumBytes || hdr.PrewarmPair&(uint64(2)<<hdr.PrewarmK-1) != 0) {
+		return fmt.Errorf("%w: prewarmed pair at offset %#x of kval %d", ErrInvalidExport, hdr.PrewarmPair, hdr.PrewarmK)
+	}
+	if hdr.HoldSplits > uint64(math.MaxInt) {
+		return fmt.Errorf("%w: holding %d splits", ErrInvalidExport, hdr.HoldSplits)
+	}
+
+	// Recreate the pool with every option its headers and unmerged buddies depend on
+	var opts Options = Options{
+		SmallestK:        uint(hdr.SmallestK),
+		AlignToCacheLine: hdr.Flags&exportCacheLine != 0,
+		Checksum:         hdr.Flags&exportChecksum != 0,
+		Redzone:          hdr.Flags&exportRedzone != 0,
+		Strategy:         Strategy(hdr.Strategy),
+		PrewarmK:         uint(hdr.PrewarmK),
+		DeferCoalesce:    hdr.Flags&exportDeferCoalesce != 0,
+		HoldSplits:       int(hdr.HoldSplits),
+	}
+	err = buddyInitWithOptions(pool, uintptr(hdr.NumBytes), opts)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidExport, err)
+	}
+	if pool.numBytes != uintptr(hdr.NumBytes) {
+		_ = buddyDestroy(pool)
+		return fmt.Errorf("%w: mapped %d bytes for an export of %d", ErrInvalidExport, pool.numBytes, hdr.NumBytes)
+	}
+
+	// Overwrite the fresh pool with the exported bytes and translate the links inside them
+	_, err = io.ReadFull(r, unsafe.Slice((*byte)(unsafe.Pointer(pool.base)), pool.numBytes))
+	var cached []*Avail
+	if err == nil {
+		lockAll(pool)
+		cached, err = relocateBlocks(pool, uintptr(hdr.Base), uintptr(hdr.Avail))
+
+		// The prewarmed pair and held pairs are the exporter's, not the ones init made
+		pool.prewarmPair.Store(0)
+		if prewarmed {
+			pool.prewarmPair.Store(pool.base + uintptr(hdr.PrewarmPair))
+		}
+		if err == nil && pool.holdSplits != 0 {
+			pool.held.Store(countHeld(pool))
+		}
+		unlockAll(pool)
+	}
+
+	// Blocks still cached when the exporter copied its pool were free, coalesce them now
+	for i := 0; err == nil && i < len(cached); i++ {
+		err = releaseBlock(pool, cached[i])
+	}
+	if err == nil {
+		err = buddyVerify(pool)
+	}
+	if err != nil {
+		_ = buddyDestroy(pool)
+		return fmt.Errorf("%w: %w", ErrInvalidExport, err)
+	}
+
+	return nil
+}
+
+// Walks the blocks of a freshly imported pool from base, rewriting the next and prev links of every
+// free block from the exporting pool's addresses to this pool's and counting the reserved blocks.
+// Returns the blocks that were in the exporter's free cache, to be released once the locks are dropped.
+// The caller must hold every class lock
+func relocateBlocks(pool *BuddyPool, oldBase, oldAvail uintptr) ([]*Avail, error) {
+	resetHeads(pool)
+
+	var cached []*Avail
+	var allocs, reserved int64
+	var offset uintptr
+	for offset < pool.numBytes {
+		var block *Avail = (*Avail)(unsafe.Pointer(pool.base + offset))
+		var k uint = uint(block.kval)
+		if k < pool.smallestK || k > pool.kvalM || offset&((uintptr(1)<<k)-1) != 0 {
+			return nil, fmt.Errorf("%w: block at offset %#x has kval %d", ErrCorruptPool, offset, k)
+		}
+
+		switch block.tag {
+		case BLOCK_AVAIL:
+			// The stored links are the exporter's addresses, read them as plain integers so the
+			// garbage collector never sees a pointer to the exporting pool's sentinels
+			var next *Avail = relocateLink(pool, *(*uintptr)(unsafe.Pointer(&block.next)), oldBase, oldAvail)
+			var prev *Avail = relocateLink(pool, *(*uintptr)(unsafe.Pointer(&block.prev)), oldBase, oldAvail)
+			if next == nil || prev == nil {
+				return nil, fmt.Errorf("%w: free block at offset %#x links outside the exported pool", ErrCorruptPool, offset)
+			}
+			block.next, block.prev = next, prev
+
+			// The ends of each list pointed at the exporter's sentinel, hook the new one onto them
+			if next == &pool.avail[k] {
+				next.prev = block
+			}
+			if prev == &pool.avail[k] {
+				prev.next = block
+			}
+		case BLOCK_RESERVED:
+			allocs++
+			reserved += int64(blockUsable(pool, block))
+		case BLOCK_CACHED:
+			// Freed by the user, its links are stale so it is linked in by releasing it later
+			if !headerIntact(pool, block) {
+				return nil, fmt.Errorf("%w: %w: cached block at offset %#x", ErrCorruptPool, ErrCorruptedHeader, offset)
+			}
+			cached = append(cached, block)
+		default:
+			return nil, fmt.Errorf("%w: block at offset %#x has tag %d", ErrCorruptPool, offset, block.tag)
+		}
+
+		offset += uintptr(1) << k
+	}
+
+	pool.allocs.Store(allocs)
+	pool.reserved.Store(reserved)
+	raisePeak(pool, reserved)
+
+	return cached, nil
+}
+
+// Translates a free list link written by the exporting pool. Links into its mapping move by the
+// difference between the bases and links to one of its sentinels map to the sentinel of the same
+// k here. Returns nil for a link into neither
+func relocateLink(pool *BuddyPool, addr, oldBase, oldAvail uintptr) *Avail {
+	var sentinel uintptr = unsafe.Sizeof(Avail{})
+
+	if addr >= oldBase && addr < oldBase+pool.numBytes {
+		return (*Avail)(unsafe.Pointer(pool.base + (addr - oldBase)))
+	}
+	if addr >= oldAvail && addr < oldAvail+uintptr(MAX_K)*sentinel && (addr-oldAvail)%sentinel == 0 {
+		return &pool.avail[(addr-oldAvail)/sentinel]
+	}
+
+	return nil
+}
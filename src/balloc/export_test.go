@@ -0,0 +1,214 @@
+package balloc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing a pool exported and imported keeps its data and free lists")
+	for _, opts := range []Options{{}, {AlignToCacheLine: true}, {Checksum: true}, {Strategy: StrategyAddressOrdered}, {CacheDepth: 4}} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+
+		// Fill live allocations with their own byte and free every other one to scatter the lists
+		var rng *rand.Rand = rand.New(rand.NewSource(94))
+		type live struct {
+			size uint
+			fill byte
+		}
+		var lives map[uintptr]live = make(map[uintptr]live)
+		for i := 0; i < 300; i++ {
+			var size uint = uint(1 + rng.Intn(3000))
+			ptr, err := buddyMalloc(&pool, size)
+			assert.NoError(t, err)
+			if i%2 == 1 {
+				assert.NoError(t, buddyFree(&pool, ptr))
+				continue
+			}
+			fillBytes(ptr, size, byte(i))
+			lives[uintptr(ptr)-pool.base] = live{size, byte(i)}
+		}
+		var snap PoolSnapshot = buddySnapshot(&pool)
+		var stats Stats = buddyStats(&pool)
+
+		// The exporting pool is gone before the import so no link can still point into it
+		var buf bytes.Buffer
+		assert.NoError(t, buddyExport(&pool, &buf))
+		_ = buddyDestroy(&pool)
+		imported, err := buddyImport(&buf)
+		if !assert.NoError(t, err, "opts %+v", opts) {
+			continue
+		}
+		assert.Zero(t, buf.Len())
+
+		// Same blocks in the same list order, each allocation still holding its bytes
+		assert.NoError(t, buddyVerify(imported))
+		assert.Equal(t, snap, buddySnapshot(imported))
+		assert.Equal(t, stats, buddyStats(imported))
+		for offset, l := range lives {
+			assert.True(t, checkBytes(unsafe.Pointer(imported.base+offset), l.size, l.fill), "allocation at offset %#x", offset)
+		}
+
+		// The imported pool keeps allocating and coalesces back into one block
+		extra, err := buddyMalloc(imported, 100)
+		assert.NoError(t, err)
+		assert.NoError(t, buddyFree(imported, extra))
+		for offset := range lives {
+			assert.NoError(t, buddyFree(imported, unsafe.Pointer(imported.base+offset)))
+		}
+		checkBuddyPoolFull(t, imported)
+		_ = buddyDestroy(imported)
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing import rejects streams that are not a consistent export")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	a, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, buddyExport(&pool, &buf))
+	var export []byte = buf.Bytes()
+	var hdrSize int = binary.Size(exportHeader{})
+
+	// A free block linking to an address outside both the mapping and the sentinels
+	var free *Avail = ptrToBlock(&pool, unsafe.Add(a, 1<<7))
+	var linkOffset int = hdrSize + int(uintptr(unsafe.Pointer(free))-pool.base) + int(unsafe.Offsetof(free.next))
+	var badLink []byte = bytes.Clone(export)
+	*(*uintptr)(unsafe.Pointer(&badLink[linkOffset])) = 0xDEAD0
+
+	for name, stream := range map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte{0}, export[1:]...),
+		"truncated": export[:len(export)-1],
+		"kval":      append(append(bytes.Clone(export[:5]), 0xFF), export[6:]...),
+		"link":      badLink,
+	} {
+		imported, err := buddyImport(bytes.NewReader(stream))
+		assert.Nil(t, imported, name)
+		assert.ErrorIs(t, err, ErrInvalidExport, name)
+	}
+
+	// Closed pools have nothing to export
+	assert.NoError(t, buddyFree(&pool, a))
+	_ = buddyDestroy(&pool)
+	assert.ErrorIs(t, buddyExport(&pool, &buf), ErrPoolClosed)
+}
+
+func TestImportCachedBlocks(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing blocks cached by a free racing the export are freed by the import")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{CacheDepth: 4}))
+	a, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	b, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	c, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	var offsets [3]uintptr = [3]uintptr{uintptr(a) - pool.base, uintptr(b) - pool.base, uintptr(c) - pool.base}
+
+	// Stand in for frees that cached a and b between the exporter's flush and its locks
+	var buf bytes.Buffer
+	assert.NoError(t, buddyExport(&pool, &buf))
+	var export []byte = buf.Bytes()
+	var hdrSize int = binary.Size(exportHeader{})
+	for _, offset := range offsets[:2] {
+		var tag int = hdrSize + int(offset-pool.header) + int(unsafe.Offsetof(Avail{}.tag))
+		*(*uint16)(unsafe.Pointer(&export[tag])) = BLOCK_CACHED
+	}
+	_ = buddyFree(&pool, a)
+	_ = buddyFree(&pool, b)
+	_ = buddyFree(&pool, c)
+	_ = buddyDestroy(&pool)
+
+	// The cached blocks come back free and merged with their buddies, the live one stays live
+	imported, err := buddyImport(bytes.NewReader(export))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, buddyVerify(imported))
+	assert.Equal(t, int64(1), imported.allocs.Load())
+	for i, offset := range offsets {
+		free, err := buddyIsFree(imported, unsafe.Pointer(imported.base+offset))
+		assert.NoError(t, err)
+		assert.Equal(t, i < 2, free, "block at offset %#x", offset)
+	}
+	assert.NoError(t, buddyFree(imported, unsafe.Pointer(imported.base+offsets[2])))
+	checkBuddyPoolFull(t, imported)
+	_ = buddyDestroy(imported)
+}
+
+func TestExportUnmergedBuddies(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing options that leave free buddies unmerged survive a round trip")
+	for _, opts := range []Options{{PrewarmK: 10}, {DeferCoalesce: true}, {HoldSplits: 2}} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+
+		// Prewarming leaves its pair at init, the other two need a free to leave one
+		if opts.PrewarmK == 0 {
+			ptr, err := buddyMalloc(&pool, 100)
+			assert.NoError(t, err)
+			assert.NoError(t, buddyFree(&pool, ptr))
+		}
+		var snap PoolSnapshot = buddySnapshot(&pool)
+		var held int64 = pool.held.Load()
+
+		var buf bytes.Buffer
+		assert.NoError(t, buddyExport(&pool, &buf))
+		_ = buddyDestroy(&pool)
+		imported, err := buddyImport(&buf)
+		if !assert.NoError(t, err, "opts %+v", opts) {
+			continue
+		}
+
+		// Same unmerged pairs, still exempt from the coalescing checks under the same option
+		assert.NoError(t, buddyVerify(imported))
+		assert.Equal(t, snap, buddySnapshot(imported))
+		assert.Equal(t, opts.PrewarmK, imported.prewarmK)
+		assert.Equal(t, opts.DeferCoalesce, imported.deferCoalesce)
+		assert.Equal(t, int64(opts.HoldSplits), imported.holdSplits)
+		assert.Equal(t, held, imported.held.Load())
+
+		// Touching the prewarmed pair ends its exemption like it would have in the exporter
+		if opts.PrewarmK != 0 {
+			assert.NotZero(t, imported.prewarmPair.Load())
+			ptr, err := buddyMalloc(imported, 1<<(opts.PrewarmK-1))
+			assert.NoError(t, err)
+			assert.NoError(t, buddyFree(imported, ptr))
+			assert.Zero(t, imported.prewarmPair.Load())
+		}
+		if opts.DeferCoalesce {
+			buddyCoalesceAll(imported)
+		}
+		assert.NoError(t, buddyVerify(imported))
+		_ = buddyDestroy(imported)
+	}
+}
+
+func TestPoolExportImport(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing Pool export and import")
+	p, err := New(1 << MIN_K)
+	assert.NoError(t, err)
+	ptr, err := p.Alloc(64)
+	assert.NoError(t, err)
+	fillBytes(ptr, 64, 0x5A)
+	var offset uintptr = uintptr(ptr) - p.buddy.base
+
+	var buf bytes.Buffer
+	assert.NoError(t, p.Export(&buf))
+	q, err := Import(&buf)
+	assert.NoError(t, err)
+	assert.True(t, checkBytes(unsafe.Pointer(q.buddy.base+offset), 64, 0x5A))
+	assert.NoError(t, q.Free(unsafe.Pointer(q.buddy.base+offset)))
+	assert.NoError(t, q.Destroy())
+	assert.NoError(t, p.Destroy())
+}
@@ -0,0 +1,30 @@
+package balloc
+
+import "expvar"
+
+// Metrics exposed for a pool on /debug/vars
+type expvarStats struct {
+	ReservedBytes uintptr `json:"reserved_bytes"` // usable bytes handed out to the user
+	FreeBytes     uintptr `json:"free_bytes"`     // bytes sitting in the avail lists
+	CachedBytes   uintptr `json:"cached_bytes"`   // bytes of freed blocks parked in the free cache
+	Allocations   uint    `json:"allocations"`    // number of live allocations
+	Fragmentation float64 `json:"fragmentation"`  // external fragmentation ratio from buddyFragmentation
+}
+
+// Registers an expvar under name exposing the pool's metrics as a JSON object.
+// Every read recomputes them with buddyMetrics in one pass under the class read locks, so the free bytes
+// and fragmentation always describe the same avail lists. The free cache and the live
+// count are not guarded by those locks and may be a few blocks ahead of them under
+// concurrent use. Like expvar.Publish this panics if name is already registered
+func PublishExpvar(name string, pool *BuddyPool) {
+	expvar.Publish(name, expvar.Func(func() any {
+		stats, frag := buddyMetrics(pool)
+		return expvarStats{
+			ReservedBytes: stats.ReservedBytes,
+			FreeBytes:     stats.FreeBytes,
+			CachedBytes:   stats.CachedBytes,
+			Allocations:   stats.LiveAllocations,
+			Fragmentation: frag,
+		}
+	}))
+}
@@ -0,0 +1,104 @@
+package balloc
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Reads the published expvar back the way /debug/vars renders it
+func readExpvar(t *testing.T, name string) expvarStats {
+	var stats expvarStats
+	var v expvar.Var = expvar.Get(name)
+	assert.NotNil(t, v)
+	assert.NoError(t, json.Unmarshal([]byte(v.String()), &stats))
+	return stats
+}
+
+func TestPublishExpvar(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing expvar metrics")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+	PublishExpvar("balloc_test_pool", &pool)
+
+	// Fresh pool is all free
+	stats := readExpvar(t, "balloc_test_pool")
+	assert.Equal(t, uint(0), stats.Allocations)
+	assert.Equal(t, uintptr(1)<<MIN_K, stats.FreeBytes)
+	assert.Equal(t, 0.0, stats.Fragmentation)
+
+	// Values are recomputed on every read
+	a, _ := buddyMalloc(&pool, 100)
+	b, _ := buddyMalloc(&pool, 1000)
+	stats = readExpvar(t, "balloc_test_pool")
+	assert.Equal(t, uint(2), stats.Allocations)
+	assert.Equal(t, buddyStats(&pool).ReservedBytes, stats.ReservedBytes)
+	assert.Equal(t, buddyStats(&pool).FreeBytes, stats.FreeBytes)
+	assert.Equal(t, buddyFragmentation(&pool), stats.Fragmentation)
+
+	_ = buddyFree(&pool, a)
+	_ = buddyFree(&pool, b)
+	stats = readExpvar(t, "balloc_test_pool")
+	assert.Equal(t, uint(0), stats.Allocations)
+	assert.Equal(t, uintptr(1)<<MIN_K, stats.FreeBytes)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestPublishExpvarConsistent(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing every expvar read is one consistent snapshot")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{CacheDepth: 4}))
+	PublishExpvar("balloc_test_consistent", &pool)
+
+	// Churn the pool while reading, each read adds up to the whole pool
+	var done chan struct{} = make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			ptr, err := buddyMalloc(&pool, uint(1+i%3000))
+			if err == nil {
+				_ = buddyFree(&pool, ptr)
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		var stats expvarStats = readExpvar(t, "balloc_test_consistent")
+		assert.LessOrEqual(t, stats.FreeBytes+stats.CachedBytes, pool.numBytes)
+		assert.GreaterOrEqual(t, stats.Fragmentation, 0.0)
+		assert.Less(t, stats.Fragmentation, 1.0)
+	}
+	<-done
+
+	// Once quiet the cache is reported on its own, not as reserved
+	var stats expvarStats = readExpvar(t, "balloc_test_consistent")
+	assert.Zero(t, stats.Allocations)
+	assert.Zero(t, stats.ReservedBytes)
+	assert.Equal(t, pool.numBytes, stats.FreeBytes+stats.CachedBytes)
+	_ = buddyDestroy(&pool)
+}
+
+func TestPublishExpvarMultiplePools(t *testing.T) {
+	var first, second BuddyPool
+	_ = buddyInit(&first, 1<<MIN_K)
+	_ = buddyInit(&second, 1<<(MIN_K+1))
+	PublishExpvar("balloc_test_first", &first)
+	PublishExpvar("balloc_test_second", &second)
+
+	// Each name reports its own pool
+	ptr, _ := buddyMalloc(&first, 10)
+	assert.Equal(t, uint(1), readExpvar(t, "balloc_test_first").Allocations)
+	assert.Equal(t, uint(0), readExpvar(t, "balloc_test_second").Allocations)
+	assert.Equal(t, uintptr(1)<<(MIN_K+1), readExpvar(t, "balloc_test_second").FreeBytes)
+
+	// Registering a name twice panics like expvar.Publish
+	assert.Panics(t, func() { PublishExpvar("balloc_test_first", &second) })
+
+	_ = buddyFree(&first, ptr)
+	_ = buddyDestroy(&first)
+	_ = buddyDestroy(&second)
+}
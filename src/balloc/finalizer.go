@@ -0,0 +1,31 @@
+package balloc
+
+import "runtime"
+
+// Arms a finalizer that unmaps the pool if p is garbage collected while still mapped.
+// Finalizers run at some point after p becomes unreachable, or never if the program
+// exits first, so this is a safety net for leaked pools and not a replacement for Destroy.
+// Pointers handed out by the pool do not keep p alive and must not outlive it
+func setFinalizer(p *Pool) {
+	runtime.SetFinalizer(p, finalizePool)
+}
+
+// Unmaps a pool that was never destroyed. A pool that was is left alone,
+// buddyDestroy takes every lock and returns early once base is 0
+func finalizePool(p *Pool) {
+	// Check under the locks that the region is still mapped. Nothing can destroy
+	// a collected pool later, so strict destroy mode does not hold it back
+	lockAll(&p.buddy)
+	var size uintptr = p.buddy.numBytes
+	p.buddy.strictDestroy = false
+	unlockAll(&p.buddy)
+	if size == 0 {
+		return
+	}
+
+	logf(&p.buddy, "WARNING: Pool of %d bytes garbage collected without Destroy, unmapping it", size)
+	var err error = buddyDestroy(&p.buddy)
+	if err != nil {
+		logf(&p.buddy, "ERROR: Unmapping garbage collected pool failed: %v", err)
+	}
+}
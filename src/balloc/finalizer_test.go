@@ -0,0 +1,74 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Reports whether logger has recorded a message containing substr
+func (c *captureLogger) contains(substr string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, msg := range c.messages {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFinalizePool(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the finalizer unmaps a pool that was not destroyed")
+	var logger captureLogger
+	p, err := NewWithOptions(1<<MIN_K, Options{Finalizer: true, Logger: &logger})
+	assert.NoError(t, err)
+	_, err = p.Alloc(100)
+	assert.NoError(t, err)
+
+	// Running the finalizer by hand unmaps and zeroes the pool
+	finalizePool(p)
+	assert.Equal(t, uintptr(0), p.buddy.base)
+	assert.Equal(t, uintptr(0), p.buddy.numBytes)
+	assert.True(t, logger.contains("garbage collected without Destroy"))
+
+	// Destroy afterwards and a second finalizer run are no-ops
+	assert.NoError(t, p.Destroy())
+	logger.messages = nil
+	finalizePool(p)
+	assert.Empty(t, logger.messages)
+}
+
+func TestFinalizerRunsOnGC(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing a dropped pool is unmapped by the garbage collector")
+	var logger captureLogger
+
+	// Drop one pool without destroying it, and destroy another whose finalizer is then cleared
+	func() {
+		leaked, err := NewWithOptions(1<<MIN_K, Options{Finalizer: true, Logger: &logger})
+		assert.NoError(t, err)
+		_, err = leaked.Alloc(100)
+		assert.NoError(t, err)
+
+		destroyed, err := NewWithOptions(1<<(MIN_K+1), Options{Finalizer: true, Logger: &logger})
+		assert.NoError(t, err)
+		assert.NoError(t, destroyed.Destroy())
+	}()
+
+	// Finalizers run on their own goroutine some time after a collection, give them a while
+	for i := 0; i < 100 && !logger.contains("garbage collected"); i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !logger.contains("garbage collected") {
+		t.Skip("finalizer did not run")
+	}
+	assert.True(t, logger.contains(fmt.Sprintf("Pool of %d bytes", 1<<MIN_K)))
+	assert.False(t, logger.contains(fmt.Sprintf("Pool of %d bytes", 1<<(MIN_K+1))))
+	assert.False(t, logger.contains("ERROR"))
+}
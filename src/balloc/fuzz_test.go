@@ -0,0 +1,101 @@
+package balloc
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Checks every avail list is a well formed circular list of free blocks of its size
+// inside the pool. Cheaper than buddyVerify, which also walks every block
+func checkAvailLists(t *testing.T, pool *BuddyPool) {
+	var maxNodes uintptr = pool.numBytes >> pool.smallestK
+	for k := uint(0); k <= pool.kvalM; k++ {
+		var head *Avail = &pool.avail[k]
+		var n uintptr
+		for block := head.next; block != head; block = block.next {
+			var addr uintptr = uintptr(unsafe.Pointer(block))
+			if !assert.True(t, addr >= pool.base && addr+uintptr(1)<<k <= pool.base+pool.numBytes, "avail[%d] block out of range", k) ||
+				!assert.Equal(t, BLOCK_AVAIL, block.tag, "avail[%d] block not free", k) ||
+				!assert.Equal(t, uint16(k), block.kval, "avail[%d] block of wrong size", k) ||
+				!assert.Same(t, block, block.next.prev, "avail[%d] links broken", k) {
+				t.FailNow()
+			}
+			n++
+			if n > maxNodes {
+				t.Fatalf("avail[%d] does not lead back to its head", k)
+			}
+		}
+	}
+}
+
+// Interprets data as a sequence of operations on a fresh pool, checking the lists after each.
+// Bytes are read as an opcode followed by its operands:
+//   - op%3 == 0: malloc, the next two bytes are the size
+//   - op%3 == 1: free, the next byte picks a live pointer
+//   - op%3 == 2: realloc, the next byte picks a live pointer and the two after it are the new size
+func FuzzBuddy(f *testing.F) {
+	f.Add([]byte{0, 0, 100, 0, 1, 0, 1, 0})
+	f.Add([]byte{0, 0xff, 0xff, 0, 0, 1, 2, 0, 0x10, 0x00, 1, 1, 1, 0})
+	f.Add([]byte{0, 0x00, 0x40, 0, 0x00, 0x40, 0, 0x00, 0x40, 1, 1, 1, 0, 1, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var pool BuddyPool
+		if !assert.NoError(t, buddyInit(&pool, 1<<MIN_K)) {
+			return
+		}
+		defer func() { _ = buddyDestroy(&pool) }()
+
+		// Only pointers the pool handed out are ever freed
+		var live []unsafe.Pointer
+	ops:
+		for len(data) > 0 {
+			var op byte = data[0]
+			data = data[1:]
+			switch op % 3 {
+			case 0:
+				if len(data) < 2 {
+					break ops
+				}
+				var size uint = uint(data[0])<<8 | uint(data[1])
+				data = data[2:]
+				ptr, err := buddyMalloc(&pool, size)
+				if err == nil && ptr != nil {
+					live = append(live, ptr)
+				}
+			case 1:
+				if len(data) < 1 || len(live) == 0 {
+					break ops
+				}
+				var i int = int(data[0]) % len(live)
+				data = data[1:]
+				assert.NoError(t, buddyFree(&pool, live[i]))
+				live = append(live[:i], live[i+1:]...)
+			case 2:
+				if len(data) < 3 || len(live) == 0 {
+					break ops
+				}
+				var i int = int(data[0]) % len(live)
+				var size uint = uint(data[1])<<8 | uint(data[2])
+				data = data[3:]
+				ptr, err := buddyRealloc(&pool, live[i], size)
+				if err != nil {
+					continue
+				}
+				if ptr == nil {
+					live = append(live[:i], live[i+1:]...)
+				} else {
+					live[i] = ptr
+				}
+			}
+			checkAvailLists(t, &pool)
+		}
+
+		// Freeing everything that is left restores the single top block
+		for _, ptr := range live {
+			assert.NoError(t, buddyFree(&pool, ptr))
+		}
+		checkBuddyPoolFull(t, &pool)
+	})
+}
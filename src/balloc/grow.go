@@ -0,0 +1,146 @@
+package balloc
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Grows the pool to manage at least newSize bytes, rounded up to a power of two.
+// The mapping is resized with mremap which may move it, invalidating every pointer
+// into the pool, so growth is only allowed while there are no live allocations.
+// Returns ErrPoolInUse if any allocation is outstanding. File-backed pools cannot grow,
+// the pages past the end of the file would fault with SIGBUS on first touch
+func buddyGrow(pool *BuddyPool, newSize uintptr) error {
+	pool.lifecycle.Lock()
+	defer pool.lifecycle.Unlock()
+
+	// Cached blocks are not held by anyone, hand them back so they do not block the grow
+	if pool.cache != nil {
+		pool.cache.flush(pool)
+	}
+
+	lockAll(pool)
+	defer unlockAll(pool)
+
+	if pool.base == 0 {
+		return fmt.Errorf("%w: pool is not initialized", ErrInvalidOptions)
+	}
+	if pool.readOnly {
+		return ErrReadOnly
+	}
+	if pool.region != nil {
+		return fmt.Errorf("%w: cannot grow caller supplied memory", ErrInvalidOptions)
+	}
+	if pool.fileBacked {
+		return fmt.Errorf("%w: cannot grow a file-backed mapping past its file", ErrInvalidOptions)
+	}
+	if pool.allocs.Load() != 0 {
+		logf(pool, "ERROR: Cannot grow a pool with live allocations")
+		return fmt.Errorf("%w: %d allocations outstanding", ErrPoolInUse, pool.allocs.Load())
+	}
+
+	var kval uint
+	var err error
+	kval, err = poolKval(newSize, false)
+	if err != nil {
+		return err
+	}
+	if kval <= pool.kvalM {
+		return fmt.Errorf("%w: new size 2^%d is not larger than the current 2^%d", ErrInvalidOptions, kval, pool.kvalM)
+	}
+
+	// Resize the mapping, letting the kernel move it if it cannot grow in place
+	var data []byte
+	data, err = unix.Mremap(poolBytes(pool), int(uintptr(1)<<kval), unix.MREMAP_MAYMOVE)
+	if err != nil {
+		return err
+	}
+	if pool.locked {
+		err = unix.Mlock(data[pool.numBytes:])
+		if err != nil {
+			logf(pool, "WARNING: Grown pages could not be locked: %v", err)
+		}
+	}
+
+	pool.base = uintptr(unsafe.Pointer(&data[0]))
+	pool.kvalM = kval
+	pool.numBytes = uintptr(1) << kval
+
+	// Nothing is allocated so the whole grown mapping is one free block
+	resetAvail(pool)
+
+	return nil
+}
+
+// Grows the pool to manage at least newSize bytes, rounded up to a power of two,
+// without moving it. The mapping is extended with mremap and no MREMAP_MAYMOVE so
+// every outstanding pointer stays valid. Fails with the kernel's error, typically
+// ENOMEM, if the address space right after the pool is already taken
+func buddyGrowInPlace(pool *BuddyPool, newSize uintptr) error {
+	pool.lifecycle.Lock()
+	defer pool.lifecycle.Unlock()
+	lockAll(pool)
+	defer unlockAll(pool)
+
+	if pool.base == 0 {
+		return fmt.Errorf("%w: pool is not initialized", ErrInvalidOptions)
+	}
+	if pool.readOnly {
+		return ErrReadOnly
+	}
+	if pool.region != nil {
+		return fmt.Errorf("%w: cannot grow caller supplied memory", ErrInvalidOptions)
+	}
+	if pool.fileBacked {
+		return fmt.Errorf("%w: cannot grow a file-backed mapping past its file", ErrInvalidOptions)
+	}
+
+	kval, err := poolKval(newSize, false)
+	if err != nil {
+		return err
+	}
+	if kval <= pool.kvalM {
+		return fmt.Errorf("%w: new size 2^%d is not larger than the current 2^%d", ErrInvalidOptions, kval, pool.kvalM)
+	}
+
+	// Extend the mapping where it is, the kernel refuses rather than moving it
+	data, err := unix.Mremap(poolBytes(pool), int(uintptr(1)<<kval), 0)
+	if err != nil {
+		logf(pool, "ERROR: Pool cannot grow in place to 2^%d bytes: %v", kval, err)
+		return fmt.Errorf("%w: pool cannot grow in place to 2^%d bytes", err, kval)
+	}
+	if pool.locked {
+		err = unix.Mlock(data[pool.numBytes:])
+		if err != nil {
+			logf(pool, "WARNING: Grown pages could not be locked: %v", err)
+		}
+	}
+
+	// A pool with nothing in it becomes one free block as after init
+	var oldK uint = pool.kvalM
+	var root *Avail = (*Avail)(unsafe.Pointer(pool.base))
+	var empty bool = root.tag == BLOCK_AVAIL && uint(root.kval) == oldK
+	pool.kvalM = kval
+	pool.numBytes = uintptr(1) << kval
+	if empty {
+		resetAvail(pool)
+		return nil
+	}
+
+	// Otherwise the old pool is the lower half of a new tree and each level above it
+	// gains an upper half. None of them has a free buddy so they are linked in as they are
+	for k := oldK; k < kval; k++ {
+		var block *Avail = (*Avail)(unsafe.Pointer(pool.base + (uintptr(1) << k)))
+		block.tag = BLOCK_AVAIL
+		block.kval = uint16(k)
+		sealHeader(pool, block)
+		if pool.poison {
+			poisonBlock(block)
+		}
+		putBlock(pool, &pool.avail[k], block)
+	}
+
+	return nil
+}
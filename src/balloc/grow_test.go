@@ -0,0 +1,160 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestBuddyGrow(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing growing an empty pool")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Use and release some memory first so the grow starts from a coalesced pool
+	mem, _ := buddyMalloc(&pool, 1000)
+	assert.NoError(t, buddyFree(&pool, mem))
+
+	assert.NoError(t, buddyGrow(&pool, 1<<(MIN_K+2)))
+	assert.Equal(t, MIN_K+2, pool.kvalM)
+	assert.Equal(t, uintptr(1)<<(MIN_K+2), pool.numBytes)
+	checkBuddyPoolFull(t, &pool)
+
+	// The new capacity is allocatable in one piece
+	big, err := buddyMalloc(&pool, uint(uintptr(1)<<(MIN_K+2)-BLOCK_HEADER))
+	assert.NoError(t, err)
+	unsafe.Slice((*byte)(big), 1<<(MIN_K+1))[1<<(MIN_K+1)-1] = 1
+	assert.NoError(t, buddyFree(&pool, big))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyGrowRejected(t *testing.T) {
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Live allocations would be invalidated by a move
+	mem, _ := buddyMalloc(&pool, 10)
+	assert.ErrorIs(t, buddyGrow(&pool, 1<<(MIN_K+1)), ErrPoolInUse)
+	assert.Equal(t, MIN_K, pool.kvalM)
+	assert.NoError(t, buddyFree(&pool, mem))
+
+	// Not larger than the current size
+	assert.ErrorIs(t, buddyGrow(&pool, 1<<MIN_K), ErrInvalidOptions)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+
+	// A file-backed mapping cannot outgrow its file
+	f, err := os.CreateTemp(t.TempDir(), "balloc")
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, unix.Ftruncate(int(f.Fd()), 1<<MIN_K))
+	assert.NoError(t, buddyInitFromFd(&pool, int(f.Fd()), 1<<MIN_K))
+	assert.ErrorIs(t, buddyGrow(&pool, 1<<(MIN_K+1)), ErrInvalidOptions)
+	assert.Equal(t, MIN_K, pool.kvalM)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyGrowInPlace(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing growing a pool in place with live allocations")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	defer func() { _ = buddyDestroy(&pool) }()
+	makeRoomAbove(t, &pool, 1<<(MIN_K+2))
+
+	// Live blocks of a few sizes holding a pattern
+	var ptrs []unsafe.Pointer
+	for _, size := range []uint{100, 5000, 70000} {
+		ptr, err := buddyMalloc(&pool, size)
+		assert.NoError(t, err)
+		unsafe.Slice((*byte)(ptr), size)[size-1] = byte(size)
+		ptrs = append(ptrs, ptr)
+	}
+	var base uintptr = pool.base
+	var growth uintptr = uintptr(1)<<(MIN_K+2) - pool.numBytes
+
+	// With the address space after the pool taken the grow fails and nothing moves
+	var above unsafe.Pointer = claimAbove(t, &pool, growth)
+	err := buddyGrowInPlace(&pool, 1<<(MIN_K+2))
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.Equal(t, MIN_K, pool.kvalM)
+	assert.NoError(t, buddyVerify(&pool))
+	assert.NoError(t, unix.MunmapPtr(above, growth))
+
+	// Once it is free the pool grows where it is and the old pointers stay valid
+	assert.NoError(t, buddyGrowInPlace(&pool, 1<<(MIN_K+2)))
+	assert.Equal(t, base, pool.base)
+	assert.Equal(t, MIN_K+2, pool.kvalM)
+	assert.NoError(t, buddyVerify(&pool))
+	for i, size := range []uint{100, 5000, 70000} {
+		assert.Equal(t, byte(size), unsafe.Slice((*byte)(ptrs[i]), size)[size-1])
+	}
+
+	// Both new top level blocks can be allocated and written
+	big, err := buddyMalloc(&pool, uint(uintptr(1)<<(MIN_K+1)-BLOCK_HEADER))
+	assert.NoError(t, err)
+	unsafe.Slice((*byte)(big), 1<<(MIN_K+1)-BLOCK_HEADER)[1<<(MIN_K+1)-BLOCK_HEADER-1] = 1
+	mid, err := buddyMalloc(&pool, uint(uintptr(1)<<MIN_K-BLOCK_HEADER))
+	assert.NoError(t, err)
+	assert.Equal(t, base+uintptr(1)<<MIN_K, uintptr(mid)-BLOCK_HEADER)
+
+	// Freeing everything merges the grown pool back into one block
+	for _, ptr := range append(ptrs, big, mid) {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	checkBuddyPoolFull(t, &pool)
+}
+
+func TestBuddyGrowInPlaceEmpty(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing growing an empty pool in place")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Poison: true}))
+	defer func() { _ = buddyDestroy(&pool) }()
+	makeRoomAbove(t, &pool, 1<<(MIN_K+1))
+
+	assert.NoError(t, buddyGrowInPlace(&pool, 1<<(MIN_K+1)))
+	checkBuddyPoolFull(t, &pool)
+
+	// Reusing grown memory finds it poisoned like the rest of the pool
+	mem, err := buddyMalloc(&pool, uint(uintptr(1)<<(MIN_K+1)-BLOCK_HEADER))
+	assert.NoError(t, err)
+	assert.Equal(t, POISON_BYTE, unsafe.Slice((*byte)(mem), 1<<(MIN_K+1)-BLOCK_HEADER)[1<<(MIN_K+1)-BLOCK_HEADER-1])
+	assert.NoError(t, buddyFree(&pool, mem))
+
+	// Not larger than the current size
+	assert.ErrorIs(t, buddyGrowInPlace(&pool, 1<<MIN_K), ErrInvalidOptions)
+}
+
+// Moves the mapping of an empty pool to where it can grow to size bytes in place, by growing
+// it with MREMAP_MAYMOVE and shrinking it back. Shrinking never moves and unmaps the tail
+func makeRoomAbove(t *testing.T, pool *BuddyPool, size uintptr) {
+	data, err := unix.Mremap(poolBytes(pool), int(size), unix.MREMAP_MAYMOVE)
+	assert.NoError(t, err)
+	data, err = unix.Mremap(data, int(pool.numBytes), 0)
+	assert.NoError(t, err)
+	pool.base = uintptr(unsafe.Pointer(&data[0]))
+	resetAvail(pool)
+}
+
+// Maps length bytes of PROT_NONE memory right after the pool and returns them.
+// Skips the test if that address space is already in use
+func claimAbove(t *testing.T, pool *BuddyPool, length uintptr) unsafe.Pointer {
+	var want unsafe.Pointer = unsafe.Pointer(pool.base + pool.numBytes)
+	ptr, err := unix.MmapPtr(-1, 0, want, length, unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_FIXED_NOREPLACE)
+	if err == nil && ptr != want {
+		// Kernels before 4.17 take the address as a hint only
+		_ = unix.MunmapPtr(ptr, length)
+		err = unix.EEXIST
+	}
+	if err != nil {
+		t.Skipf("address space after the pool is in use: %v", err)
+	}
+	return ptr
+}
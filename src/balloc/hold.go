@@ -0,0 +1,51 @@
+package balloc
+
+import "unsafe"
+
+// Claims one of the pool's holdSplits slots for a pair of free buddies left unmerged.
+// Returns false once every slot is taken, in which case the free merges as normal
+func tryHold(pool *BuddyPool) bool {
+	for {
+		var held int64 = pool.held.Load()
+		if held >= pool.holdSplits {
+			return false
+		}
+		if pool.held.CompareAndSwap(held, held+1) {
+			return true
+		}
+	}
+}
+
+// Gives back the slot of a held pair when one of its halves leaves the avail lists.
+// block has just been unlinked from avail[block.kval], which the caller holds the lock for
+func unhold(pool *BuddyPool, block *Avail) {
+	if pool.holdSplits == 0 || uint(block.kval) >= pool.kvalM {
+		return
+	}
+
+	var buddy *Avail = buddyCalc(pool, block)
+	if buddy.tag == BLOCK_AVAIL && buddy.kval == block.kval {
+		pool.held.Add(-1)
+	}
+}
+
+// Counts the pairs of free buddies of the same size sitting unmerged in the avail lists.
+// The caller must hold every class lock
+func countHeld(pool *BuddyPool) int64 {
+	var held int64
+	for k := pool.smallestK; k < pool.kvalM; k++ {
+		var head *Avail = &pool.avail[k]
+		for block := head.next; block != head; block = block.next {
+			// Count each pair once, from its lower half
+			if (uintptr(unsafe.Pointer(block))-pool.base)&(uintptr(1)<<k) != 0 {
+				continue
+			}
+			var buddy *Avail = buddyCalc(pool, block)
+			if buddy.tag == BLOCK_AVAIL && buddy.kval == block.kval {
+				held++
+			}
+		}
+	}
+
+	return held
+}
@@ -0,0 +1,169 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHoldSplits(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing frees hold recently split blocks back from merging")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{HoldSplits: 2}))
+	var k uint = requestK(&pool, 1000)
+
+	// The first malloc splits the pool, freeing it keeps the pair split at k
+	mem, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.Equal(t, int64(1), pool.held.Load())
+	assert.Equal(t, 2, availCount(&pool, k))
+	assert.Equal(t, 0, availCount(&pool, pool.kvalM))
+	assert.NoError(t, buddyVerify(&pool))
+
+	// The same size again takes a held half without splitting anything
+	again, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pool.held.Load())
+	assert.Equal(t, 1, availCount(&pool, k))
+	for j := k + 1; j < pool.kvalM; j++ {
+		assert.Equal(t, 1, availCount(&pool, j), "avail[%d]", j)
+	}
+	assert.NoError(t, buddyFree(&pool, again))
+	assert.Equal(t, int64(1), pool.held.Load())
+
+	// Past the cap frees merge as normal
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 8; i++ {
+		p, err := buddyMalloc(&pool, 1000)
+		assert.NoError(t, err)
+		ptrs = append(ptrs, p)
+	}
+	for _, p := range ptrs {
+		assert.NoError(t, buddyFree(&pool, p))
+		assert.LessOrEqual(t, pool.held.Load(), int64(2))
+		assert.NoError(t, buddyVerify(&pool))
+	}
+	assert.Equal(t, int64(2), pool.held.Load())
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestHoldSplitsCoalesced(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing held splits are eventually coalesced")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{HoldSplits: 4}))
+
+	// Leave held pairs of a few sizes behind
+	for _, size := range []uint{100, 1000, 10000} {
+		mem, err := buddyMalloc(&pool, size)
+		assert.NoError(t, err)
+		assert.NoError(t, buddyFree(&pool, mem))
+	}
+	assert.NotZero(t, pool.held.Load())
+
+	// A malloc of the whole pool merges the held pairs instead of failing
+	whole, err := buddyMalloc(&pool, 1<<MIN_K-uint(BLOCK_HEADER))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pool.held.Load())
+	assert.NoError(t, buddyFree(&pool, whole))
+	checkBuddyPoolFull(t, &pool)
+
+	// A full sweep merges them too
+	mem, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	buddyCoalesceAll(&pool)
+	assert.Equal(t, int64(0), pool.held.Load())
+	checkBuddyPoolFull(t, &pool)
+
+	// Reset returns the pool to one block
+	mem, err = buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	buddyReset(&pool)
+	assert.Equal(t, int64(0), pool.held.Load())
+	checkBuddyPoolFull(t, &pool)
+
+	// Destroy clears the mode
+	assert.NoError(t, buddyDestroy(&pool))
+	assert.Equal(t, int64(0), pool.holdSplits)
+	assert.Equal(t, int64(0), pool.held.Load())
+}
+
+func TestHoldSplitsConcurrent(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing held splits stay counted under concurrent churn")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{HoldSplits: 8, PrewarmK: 12}))
+	assert.Equal(t, int64(1), pool.held.Load())
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				p, err := buddyMalloc(&pool, uint(64<<(i%6+g%3)))
+				if err == nil {
+					_ = buddyFree(&pool, p)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	assert.NoError(t, buddyVerify(&pool))
+	assert.LessOrEqual(t, pool.held.Load(), int64(8))
+	buddyCoalesceAll(&pool)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestHoldSplitsInvalid(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing hold splits option validation")
+	var pool BuddyPool
+	assert.ErrorIs(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{HoldSplits: -1}), ErrInvalidOptions)
+	assert.ErrorIs(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{HoldSplits: 1, DeferCoalesce: true}), ErrInvalidOptions)
+	assert.Equal(t, uintptr(0), pool.base)
+}
+
+// Counts the blocks linked into avail[k]
+func availCount(pool *BuddyPool, k uint) int {
+	var count int
+	for block := pool.avail[k].next; block != &pool.avail[k]; block = block.next {
+		count++
+	}
+	return count
+}
+
+// Allocates and frees one size just below a split boundary. splits/op is the share of
+// mallocs that found avail[k] empty and had to split, each of which the free merges back
+func BenchmarkHoldSplits(b *testing.B) {
+	for _, hold := range []int{0, 4} {
+		b.Run(fmt.Sprintf("hold=%d", hold), func(b *testing.B) {
+			var pool BuddyPool
+			_ = buddyInitWithOptions(&pool, 1<<MIN_K, Options{HoldSplits: hold})
+			var size uint = 1<<12 - uint(BLOCK_HEADER)
+			var k uint = requestK(&pool, size)
+
+			var splits int
+			for i := 0; i < b.N; i++ {
+				if pool.avail[k].next == &pool.avail[k] {
+					splits++
+				}
+				p, err := buddyMalloc(&pool, size)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = buddyFree(&pool, p)
+			}
+
+			b.ReportMetric(float64(splits)/float64(b.N), "splits/op")
+			_ = buddyDestroy(&pool)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package balloc
+
+import "time"
+
+// Locks avail[lo] through avail[hi] in ascending k order.
+// Every path that holds more than one class lock takes them in this order so they can never deadlock
+func lockRange(pool *BuddyPool, lo, hi uint) {
+	for k := lo; k <= hi; k++ {
+		lockClass(pool, k)
+	}
+}
+
+// Locks avail[k]. With lock stats enabled a contended acquisition is timed,
+// one that is free straight away skips the clock
+func lockClass(pool *BuddyPool, k uint) {
+	if pool.lockStats == nil {
+		pool.locks[k].Lock()
+		return
+	}
+
+	if pool.locks[k].TryLock() {
+		pool.lockStats.acquired.Add(1)
+		return
+	}
+	var start time.Time = time.Now()
+	pool.locks[k].Lock()
+	pool.lockStats.record(time.Since(start))
+}
+
+// Unlocks avail[lo] through avail[hi]
+func unlockRange(pool *BuddyPool, lo, hi uint) {
+	for k := lo; k <= hi; k++ {
+		pool.locks[k].Unlock()
+	}
+}
+
+// Locks every size class for operations that change the whole pool such as init, destroy and reset
+func lockAll(pool *BuddyPool) {
+	lockRange(pool, 0, MAX_K-1)
+}
+
+// Unlocks every size class
+func unlockAll(pool *BuddyPool) {
+	unlockRange(pool, 0, MAX_K-1)
+}
+
+// Read locks every size class in ascending k order for operations that only look at the
+// whole pool, such as stats, dumps and verify. Any number of them run at once, while mallocs
+// and frees wait for them as for lockAll. Nothing holding these may write a header or a list
+func rlockAll(pool *BuddyPool) {
+	for k := uint(0); k < MAX_K; k++ {
+		rlockClass(pool, k)
+	}
+}
+
+// Read locks avail[k], timed like lockClass with lock stats enabled
+func rlockClass(pool *BuddyPool, k uint) {
+	if pool.lockStats == nil {
+		pool.locks[k].RLock()
+		return
+	}
+
+	if pool.locks[k].TryRLock() {
+		pool.lockStats.acquired.Add(1)
+		return
+	}
+	var start time.Time = time.Now()
+	pool.locks[k].RLock()
+	pool.lockStats.record(time.Since(start))
+}
+
+// Read unlocks every size class
+func runlockAll(pool *BuddyPool) {
+	for k := uint(0); k < MAX_K; k++ {
+		pool.locks[k].RUnlock()
+	}
+}
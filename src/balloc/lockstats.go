@@ -0,0 +1,50 @@
+package balloc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How long the class locks of a pool have been waited on since init
+type LockStats struct {
+	Acquisitions uint64        // class lock acquisitions, contended or not
+	Contended    uint64        // acquisitions that had to wait for another holder
+	TotalWait    time.Duration // time spent waiting across every contended acquisition
+	MaxWait      time.Duration // longest single wait
+}
+
+// Running lock wait counters of a pool
+type lockCounters struct {
+	acquired  atomic.Uint64 // every acquisition
+	contended atomic.Uint64 // acquisitions that had to wait
+	total     atomic.Int64  // nanoseconds waited in total
+	max       atomic.Int64  // nanoseconds of the longest wait
+}
+
+// Records a contended acquisition that waited for wait
+func (c *lockCounters) record(wait time.Duration) {
+	c.acquired.Add(1)
+	c.contended.Add(1)
+	c.total.Add(int64(wait))
+	for {
+		var longest int64 = c.max.Load()
+		if int64(wait) <= longest || c.max.CompareAndSwap(longest, int64(wait)) {
+			return
+		}
+	}
+}
+
+// Returns the lock wait stats of the pool. Read without locking, so each field is loaded
+// on its own. Returns the zero LockStats unless the pool was initialized with LockStats
+func buddyLockStats(pool *BuddyPool) LockStats {
+	if pool == nil || pool.lockStats == nil {
+		return LockStats{}
+	}
+
+	return LockStats{
+		Acquisitions: pool.lockStats.acquired.Load(),
+		Contended:    pool.lockStats.contended.Load(),
+		TotalWait:    time.Duration(pool.lockStats.total.Load()),
+		MaxWait:      time.Duration(pool.lockStats.max.Load()),
+	}
+}
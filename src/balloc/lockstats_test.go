@@ -0,0 +1,82 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockStatsSingleGoroutine(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing lock stats stay at zero wait without contention")
+	var pool BuddyPool
+	assert.Equal(t, LockStats{}, buddyLockStats(&pool))
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{LockStats: true}))
+
+	for i := 0; i < 100; i++ {
+		mem, err := buddyMalloc(&pool, 100)
+		assert.NoError(t, err)
+		assert.NoError(t, buddyFree(&pool, mem))
+	}
+
+	// Every acquisition was counted and none of them waited
+	var stats LockStats = buddyLockStats(&pool)
+	assert.Greater(t, stats.Acquisitions, uint64(200))
+	assert.Equal(t, uint64(0), stats.Contended)
+	assert.Equal(t, time.Duration(0), stats.MaxWait)
+	assert.Equal(t, time.Duration(0), stats.TotalWait)
+
+	_ = buddyDestroy(&pool)
+	assert.Equal(t, LockStats{}, buddyLockStats(&pool))
+}
+
+func TestLockStatsContended(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing lock stats record waits of contending goroutines")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{LockStats: true}))
+
+	// Hold the class a malloc needs so it has to wait at least the sleep
+	var k uint = requestK(&pool, 100)
+	pool.locks[k].Lock()
+	var done chan struct{} = make(chan struct{})
+	go func() {
+		defer close(done)
+		mem, err := buddyMalloc(&pool, 100)
+		assert.NoError(t, err)
+		assert.NoError(t, buddyFree(&pool, mem))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	pool.locks[k].Unlock()
+	<-done
+
+	var stats LockStats = buddyLockStats(&pool)
+	assert.GreaterOrEqual(t, stats.Contended, uint64(1))
+	assert.GreaterOrEqual(t, stats.MaxWait, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, stats.TotalWait, stats.MaxWait)
+
+	// Goroutines hammering the same size class pile up on its lock too
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				mem, err := buddyMalloc(&pool, 100)
+				if assert.NoError(t, err) {
+					assert.NoError(t, buddyFree(&pool, mem))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	var after LockStats = buddyLockStats(&pool)
+	assert.Greater(t, after.Acquisitions, stats.Acquisitions)
+	assert.GreaterOrEqual(t, after.Contended, stats.Contended)
+	assert.Greater(t, after.MaxWait, time.Duration(0))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
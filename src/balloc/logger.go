@@ -0,0 +1,16 @@
+package balloc
+
+// Logger receives the allocator's diagnostics, such as out of memory errors
+// and debug mode warnings. *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Sends a diagnostic to the pool's logger. Pools without a logger stay silent
+func logf(pool *BuddyPool, format string, v ...any) {
+	if pool == nil || pool.logger == nil {
+		return
+	}
+
+	pool.logger.Printf(format, v...)
+}
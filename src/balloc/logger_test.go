@@ -0,0 +1,74 @@
+package balloc
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// Logger recording every formatted message
+type captureLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (c *captureLogger) Printf(format string, v ...any) {
+	c.lock.Lock()
+	c.messages = append(c.messages, fmt.Sprintf(format, v...))
+	c.lock.Unlock()
+}
+
+func TestLoggerReceivesOOM(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing diagnostics go to the injected logger")
+
+	// Watch the global logger to make sure nothing reaches it
+	var global bytes.Buffer
+	log.SetOutput(&global)
+	defer log.SetOutput(os.Stderr)
+
+	var logger captureLogger
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Logger: &logger}))
+
+	mem, err := buddyMalloc(&pool, 1<<(MIN_K+1))
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.Equal(t, []string{"ERROR: No memory available to be allocated"}, logger.messages)
+
+	// Other diagnostics go to the same logger
+	mem, _ = buddyMalloc(&pool, 10)
+	_ = buddyFree(&pool, mem)
+	assert.ErrorIs(t, buddyFree(&pool, mem), ErrDoubleFree)
+	assert.Equal(t, "ERROR: Double free detected", logger.messages[1])
+	assert.Empty(t, global.String())
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestLoggerDefaultSilent(t *testing.T) {
+	var global bytes.Buffer
+	log.SetOutput(&global)
+	defer log.SetOutput(os.Stderr)
+
+	// No logger discards diagnostics
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+	_, err := buddyMalloc(&pool, 1<<(MIN_K+1))
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.Empty(t, global.String())
+
+	// A standard library logger can be plugged in directly
+	var out bytes.Buffer
+	_ = buddyDestroy(&pool)
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Logger: log.New(&out, "balloc ", 0)}))
+	_, _ = buddyMalloc(&pool, 1<<(MIN_K+1))
+	assert.Equal(t, "balloc ERROR: No memory available to be allocated\n", out.String())
+
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,51 @@
+package balloc
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Hands the pages of a block being freed back to the OS if it is at least 2^adviseK bytes.
+// Poison mode needs the freed memory kept intact so it never advises
+func releasePages(pool *BuddyPool, block *Avail) {
+	if pool.adviseK == 0 || uint(block.kval) < pool.adviseK || pool.poison {
+		return
+	}
+
+	var err error = adviseFree(pool, block)
+	if err != nil {
+		logf(pool, "WARNING: madvise failed on block of kval %d: %v", block.kval, err)
+	}
+}
+
+// Advises MADV_DONTNEED on the whole pages inside the user region of block
+func adviseFree(pool *BuddyPool, block *Avail) error {
+	var pages []byte = blockPages(pool, block)
+	if len(pages) == 0 {
+		return nil
+	}
+
+	return unix.Madvise(pages, unix.MADV_DONTNEED)
+}
+
+// Returns the whole pages inside block past its Avail header, nil if there are none.
+// The page holding the header is left out as the avail lists still need it, and
+// partial pages at either end are left out as they may belong to other blocks
+func blockPages(pool *BuddyPool, block *Avail) []byte {
+	var pageSize uintptr = uintptr(unix.Getpagesize())
+	if pool.hugePages {
+		pageSize = uintptr(1) << HUGE_PAGE_K
+	}
+
+	// Round the start up and the end down to page boundaries
+	var start uintptr = uintptr(unsafe.Pointer(block)) + AVAIL_HEADER
+	var end uintptr = uintptr(unsafe.Pointer(block)) + uintptr(1)<<block.kval
+	start = (start + pageSize - 1) &^ (pageSize - 1)
+	end = end &^ (pageSize - 1)
+	if start >= end {
+		return nil
+	}
+
+	return unsafe.Slice((*byte)(unsafe.Pointer(start)), end-start)
+}
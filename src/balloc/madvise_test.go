@@ -0,0 +1,140 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// Counts how many pages of [ptr, ptr+size) are resident. Returns -1 if mincore is unavailable
+func residentPages(ptr unsafe.Pointer, size uintptr) int {
+	var pageSize uintptr = uintptr(unix.Getpagesize())
+	var vec []byte = make([]byte, (size+pageSize-1)/pageSize)
+	_, _, errno := unix.Syscall(unix.SYS_MINCORE, uintptr(ptr), size, uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		return -1
+	}
+
+	var count int
+	for _, v := range vec {
+		count += int(v & 1)
+	}
+	return count
+}
+
+func TestMadviseOnFree(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing large frees give their pages back")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{MadviseK: 16}))
+
+	// Touch every page of a 256KiB block
+	var size uint = 1<<18 - uint(BLOCK_HEADER)
+	mem, err := buddyMalloc(&pool, size)
+	assert.NoError(t, err)
+	var region []byte = unsafe.Slice((*byte)(mem), size)
+	for i := range region {
+		region[i] = 0xAB
+	}
+
+	// The advice succeeds and the whole pages past the header page are dropped on free
+	var pageSize uintptr = uintptr(unix.Getpagesize())
+	var interior unsafe.Pointer = unsafe.Add(unsafe.Pointer(ptrToBlock(&pool, mem)), pageSize)
+	var interiorSize uintptr = 1<<18 - pageSize
+	assert.NoError(t, adviseFree(&pool, ptrToBlock(&pool, mem)))
+	assert.NoError(t, buddyFree(&pool, mem))
+	if resident := residentPages(interior, interiorSize); resident >= 0 {
+		assert.Equal(t, 0, resident)
+	}
+
+	// The avail lists are intact and the memory reads back as zero when reused
+	checkBuddyPoolFull(t, &pool)
+	assert.NoError(t, buddyVerify(&pool))
+	mem, err = buddyMalloc(&pool, size)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0), unsafe.Slice((*byte)(mem), size)[size-1])
+	assert.NoError(t, buddyFree(&pool, mem))
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestMadviseBelowThreshold(t *testing.T) {
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{MadviseK: 16}))
+
+	// Blocks under 2^MadviseK keep their contents
+	mem, _ := buddyMalloc(&pool, 1<<14)
+	var size uint = buddyUsableSize(&pool, mem)
+	unsafe.Slice((*byte)(mem), size)[size-1] = 0xAB
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.Equal(t, byte(0xAB), unsafe.Slice((*byte)(mem), size)[size-1])
+
+	// Blocks smaller than a page have no whole page to give back
+	small, _ := buddyMalloc(&pool, 100)
+	assert.NoError(t, adviseFree(&pool, ptrToBlock(&pool, small)))
+	assert.NoError(t, buddyFree(&pool, small))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+// Returns the VmFlags of the mapping containing addr from /proc/self/smaps, "" if it cannot be read
+func vmFlags(addr uintptr) string {
+	data, err := os.ReadFile("/proc/self/smaps")
+	if err != nil {
+		return ""
+	}
+
+	var inside bool
+	for _, line := range strings.Split(string(data), "\n") {
+		var lo, hi uintptr
+		// Each mapping starts with its address range, followed by its fields
+		if n, _ := fmt.Sscanf(line, "%x-%x", &lo, &hi); n == 2 {
+			inside = addr >= lo && addr < hi
+			continue
+		}
+		if inside && strings.HasPrefix(line, "VmFlags:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "VmFlags:"))
+		}
+	}
+	return ""
+}
+
+func TestTransparentHugePages(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing transparent huge page hinting")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<(HUGE_PAGE_K+1), Options{TransparentHugePages: true}))
+
+	// The pool works as normal whether or not the hint was taken
+	mem, err := buddyMalloc(&pool, 1<<HUGE_PAGE_K)
+	assert.NoError(t, err)
+	unsafe.Slice((*byte)(mem), 1<<HUGE_PAGE_K)[0] = 0xAB
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	// Kernels built without THP reject the advice
+	var supported bool = unix.Madvise(poolBytes(&pool), unix.MADV_HUGEPAGE) == nil
+	if supported {
+		if flags := vmFlags(pool.base); flags != "" {
+			assert.Contains(t, strings.Fields(flags), "hg")
+		}
+	}
+	_ = buddyDestroy(&pool)
+
+	// Strict init fails only where the hint is rejected
+	err = buddyInitWithOptions(&pool, 1<<MIN_K, Options{TransparentHugePages: true, Strict: true})
+	if !supported {
+		assert.ErrorIs(t, err, unix.EINVAL)
+		assert.Equal(t, uintptr(0), pool.base)
+		t.Skip("transparent huge pages are not supported by this kernel")
+	}
+	assert.NoError(t, err)
+	if flags := vmFlags(pool.base); flags != "" {
+		assert.Contains(t, strings.Fields(flags), "hg")
+	}
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,6 @@
+//go:build !race
+
+package balloc
+
+// The race detector is off so checkptr does not look at pointer arithmetic
+const raceEnabled = false
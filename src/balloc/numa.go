@@ -0,0 +1,31 @@
+package balloc
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mbind policy and flag values from linux/mempolicy.h, which golang.org/x/sys/unix does not define
+const (
+	mpolBind   = 2      // MPOL_BIND, only allocate from the given nodes
+	mpolMfMove = 1 << 1 // MPOL_MF_MOVE, migrate pages already faulted in, e.g. by MAP_POPULATE
+)
+
+// Binds the memory of data to NUMA node with mbind(MPOL_BIND)
+func bindNode(data []byte, node int) error {
+	// One bit per node, rounded up to whole words
+	var mask []uint64 = make([]uint64, node/64+1)
+	mask[node/64] |= 1 << (node % 64)
+
+	// The kernel reads maxnode-1 bits, so pass one more than the mask holds
+	var maxNode uintptr = uintptr(len(mask)*64) + 1
+	_, _, errno := unix.Syscall6(unix.SYS_MBIND,
+		uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)),
+		mpolBind, uintptr(unsafe.Pointer(&mask[0])), maxNode, mpolMfMove)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
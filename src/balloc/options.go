@@ -0,0 +1,67 @@
+package balloc
+
+import "unsafe"
+
+// Options tweaks how a pool is initialized.
+// The zero value gives the same behavior as buddyInit
+type Options struct {
+	SmallestK            uint       // smallest k this pool will hand out. 0 uses SMALLEST_K. must hold an Avail header and be <= the pool's k
+	HugePages            bool       // back the pool with huge pages via MAP_HUGETLB, falling back to normal pages if the kernel refuses
+	TransparentHugePages bool       // advise MADV_HUGEPAGE on the mapping so transparent huge pages can back it without reserved hugetlb pages. a rejected hint is logged, or fails init when Strict
+	Mlock                bool       // mlock the mapping so the OS will not page it out. fails if RLIMIT_MEMLOCK is too low
+	Populate             bool       // prefault the whole mapping with MAP_POPULATE. slows init but removes minor faults later
+	NumaBind             bool       // bind the mapping to NumaNode with mbind(MPOL_BIND). init returns the mbind error unless NumaBestEffort is set
+	NumaNode             int        // NUMA node id the mapping is bound to when NumaBind is set
+	NumaBestEffort       bool       // log a failed NUMA binding and carry on with the unbound mapping instead of failing init
+	TouchPages           bool       // additionally write a byte in every page during init to guarantee residency
+	Probe                bool       // fault in every page for writing during init and fail it if the kernel cannot back them, instead of crashing on a later write
+	Redzone              bool       // debug mode writing a canary after each allocation that free verifies to catch overruns
+	Checksum             bool       // debug mode keeping a checksum of each block header that free and coalesce verify; cannot combine with Redzone
+	Poison               bool       // debug mode filling freed memory with POISON_BYTE and checking it is untouched when the block is reused
+	VerifyFrees          bool       // debug mode running buddyVerify after every free so the free that broke an invariant returns the error
+	SecureClear          bool       // zero the usable region of every freed block so sensitive data cannot be read by a later allocation. poison mode scrubs already
+	OnPoison             PoisonFunc // called on a poison mismatch with the reused block's user pointer and first overwritten offset. nil only logs
+	OnOOM                OOMFunc    // called with the requested size when malloc runs out of memory. malloc retries once after it returns so it may free memory
+	OnSplit              SplitFunc  // traces every split with the k and offset of the block being split. nil disables
+	OnMerge              MergeFunc  // traces every merge with the k of the two buddies and the offset of the merged block. nil disables
+	Logger               Logger     // receives error and warning diagnostics. nil discards them
+	TrackLeaks           bool       // debug mode recording the call site of every live allocation for buddyLeaks. adds a map insert per malloc
+	Histogram            bool       // count how many allocations land in each size class for buddyHistogram
+	LockStats            bool       // time how long contended class lock acquisitions wait for buddyLockStats. uncontended ones only pay for a TryLock
+	UniqueZero           bool       // malloc(0) returns a distinct freeable pointer to a smallest block, like C, instead of nil
+	StrictDestroy        bool       // destroy returns ErrAllocationsOutstanding and leaves the pool mapped while any block is still handed out
+	PanicOnError         bool       // double frees, invalid pointers and corrupted headers panic instead of returning an error
+	SplitHigh            bool       // hand out the upper half of every split and free the lower one, packing allocations towards the end of the pool instead of the base
+	Strategy             Strategy   // which free block malloc splits and how free lists are ordered. the zero value is StrategyClimb
+	PrewarmK             uint       // split the pool at init and reset so every avail list from PrewarmK up holds a block. 0 disables
+	DeferCoalesce        bool       // free skips merging buddies until buddyCoalesceAll runs, or malloc runs out of memory
+	HoldSplits           int        // free leaves up to this many pairs of buddies split at their child size so the next malloc of that size skips re-splitting. a free past the cap merges. 0 disables
+	DrainAt              float64    // after a free takes buddyFragmentation above this ratio, advise MADV_DONTNEED on every free block of at least 2^DrainK bytes. fires once per crossing. 0 disables
+	DrainK               uint       // smallest k drained when DrainAt is crossed. 0 uses the smallest k spanning two pages
+	MadviseK             uint       // freeing a block of at least 2^MadviseK bytes returns its whole pages to the OS with MADV_DONTNEED. 0 disables
+	CacheDepth           int        // blocks per size class each free cache shard keeps for reuse without taking the class locks. 0 disables the cache
+	Finalizer            bool       // NewWithOptions arms a finalizer unmapping the pool if it is garbage collected without Destroy. ignored by buddyInitWithOptions
+	MaxReserved          uintptr    // cap on the usable bytes handed out at once. malloc returns ENOMEM rather than exceed it. 0 disables
+	MaxAllocations       uint       // cap on the number of allocations outstanding at once, whatever their size. malloc returns ENOMEM rather than exceed it. 0 disables
+	AlignToCacheLine     bool       // put every user pointer CACHE_LINE bytes into its block so it starts on a cache line. tiny requests take at least a 2^7 block
+	Deterministic        bool       // guarantee the same sequence of calls on a fresh pool returns the same offsets from base, as long as the calls are not concurrent
+	Strict               bool       // return ErrSizeOutOfRange instead of clamping sizes outside [2^MIN_K, 2^(MAX_K-1)], and fail init if the TransparentHugePages hint is rejected
+	readOnly             bool       // map the file read-only and keep the blocks found in it. only set by buddyInitReadOnly
+	region               []byte     // caller supplied memory of exactly the pool size to manage instead of mapping. only set by buddyInitOnRegion
+}
+
+// Called in poison mode when a reused block no longer holds only POISON_BYTE.
+// ptr is the user pointer of the block being handed out and offset the first overwritten byte
+type PoisonFunc func(ptr unsafe.Pointer, offset uint)
+
+// Called when malloc cannot find a block for a request of requested bytes.
+// It runs with no pool locks held, so it may free blocks or alert before malloc retries once
+type OOMFunc func(requested uint)
+
+// Called when a free block of 2^parentK bytes at offset from the pool base is split in two.
+// It runs under the class locks, so it must be quick and must not call back into the pool
+type SplitFunc func(parentK uint, offset uintptr)
+
+// Called when two free 2^childK byte buddies are merged into the block at offset from the pool base.
+// It runs under the class locks, so it must be quick and must not call back into the pool
+type MergeFunc func(childK uint, offset uintptr)
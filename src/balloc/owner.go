@@ -0,0 +1,91 @@
+package balloc
+
+import "unsafe"
+
+// Mallocs size bytes like buddyMalloc and charges the block's usable bytes to owner.
+// The reserved header has no room left, so owners are kept in a side map keyed by user pointer
+func buddyMallocTagged(pool *BuddyPool, size uint, owner uint32) (unsafe.Pointer, error) {
+	ptr, err := buddyMalloc(pool, size)
+	if err != nil || ptr == nil {
+		return ptr, err
+	}
+
+	tagBlock(pool, ptr, owner)
+	return ptr, nil
+}
+
+// Returns the usable bytes currently reserved by each owner that holds any tagged allocation
+func buddyUsageByOwner(pool *BuddyPool) map[uint32]uint {
+	if pool == nil {
+		return nil
+	}
+
+	pool.ownerLock.Lock()
+	defer pool.ownerLock.Unlock()
+
+	var usage map[uint32]uint = make(map[uint32]uint, len(pool.usage))
+	for owner, bytes := range pool.usage {
+		usage[owner] = bytes
+	}
+
+	return usage
+}
+
+// Records owner as the owner of the live block at ptr
+func tagBlock(pool *BuddyPool, ptr unsafe.Pointer, owner uint32) {
+	pool.ownerLock.Lock()
+	defer pool.ownerLock.Unlock()
+
+	if pool.owners == nil {
+		pool.owners = make(map[uintptr]uint32)
+		pool.usage = make(map[uint32]uint)
+	}
+	pool.owners[uintptr(ptr)] = owner
+	pool.usage[owner] += blockUsable(pool, ptrToBlock(pool, ptr))
+	pool.tagged.Store(true)
+}
+
+// Returns the owner the block at ptr was tagged with, if any
+func blockOwner(pool *BuddyPool, ptr unsafe.Pointer) (uint32, bool) {
+	pool.ownerLock.Lock()
+	defer pool.ownerLock.Unlock()
+
+	owner, ok := pool.owners[uintptr(ptr)]
+	return owner, ok
+}
+
+// Takes usable bytes of a block being freed off its owner's total
+func untagBlock(pool *BuddyPool, ptr unsafe.Pointer, usable uint) {
+	pool.ownerLock.Lock()
+	defer pool.ownerLock.Unlock()
+
+	owner, ok := pool.owners[uintptr(ptr)]
+	if !ok {
+		return
+	}
+	delete(pool.owners, uintptr(ptr))
+	pool.usage[owner] -= usable
+	if pool.usage[owner] == 0 {
+		delete(pool.usage, owner)
+	}
+}
+
+// Adds grown usable bytes to the owner of the block at ptr, if it has one
+func growOwner(pool *BuddyPool, ptr unsafe.Pointer, grown uint) {
+	pool.ownerLock.Lock()
+	defer pool.ownerLock.Unlock()
+
+	owner, ok := pool.owners[uintptr(ptr)]
+	if ok {
+		pool.usage[owner] += grown
+	}
+}
+
+// Forgets every owner, for when every allocation is dropped at once
+func clearOwners(pool *BuddyPool) {
+	pool.ownerLock.Lock()
+	pool.owners = nil
+	pool.usage = nil
+	pool.tagged.Store(false)
+	pool.ownerLock.Unlock()
+}
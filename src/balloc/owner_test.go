@@ -0,0 +1,52 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuddyUsageByOwner(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing per owner accounting of tagged allocations")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	assert.Empty(t, buddyUsageByOwner(&pool))
+
+	// Two owners, each charged the usable size of their blocks
+	var small uint = 1<<SMALLEST_K - uint(BLOCK_HEADER)
+	var large uint = 1<<10 - uint(BLOCK_HEADER)
+	a1, err := buddyMallocTagged(&pool, 10, 1)
+	assert.NoError(t, err)
+	a2, _ := buddyMallocTagged(&pool, 1000, 1)
+	b1, _ := buddyMallocTagged(&pool, 20, 2)
+	untagged, _ := buddyMalloc(&pool, 100)
+	assert.Equal(t, map[uint32]uint{1: small + large, 2: small}, buddyUsageByOwner(&pool))
+
+	// Frees take the bytes off the right owner, untagged blocks touch nobody
+	assert.NoError(t, buddyFree(&pool, a2))
+	assert.Equal(t, map[uint32]uint{1: small, 2: small}, buddyUsageByOwner(&pool))
+	assert.NoError(t, buddyFree(&pool, untagged))
+	assert.Equal(t, map[uint32]uint{1: small, 2: small}, buddyUsageByOwner(&pool))
+
+	// A moved block keeps its owner
+	b1, err = buddyRealloc(&pool, b1, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint32]uint{1: small, 2: large}, buddyUsageByOwner(&pool))
+
+	// Owners with nothing left drop out
+	assert.NoError(t, buddyFreeBatch(&pool, []unsafe.Pointer{a1}))
+	assert.Equal(t, map[uint32]uint{2: large}, buddyUsageByOwner(&pool))
+	assert.NoError(t, buddyFree(&pool, b1))
+	assert.Empty(t, buddyUsageByOwner(&pool))
+	checkBuddyPoolFull(t, &pool)
+
+	// Reset forgets every owner
+	_, _ = buddyMallocTagged(&pool, 10, 3)
+	buddyReset(&pool)
+	assert.Empty(t, buddyUsageByOwner(&pool))
+
+	_ = buddyDestroy(&pool)
+}
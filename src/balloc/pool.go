@@ -0,0 +1,389 @@
+package balloc
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"unsafe"
+)
+
+// Pool is the exported entry point to the buddy allocator.
+// It wraps a BuddyPool and delegates to the internal buddy functions
+type Pool struct {
+	buddy BuddyPool // the underlying buddy memory pool
+}
+
+// Creates a new Pool managing at least size bytes.
+// A size of 0 uses the default of 2^DEFAULT_K bytes
+func New(size uintptr) (*Pool, error) {
+	var p *Pool = &Pool{}
+	var err error = buddyInit(&p.buddy, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Creates a new Pool managing at least size bytes using the given options
+func NewWithOptions(size uintptr, opts Options) (*Pool, error) {
+	var p *Pool = &Pool{}
+	var err error = buddyInitWithOptions(&p.buddy, size, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmap the pool if the caller drops it without destroying it
+	if opts.Finalizer {
+		setFinalizer(p)
+	}
+
+	return p, nil
+}
+
+// Creates a new Pool backed by the file behind fd.
+// The file must already be sized to hold the pool, e.g. with ftruncate
+func NewFromFd(fd int, size uintptr) (*Pool, error) {
+	var p *Pool = &Pool{}
+	var err error = buddyInitFromFd(&p.buddy, fd, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Opens the pool persisted in the file behind fd for inspection. Allocating
+// or freeing through it fails with ErrReadOnly and the file is never written
+func NewReadOnly(fd int, size uintptr) (*Pool, error) {
+	var p *Pool = &Pool{}
+	var err error = buddyInitReadOnly(&p.buddy, fd, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Creates a new Pool holding the pool an Export wrote to r, with its allocations
+// live at the same offsets from the new base
+func Import(r io.Reader) (*Pool, error) {
+	var p *Pool = &Pool{}
+	var err error = importPool(&p.buddy, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Creates a new Pool managing the size bytes of memory at base, which the caller
+// mapped or allocated itself. Destroy leaves the memory in place for the caller to release
+func NewOnRegion(base unsafe.Pointer, size uintptr) (*Pool, error) {
+	var p *Pool = &Pool{}
+	var err error = buddyInitOnRegion(&p.buddy, base, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Allocates a block of at least size bytes from the pool
+func (p *Pool) Alloc(size uint) (unsafe.Pointer, error) {
+	return buddyMalloc(&p.buddy, size)
+}
+
+// Allocates a block of at least size bytes and also returns its size as 2^k bytes header included
+func (p *Pool) AllocK(size uint) (unsafe.Pointer, uint, error) {
+	return buddyMallocK(&p.buddy, size)
+}
+
+// Allocates a block of at least size bytes charged to owner in UsageByOwner
+func (p *Pool) AllocTagged(size uint, owner uint32) (unsafe.Pointer, error) {
+	return buddyMallocTagged(&p.buddy, size, owner)
+}
+
+// Returns the usable bytes each owner currently holds through AllocTagged
+func (p *Pool) UsageByOwner() map[uint32]uint {
+	return buddyUsageByOwner(&p.buddy)
+}
+
+// Allocates size bytes, blocking until memory is freed if the pool is full.
+// Returns ctx.Err() if ctx is done before the allocation succeeds
+func (p *Pool) AllocWait(ctx context.Context, size uint) (unsafe.Pointer, error) {
+	return buddyMallocWait(ctx, &p.buddy, size)
+}
+
+// Allocates zeroed memory for nmemb elements of size bytes each
+func (p *Pool) Calloc(nmemb, size uint) (unsafe.Pointer, error) {
+	return buddyCalloc(&p.buddy, nmemb, size)
+}
+
+// Resizes the allocation at ptr to hold at least size bytes,
+// moving it to a new block if it no longer fits
+func (p *Pool) Realloc(ptr unsafe.Pointer, size uint) (unsafe.Pointer, error) {
+	return buddyRealloc(&p.buddy, ptr, size)
+}
+
+// Returns the number of bytes usable at ptr, which may exceed the requested size
+func (p *Pool) UsableSize(ptr unsafe.Pointer) uint {
+	return buddyUsableSize(&p.buddy, ptr)
+}
+
+// Allocates at least size bytes and returns them as a slice covering the usable region
+func (p *Pool) AllocSlice(size uint) ([]byte, error) {
+	return buddyMallocSlice(&p.buddy, size)
+}
+
+// Frees a slice previously returned by AllocSlice
+func (p *Pool) FreeSlice(buf []byte) error {
+	return buddyFreeSlice(&p.buddy, buf)
+}
+
+// Allocates at least size bytes aligned to alignment, which must be a power of two.
+// The pointer is released with Free like any other
+func (p *Pool) AllocAligned(size, alignment uint) (unsafe.Pointer, error) {
+	return buddyMallocAligned(&p.buddy, size, alignment)
+}
+
+// Allocates at least size bytes starting on an OS page boundary.
+// The pointer is released with Free like any other
+func (p *Pool) AllocPageAligned(size uint) (unsafe.Pointer, error) {
+	return buddyMallocPageAligned(&p.buddy, size)
+}
+
+// Frees a pointer previously returned by AllocAligned or AllocPageAligned, the same as Free
+func (p *Pool) FreeAligned(ptr unsafe.Pointer) error {
+	return buddyFreeAligned(&p.buddy, ptr)
+}
+
+// Allocates count blocks of at least size bytes each in one pass.
+// Either every block is allocated or none are and ENOMEM is returned
+func (p *Pool) AllocBatch(size uint, count int) ([]unsafe.Pointer, error) {
+	return buddyMallocBatch(&p.buddy, size, count)
+}
+
+// Frees every pointer in ptrs in one pass. Nothing is freed if any pointer is invalid
+func (p *Pool) FreeBatch(ptrs []unsafe.Pointer) error {
+	return buddyFreeBatch(&p.buddy, ptrs)
+}
+
+// Returns a Buffer holding at least size bytes of pool memory. Close it to give the memory back
+func (p *Pool) NewBuffer(size uint) (*Buffer, error) {
+	return newBuffer(&p.buddy, size)
+}
+
+// Reserves a block of at least size bytes without keeping its pages resident.
+// Commit the reservation to get the pointer or Release it to give the block back
+func (p *Pool) Reserve(size uint) (*Reservation, error) {
+	return buddyReserve(&p.buddy, size)
+}
+
+// Returns a new Scope allocating from the pool. Releasing the scope frees
+// every block allocated through it at once
+func (p *Pool) Scope() *Scope {
+	return newScope(&p.buddy)
+}
+
+// Returns a size class front-end over the pool that packs small requests into
+// finer classes than powers of two. Free its pointers through it, not the pool
+func (p *Pool) SizeClasses() *SizeClasses {
+	return newSizeClasses(&p.buddy)
+}
+
+// Frees a pointer previously returned by Alloc.
+// Returns ErrDoubleFree if ptr has already been freed
+// and ErrInvalidPointer if ptr does not belong to the pool
+func (p *Pool) Free(ptr unsafe.Pointer) error {
+	return buddyFree(&p.buddy, ptr)
+}
+
+// Returns how far into the pool ptr lies. See Options.Deterministic for when offsets are reproducible
+func (p *Pool) Offset(ptr unsafe.Pointer) (uintptr, error) {
+	return buddyOffset(&p.buddy, ptr)
+}
+
+// Adds a reference to the allocation at ptr, which then needs one more ReleaseRef before it is freed
+func (p *Pool) Retain(ptr unsafe.Pointer) error {
+	return buddyRetain(&p.buddy, ptr)
+}
+
+// Drops a reference to the allocation at ptr, freeing it when the last one is released
+func (p *Pool) ReleaseRef(ptr unsafe.Pointer) error {
+	return buddyReleaseRef(&p.buddy, ptr)
+}
+
+// Merges every pair of free buddies. Only needed with Options.DeferCoalesce
+func (p *Pool) CoalesceAll() {
+	buddyCoalesceAll(&p.buddy)
+}
+
+// Merges every pair of free buddies and returns how many merges that took
+func (p *Pool) Recoalesce() int {
+	return buddyRecoalesce(&p.buddy)
+}
+
+// Hands every block parked in the free cache back to the pool
+func (p *Pool) FlushCache() {
+	buddyFlushCache(&p.buddy)
+}
+
+// Grows the pool to at least newSize bytes. The mapping may move so this is only
+// allowed while nothing is allocated, otherwise ErrPoolInUse is returned
+func (p *Pool) Grow(newSize uintptr) error {
+	return buddyGrow(&p.buddy, newSize)
+}
+
+// Grows the pool to at least newSize bytes without moving it, so live allocations
+// stay valid. Fails if the address space after the pool is already in use
+func (p *Pool) GrowInPlace(newSize uintptr) error {
+	return buddyGrowInPlace(&p.buddy, newSize)
+}
+
+// Publishes the pool's metrics as an expvar under name, see PublishExpvar
+func (p *Pool) PublishExpvar(name string) {
+	PublishExpvar(name, &p.buddy)
+}
+
+// Captures the pool's block layout so it can be restored later
+func (p *Pool) Snapshot() PoolSnapshot {
+	return buddySnapshot(&p.buddy)
+}
+
+// Rebuilds the pool's block layout from snap. Blocks reserved in snap are live again
+// and blocks free in snap must not be used through old pointers
+func (p *Pool) Restore(snap PoolSnapshot) error {
+	return buddyRestore(&p.buddy, snap)
+}
+
+// Writes the whole pool, header and raw bytes, to w so Import can load it back
+func (p *Pool) Export(w io.Writer) error {
+	return buddyExport(&p.buddy, w)
+}
+
+// Frees every allocation at once without unmapping the pool.
+// Much cheaper than Destroy followed by New, every pointer into the pool is invalid afterwards
+func (p *Pool) Reset() {
+	buddyReset(&p.buddy)
+}
+
+// Returns a snapshot of the pool's memory usage
+func (p *Pool) Stats() Stats {
+	return buddyStats(&p.buddy)
+}
+
+// Returns the largest single allocation that could succeed right now, 0 if the pool is exhausted
+func (p *Pool) MaxAlloc() uint {
+	return buddyMaxAlloc(&p.buddy)
+}
+
+// Reports whether an Alloc of size bytes would succeed right now without allocating
+func (p *Pool) CanAlloc(size uint) bool {
+	return buddyCanAlloc(&p.buddy, size)
+}
+
+// Returns the alignment every pointer from Alloc is guaranteed to have
+func (p *Pool) Alignment() uint {
+	return buddyAlignment(&p.buddy)
+}
+
+// Returns how often and how long the pool's class locks were waited on. Zero unless enabled by Options.LockStats
+func (p *Pool) LockStats() LockStats {
+	return buddyLockStats(&p.buddy)
+}
+
+// Returns the pool's running alloc, free and outstanding counts without taking any lock
+func (p *Pool) Counters() Counters {
+	return buddyCounters(&p.buddy)
+}
+
+// Returns how many blocks the pool has split and merged since init or the last Reset
+func (p *Pool) OpStats() OpStats {
+	return buddyOpStats(&p.buddy)
+}
+
+// Returns the most usable bytes that were allocated at once since the pool was
+// created or last Reset
+func (p *Pool) Peak() uintptr {
+	return buddyPeak(&p.buddy)
+}
+
+// Returns how many allocations were served from each block size k.
+// nil unless the pool was created with Options.Histogram
+func (p *Pool) Histogram() map[uint]uint64 {
+	return buddyHistogram(&p.buddy)
+}
+
+// Returns the usable size of every free block, smallest first. See buddyFreeBlocks
+func (p *Pool) FreeBlocks() []uint {
+	return buddyFreeBlocks(&p.buddy)
+}
+
+// Returns the external fragmentation ratio of the pool in [0.0, 1.0)
+func (p *Pool) Fragmentation() float64 {
+	return buddyFragmentation(&p.buddy)
+}
+
+// Returns Stats and Fragmentation read together, so the ratio matches the free bytes
+// in the stats. Use it over two separate calls when publishing both
+func (p *Pool) Metrics() (Stats, float64) {
+	return buddyMetrics(&p.buddy)
+}
+
+// Reports whether the block behind ptr is free. Returns ErrInvalidPointer for pointers that are
+// outside the pool or inside a live block
+func (p *Pool) IsFree(ptr unsafe.Pointer) (bool, error) {
+	return buddyIsFree(&p.buddy, ptr)
+}
+
+// Returns the user pointer of the buddy of ptr's block, nil if it has none. For debugging coalescing
+func (p *Pool) BuddyOf(ptr unsafe.Pointer) unsafe.Pointer {
+	return buddyOf(&p.buddy, ptr)
+}
+
+// Writes a human readable report of the free blocks per size to w
+func (p *Pool) Dump(w io.Writer) {
+	buddyDump(&p.buddy, w)
+}
+
+// Calls fn with the pointer and usable size of every live allocation in address order,
+// stopping early if fn returns false. The pool is locked during the walk so fn must not use it
+func (p *Pool) Walk(fn func(ptr unsafe.Pointer, size uint) bool) {
+	buddyWalk(&p.buddy, fn)
+}
+
+// Returns the allocations still outstanding when the pool was created with TrackLeaks
+func (p *Pool) Leaks() []LeakInfo {
+	return buddyLeaks(&p.buddy)
+}
+
+// Runs Stress against the pool
+func (p *Pool) Stress(ops int, seed int64) error {
+	return Stress(&p.buddy, ops, seed)
+}
+
+// Checks the pool's internal invariants, returning ErrCorruptPool on the first violation
+func (p *Pool) Verify() error {
+	return buddyVerify(&p.buddy)
+}
+
+// Reports whether the pool obtained the huge pages asked for in Options
+func (p *Pool) HugePages() bool {
+	lockAll(&p.buddy)
+	defer unlockAll(&p.buddy)
+
+	return p.buddy.hugePages
+}
+
+// Destroys the pool and unmaps its memory. A finalizer armed by Options.Finalizer is dropped.
+// With Options.StrictDestroy outstanding allocations fail it with ErrAllocationsOutstanding
+func (p *Pool) Destroy() error {
+	var err error = buddyDestroy(&p.buddy)
+	if err != nil {
+		return err
+	}
+
+	runtime.SetFinalizer(p, nil)
+	return nil
+}
@@ -0,0 +1,53 @@
+package balloc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolNewAllocFreeDestroy(t *testing.T) {
+	pool, err := New(uintptr(1) << MIN_K)
+	assert.NoError(t, err)
+	assert.NotNil(t, pool)
+	assert.Equal(t, MIN_K, pool.buddy.kvalM)
+
+	mem, err := pool.Alloc(64)
+	assert.NoError(t, err)
+	assert.NotNil(t, mem)
+
+	assert.NoError(t, pool.Free(mem))
+	assert.ErrorIs(t, pool.Free(mem), ErrDoubleFree)
+	checkBuddyPoolFull(t, &pool.buddy)
+
+	err = pool.Destroy()
+	assert.NoError(t, err)
+}
+
+func ExamplePool() {
+	pool, err := New(uintptr(1) << MIN_K)
+	if err != nil {
+		fmt.Println("init failed:", err)
+		return
+	}
+
+	mem, err := pool.Alloc(128)
+	if err != nil {
+		fmt.Println("alloc failed:", err)
+		return
+	}
+	fmt.Println("allocated:", mem != nil)
+
+	err = pool.Free(mem)
+	if err != nil {
+		fmt.Println("free failed:", err)
+		return
+	}
+
+	err = pool.Destroy()
+	fmt.Println("destroyed:", err == nil)
+	// Output:
+	// allocated: true
+	// destroyed: true
+}
@@ -0,0 +1,90 @@
+package balloc
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"unsafe"
+)
+
+// PoolSet routes raw pointers back to the pool they came from among several.
+// Lookups may run concurrently with each other and with Add and Remove.
+// A pool must be removed before it is grown or destroyed, both can move its mapping
+type PoolSet struct {
+	lock  sync.RWMutex // guards pools
+	pools []*BuddyPool // every registered pool sorted by base address
+}
+
+// Registers pool with the set. Adding a pool twice is a no-op.
+// Returns ErrInvalidOptions for a pool that is not mapped
+func (s *PoolSet) Add(pool *BuddyPool) error {
+	if pool == nil || pool.base == 0 {
+		return fmt.Errorf("%w: pool is not mapped", ErrInvalidOptions)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Keep the pools sorted so OwnerOf can binary search them
+	i, found := slices.BinarySearchFunc(s.pools, pool.base, func(p *BuddyPool, base uintptr) int {
+		return cmp.Compare(p.base, base)
+	})
+	if !found {
+		s.pools = slices.Insert(s.pools, i, pool)
+	}
+
+	return nil
+}
+
+// Registers the pool behind p with the set
+func (s *PoolSet) AddPool(p *Pool) error {
+	return s.Add(&p.buddy)
+}
+
+// Unregisters pool from the set, doing nothing if it was never added
+func (s *PoolSet) Remove(pool *BuddyPool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var i int = slices.Index(s.pools, pool)
+	if i >= 0 {
+		s.pools = slices.Delete(s.pools, i, i+1)
+	}
+}
+
+// Returns the pool whose [base, base+numBytes) range contains ptr, or nil if none does
+func (s *PoolSet) OwnerOf(ptr unsafe.Pointer) *BuddyPool {
+	var addr uintptr = uintptr(ptr)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// Find the last pool starting at or below addr, only that one can contain it
+	i, found := slices.BinarySearchFunc(s.pools, addr, func(p *BuddyPool, addr uintptr) int {
+		return cmp.Compare(p.base, addr)
+	})
+	if !found {
+		i--
+	}
+	if i < 0 || addr >= s.pools[i].base+s.pools[i].numBytes {
+		return nil
+	}
+
+	return s.pools[i]
+}
+
+// Frees ptr in whichever registered pool it belongs to.
+// Returns ErrInvalidPointer if no pool in the set contains it
+func (s *PoolSet) Free(ptr unsafe.Pointer) error {
+	if ptr == nil {
+		return nil
+	}
+
+	var pool *BuddyPool = s.OwnerOf(ptr)
+	if pool == nil {
+		return ErrInvalidPointer
+	}
+
+	return buddyFree(pool, ptr)
+}
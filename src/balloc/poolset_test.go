@@ -0,0 +1,68 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolSet(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing pointers are routed to the pool that owns them")
+	var set PoolSet
+	var pools [3]BuddyPool
+	var ptrs [3][]unsafe.Pointer
+	for i := range pools {
+		assert.NoError(t, buddyInit(&pools[i], 1<<MIN_K))
+		assert.NoError(t, set.Add(&pools[i]))
+		for j := 0; j < 10; j++ {
+			ptr, _ := buddyMalloc(&pools[i], uint(j*100+1))
+			ptrs[i] = append(ptrs[i], ptr)
+		}
+	}
+	assert.NoError(t, set.Add(&pools[0]))
+	assert.Len(t, set.pools, 3)
+
+	// Every pointer maps back to its own pool, including the first and last byte of each
+	for i := range pools {
+		for _, ptr := range ptrs[i] {
+			assert.Same(t, &pools[i], set.OwnerOf(ptr))
+		}
+		assert.Same(t, &pools[i], set.OwnerOf(unsafe.Pointer(pools[i].base)))
+		assert.Same(t, &pools[i], set.OwnerOf(unsafe.Pointer(pools[i].base+pools[i].numBytes-1)))
+	}
+
+	// Foreign pointers have no owner
+	var x int
+	assert.Nil(t, set.OwnerOf(unsafe.Pointer(&x)))
+	assert.Nil(t, set.OwnerOf(nil))
+	assert.ErrorIs(t, set.Free(unsafe.Pointer(&x)), ErrInvalidPointer)
+
+	// Free dispatches to the right pool, concurrently
+	var wg sync.WaitGroup
+	for i := range pools {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, ptr := range ptrs[i] {
+				assert.NoError(t, set.Free(ptr))
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range pools {
+		checkBuddyPoolFull(t, &pools[i])
+	}
+
+	// Removed and unmapped pools are no longer found
+	set.Remove(&pools[1])
+	assert.Nil(t, set.OwnerOf(unsafe.Pointer(pools[1].base)))
+	assert.Same(t, &pools[2], set.OwnerOf(unsafe.Pointer(pools[2].base)))
+	for i := range pools {
+		_ = buddyDestroy(&pools[i])
+	}
+	assert.ErrorIs(t, set.Add(&pools[1]), ErrInvalidOptions)
+}
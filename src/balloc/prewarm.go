@@ -0,0 +1,39 @@
+package balloc
+
+import "unsafe"
+
+// Splits the pool's single free block down to k, leaving one free block in every
+// avail list in [k, kvalM) and a second one in avail[k]. Allocations of 2^k and up
+// then find a block without splitting and smaller ones start splitting from k.
+// No memory is used up, the splits are only done ahead of time. The two halves
+// in avail[k] are buddies left unmerged on purpose, they stay that way until one
+// is allocated or merged, and only for that long are they exempt from the coalescing checks.
+// The caller must hold every class lock or own the pool exclusively
+func prewarm(pool *BuddyPool, k uint) {
+	if k >= pool.kvalM || pool.avail[pool.kvalM].next == &pool.avail[pool.kvalM] {
+		return
+	}
+
+	var block *Avail = splitBlock(pool, pool.kvalM, k)
+	block.tag = BLOCK_AVAIL
+	sealHeader(pool, block)
+	putBlock(pool, &pool.avail[k], block)
+	pool.prewarmPair.Store(pool.base + (uintptr(unsafe.Pointer(block))-pool.base)&^(uintptr(1)<<k))
+}
+
+// Ends the coalescing exemption of the prewarmed pair if block overlaps it. Called with every
+// block handed out and every block made by a merge, either means the pair was taken apart
+func leavePrewarm(pool *BuddyPool, block *Avail) {
+	var pair uintptr = pool.prewarmPair.Load()
+	var start uintptr = uintptr(unsafe.Pointer(block))
+	if pair != 0 && start < pair+(uintptr(1)<<(pool.prewarmK+1)) && pair < start+(uintptr(1)<<block.kval) {
+		pool.prewarmPair.CompareAndSwap(pair, 0)
+	}
+}
+
+// Reports whether the free block of kval k at offset is half of the prewarmed pair while it is
+// still untouched, the only free buddies allowed to sit side by side outside deferred coalescing
+func prewarmedHalf(pool *BuddyPool, offset uintptr, k uint) bool {
+	var pair uintptr = pool.prewarmPair.Load()
+	return pair != 0 && k == pool.prewarmK && pool.base+offset&^(uintptr(1)<<k) == pair
+}
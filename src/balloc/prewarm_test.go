@@ -0,0 +1,116 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the number of blocks in avail[k]
+func availLen(pool *BuddyPool, k uint) int {
+	var n int
+	for block := pool.avail[k].next; block != &pool.avail[k]; block = block.next {
+		n++
+	}
+	return n
+}
+
+func TestPrewarm(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing prewarmed avail lists")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{PrewarmK: 10}))
+
+	// One block in every list from 10 up to the top, two in avail[10] and none at the top
+	assert.Equal(t, 2, availLen(&pool, 10))
+	for k := uint(11); k < MIN_K; k++ {
+		assert.Equal(t, 1, availLen(&pool, k), "avail[%d]", k)
+	}
+	assert.Equal(t, 0, availLen(&pool, MIN_K))
+	assert.Equal(t, 0, availLen(&pool, 9))
+	assert.NoError(t, buddyVerify(&pool))
+	assert.Equal(t, pool.numBytes, buddyStats(&pool).FreeBytes)
+
+	// A 2^10 allocation is served straight from the list and still comes from the base
+	mem, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, pool.base+BLOCK_HEADER, uintptr(mem))
+	assert.Equal(t, 1, availLen(&pool, 10))
+	assert.Equal(t, 1, availLen(&pool, 11))
+	assert.NoError(t, buddyVerify(&pool))
+
+	// Freeing it merges all the way back, the whole pool can still be allocated
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	// Reset warms the pool up again
+	buddyReset(&pool)
+	assert.Equal(t, 2, availLen(&pool, 10))
+
+	// Out of range prewarm sizes are rejected
+	_ = buddyDestroy(&pool)
+	assert.ErrorIs(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{PrewarmK: SMALLEST_K - 1}), ErrInvalidOptions)
+	assert.ErrorIs(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{PrewarmK: MIN_K + 1}), ErrInvalidOptions)
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{PrewarmK: MIN_K}))
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestPrewarmCoalescingChecked(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the prewarmed pair is only exempt from coalescing checks while untouched")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{PrewarmK: 10}))
+
+	// The untouched pair passes both checks, also after a snapshot round trip
+	assert.NoError(t, buddyVerify(&pool))
+	var snap PoolSnapshot = buddySnapshot(&pool)
+	assert.True(t, snap.Prewarmed)
+	assert.NoError(t, buddyRestore(&pool, snap))
+	assert.NoError(t, buddyVerify(&pool))
+
+	// Allocating both halves ends the exemption
+	a, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	assert.Zero(t, pool.prewarmPair.Load())
+	b, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, b))
+
+	// A free that skips coalescing at the prewarm size is reported like at any other size
+	var block *Avail = ptrToBlock(&pool, a)
+	block.tag = BLOCK_AVAIL
+	sealHeader(&pool, block)
+	putBlock(&pool, &pool.avail[10], block)
+	forgetBlock(&pool, a, blockUsable(&pool, block))
+	assert.ErrorIs(t, buddyVerify(&pool), ErrCorruptPool)
+	assert.ErrorIs(t, buddyRestore(&pool, buddySnapshot(&pool)), ErrInvalidSnapshot)
+
+	assert.Positive(t, buddyRecoalesce(&pool))
+	checkBuddyPoolFull(t, &pool)
+
+	// Reset prewarms a new untouched pair
+	buddyReset(&pool)
+	assert.NotZero(t, pool.prewarmPair.Load())
+	assert.NoError(t, buddyVerify(&pool))
+	_ = buddyDestroy(&pool)
+}
+
+func BenchmarkFirstAlloc(b *testing.B) {
+	for _, prewarmK := range []uint{0, SMALLEST_K} {
+		b.Run(fmt.Sprintf("prewarm=%d", prewarmK), func(b *testing.B) {
+			var pool BuddyPool
+			_ = buddyInitWithOptions(&pool, 1<<(MIN_K+4), Options{PrewarmK: prewarmK})
+
+			// Only the first allocation on a fresh pool is timed, reset puts it back
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				buddyReset(&pool)
+				b.StartTimer()
+				_, _ = buddyMalloc(&pool, 1)
+			}
+
+			_ = buddyDestroy(&pool)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package balloc
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"golang.org/x/sys/unix"
+)
+
+// Faults in every page of data for writing so a mapping the kernel cannot back, e.g. with
+// overcommit disabled or past the end of a short file, fails at init instead of mid-request.
+// MADV_POPULATE_WRITE reports the failure as an error. Kernels without it fall back to writing
+// a byte per page with faults turned into a recoverable panic
+func probePages(data []byte) error {
+	var err error = unix.Madvise(data, unix.MADV_POPULATE_WRITE)
+	if err != unix.EINVAL {
+		return err
+	}
+
+	return touchPagesSafely(data)
+}
+
+// Writes one byte per page of data like touchPages, returning an error instead of crashing if a write faults
+func touchPagesSafely(data []byte) (err error) {
+	var old bool = debug.SetPanicOnFault(true)
+	defer debug.SetPanicOnFault(old)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: probing pool pages: %v", unix.EFAULT, r)
+		}
+	}()
+
+	touchPages(data)
+	return nil
+}
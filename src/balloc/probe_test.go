@@ -0,0 +1,72 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestProbe(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing init probing leaves a usable pool")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Probe: true}))
+	checkBuddyPoolFull(t, &pool)
+
+	// Every page is already faulted in
+	if resident := residentPages(unsafe.Pointer(pool.base), pool.numBytes); resident >= 0 {
+		assert.Equal(t, int(pool.numBytes)/unix.Getpagesize(), resident)
+	}
+
+	// And the pool works as normal
+	mem, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	unsafe.Slice((*byte)(mem), 1000)[999] = 0xAB
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.NoError(t, buddyVerify(&pool))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestProbeShortFile(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing init probing fails on memory that cannot be backed")
+	f, err := os.CreateTemp(t.TempDir(), "balloc")
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// Pages past the end of the file fault with SIGBUS when written
+	var size uintptr = 1 << MIN_K
+	assert.NoError(t, f.Truncate(int64(size/2)))
+	var pool BuddyPool
+	assert.Error(t, initPool(&pool, int(f.Fd()), size, Options{Probe: true}))
+	assert.Equal(t, uintptr(0), pool.base)
+
+	// The fallback for kernels without MADV_POPULATE_WRITE recovers from the fault too
+	data, err := unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, touchPagesSafely(data), unix.EFAULT)
+	assert.NoError(t, touchPagesSafely(data[:size/2]))
+	assert.NoError(t, unix.Munmap(data))
+}
+
+func TestProbeOvercommit(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing init probing under strict overcommit")
+	mode, err := os.ReadFile("/proc/sys/vm/overcommit_memory")
+	if err != nil || strings.TrimSpace(string(mode)) != "2" {
+		t.Skip("overcommit is not set to strict accounting")
+	}
+
+	// The largest pool either fails to map or fails the probe, init never succeeds with unbackable memory
+	var pool BuddyPool
+	err = buddyInitWithOptions(&pool, 1<<(MAX_K-1), Options{Probe: true})
+	if err == nil {
+		_ = buddyDestroy(&pool)
+		t.Skip("the whole pool could be backed")
+	}
+	assert.Equal(t, uintptr(0), pool.base)
+}
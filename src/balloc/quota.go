@@ -0,0 +1,41 @@
+package balloc
+
+// Adds n usable bytes to the pool's reserved count, unless that would take it
+// above the pool's cap. Returns false without changing anything if it would
+func chargeReserved(pool *BuddyPool, n int64) bool {
+	if pool.maxReserved == 0 {
+		pool.reserved.Add(n)
+		return true
+	}
+
+	// Concurrent mallocs race for the last of the budget, only a successful swap takes it
+	for {
+		var reserved int64 = pool.reserved.Load()
+		if reserved+n > pool.maxReserved {
+			return false
+		}
+		if pool.reserved.CompareAndSwap(reserved, reserved+n) {
+			return true
+		}
+	}
+}
+
+// Adds n allocations to the pool's live count, unless that would take it above
+// the pool's allocation cap. Returns false without changing anything if it would
+func chargeAllocs(pool *BuddyPool, n int64) bool {
+	if pool.maxAllocs == 0 {
+		pool.allocs.Add(n)
+		return true
+	}
+
+	// Same race for the last slots as chargeReserved
+	for {
+		var allocs int64 = pool.allocs.Load()
+		if allocs+n > pool.maxAllocs {
+			return false
+		}
+		if pool.allocs.CompareAndSwap(allocs, allocs+n) {
+			return true
+		}
+	}
+}
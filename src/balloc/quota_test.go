@@ -0,0 +1,173 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestMaxReserved(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the reserved byte cap")
+	var usable uintptr = 1<<10 - BLOCK_HEADER
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{MaxReserved: 4 * usable}))
+
+	// Allocate up to the cap, each request takes a whole 2^10 block
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 4; i++ {
+		ptr, err := buddyMalloc(&pool, 1000)
+		assert.NoError(t, err)
+		ptrs = append(ptrs, ptr)
+	}
+	assert.Equal(t, 4*usable, buddyStats(&pool).ReservedBytes)
+
+	// The pool still has plenty of free blocks but the cap is reached
+	mem, err := buddyMalloc(&pool, 1)
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	batch, err := buddyMallocBatch(&pool, 1, 1)
+	assert.Nil(t, batch)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.Equal(t, 4*usable, buddyStats(&pool).ReservedBytes)
+
+	// Freeing one makes room for allocations up to its size again
+	assert.NoError(t, buddyFree(&pool, ptrs[0]))
+	mem, err = buddyMalloc(&pool, 2000)
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	batch, err = buddyMallocBatch(&pool, 500, 2)
+	assert.NoError(t, err)
+	assert.Len(t, batch, 2)
+	assert.NoError(t, buddyFreeBatch(&pool, batch))
+	ptrs[0], err = buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+
+	assert.NoError(t, buddyFreeBatch(&pool, ptrs))
+	assert.Equal(t, uintptr(0), buddyStats(&pool).ReservedBytes)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestMaxReservedConcurrent(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the reserved byte cap under concurrent mallocs")
+	var usable uintptr = 1<<SMALLEST_K - BLOCK_HEADER
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{MaxReserved: 100 * usable}))
+
+	// Many goroutines race for the budget, exactly 100 blocks fit under it
+	var lock sync.Mutex
+	var ptrs []unsafe.Pointer
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				ptr, err := buddyMalloc(&pool, 1)
+				if err != nil {
+					continue
+				}
+				lock.Lock()
+				ptrs = append(ptrs, ptr)
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, ptrs, 100)
+	assert.Equal(t, int64(100*usable), pool.peak.Load())
+
+	assert.NoError(t, buddyFreeBatch(&pool, ptrs))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestMaxAllocations(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the outstanding allocation cap")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{MaxAllocations: 8}))
+
+	// Tiny allocations up to the cap, nowhere near the byte capacity of the pool
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 8; i++ {
+		ptr, err := buddyMalloc(&pool, 1)
+		assert.NoError(t, err)
+		ptrs = append(ptrs, ptr)
+	}
+	assert.Equal(t, uint(8), buddyStats(&pool).LiveAllocations)
+
+	// The next one fails whatever its size and the counts are left as they were
+	mem, err := buddyMalloc(&pool, 1)
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.False(t, buddyCanAlloc(&pool, 1))
+	batch, err := buddyMallocBatch(&pool, 1, 1)
+	assert.Nil(t, batch)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	assert.Equal(t, uint(8), buddyStats(&pool).LiveAllocations)
+	assert.Equal(t, 8*(uintptr(1)<<SMALLEST_K-BLOCK_HEADER), buddyStats(&pool).ReservedBytes)
+
+	// Freeing one allows exactly one more
+	assert.NoError(t, buddyFree(&pool, ptrs[0]))
+	ptrs[0], err = buddyMalloc(&pool, 1<<12)
+	assert.NoError(t, err)
+	mem, err = buddyMalloc(&pool, 1)
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+
+	// A batch is all or nothing under the cap too
+	assert.NoError(t, buddyFreeBatch(&pool, ptrs[:2]))
+	batch, err = buddyMallocBatch(&pool, 1, 3)
+	assert.Nil(t, batch)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	batch, err = buddyMallocBatch(&pool, 1, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFreeBatch(&pool, batch))
+
+	assert.NoError(t, buddyFreeBatch(&pool, ptrs[2:]))
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestMaxAllocationsConcurrent(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the outstanding allocation cap under concurrent mallocs")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{MaxAllocations: 100, CacheDepth: 4}))
+
+	// Many goroutines race for the cap, exactly 100 allocations fit under it
+	var lock sync.Mutex
+	var ptrs []unsafe.Pointer
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				ptr, err := buddyMalloc(&pool, uint(1+g*100))
+				if err != nil {
+					continue
+				}
+				lock.Lock()
+				ptrs = append(ptrs, ptr)
+				lock.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Len(t, ptrs, 100)
+
+	for _, ptr := range ptrs {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	assert.Zero(t, buddyStats(&pool).LiveAllocations)
+	pool.cache.flush(&pool)
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package balloc
+
+// The race detector turns on checkptr, which rejects uintptr arithmetic landing in the Go heap
+const raceEnabled = true
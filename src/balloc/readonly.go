@@ -0,0 +1,75 @@
+package balloc
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Opens the pool persisted in the file behind fd for inspection only, e.g. by forensic tooling.
+// The blocks found in the file are kept so walks, stats, dumps and verify report its contents,
+// while malloc, free and anything else that would write fails with ErrReadOnly.
+// The file is never modified and fd may be opened O_RDONLY. The pool must have used the default header
+func buddyInitReadOnly(pool *BuddyPool, fd int, size uintptr) error {
+	if fd < 0 {
+		return fmt.Errorf("%w: invalid file descriptor %d", ErrInvalidOptions, fd)
+	}
+
+	// Accept every block size the writer might have been configured with
+	return initPool(pool, fd, size, Options{SmallestK: headerK(), readOnly: true})
+}
+
+// Rebuilds the avail lists of a pool mapped from a file, then drops write access to the mapping.
+// The links stored in the file point into the writer's own mapping so only tags and kvals are
+// trusted. Unmaps data and returns ErrCorruptPool if the headers do not tile the pool
+func openReadOnly(pool *BuddyPool, data []byte) error {
+	var err error = relinkBlocks(pool)
+	if err == nil {
+		err = unix.Mprotect(data, unix.PROT_READ)
+	}
+	if err != nil {
+		_ = unix.Munmap(data)
+		pool.base = 0
+		pool.readOnly = false
+		return err
+	}
+
+	return nil
+}
+
+// Walks the blocks of the pool from base by block size, linking the free ones into the avail lists
+// and counting the reserved ones. Cached blocks belonged to the writer's free cache so they are
+// left out of both
+func relinkBlocks(pool *BuddyPool) error {
+	resetHeads(pool)
+
+	var allocs, reserved int64
+	var offset uintptr
+	for offset < pool.numBytes {
+		var block *Avail = (*Avail)(unsafe.Pointer(pool.base + offset))
+		var k uint = uint(block.kval)
+		if k < pool.smallestK || k > pool.kvalM || offset&((uintptr(1)<<k)-1) != 0 {
+			return fmt.Errorf("%w: block at offset %d has kval %d", ErrCorruptPool, offset, k)
+		}
+
+		switch block.tag {
+		case BLOCK_AVAIL:
+			putBlock(pool, &pool.avail[k], block)
+		case BLOCK_RESERVED:
+			allocs++
+			reserved += int64(blockUsable(pool, block))
+		case BLOCK_CACHED:
+		default:
+			return fmt.Errorf("%w: block at offset %d has tag %d", ErrCorruptPool, offset, block.tag)
+		}
+
+		offset += uintptr(1) << k
+	}
+
+	pool.allocs.Store(allocs)
+	pool.reserved.Store(reserved)
+	raisePeak(pool, reserved)
+
+	return nil
+}
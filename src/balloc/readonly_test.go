@@ -0,0 +1,92 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuddyInitReadOnly(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing a persisted pool reopened read-only for inspection")
+	var path string = t.TempDir() + "/pool"
+	var size uintptr = 1 << MIN_K
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Truncate(int64(size)))
+
+	// Write a few allocations through a file-backed pool, freeing one of them
+	var pool BuddyPool
+	assert.NoError(t, buddyInitFromFd(&pool, int(f.Fd()), size))
+	var want map[uintptr]string = make(map[uintptr]string)
+	var freed unsafe.Pointer
+	for i, s := range []string{"alpha", "bravo", "charlie", "delta"} {
+		mem, err := buddyMalloc(&pool, uint(100*(i+1)))
+		assert.NoError(t, err)
+		copy(unsafe.Slice((*byte)(mem), len(s)), s)
+		if i == 1 {
+			freed = mem
+			continue
+		}
+		want[uintptr(mem)-pool.base] = s
+	}
+	assert.NoError(t, buddyFree(&pool, freed))
+	assert.NoError(t, buddyDestroy(&pool))
+	assert.NoError(t, f.Close())
+	before, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	// Reopen it read-only and walk what the writer left behind
+	f, err = os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, buddyInitReadOnly(&pool, int(f.Fd()), size))
+	var got map[uintptr]string = make(map[uintptr]string)
+	buddyWalk(&pool, func(ptr unsafe.Pointer, usable uint) bool {
+		var s string = want[uintptr(ptr)-pool.base]
+		got[uintptr(ptr)-pool.base] = string(unsafe.Slice((*byte)(ptr), len(s)))
+		return true
+	})
+	assert.Equal(t, want, got)
+	assert.Equal(t, uint(len(want)), buddyStats(&pool).LiveAllocations)
+	assert.NoError(t, buddyVerify(&pool))
+
+	// Anything that would write fails cleanly
+	_, err = buddyMalloc(&pool, 10)
+	assert.ErrorIs(t, err, ErrReadOnly)
+	_, err = buddyCalloc(&pool, 1, 10)
+	assert.ErrorIs(t, err, ErrReadOnly)
+	_, err = buddyMallocBatch(&pool, 10, 2)
+	assert.ErrorIs(t, err, ErrReadOnly)
+	for offset := range want {
+		var ptr unsafe.Pointer = unsafe.Pointer(pool.base + offset)
+		assert.ErrorIs(t, buddyFree(&pool, ptr), ErrReadOnly)
+		_, err = buddyRealloc(&pool, ptr, 1<<12)
+		assert.ErrorIs(t, err, ErrReadOnly)
+	}
+	assert.ErrorIs(t, buddyGrow(&pool, size*2), ErrReadOnly)
+	buddyReset(&pool)
+	assert.Equal(t, uint(len(want)), buddyStats(&pool).LiveAllocations)
+
+	// The file is untouched
+	assert.NoError(t, buddyDestroy(&pool))
+	after, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestBuddyInitReadOnlyCorrupt(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing read-only init rejects files that are not a pool")
+	var pool BuddyPool
+	assert.ErrorIs(t, buddyInitReadOnly(&pool, -1, 1<<MIN_K), ErrInvalidOptions)
+
+	// A file of zeroes has no valid first header
+	f, err := os.CreateTemp(t.TempDir(), "balloc")
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, f.Truncate(1<<MIN_K))
+	assert.ErrorIs(t, buddyInitReadOnly(&pool, int(f.Fd()), 1<<MIN_K), ErrCorruptPool)
+	assert.Equal(t, uintptr(0), pool.base)
+}
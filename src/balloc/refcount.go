@@ -0,0 +1,75 @@
+package balloc
+
+import "unsafe"
+
+// Adds a reference to the live allocation at ptr. Every allocation starts with one
+// reference held by whoever malloc'd it, buddyReleaseRef frees it when the last is dropped.
+// A block with extra references should be released through buddyReleaseRef. Freeing it
+// directly with buddyFree frees it at once and drops the references still held on it
+func buddyRetain(pool *BuddyPool, ptr unsafe.Pointer) error {
+	if pool == nil || ptr == nil {
+		return nil
+	}
+
+	// Only blocks still handed out can gain a reference. Counts are kept on the block's natural
+	// user pointer so an aligned pointer and the block it was carved from share them
+	ptr = unalignPtr(pool, ptr)
+	block, err := validateBlock(pool, ptr)
+	if err != nil {
+		logf(pool, "ERROR: Invalid pointer passed to retain: %v", err)
+		return misuse(pool, err, ptr)
+	}
+	if block.tag == BLOCK_AVAIL || block.tag == BLOCK_CACHED {
+		logf(pool, "ERROR: Retain of a freed block")
+		return misuse(pool, ErrDoubleFree, ptr)
+	}
+
+	// Only counts above the initial reference are stored
+	pool.refLock.Lock()
+	if pool.refs == nil {
+		pool.refs = make(map[uintptr]int32)
+		pool.retained.Store(true)
+	}
+	pool.refs[uintptr(ptr)]++
+	pool.refLock.Unlock()
+
+	return nil
+}
+
+// Drops a reference to the allocation at ptr and frees the block once none are left.
+// The count is checked and decremented under one lock so exactly one caller frees it
+func buddyReleaseRef(pool *BuddyPool, ptr unsafe.Pointer) error {
+	if pool == nil || ptr == nil {
+		return nil
+	}
+
+	// Drop an extra reference if there is one
+	ptr = unalignPtr(pool, ptr)
+	pool.refLock.Lock()
+	var extra int32 = pool.refs[uintptr(ptr)]
+	if extra > 1 {
+		pool.refs[uintptr(ptr)] = extra - 1
+	} else if extra == 1 {
+		delete(pool.refs, uintptr(ptr))
+	}
+	pool.refLock.Unlock()
+	if extra > 0 {
+		return nil
+	}
+
+	// That was the last reference
+	return buddyFree(pool, ptr)
+}
+
+// Returns the number of references held on the allocation at ptr, 0 for nil
+func buddyRefCount(pool *BuddyPool, ptr unsafe.Pointer) uint {
+	if pool == nil || ptr == nil {
+		return 0
+	}
+
+	ptr = unalignPtr(pool, ptr)
+	pool.refLock.Lock()
+	defer pool.refLock.Unlock()
+
+	return uint(pool.refs[uintptr(ptr)]) + 1
+}
@@ -0,0 +1,104 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuddyRefCount(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing shared allocations are freed on the last release")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// Allocations start with the caller's reference
+	mem, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1), buddyRefCount(&pool, mem))
+
+	// Retain twice, then release three times in total
+	assert.NoError(t, buddyRetain(&pool, mem))
+	assert.NoError(t, buddyRetain(&pool, mem))
+	assert.Equal(t, uint(3), buddyRefCount(&pool, mem))
+	assert.NoError(t, buddyReleaseRef(&pool, mem))
+	assert.Equal(t, int64(1), pool.allocs.Load())
+	assert.NoError(t, buddyReleaseRef(&pool, mem))
+	assert.Equal(t, int64(1), pool.allocs.Load())
+	assert.Equal(t, uint(1), buddyRefCount(&pool, mem))
+
+	// Only the final release hands the block back
+	assert.NoError(t, buddyReleaseRef(&pool, mem))
+	assert.Equal(t, int64(0), pool.allocs.Load())
+	checkBuddyPoolFull(t, &pool)
+
+	// A freed block can not be retained or released again
+	assert.ErrorIs(t, buddyRetain(&pool, mem), ErrDoubleFree)
+	assert.ErrorIs(t, buddyReleaseRef(&pool, mem), ErrDoubleFree)
+	var x int
+	assert.ErrorIs(t, buddyRetain(&pool, unsafe.Pointer(&x)), ErrInvalidPointer)
+	assert.NoError(t, buddyRetain(&pool, nil))
+	assert.NoError(t, buddyReleaseRef(&pool, nil))
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyRefCountDirectFree(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing a direct free drops the references held on a block")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// Freeing a retained block skips the remaining releases
+	mem, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyRetain(&pool, mem))
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.Empty(t, pool.refs)
+
+	// The next allocation at the same address starts over with a single reference
+	again, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, mem, again)
+	assert.Equal(t, uint(1), buddyRefCount(&pool, again))
+	assert.NoError(t, buddyReleaseRef(&pool, again))
+	checkBuddyPoolFull(t, &pool)
+
+	// So does a retained block freed in a batch
+	mem, err = buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyRetain(&pool, mem))
+	assert.NoError(t, buddyFreeBatch(&pool, []unsafe.Pointer{mem}))
+	assert.Empty(t, pool.refs)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyRefCountConcurrent(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing references are released concurrently")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// Hand one buffer to many goroutines, each holding its own reference
+	mem, _ := buddyMalloc(&pool, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		assert.NoError(t, buddyRetain(&pool, mem))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, buddyReleaseRef(&pool, mem))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), pool.allocs.Load())
+
+	// The creator's reference is the last one
+	assert.NoError(t, buddyReleaseRef(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
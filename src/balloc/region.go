@@ -0,0 +1,29 @@
+package balloc
+
+import (
+	"fmt"
+	"math/bits"
+	"unsafe"
+)
+
+// Initializes the pool on size bytes of memory at base that the caller owns, e.g. shared memory,
+// a MAP_FIXED mapping or a Go slice, instead of mapping its own. A size that is not a power of
+// two is clamped down to the largest one that fits and the tail is left unused. The memory must
+// stay valid until the pool is destroyed, and destroy never unmaps it. Go heap memory works but
+// trips checkptr, which the race detector turns on, as the pool addresses blocks through uintptrs
+func buddyInitOnRegion(pool *BuddyPool, base unsafe.Pointer, size uintptr) error {
+	if base == nil {
+		return fmt.Errorf("%w: region base is nil", ErrInvalidOptions)
+	}
+	if uintptr(base)%MIN_ALIGN != 0 {
+		return fmt.Errorf("%w: region base %p is not aligned to %d bytes", ErrInvalidOptions, base, MIN_ALIGN)
+	}
+	if size < uintptr(1)<<MIN_K {
+		return fmt.Errorf("%w: %d byte region is below the minimum pool size of 2^%d bytes", ErrSizeOutOfRange, size, MIN_K)
+	}
+
+	// Manage the largest power of two that fits in the region
+	var kval uint = min(uint(bits.Len(uint(size)))-1, MAX_K-1)
+	var region []byte = unsafe.Slice((*byte)(base), uintptr(1)<<kval)
+	return initPool(pool, -1, uintptr(1)<<kval, Options{Strict: true, region: region})
+}
@@ -0,0 +1,86 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestBuddyInitOnRegion(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing pools on caller supplied memory")
+	if raceEnabled {
+		t.Skip("checkptr rejects the pool's address arithmetic on Go heap memory")
+	}
+	var buf []byte = make([]byte, 1<<MIN_K)
+	var pool BuddyPool
+	assert.NoError(t, buddyInitOnRegion(&pool, unsafe.Pointer(&buf[0]), uintptr(len(buf))))
+	assert.Equal(t, uintptr(unsafe.Pointer(&buf[0])), pool.base)
+	assert.Equal(t, MIN_K, pool.kvalM)
+	checkBuddyPoolFull(t, &pool)
+
+	// The pool hands out pieces of the slice and works as normal
+	mem, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, uintptr(mem), pool.base)
+	assert.Less(t, uintptr(mem), pool.base+uintptr(len(buf)))
+	unsafe.Slice((*byte)(mem), 1000)[999] = 0xAB
+	var offset uintptr = uintptr(mem) + 999 - pool.base
+	assert.Equal(t, byte(0xAB), buf[offset])
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.NoError(t, buddyVerify(&pool))
+	checkBuddyPoolFull(t, &pool)
+
+	// Growing would need a mapping the pool does not own
+	assert.ErrorIs(t, buddyGrow(&pool, 1<<(MIN_K+1)), ErrInvalidOptions)
+
+	// Destroy leaves the slice valid and its contents in place
+	mem, err = buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	unsafe.Slice((*byte)(mem), 1000)[999] = 0xCD
+	offset = uintptr(mem) + 999 - pool.base
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.NoError(t, buddyDestroy(&pool))
+	assert.Equal(t, uintptr(0), pool.base)
+	assert.Nil(t, pool.region)
+	assert.Equal(t, byte(0xCD), buf[offset])
+	for i := range buf {
+		buf[i] = 0x11
+	}
+	assert.Equal(t, byte(0x11), buf[len(buf)-1])
+}
+
+func TestBuddyInitOnRegionMapped(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing pools on a caller's own mapping that is not a power of two")
+	var size int = 1<<MIN_K + 3*unix.Getpagesize()
+	data, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	assert.NoError(t, err)
+
+	// Only the largest power of two that fits is managed
+	var pool BuddyPool
+	assert.NoError(t, buddyInitOnRegion(&pool, unsafe.Pointer(&data[0]), uintptr(size)))
+	assert.Equal(t, MIN_K, pool.kvalM)
+	assert.Equal(t, uintptr(1)<<MIN_K, pool.numBytes)
+	mem, err := buddyMalloc(&pool, 1<<MIN_K-uint(BLOCK_HEADER))
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.NoError(t, buddyDestroy(&pool))
+
+	// The mapping is still the caller's to use and unmap
+	data[size-1] = 0xAB
+	assert.NoError(t, unix.Munmap(data))
+}
+
+func TestBuddyInitOnRegionInvalid(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing regions that cannot hold a pool")
+	var buf []byte = make([]byte, 1<<MIN_K+MIN_ALIGN)
+	var pool BuddyPool
+
+	assert.ErrorIs(t, buddyInitOnRegion(&pool, nil, 1<<MIN_K), ErrInvalidOptions)
+	assert.ErrorIs(t, buddyInitOnRegion(&pool, unsafe.Pointer(&buf[1]), 1<<MIN_K), ErrInvalidOptions)
+	assert.ErrorIs(t, buddyInitOnRegion(&pool, unsafe.Pointer(&buf[0]), 1<<MIN_K-1), ErrSizeOutOfRange)
+	assert.Equal(t, uintptr(0), pool.base)
+}
@@ -0,0 +1,92 @@
+package balloc
+
+import (
+	"unsafe"
+)
+
+// Block held for a caller that does not need its memory yet. The block is taken out of the
+// avail lists so nothing else can allocate it, but the pages past its header are handed back
+// to the kernel until Commit faults them in. Not safe for concurrent use
+type Reservation struct {
+	pool *BuddyPool     // the pool the block belongs to
+	ptr  unsafe.Pointer // user pointer of the block, nil once committed or released
+}
+
+// Reserves a block able to hold size bytes without keeping its pages resident.
+// Redzone and poison mode need their fill bytes kept intact so the pages stay resident there
+func buddyReserve(pool *BuddyPool, size uint) (*Reservation, error) {
+	ptr, err := buddyMalloc(pool, max(size, 1))
+	if err != nil {
+		return nil, err
+	}
+	if ptr == nil {
+		return nil, nil
+	}
+
+	// Drop the pages the block may have kept from an earlier use
+	if !pool.redzone && !pool.poison {
+		var block *Avail = ptrToBlock(pool, ptr)
+		err = adviseFree(pool, block)
+		if err != nil {
+			logf(pool, "WARNING: madvise failed reserving block of kval %d: %v", block.kval, err)
+		}
+	}
+
+	return &Reservation{pool: pool, ptr: ptr}, nil
+}
+
+// Faults in the pages of a reservation and hands its block over to the caller, who frees the
+// returned pointer like any other allocation. If the kernel cannot back the pages the error is
+// returned and the reservation is left as it was
+func buddyCommit(r *Reservation) (unsafe.Pointer, error) {
+	if r.ptr == nil {
+		return nil, ErrReservationUsed
+	}
+
+	var pages []byte = blockPages(r.pool, ptrToBlock(r.pool, r.ptr))
+	if len(pages) != 0 {
+		var err error = probePages(pages)
+		if err != nil {
+			logf(r.pool, "ERROR: Reserved block cannot be backed: %v", err)
+			return nil, err
+		}
+	}
+
+	var ptr unsafe.Pointer = r.ptr
+	r.ptr = nil
+	return ptr, nil
+}
+
+// Frees the block of a reservation that was never committed
+func buddyUnreserve(r *Reservation) error {
+	if r.ptr == nil {
+		return ErrReservationUsed
+	}
+
+	var err error = buddyFree(r.pool, r.ptr)
+	if err != nil {
+		return err
+	}
+
+	r.ptr = nil
+	return nil
+}
+
+// Faults in the reserved pages and returns the usable pointer. Free it with the pool's Free
+func (r *Reservation) Commit() (unsafe.Pointer, error) {
+	return buddyCommit(r)
+}
+
+// Gives an uncommitted reservation back to the pool
+func (r *Reservation) Release() error {
+	return buddyUnreserve(r)
+}
+
+// Returns the usable size the committed pointer will have, 0 once committed or released
+func (r *Reservation) Size() uint {
+	if r.ptr == nil {
+		return 0
+	}
+
+	return userSize(r.pool, ptrToBlock(r.pool, r.ptr))
+}
@@ -0,0 +1,86 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestBuddyReserveCommit(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing reservations hold blocks and commit lazily")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// Fault in the pool so the reservations have pages to give back
+	touchPages(unsafe.Slice((*byte)(unsafe.Pointer(pool.base)), pool.numBytes))
+
+	// Each reservation takes its block out of the pool
+	var size uint = 1<<16 - uint(BLOCK_HEADER)
+	var reservations []*Reservation
+	for i := 0; i < 4; i++ {
+		var before uintptr = buddyStats(&pool).FreeBytes
+		r, err := buddyReserve(&pool, size)
+		assert.NoError(t, err)
+		assert.Equal(t, before-1<<16, buddyStats(&pool).FreeBytes)
+		assert.Equal(t, size, r.Size())
+		reservations = append(reservations, r)
+	}
+	assert.Equal(t, uint(4), buddyStats(&pool).LiveAllocations)
+
+	// Only the header page of an uncommitted block is resident
+	var pages []byte = blockPages(&pool, ptrToBlock(&pool, reservations[0].ptr))
+	if resident := residentPages(unsafe.Pointer(&pages[0]), uintptr(len(pages))); resident >= 0 {
+		assert.Equal(t, 0, resident)
+	}
+
+	// Committing faults the pages in and hands the block over
+	mem, err := buddyCommit(reservations[0])
+	assert.NoError(t, err)
+	if resident := residentPages(unsafe.Pointer(&pages[0]), uintptr(len(pages))); resident >= 0 {
+		assert.Equal(t, len(pages)/unix.Getpagesize(), resident)
+	}
+	var region []byte = unsafe.Slice((*byte)(mem), size)
+	region[0], region[size-1] = 0xAB, 0xCD
+	assert.Equal(t, uint(0), reservations[0].Size())
+
+	// A spent reservation cannot be committed or released again
+	_, err = buddyCommit(reservations[0])
+	assert.ErrorIs(t, err, ErrReservationUsed)
+	assert.ErrorIs(t, buddyUnreserve(reservations[0]), ErrReservationUsed)
+
+	// Commit another, then free committed blocks as normal and release the rest
+	mem2, err := buddyCommit(reservations[1])
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+	assert.NoError(t, buddyFree(&pool, mem2))
+	assert.NoError(t, buddyUnreserve(reservations[2]))
+	assert.NoError(t, reservations[3].Release())
+	assert.ErrorIs(t, reservations[3].Release(), ErrReservationUsed)
+
+	checkBuddyPoolFull(t, &pool)
+	assert.NoError(t, buddyVerify(&pool))
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyReserveFull(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing reservations fail once the pool is taken")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// A reservation of the whole pool leaves nothing else to allocate
+	r, err := buddyReserve(&pool, 1<<MIN_K-uint(BLOCK_HEADER))
+	assert.NoError(t, err)
+	_, err = buddyReserve(&pool, 1)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	_, err = buddyMalloc(&pool, 1)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+
+	// Releasing it makes the space available again
+	assert.NoError(t, r.Release())
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,48 @@
+package balloc
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// Scope records every block allocated through it so they can all be freed at once.
+// It is a thin wrapper around a BuddyPool, released blocks go back to the buddy system
+type Scope struct {
+	pool *BuddyPool       // the pool the scope allocates from
+	lock sync.Mutex       // guards ptrs so a scope can be shared between goroutines
+	ptrs []unsafe.Pointer // every live pointer allocated through the scope
+}
+
+// Creates an empty scope allocating from pool
+func newScope(pool *BuddyPool) *Scope {
+	return &Scope{pool: pool}
+}
+
+// Allocates a block of at least size bytes and records it in the scope
+func (s *Scope) Alloc(size uint) (unsafe.Pointer, error) {
+	ptr, err := buddyMalloc(s.pool, size)
+	if err != nil || ptr == nil {
+		return ptr, err
+	}
+
+	s.lock.Lock()
+	s.ptrs = append(s.ptrs, ptr)
+	s.lock.Unlock()
+
+	return ptr, nil
+}
+
+// Frees every block allocated through the scope in one locked pass.
+// The scope is empty afterwards and can be reused
+func (s *Scope) Release() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error = buddyFreeBatch(s.pool, s.ptrs)
+	if err != nil {
+		return err
+	}
+	s.ptrs = nil
+
+	return nil
+}
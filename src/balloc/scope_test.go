@@ -0,0 +1,62 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopeRelease(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing scope release frees every block")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Allocate dozens of mixed size blocks through the scope
+	var scope *Scope = newScope(&pool)
+	for i := 1; i <= 48; i++ {
+		ptr, err := scope.Alloc(uint(i * 37))
+		assert.NoError(t, err)
+		*(*byte)(ptr) = byte(i)
+	}
+	assert.Equal(t, uint(48), buddyStats(&pool).LiveAllocations)
+
+	assert.NoError(t, scope.Release())
+	checkBuddyPoolFull(t, &pool)
+
+	// The scope is reusable after a release
+	_, err := scope.Alloc(100)
+	assert.NoError(t, err)
+	assert.NoError(t, scope.Release())
+	checkBuddyPoolFull(t, &pool)
+
+	// Releasing an empty scope is a no-op
+	assert.NoError(t, scope.Release())
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestScopeOnlyReleasesItsBlocks(t *testing.T) {
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Blocks allocated outside the scope survive its release
+	outside, _ := buddyMalloc(&pool, 64)
+	var scope *Scope = newScope(&pool)
+	for i := 0; i < 24; i++ {
+		_, _ = scope.Alloc(64)
+	}
+	assert.NoError(t, scope.Release())
+	assert.Equal(t, uint(1), buddyStats(&pool).LiveAllocations)
+
+	assert.NoError(t, buddyFree(&pool, outside))
+	checkBuddyPoolFull(t, &pool)
+
+	// A failed allocation is not recorded
+	_, err := scope.Alloc(uint(pool.numBytes))
+	assert.Error(t, err)
+	assert.Empty(t, scope.ptrs)
+
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,25 @@
+package balloc
+
+import "unsafe"
+
+// Overwrites the user region of a block being freed. Poison mode fills it with
+// POISON_BYTE, SecureClear zeroes it. The header is left alone, coalescing needs it
+func scrubBlock(pool *BuddyPool, block *Avail) {
+	if pool.poison {
+		poisonBlock(block)
+	} else if pool.secureClear {
+		clearBlock(pool, block)
+	}
+}
+
+// Zeroes every byte after the reserved header of block
+func clearBlock(pool *BuddyPool, block *Avail) {
+	var ptr unsafe.Pointer = blockToPtr(pool, block)
+	clear(unsafe.Slice((*byte)(ptr), blockUsable(pool, block)))
+}
+
+// Zeroes the next and prev links of a block leaving the avail lists, they are user data from now on
+func clearLinks(block *Avail) {
+	var links unsafe.Pointer = unsafe.Add(unsafe.Pointer(block), BLOCK_HEADER)
+	clear(unsafe.Slice((*byte)(links), AVAIL_HEADER-BLOCK_HEADER))
+}
@@ -0,0 +1,51 @@
+package balloc
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecureClear(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing freed memory is zeroed with SecureClear")
+	var secret []byte = bytes.Repeat([]byte("hunter2!"), 100)
+	for _, opts := range []Options{{SecureClear: true}, {SecureClear: true, CacheDepth: 4}} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+
+		// Write a secret across the whole usable region and free it
+		mem, err := buddyMalloc(&pool, uint(len(secret)))
+		assert.NoError(t, err)
+		usable := buddyUsableSize(&pool, mem)
+		copy(unsafe.Slice((*byte)(mem), usable), secret)
+		assert.NoError(t, buddyFree(&pool, mem))
+
+		// The memory is zeroed right away, apart from the links of the free block
+		assert.Equal(t, make([]byte, usable-uint(AVAIL_HEADER-BLOCK_HEADER)), unsafe.Slice((*byte)(unsafe.Add(mem, AVAIL_HEADER-BLOCK_HEADER)), usable-uint(AVAIL_HEADER-BLOCK_HEADER)))
+
+		// The same block comes back holding zeros rather than the secret
+		reused, err := buddyMalloc(&pool, uint(len(secret)))
+		assert.NoError(t, err)
+		assert.Equal(t, mem, reused)
+		assert.Equal(t, make([]byte, usable), unsafe.Slice((*byte)(reused), usable))
+		assert.NoError(t, buddyFree(&pool, reused))
+
+		// Batch frees scrub too, and merged blocks only hold zeros
+		ptrs, err := buddyMallocBatch(&pool, 40, 8)
+		assert.NoError(t, err)
+		for _, ptr := range ptrs {
+			copy(unsafe.Slice((*byte)(ptr), 40), secret)
+		}
+		assert.NoError(t, buddyFreeBatch(&pool, ptrs))
+		big, err := buddyMalloc(&pool, 1000)
+		assert.NoError(t, err)
+		assert.False(t, bytes.Contains(unsafe.Slice((*byte)(big), 1000), []byte("hunter2")))
+
+		assert.NoError(t, buddyFree(&pool, big))
+		_ = buddyDestroy(&pool)
+	}
+}
@@ -0,0 +1,210 @@
+package balloc
+
+import (
+	"cmp"
+	"math/bits"
+	"slices"
+	"sync"
+	"unsafe"
+)
+
+// SizeClasses serves small requests from size classes spaced four to a doubling, jemalloc style,
+// instead of rounding them up to a power of two. Each class carves whole buddy blocks into
+// equal slots and hands out the tightest fitting one. Requests above SIZE_CLASS_MAX go to the
+// buddy system directly. Safe for concurrent use
+type SizeClasses struct {
+	pool    *BuddyPool    // the pool runs and large requests are allocated from
+	lock    sync.Mutex    // guards runs and partial
+	runs    []*classRun   // every live run sorted by base address so a slot can be traced back to its run
+	partial [][]*classRun // runs of each class with at least one free slot, indexed like sizeClassTable
+}
+
+// One buddy block carved into the slots of a single class
+type classRun struct {
+	base  uintptr // user pointer of the buddy block, the address of slot 0
+	class int     // index of the run's class in sizeClassTable
+	slots uint    // number of slots carved, at most 64
+	used  uint64  // bit i is set while slot i is handed out
+	index int     // position in its class's partial list, -1 while every slot is handed out
+}
+
+// Slot size of every class in ascending order
+var sizeClassTable []uint = buildSizeClasses()
+
+// Generates the class sizes up to SIZE_CLASS_MAX. Up to 32 bytes the classes step by MIN_ALIGN,
+// from there every doubling is split into classes at 1, 1.25, 1.5 and 1.75 times its start
+func buildSizeClasses() []uint {
+	var classes []uint
+	for size := uint(2 * MIN_ALIGN); size <= SIZE_CLASS_MAX; {
+		classes = append(classes, size)
+		size += max(uint(MIN_ALIGN), (uint(1)<<(bits.Len(size)-1))/4)
+	}
+	return classes
+}
+
+// Returns the slot size a request of size bytes is served from, 0 if it bypasses the classes
+func sizeClassOf(size uint) uint {
+	if size == 0 || size > SIZE_CLASS_MAX {
+		return 0
+	}
+	class, _ := slices.BinarySearch(sizeClassTable, size)
+	return sizeClassTable[class]
+}
+
+// Creates a size class front-end allocating from pool
+func newSizeClasses(pool *BuddyPool) *SizeClasses {
+	return &SizeClasses{pool: pool, partial: make([][]*classRun, len(sizeClassTable))}
+}
+
+// Allocates at least size bytes from the smallest class that fits it.
+// Zero and sizes above SIZE_CLASS_MAX are passed to buddyMalloc unchanged
+func (c *SizeClasses) Alloc(size uint) (unsafe.Pointer, error) {
+	if sizeClassOf(size) == 0 {
+		return buddyMalloc(c.pool, size)
+	}
+	class, _ := slices.BinarySearch(sizeClassTable, size)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Carve a new run once every run of the class is full. A pool without room for a
+	// whole run may still fit the request on its own, so hand it a plain block instead
+	if len(c.partial[class]) == 0 {
+		var runBytes uint = sizeClassTable[class] * SIZE_CLASS_SLOTS
+		if !buddyCanAlloc(c.pool, runBytes) {
+			return buddyMalloc(c.pool, size)
+		}
+		var err error = c.newRun(class, runBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Take the lowest free slot of the most recently carved or freed into run
+	var partial []*classRun = c.partial[class]
+	var run *classRun = partial[len(partial)-1]
+	var slot int = bits.TrailingZeros64(^run.used)
+	run.used |= uint64(1) << slot
+	if uint(bits.OnesCount64(run.used)) == run.slots {
+		c.unlinkPartial(run)
+	}
+
+	return unsafe.Pointer(run.base + uintptr(slot)*uintptr(sizeClassTable[class])), nil
+}
+
+// Frees a pointer returned by Alloc. Slots go back to their run, which is returned to the
+// buddy system once its last slot is freed. Anything else is passed to buddyFree
+func (c *SizeClasses) Free(ptr unsafe.Pointer) error {
+	if ptr == nil {
+		return nil
+	}
+
+	c.lock.Lock()
+	var run *classRun = c.runOf(ptr)
+	if run == nil {
+		c.lock.Unlock()
+		return buddyFree(c.pool, ptr)
+	}
+	defer c.lock.Unlock()
+
+	// The pointer must start a slot that is handed out
+	var size uintptr = uintptr(sizeClassTable[run.class])
+	var offset uintptr = uintptr(ptr) - run.base
+	if offset%size != 0 {
+		logf(c.pool, "ERROR: Invalid pointer passed to size class free")
+		return misuse(c.pool, ErrInvalidPointer, ptr)
+	}
+	var bit uint64 = uint64(1) << (offset / size)
+	if run.used&bit == 0 {
+		logf(c.pool, "ERROR: Double free of size class slot")
+		return misuse(c.pool, ErrDoubleFree, ptr)
+	}
+
+	// A full run has room again. An empty one goes back to the buddy system
+	if run.index < 0 {
+		c.partial[run.class] = append(c.partial[run.class], run)
+		run.index = len(c.partial[run.class]) - 1
+	}
+	run.used &^= bit
+	if run.used != 0 {
+		return nil
+	}
+	c.unlinkPartial(run)
+	var i int = slices.Index(c.runs, run)
+	c.runs = slices.Delete(c.runs, i, i+1)
+
+	return buddyFree(c.pool, unsafe.Pointer(run.base))
+}
+
+// Returns the number of bytes usable at ptr, the slot size for pointers from a class
+func (c *SizeClasses) UsableSize(ptr unsafe.Pointer) uint {
+	if ptr == nil {
+		return 0
+	}
+
+	c.lock.Lock()
+	var run *classRun = c.runOf(ptr)
+	c.lock.Unlock()
+	if run == nil {
+		return buddyUsableSize(c.pool, ptr)
+	}
+
+	return sizeClassTable[run.class]
+}
+
+// Allocates a buddy block of at least runBytes and links it in as a run of class.
+// The caller must hold the lock
+func (c *SizeClasses) newRun(class int, runBytes uint) error {
+	ptr, err := buddyMalloc(c.pool, runBytes)
+	if err != nil {
+		return err
+	}
+
+	// Slots past the 64 the bitmap can track are left unused
+	var run *classRun = &classRun{base: uintptr(ptr), class: class}
+	run.slots = min(userSize(c.pool, ptrToBlock(c.pool, ptr))/sizeClassTable[class], 64)
+
+	// Keep runs sorted so runOf can binary search them
+	i, _ := slices.BinarySearchFunc(c.runs, run.base, func(r *classRun, base uintptr) int {
+		return cmp.Compare(r.base, base)
+	})
+	c.runs = slices.Insert(c.runs, i, run)
+	c.partial[class] = append(c.partial[class], run)
+	run.index = len(c.partial[class]) - 1
+
+	return nil
+}
+
+// Removes run from its class's partial list by moving the last entry into its place.
+// Does nothing for a full run. The caller must hold the lock
+func (c *SizeClasses) unlinkPartial(run *classRun) {
+	if run.index < 0 {
+		return
+	}
+
+	var partial []*classRun = c.partial[run.class]
+	var last *classRun = partial[len(partial)-1]
+	partial[run.index] = last
+	last.index = run.index
+	c.partial[run.class] = partial[:len(partial)-1]
+	run.index = -1
+}
+
+// Returns the run whose slots contain ptr, or nil if ptr is not inside any run.
+// The caller must hold the lock
+func (c *SizeClasses) runOf(ptr unsafe.Pointer) *classRun {
+	var addr uintptr = uintptr(ptr)
+
+	// Find the last run starting at or below addr, only that one can contain it
+	i, found := slices.BinarySearchFunc(c.runs, addr, func(r *classRun, addr uintptr) int {
+		return cmp.Compare(r.base, addr)
+	})
+	if !found {
+		i--
+	}
+	if i < 0 || addr >= c.runs[i].base+uintptr(c.runs[i].slots)*uintptr(sizeClassTable[c.runs[i].class]) {
+		return nil
+	}
+
+	return c.runs[i]
+}
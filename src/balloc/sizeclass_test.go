@@ -0,0 +1,190 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizeClassTable(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the size class table spacing")
+	assert.Equal(t, []uint{16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128}, sizeClassTable[:11])
+	assert.Equal(t, SIZE_CLASS_MAX, sizeClassTable[len(sizeClassTable)-1])
+	for i := 1; i < len(sizeClassTable); i++ {
+		assert.Zero(t, sizeClassTable[i]%uint(MIN_ALIGN))
+		assert.LessOrEqual(t, float64(sizeClassTable[i]), 1.5*float64(sizeClassTable[i-1]))
+	}
+
+	// Requests round up to the next class and large ones bypass the table
+	assert.Equal(t, uint(16), sizeClassOf(1))
+	assert.Equal(t, uint(640), sizeClassOf(513))
+	assert.Equal(t, uint(512), sizeClassOf(512))
+	assert.Equal(t, uint(0), sizeClassOf(0))
+	assert.Equal(t, uint(0), sizeClassOf(SIZE_CLASS_MAX+1))
+}
+
+func TestSizeClassesFootprint(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing size classes use less memory than pure buddy blocks")
+	const count int = 1000
+	var used [2]uintptr
+	for i, classes := range []bool{false, true} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInit(&pool, 1<<(MIN_K+1)))
+		var c *SizeClasses = newSizeClasses(&pool)
+
+		// Fill every object with its own byte so overlapping slots would show
+		var ptrs []unsafe.Pointer
+		for j := 0; j < count; j++ {
+			var ptr unsafe.Pointer
+			var err error
+			if classes {
+				ptr, err = c.Alloc(513)
+			} else {
+				ptr, err = buddyMalloc(&pool, 513)
+			}
+			assert.NoError(t, err)
+			fillBytes(ptr, 513, byte(j))
+			ptrs = append(ptrs, ptr)
+		}
+		for j, ptr := range ptrs {
+			assert.True(t, checkBytes(ptr, 513, byte(j)), "object %d was overwritten", j)
+		}
+		var stats Stats = buddyStats(&pool)
+		used[i] = stats.TotalBytes - stats.FreeBytes
+
+		// Every slot frees cleanly and the empty runs merge back into the whole pool
+		for _, ptr := range ptrs {
+			if classes {
+				assert.NoError(t, c.Free(ptr))
+			} else {
+				assert.NoError(t, buddyFree(&pool, ptr))
+			}
+		}
+		assert.Empty(t, c.runs)
+		assert.Equal(t, 1, availCount(&pool, pool.kvalM))
+		assert.NoError(t, buddyVerify(&pool))
+		_ = buddyDestroy(&pool)
+	}
+
+	// 513 bytes take a 1024 byte block on their own but a 640 byte slot in a class
+	assert.Equal(t, uintptr(count)*1024, used[0])
+	assert.Less(t, used[1], used[0]*3/4)
+}
+
+func TestSizeClassesFree(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing size class frees are checked")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	var c *SizeClasses = newSizeClasses(&pool)
+
+	a, err := c.Alloc(100)
+	assert.NoError(t, err)
+	b, err := c.Alloc(100)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(112), c.UsableSize(a))
+	assert.Equal(t, uintptr(112), uintptr(b)-uintptr(a))
+
+	// Interior pointers and double frees of a slot are rejected
+	assert.ErrorIs(t, c.Free(unsafe.Add(a, 8)), ErrInvalidPointer)
+	assert.NoError(t, c.Free(a))
+	assert.ErrorIs(t, c.Free(a), ErrDoubleFree)
+
+	// The freed slot is handed out again
+	again, err := c.Alloc(97)
+	assert.NoError(t, err)
+	assert.Equal(t, a, again)
+
+	// Large requests are plain buddy blocks
+	big, err := c.Alloc(SIZE_CLASS_MAX + 1)
+	assert.NoError(t, err)
+	assert.Equal(t, buddyUsableSize(&pool, big), c.UsableSize(big))
+	assert.NoError(t, c.Free(big))
+	assert.ErrorIs(t, c.Free(big), ErrDoubleFree)
+
+	assert.NoError(t, c.Free(again))
+	assert.NoError(t, c.Free(b))
+	assert.NoError(t, c.Free(nil))
+	assert.Empty(t, c.runs)
+	assert.Equal(t, 1, availCount(&pool, pool.kvalM))
+	_ = buddyDestroy(&pool)
+}
+
+func TestSizeClassesFallback(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing size classes fall back to a plain block without room for a run")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	var c *SizeClasses = newSizeClasses(&pool)
+
+	// Leave a single 8 KiB block free, too small for a run of the 4096 byte class
+	var ptrs []unsafe.Pointer
+	for {
+		ptr, err := buddyMalloc(&pool, 1<<12)
+		if err != nil {
+			break
+		}
+		ptrs = append(ptrs, ptr)
+	}
+	assert.NoError(t, buddyFree(&pool, ptrs[len(ptrs)-1]))
+	ptrs = ptrs[:len(ptrs)-1]
+	ptr, err := c.Alloc(3000)
+	assert.NoError(t, err)
+	assert.Empty(t, c.runs)
+	assert.NoError(t, c.Free(ptr))
+
+	for _, ptr := range ptrs {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	_ = buddyDestroy(&pool)
+}
+
+func TestSizeClassesConcurrent(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing size classes under concurrent use")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<(MIN_K+2)))
+	var c *SizeClasses = newSizeClasses(&pool)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				var size uint = uint(1 + (g*131+i*37)%2000)
+				ptr, err := c.Alloc(size)
+				if !assert.NoError(t, err) {
+					return
+				}
+				fillBytes(ptr, size, byte(g))
+				assert.True(t, checkBytes(ptr, size, byte(g)))
+				assert.NoError(t, c.Free(ptr))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	assert.Empty(t, c.runs)
+	assert.NoError(t, buddyVerify(&pool))
+	_ = buddyDestroy(&pool)
+}
+
+// Writes b over the first size bytes at ptr
+func fillBytes(ptr unsafe.Pointer, size uint, b byte) {
+	var buf []byte = unsafe.Slice((*byte)(ptr), size)
+	for i := range buf {
+		buf[i] = b
+	}
+}
+
+// Reports whether the first size bytes at ptr all hold b
+func checkBytes(ptr unsafe.Pointer, size uint, b byte) bool {
+	for _, got := range unsafe.Slice((*byte)(ptr), size) {
+		if got != b {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package balloc
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Slab hands out fixed size slots carved from a buddy pool once at creation.
+// Slots stay reserved in the buddy system for the slab's whole life, so alloc and
+// free never split or coalesce, they only pop and push a free list of slot headers
+type Slab struct {
+	pool  BuddyPool  // the pool the slots were carved from
+	k     uint       // k of every slot
+	count int        // number of slots carved
+	lock  sync.Mutex // guards free and avail
+	free  *Avail     // header of the first free slot, linked through next. nil when every slot is handed out
+	avail int        // number of slots in free
+}
+
+// Creates a slab of count slots, each able to hold objectSize bytes.
+// Slots are 2^k bytes for the smallest k fitting objectSize plus the header
+func NewSlab(objectSize uint, count int) (*Slab, error) {
+	if objectSize == 0 || count <= 0 {
+		return nil, fmt.Errorf("%w: slab needs a positive object size and count, got %d and %d", ErrInvalidOptions, objectSize, count)
+	}
+
+	// Work out the slot size and make sure count of them fit the largest pool
+	if uintptr(objectSize) > ^uintptr(0)-BLOCK_HEADER {
+		return nil, fmt.Errorf("%w: %d byte slab objects are too large", ErrSizeOutOfRange, objectSize)
+	}
+	var k uint = btokMin(uintptr(objectSize)+BLOCK_HEADER, headerK())
+	if k > MAX_K-1 || uintptr(count) > (uintptr(1)<<(MAX_K-1))>>k {
+		return nil, fmt.Errorf("%w: %d slots of 2^%d bytes are above the maximum pool size of 2^%d bytes", ErrSizeOutOfRange, count, k, MAX_K-1)
+	}
+
+	// Map the pool without splitting anything below the slot size
+	var s *Slab = &Slab{k: k, count: count}
+	var err error = buddyInitWithOptions(&s.pool, uintptr(count)<<k, Options{SmallestK: k})
+	if err != nil {
+		return nil, err
+	}
+
+	// Carve every slot up front and push it onto the free list
+	for i := 0; i < count; i++ {
+		ptr, err := buddyMalloc(&s.pool, uint((uintptr(1)<<k)-BLOCK_HEADER))
+		if err != nil {
+			_ = buddyDestroy(&s.pool)
+			return nil, err
+		}
+		s.push(ptrToBlock(&s.pool, ptr))
+	}
+
+	return s, nil
+}
+
+// Links a slot into the free list. The caller must hold the lock or own the slab exclusively.
+// The header is resealed so a pool in checksum mode still trusts it
+func (s *Slab) push(block *Avail) {
+	block.tag = BLOCK_CACHED
+	sealHeader(&s.pool, block)
+	block.next = s.free
+	s.free = block
+	s.avail++
+}
+
+// Hands out a free slot. Returns unix.ENOMEM once every slot is in use
+func (s *Slab) Alloc() (unsafe.Pointer, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.free == nil {
+		return nil, &BallocError{Err: unix.ENOMEM, RequestedSize: s.SlotSize(), RequiredK: s.k}
+	}
+
+	// Pop the first free slot, its next link becomes user data again
+	var block *Avail = s.free
+	s.free = block.next
+	s.avail--
+	block.tag = BLOCK_RESERVED
+	sealHeader(&s.pool, block)
+	block.next = nil
+
+	return blockToPtr(&s.pool, block), nil
+}
+
+// Returns a slot to the free list.
+// Returns ErrInvalidPointer for pointers that are not a slot of this slab and ErrDoubleFree for free slots
+func (s *Slab) Free(ptr unsafe.Pointer) error {
+	if ptr == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Slots are all the same size so anything else did not come from Alloc
+	block, err := validateBlock(&s.pool, ptr)
+	if err != nil || uint(block.kval) != s.k {
+		logf(&s.pool, "ERROR: Invalid pointer passed to slab free")
+		return ErrInvalidPointer
+	}
+	if block.tag == BLOCK_CACHED {
+		logf(&s.pool, "ERROR: Double free of slab slot")
+		return ErrDoubleFree
+	}
+
+	s.push(block)
+	return nil
+}
+
+// Returns the number of bytes usable in every slot
+func (s *Slab) SlotSize() uint {
+	return uint((uintptr(1) << s.k) - BLOCK_HEADER)
+}
+
+// Returns the number of slots the slab was created with
+func (s *Slab) Len() int {
+	return s.count
+}
+
+// Returns the number of slots currently free
+func (s *Slab) Available() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.avail
+}
+
+// Unmaps the slab. Every slot is invalid afterwards
+func (s *Slab) Destroy() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.free = nil
+	s.avail = 0
+	return buddyDestroy(&s.pool)
+}
@@ -0,0 +1,82 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSlab(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing slab allocation of fixed size slots")
+	s, err := NewSlab(100, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(128)-uint(BLOCK_HEADER), s.SlotSize())
+	assert.Equal(t, 10, s.Len())
+	assert.Equal(t, 10, s.Available())
+
+	// Every slot can be handed out and written in full
+	var slots []unsafe.Pointer
+	for i := 0; i < 10; i++ {
+		ptr, err := s.Alloc()
+		assert.NoError(t, err)
+		assert.NotNil(t, ptr)
+		region := unsafe.Slice((*byte)(ptr), s.SlotSize())
+		for j := range region {
+			region[j] = byte(i)
+		}
+		slots = append(slots, ptr)
+	}
+	assert.Equal(t, 0, s.Available())
+
+	// The next alloc fails even though the underlying pool has room left
+	mem, err := s.Alloc()
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+
+	// Freeing one makes exactly that one slot available again
+	assert.NoError(t, s.Free(slots[3]))
+	assert.Equal(t, 1, s.Available())
+	mem, err = s.Alloc()
+	assert.NoError(t, err)
+	assert.Equal(t, slots[3], mem)
+	mem, err = s.Alloc()
+	assert.Nil(t, mem)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+
+	// The other slots were not touched
+	for i, ptr := range slots {
+		if i != 3 {
+			assert.Equal(t, byte(i), unsafe.Slice((*byte)(ptr), s.SlotSize())[s.SlotSize()-1])
+		}
+	}
+
+	// Bad frees are rejected
+	assert.NoError(t, s.Free(slots[0]))
+	assert.ErrorIs(t, s.Free(slots[0]), ErrDoubleFree)
+	assert.ErrorIs(t, s.Free(unsafe.Add(slots[1], 8)), ErrInvalidPointer)
+	var x int
+	assert.ErrorIs(t, s.Free(unsafe.Pointer(&x)), ErrInvalidPointer)
+	assert.NoError(t, s.Free(nil))
+
+	for _, ptr := range slots[1:] {
+		assert.NoError(t, s.Free(ptr))
+	}
+	assert.Equal(t, 10, s.Available())
+	assert.NoError(t, s.Destroy())
+}
+
+func TestNewSlabInvalid(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing slab creation limits")
+	_, err := NewSlab(0, 10)
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+	_, err = NewSlab(64, 0)
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+	_, err = NewSlab(^uint(0), 1)
+	assert.ErrorIs(t, err, ErrSizeOutOfRange)
+	_, err = NewSlab(1<<(MAX_K-2), 4)
+	assert.ErrorIs(t, err, ErrSizeOutOfRange)
+}
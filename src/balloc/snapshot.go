@@ -0,0 +1,226 @@
+package balloc
+
+import (
+	"fmt"
+	"sort"
+	"unsafe"
+)
+
+// Layout of every block in a pool at one point in time.
+// Blocks are stored as offsets from the pool base so a snapshot stays valid if the mapping moves
+type PoolSnapshot struct {
+	NumBytes uintptr          // size of the pool the snapshot was taken from
+	Free     [MAX_K][]uintptr // offsets of the free blocks of each k in avail list order
+	Reserved [MAX_K][]uintptr // offsets of the blocks of each k handed out to the user
+
+	Prewarmed   bool    // the pair of free buddies prewarming left unmerged was still untouched
+	PrewarmPair uintptr // offset of the lower half of that pair, only meaningful when Prewarmed is set
+}
+
+// Captures the block layout of the pool. Cached blocks are flushed first so they are recorded as free
+func buddySnapshot(pool *BuddyPool) PoolSnapshot {
+	if pool.cache != nil {
+		pool.cache.flush(pool)
+	}
+
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	var snap PoolSnapshot = PoolSnapshot{NumBytes: pool.numBytes}
+	if pool.base == 0 {
+		return snap
+	}
+	var pair uintptr = pool.prewarmPair.Load()
+	if pair != 0 {
+		snap.Prewarmed = true
+		snap.PrewarmPair = pair - pool.base
+	}
+
+	// Record the free lists in order so a restore links them back the same way
+	for k := uint(0); k <= pool.kvalM; k++ {
+		var head *Avail = &pool.avail[k]
+		for block := head.next; block != head; block = block.next {
+			snap.Free[k] = append(snap.Free[k], uintptr(unsafe.Pointer(block))-pool.base)
+		}
+	}
+
+	// Walk the pool block by block from base to find the reserved ones
+	var offset uintptr
+	for offset < pool.numBytes {
+		var block *Avail = (*Avail)(unsafe.Pointer(pool.base + offset))
+		if block.tag == BLOCK_RESERVED {
+			snap.Reserved[block.kval] = append(snap.Reserved[block.kval], offset)
+		}
+		offset += uintptr(1) << block.kval
+	}
+
+	return snap
+}
+
+// Rebuilds the pool so its blocks match snap, rewriting every block header.
+// Blocks free in snap must not be used through old pointers afterwards and blocks reserved in
+// snap are live again. Returns ErrInvalidSnapshot if snap was taken from a pool of a different
+// size or its blocks do not exactly tile the pool
+func buddyRestore(pool *BuddyPool, snap PoolSnapshot) error {
+	if pool.cache != nil {
+		pool.cache.flush(pool)
+	}
+
+	lockAll(pool)
+	defer unlockAll(pool)
+
+	if pool.base == 0 || snap.NumBytes != pool.numBytes {
+		logf(pool, "ERROR: Snapshot does not match the pool size")
+		return fmt.Errorf("%w: snapshot of %d bytes, pool has %d", ErrInvalidSnapshot, snap.NumBytes, pool.numBytes)
+	}
+	if pool.readOnly {
+		return ErrReadOnly
+	}
+
+	var err error = checkSnapshot(pool, snap)
+	if err != nil {
+		logf(pool, "ERROR: Snapshot blocks do not tile the pool")
+		return err
+	}
+
+	// Relink the free lists in their recorded order
+	for i := range pool.avail {
+		pool.avail[i].next = &pool.avail[i]
+		pool.avail[i].prev = &pool.avail[i]
+	}
+	for k := uint(0); k <= pool.kvalM; k++ {
+		for _, offset := range snap.Free[k] {
+			var block *Avail = (*Avail)(unsafe.Pointer(pool.base + offset))
+			block.tag = BLOCK_AVAIL
+			block.kval = uint16(k)
+			block.size = 0
+			sealHeader(pool, block)
+			var head *Avail = &pool.avail[k]
+			block.next = head
+			block.prev = head.prev
+			head.prev.next = block
+			head.prev = block
+			if pool.poison {
+				poisonBlock(block)
+			}
+		}
+	}
+
+	// Mark the reserved blocks handed out again. Their requested size is lost so redzones are unguarded
+	var live map[uintptr]bool = make(map[uintptr]bool)
+	var allocs, reserved int64
+	for k := uint(0); k <= pool.kvalM; k++ {
+		for _, offset := range snap.Reserved[k] {
+			var block *Avail = (*Avail)(unsafe.Pointer(pool.base + offset))
+			block.tag = BLOCK_RESERVED
+			block.kval = uint16(k)
+			block.size = 0
+			sealHeader(pool, block)
+			live[uintptr(blockToPtr(pool, block))] = true
+			allocs++
+			reserved += int64(blockUsable(pool, block))
+		}
+	}
+	pool.allocs.Store(allocs)
+	pool.reserved.Store(reserved)
+	pool.prewarmPair.Store(0)
+	if snap.Prewarmed && pool.prewarmK != 0 {
+		pool.prewarmPair.Store(pool.base + snap.PrewarmPair)
+	}
+	if pool.holdSplits != 0 {
+		pool.held.Store(countHeld(pool))
+	}
+	raisePeak(pool, reserved)
+
+	// Drop the leak sites of allocations the restore freed
+	if pool.sites != nil {
+		pool.siteLock.Lock()
+		for ptr := range pool.sites {
+			if !live[ptr] {
+				delete(pool.sites, ptr)
+			}
+		}
+		pool.siteLock.Unlock()
+	}
+
+	// Drop the owners of allocations the restore freed and recount the rest from their restored headers
+	pool.ownerLock.Lock()
+	clear(pool.usage)
+	for ptr, owner := range pool.owners {
+		if !live[ptr] {
+			delete(pool.owners, ptr)
+			continue
+		}
+		pool.usage[owner] += blockUsable(pool, ptrToBlock(pool, unsafe.Pointer(ptr)))
+	}
+	pool.ownerLock.Unlock()
+
+	// Drop the references of allocations the restore freed
+	pool.refLock.Lock()
+	for ptr := range pool.refs {
+		if !live[ptr] {
+			delete(pool.refs, ptr)
+		}
+	}
+	pool.refLock.Unlock()
+
+	return nil
+}
+
+// Checks every block in snap is a valid size and alignment for the pool,
+// that together they cover the pool exactly once and no free buddies are left un-coalesced
+func checkSnapshot(pool *BuddyPool, snap PoolSnapshot) error {
+	type span struct {
+		offset uintptr
+		k      uint
+	}
+
+	var spans []span
+	var free map[span]bool = make(map[span]bool)
+	for k := uint(0); k < MAX_K; k++ {
+		var count int = len(snap.Free[k]) + len(snap.Reserved[k])
+		if count == 0 {
+			continue
+		}
+		if k < pool.smallestK || k > pool.kvalM {
+			return fmt.Errorf("%w: blocks of kval %d outside [%d, %d]", ErrInvalidSnapshot, k, pool.smallestK, pool.kvalM)
+		}
+		for _, offset := range snap.Free[k] {
+			spans = append(spans, span{offset, k})
+			free[span{offset, k}] = true
+		}
+		for _, offset := range snap.Reserved[k] {
+			spans = append(spans, span{offset, k})
+		}
+	}
+
+	// Sorted by offset each block must start where the last one ended
+	sort.Slice(spans, func(i, j int) bool { return spans[i].offset < spans[j].offset })
+	var next uintptr
+	for _, s := range spans {
+		if s.offset != next {
+			return fmt.Errorf("%w: block at offset %#x, expected one at %#x", ErrInvalidSnapshot, s.offset, next)
+		}
+		if s.offset&((uintptr(1)<<s.k)-1) != 0 {
+			return fmt.Errorf("%w: block at offset %#x is not aligned to its size 2^%d", ErrInvalidSnapshot, s.offset, s.k)
+		}
+		next += uintptr(1) << s.k
+	}
+	if next != pool.numBytes {
+		return fmt.Errorf("%w: blocks cover %d bytes, pool has %d", ErrInvalidSnapshot, next, pool.numBytes)
+	}
+
+	// Coalescing relies on free buddies never sitting side by side, unless merging is deferred or held back
+	if pool.deferCoalesce || pool.holdSplits != 0 {
+		return nil
+	}
+	// The one exception is a prewarmed pair that was still untouched when the snapshot was taken
+	for s := range free {
+		var prewarmed bool = snap.Prewarmed && s.k == pool.prewarmK && s.offset&^(uintptr(1)<<s.k) == snap.PrewarmPair
+		if s.k < pool.kvalM && !prewarmed && free[span{s.offset ^ (uintptr(1) << s.k), s.k}] {
+			return fmt.Errorf("%w: free buddies at offset %#x were not coalesced", ErrInvalidSnapshot, s.offset)
+		}
+	}
+
+	return nil
+}
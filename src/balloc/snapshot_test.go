@@ -0,0 +1,100 @@
+package balloc
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuddySnapshotRestore(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing snapshot and restore round trip")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Known good state with a few live blocks
+	var kept []unsafe.Pointer
+	for _, size := range []uint{10, 500, 3000, 70} {
+		ptr, _ := buddyMalloc(&pool, size)
+		kept = append(kept, ptr)
+	}
+	_ = buddyFree(&pool, kept[1])
+	kept = append(kept[:1], kept[2:]...)
+	var snap PoolSnapshot = buddySnapshot(&pool)
+	assert.Equal(t, pool.numBytes, snap.NumBytes)
+
+	// Churn the pool, leaving some of the random blocks live and freeing one of the kept ones
+	var rng *rand.Rand = rand.New(rand.NewSource(35))
+	var live []unsafe.Pointer
+	for i := 0; i < 500; i++ {
+		if len(live) > 0 && rng.Intn(2) == 0 {
+			var j int = rng.Intn(len(live))
+			assert.NoError(t, buddyFree(&pool, live[j]))
+			live = append(live[:j], live[j+1:]...)
+		} else if ptr, err := buddyMalloc(&pool, uint(rng.Intn(4000)+1)); err == nil {
+			live = append(live, ptr)
+		}
+	}
+	assert.NoError(t, buddyFree(&pool, kept[0]))
+
+	// Restoring brings back the exact layout, the kept blocks are live again
+	assert.NoError(t, buddyRestore(&pool, snap))
+	assert.NoError(t, buddyVerify(&pool))
+	assert.Equal(t, snap, buddySnapshot(&pool))
+	assert.Equal(t, uint(len(kept)), buddyStats(&pool).LiveAllocations)
+
+	for _, ptr := range kept {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyRestoreInvalid(t *testing.T) {
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+	var other BuddyPool
+	_ = buddyInit(&other, 1<<(MIN_K+1))
+
+	// A snapshot of a different sized pool is rejected
+	assert.ErrorIs(t, buddyRestore(&pool, buddySnapshot(&other)), ErrInvalidSnapshot)
+
+	// Blocks must tile the pool exactly
+	var snap PoolSnapshot = buddySnapshot(&pool)
+	snap.Free[MIN_K-1] = []uintptr{0}
+	snap.Free[MIN_K] = nil
+	assert.ErrorIs(t, buddyRestore(&pool, snap), ErrInvalidSnapshot)
+	snap.Free[MIN_K-1] = []uintptr{0, 0}
+	assert.ErrorIs(t, buddyRestore(&pool, snap), ErrInvalidSnapshot)
+
+	// Free buddies must be coalesced
+	snap.Free[MIN_K-1] = []uintptr{0, 1 << (MIN_K - 1)}
+	assert.ErrorIs(t, buddyRestore(&pool, snap), ErrInvalidSnapshot)
+
+	// A hand built layout restores
+	snap.Free[MIN_K-1] = nil
+	snap.Free[MIN_K-2] = []uintptr{1 << (MIN_K - 2)}
+	snap.Reserved[MIN_K-2] = []uintptr{0}
+	snap.Reserved[MIN_K-1] = []uintptr{1 << (MIN_K - 1)}
+	assert.NoError(t, buddyRestore(&pool, snap))
+	assert.NoError(t, buddyVerify(&pool))
+	assert.Equal(t, uint(2), buddyStats(&pool).LiveAllocations)
+
+	// Blocks must be aligned to their size
+	var good PoolSnapshot = snap
+	snap.Reserved[MIN_K-2] = nil
+	snap.Free[MIN_K-2] = []uintptr{0, 3 << (MIN_K - 2)}
+	snap.Reserved[MIN_K-1] = []uintptr{1 << (MIN_K - 2)}
+	assert.ErrorIs(t, buddyRestore(&pool, snap), ErrInvalidSnapshot)
+
+	// A failed restore leaves the pool untouched
+	assert.NoError(t, buddyVerify(&pool))
+	assert.Equal(t, good, buddySnapshot(&pool))
+
+	_ = buddyDestroy(&pool)
+	_ = buddyDestroy(&other)
+}
@@ -0,0 +1,237 @@
+package balloc
+
+// Snapshot of how the memory in a pool is currently used.
+// FreeBytes + CachedBytes + ReservedBytes + OverheadBytes always equals TotalBytes
+type Stats struct {
+	TotalBytes       uintptr // total number of bytes the pool manages
+	ReservedBytes    uintptr // usable bytes of blocks handed out to the user, excluding headers
+	FreeBytes        uintptr // bytes sitting in the avail lists
+	CachedBytes      uintptr // bytes of blocks freed by the user but parked in the free cache, headers included
+	OverheadBytes    uintptr // bytes taken by the header in front of each live allocation
+	LiveAllocations  uint    // number of blocks currently handed out to the user
+	LargestFreeBlock uintptr // size of the largest block that can be handed out, 0 if none
+}
+
+// Computes the stats of the pool by walking the avail lists
+func buddyStats(pool *BuddyPool) Stats {
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	return poolStats(pool)
+}
+
+// Computes the stats of buddyStats. The caller must hold every class lock, read locks are enough
+func poolStats(pool *BuddyPool) Stats {
+	var stats Stats = Stats{
+		TotalBytes:      pool.numBytes,
+		LiveAllocations: uint(pool.allocs.Load()),
+	}
+
+	// A destroyed or uninitialized pool has nothing to walk
+	if pool.base == 0 {
+		return stats
+	}
+
+	// Sum every free block in every avail[k] list and track the highest non-empty k
+	for k := uint(0); k <= pool.kvalM; k++ {
+		var head *Avail = &pool.avail[k]
+		for block := head.next; block != head; block = block.next {
+			stats.FreeBytes += uintptr(1) << k
+		}
+		if head.next != head {
+			stats.LargestFreeBlock = uintptr(1) << k
+		}
+	}
+
+	// Cached blocks are free to the user even though the buddy system still sees them as taken
+	if pool.cache != nil {
+		stats.CachedBytes = pool.cache.bytes()
+	}
+
+	// Everything else is reserved, split between headers and the user region. A malloc counts
+	// itself live before it takes its block off the lists, so the headers are capped at what is
+	// left rather than letting the reserved bytes wrap around
+	var remaining uintptr = pool.numBytes - stats.FreeBytes - stats.CachedBytes
+	stats.OverheadBytes = min(uintptr(pool.allocs.Load())*pool.header, remaining)
+	stats.ReservedBytes = remaining - stats.OverheadBytes
+
+	return stats
+}
+
+// Computes the external fragmentation of the pool as
+// 1 - (largestFreeBlock / totalFreeBytes). This is 0.0 when all free memory
+// is one block and approaches 1.0 as free memory is scattered across many
+// small blocks. Returns 0.0 if there is no free memory
+func buddyFragmentation(pool *BuddyPool) float64 {
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	return fragmentation(pool)
+}
+
+// Computes the stats and the fragmentation ratio in one pass under the class read locks,
+// so the ratio always describes the same avail lists as the free bytes next to it
+func buddyMetrics(pool *BuddyPool) (Stats, float64) {
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	return poolStats(pool), fragmentation(pool)
+}
+
+// Computes the fragmentation ratio of buddyFragmentation. The caller must hold every class lock, read locks are enough
+func fragmentation(pool *BuddyPool) float64 {
+	if pool.base == 0 {
+		return 0.0
+	}
+
+	// Sum free bytes per k and track the largest free block
+	var freeBytes uintptr
+	var largest uintptr
+	for k := uint(0); k <= pool.kvalM; k++ {
+		var head *Avail = &pool.avail[k]
+		for block := head.next; block != head; block = block.next {
+			freeBytes += uintptr(1) << k
+			largest = uintptr(1) << k
+		}
+	}
+
+	if freeBytes == 0 {
+		return 0.0
+	}
+
+	return 1.0 - float64(largest)/float64(freeBytes)
+}
+
+// Returns the largest single request that could succeed right now, which is the
+// usable size of the biggest free block, or 0 if the pool is exhausted.
+// Fragmentation can keep this well below the total free bytes
+func buddyMaxAlloc(pool *BuddyPool) uint {
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	if pool.base == 0 {
+		return 0
+	}
+
+	var k uint = largestFreeK(pool)
+	if k == 0 {
+		return 0
+	}
+
+	return uint((uintptr(1) << k) - pool.header)
+}
+
+// Reports whether a malloc of size bytes would find a block right now without allocating it.
+// The request is rounded up with the same header as buddyMalloc and has to fit under MaxReserved.
+// Blocks parked in the free cache or waiting on deferred coalescing are not counted,
+// so a false may be a malloc that would still have succeeded
+func buddyCanAlloc(pool *BuddyPool, size uint) bool {
+	if pool == nil || (size == 0 && !pool.uniqueZero) {
+		return false
+	}
+
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	if pool.base == 0 {
+		return false
+	}
+
+	// Requests larger than the whole pool can never be satisfied
+	var k uint = requestK(pool, size)
+	if k > pool.kvalM {
+		return false
+	}
+
+	// The block has to fit under the reserved cap
+	var usable int64 = int64((uintptr(1) << k) - pool.header)
+	if pool.maxReserved != 0 && pool.reserved.Load()+usable > pool.maxReserved {
+		return false
+	}
+	if pool.maxAllocs != 0 && pool.allocs.Load() >= pool.maxAllocs {
+		return false
+	}
+
+	// Any non-empty list from k up can be split down to the request
+	for availableK := k; availableK <= pool.kvalM; availableK++ {
+		if pool.avail[availableK].next != &pool.avail[availableK] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the k of the highest non-empty avail list, 0 if every list is empty.
+// The caller must hold every class lock
+func largestFreeK(pool *BuddyPool) uint {
+	if pool.base == 0 {
+		return 0
+	}
+
+	// Scan top-down for the highest non-empty avail list
+	for k := int(pool.kvalM); k >= int(pool.smallestK); k-- {
+		if pool.avail[k].next != &pool.avail[k] {
+			return uint(k)
+		}
+	}
+
+	return 0
+}
+
+// Returns how many allocations were served from each block size k since init.
+// Only size classes that were used appear. Returns nil unless the pool was
+// initialized with Options.Histogram
+func buddyHistogram(pool *BuddyPool) map[uint]uint64 {
+	if pool.histogram == nil {
+		return nil
+	}
+
+	var hist map[uint]uint64 = make(map[uint]uint64)
+	for k := range pool.histogram {
+		var count uint64 = pool.histogram[k].Load()
+		if count != 0 {
+			hist[uint(k)] = count
+		}
+	}
+
+	return hist
+}
+
+// Returns the usable size of every block in the avail lists, in ascending k and within
+// a list in the order malloc would take them, most recently freed first.
+// Blocks parked in the free cache are not free in the buddy system and are left out
+func buddyFreeBlocks(pool *BuddyPool) []uint {
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	if pool.base == 0 {
+		return nil
+	}
+
+	var sizes []uint = []uint{}
+	for k := pool.smallestK; k <= pool.kvalM; k++ {
+		var usable uint = uint((uintptr(1) << k) - pool.header)
+		for block := pool.avail[k].next; block != &pool.avail[k]; block = block.next {
+			sizes = append(sizes, usable)
+		}
+	}
+
+	return sizes
+}
+
+// Returns the most usable bytes that were handed out at once since init or the last
+// buddyReset. Frees never lower it
+func buddyPeak(pool *BuddyPool) uintptr {
+	return uintptr(pool.peak.Load())
+}
+
+// Raises the pool's peak to reserved if it is higher
+func raisePeak(pool *BuddyPool, reserved int64) {
+	for {
+		var peak int64 = pool.peak.Load()
+		if reserved <= peak || pool.peak.CompareAndSwap(peak, reserved) {
+			return
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package balloc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func checkStatsSum(t *testing.T, stats Stats) {
+	assert.Equal(t, stats.TotalBytes, stats.FreeBytes+stats.CachedBytes+stats.ReservedBytes+stats.OverheadBytes)
+}
+
+func TestBuddyStats(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing pool stats")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Fresh pool is one big free block
+	stats := buddyStats(&pool)
+	assert.Equal(t, uintptr(1)<<MIN_K, stats.TotalBytes)
+	assert.Equal(t, stats.TotalBytes, stats.FreeBytes)
+	assert.Equal(t, stats.TotalBytes, stats.LargestFreeBlock)
+	assert.Equal(t, uint(0), stats.LiveAllocations)
+	checkStatsSum(t, stats)
+
+	// Two 64 byte blocks and one 1024 byte block
+	a, _ := buddyMalloc(&pool, 1)
+	b, _ := buddyMalloc(&pool, 1)
+	c, _ := buddyMalloc(&pool, 1000)
+
+	header := BLOCK_HEADER
+	stats = buddyStats(&pool)
+	assert.Equal(t, uint(3), stats.LiveAllocations)
+	assert.Equal(t, 3*header, stats.OverheadBytes)
+	assert.Equal(t, uintptr(64+64+1024)-3*header, stats.ReservedBytes)
+	assert.Equal(t, uintptr(1)<<(MIN_K-1), stats.LargestFreeBlock)
+	checkStatsSum(t, stats)
+
+	buddyFree(&pool, b)
+	stats = buddyStats(&pool)
+	assert.Equal(t, uint(2), stats.LiveAllocations)
+	assert.Equal(t, uintptr(64+1024)-2*header, stats.ReservedBytes)
+	checkStatsSum(t, stats)
+
+	buddyFree(&pool, a)
+	buddyFree(&pool, c)
+	stats = buddyStats(&pool)
+	assert.Equal(t, uint(0), stats.LiveAllocations)
+	assert.Equal(t, stats.TotalBytes, stats.FreeBytes)
+	assert.Equal(t, uintptr(0), stats.ReservedBytes)
+	checkStatsSum(t, stats)
+
+	_ = buddyDestroy(&pool)
+	assert.Equal(t, Stats{}, buddyStats(&pool))
+}
+
+func TestBuddyStatsCached(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing cached blocks are not counted as reserved")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{CacheDepth: 4}))
+
+	// A freed block in the cache is neither live nor in the avail lists
+	a, err := buddyMalloc(&pool, 1)
+	assert.NoError(t, err)
+	b, err := buddyMalloc(&pool, 1000)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, a))
+	var stats Stats = buddyStats(&pool)
+	assert.Equal(t, uint(1), stats.LiveAllocations)
+	assert.Equal(t, uintptr(64), stats.CachedBytes)
+	assert.Equal(t, uintptr(1024)-BLOCK_HEADER, stats.ReservedBytes)
+	checkStatsSum(t, stats)
+
+	// Nothing live leaves nothing reserved, whatever is still cached
+	assert.NoError(t, buddyFree(&pool, b))
+	stats = buddyStats(&pool)
+	assert.Zero(t, stats.ReservedBytes)
+	assert.Zero(t, stats.OverheadBytes)
+	assert.Equal(t, uintptr(64+1024), stats.CachedBytes)
+	checkStatsSum(t, stats)
+
+	// Flushed blocks are free again
+	buddyFlushCache(&pool)
+	stats = buddyStats(&pool)
+	assert.Zero(t, stats.CachedBytes)
+	assert.Equal(t, stats.TotalBytes, stats.FreeBytes)
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyFragmentation(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing fragmentation ratio")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// One free block, no fragmentation
+	assert.Equal(t, 0.0, buddyFragmentation(&pool))
+
+	// Consume the whole pool, no free memory
+	all, _ := buddyMalloc(&pool, uint(uintptr(1)<<MIN_K-BLOCK_HEADER))
+	assert.Equal(t, 0.0, buddyFragmentation(&pool))
+	buddyFree(&pool, all)
+
+	// Carve out a run of small blocks
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 256; i++ {
+		p, err := buddyMalloc(&pool, 1)
+		assert.NoError(t, err)
+		ptrs = append(ptrs, p)
+	}
+	before := buddyFragmentation(&pool)
+
+	// Free every other block so none of them can coalesce with its buddy
+	for i := 0; i < len(ptrs); i += 2 {
+		buddyFree(&pool, ptrs[i])
+	}
+	after := buddyFragmentation(&pool)
+	assert.Greater(t, after, before)
+	assert.Less(t, after, 1.0)
+
+	// Freeing the rest merges everything back into one block
+	for i := 1; i < len(ptrs); i += 2 {
+		buddyFree(&pool, ptrs[i])
+	}
+	assert.Equal(t, 0.0, buddyFragmentation(&pool))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyMaxAlloc(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing largest allocatable size")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+	header := uint(BLOCK_HEADER)
+
+	// Whole pool minus the header
+	full := uint(1)<<MIN_K - header
+	assert.Equal(t, full, buddyMaxAlloc(&pool))
+	mem, err := buddyMalloc(&pool, buddyMaxAlloc(&pool))
+	assert.NoError(t, err)
+	assert.Equal(t, uint(0), buddyMaxAlloc(&pool))
+	assert.NoError(t, buddyFree(&pool, mem))
+
+	// Taking a quarter leaves the other half as the biggest block
+	quarter, _ := buddyMalloc(&pool, uint(1)<<(MIN_K-2)-header)
+	assert.Equal(t, uint(1)<<(MIN_K-1)-header, buddyMaxAlloc(&pool))
+
+	// Taking the other half leaves only the remaining quarter
+	half, _ := buddyMalloc(&pool, uint(1)<<(MIN_K-1)-header)
+	assert.Equal(t, uint(1)<<(MIN_K-2)-header, buddyMaxAlloc(&pool))
+
+	// Frees coalesce back up to the full pool
+	assert.NoError(t, buddyFree(&pool, half))
+	assert.Equal(t, uint(1)<<(MIN_K-1)-header, buddyMaxAlloc(&pool))
+	assert.NoError(t, buddyFree(&pool, quarter))
+	assert.Equal(t, full, buddyMaxAlloc(&pool))
+
+	_ = buddyDestroy(&pool)
+	assert.Equal(t, uint(0), buddyMaxAlloc(&pool))
+}
+
+func TestBuddyCanAlloc(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing dry run allocation checks match malloc")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	header := uint(BLOCK_HEADER)
+	assert.False(t, buddyCanAlloc(&pool, 0))
+
+	// The header counts toward the request just like in malloc
+	assert.True(t, buddyCanAlloc(&pool, uint(1)<<MIN_K-header))
+	assert.False(t, buddyCanAlloc(&pool, uint(1)<<MIN_K-header+1))
+	_, err := buddyMalloc(&pool, uint(1)<<MIN_K-header+1)
+	assert.Error(t, err)
+
+	// Fill the pool with smallest blocks, every check agreeing with the malloc after it
+	var ptrs []unsafe.Pointer
+	for {
+		var ok bool = buddyCanAlloc(&pool, 1)
+		mem, err := buddyMalloc(&pool, 1)
+		assert.Equal(t, ok, err == nil)
+		if err != nil {
+			break
+		}
+		ptrs = append(ptrs, mem)
+	}
+	assert.Len(t, ptrs, 1<<(MIN_K-SMALLEST_K))
+	assert.False(t, buddyCanAlloc(&pool, 1))
+
+	// Checking does not change the pool
+	checkBuddyPoolEmpty(t, &pool)
+
+	// One free makes the smallest size possible again but nothing larger
+	assert.NoError(t, buddyFree(&pool, ptrs[0]))
+	assert.True(t, buddyCanAlloc(&pool, 1))
+	assert.False(t, buddyCanAlloc(&pool, uint(1)<<SMALLEST_K))
+	for _, ptr := range ptrs {
+		_ = buddyFree(&pool, ptr)
+	}
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+	assert.False(t, buddyCanAlloc(&pool, 1))
+
+	// A reserved byte cap turns away requests the lists could still serve
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{MaxReserved: 1 << SMALLEST_K}))
+	assert.True(t, buddyCanAlloc(&pool, 1))
+	mem, err := buddyMalloc(&pool, 1)
+	assert.NoError(t, err)
+	assert.False(t, buddyCanAlloc(&pool, 1))
+	_, err = buddyMalloc(&pool, 1)
+	assert.Error(t, err)
+	assert.NoError(t, buddyFree(&pool, mem))
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyHistogram(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing allocation size histogram")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Histogram: true}))
+	assert.Empty(t, buddyHistogram(&pool))
+
+	// Sizes round up to the block that fits them plus the header
+	var header uint = uint(BLOCK_HEADER)
+	var ptrs []unsafe.Pointer
+	for _, size := range []uint{
+		1, 64 - header, // 2^6
+		65 - header, 100, // 2^7, one byte over the smallest block
+		1000, 1000, 1000, // 2^10
+		1024 - header, // 2^10 exactly
+		1025 - header, // 2^11
+	} {
+		ptr, err := buddyMalloc(&pool, size)
+		assert.NoError(t, err)
+		ptrs = append(ptrs, ptr)
+	}
+	assert.Equal(t, map[uint]uint64{6: 2, 7: 2, 10: 4, 11: 1}, buddyHistogram(&pool))
+
+	// Frees do not change the counts, the histogram counts allocations ever made
+	assert.NoError(t, buddyFreeBatch(&pool, ptrs))
+	assert.Equal(t, map[uint]uint64{6: 2, 7: 2, 10: 4, 11: 1}, buddyHistogram(&pool))
+
+	// Batch allocations are counted too
+	ptrs, _ = buddyMallocBatch(&pool, 3000, 3)
+	assert.Equal(t, uint64(3), buddyHistogram(&pool)[12])
+	assert.NoError(t, buddyFreeBatch(&pool, ptrs))
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyHistogramDisabled(t *testing.T) {
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	ptr, _ := buddyMalloc(&pool, 10)
+	assert.Nil(t, buddyHistogram(&pool))
+	_ = buddyFree(&pool, ptr)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyFreeBlocks(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the free block sizes follow a fragmenting sequence")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+	var usable = func(k uint) uint { return uint((uintptr(1) << k) - BLOCK_HEADER) }
+
+	// A fresh pool is one free block
+	assert.Equal(t, []uint{usable(MIN_K)}, buddyFreeBlocks(&pool))
+
+	// Two 128 byte blocks and a 1024 byte one split the pool, then the first 128 byte block
+	// is freed but cannot merge while its buddy is allocated
+	a, _ := buddyMalloc(&pool, 100)
+	b, _ := buddyMalloc(&pool, 100)
+	c, _ := buddyMalloc(&pool, 1000)
+	assert.NoError(t, buddyFree(&pool, a))
+	var expected []uint = []uint{usable(7), usable(8), usable(9)}
+	for k := uint(11); k < MIN_K; k++ {
+		expected = append(expected, usable(k))
+	}
+	assert.Equal(t, expected, buddyFreeBlocks(&pool))
+
+	// Reusing the freed block and splitting the next class leaves one 128 byte buddy free.
+	// Freeing b puts a second one in front of it, the most recently freed comes first
+	d, _ := buddyMalloc(&pool, 100)
+	e, _ := buddyMalloc(&pool, 100)
+	assert.NoError(t, buddyFree(&pool, b))
+	assert.Equal(t, append([]uint{usable(7), usable(7), usable(9)}, expected[3:]...), buddyFreeBlocks(&pool))
+	assert.Equal(t, ptrToBlock(&pool, b), pool.avail[7].next)
+
+	// Everything freed merges back into one block, and a destroyed pool has none
+	for _, ptr := range []unsafe.Pointer{c, d, e} {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	assert.Equal(t, []uint{usable(MIN_K)}, buddyFreeBlocks(&pool))
+	_ = buddyDestroy(&pool)
+	assert.Nil(t, buddyFreeBlocks(&pool))
+}
+
+func TestBuddyPeak(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing peak usage tracking")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+	assert.Equal(t, uintptr(0), buddyPeak(&pool))
+
+	// Climb to a peak of three 4KiB blocks
+	var ptrs []unsafe.Pointer
+	for i := 0; i < 3; i++ {
+		ptr, _ := buddyMalloc(&pool, 4000)
+		ptrs = append(ptrs, ptr)
+	}
+	var peak uintptr = 3 * uintptr(blockUsable(&pool, ptrToBlock(&pool, ptrs[0])))
+	assert.Equal(t, peak, buddyPeak(&pool))
+	assert.Equal(t, buddyStats(&pool).ReservedBytes, buddyPeak(&pool))
+
+	// Freeing everything keeps the peak
+	for _, ptr := range ptrs {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	assert.Equal(t, peak, buddyPeak(&pool))
+
+	// A smaller workload afterwards does not lower it
+	small, _ := buddyMalloc(&pool, 100)
+	assert.Equal(t, peak, buddyPeak(&pool))
+	assert.NoError(t, buddyFree(&pool, small))
+
+	// Batches count towards the peak through the same path
+	ptrs, _ = buddyMallocBatch(&pool, 4000, 4)
+	assert.Equal(t, peak/3*4, buddyPeak(&pool))
+	assert.NoError(t, buddyFreeBatch(&pool, ptrs))
+
+	// Reset starts a new peak
+	_, _ = buddyMalloc(&pool, 100)
+	buddyReset(&pool)
+	assert.Equal(t, uintptr(0), buddyPeak(&pool))
+	small, _ = buddyMalloc(&pool, 100)
+	assert.Equal(t, uintptr(blockUsable(&pool, ptrToBlock(&pool, small))), buddyPeak(&pool))
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyStatsConcurrentReaders(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing stat readers share the class locks alongside allocators")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// A reader holding every read lock does not keep another reader out
+	rlockAll(&pool)
+	var done chan Stats = make(chan Stats)
+	go func() { done <- buddyStats(&pool) }()
+	select {
+	case stats := <-done:
+		assert.Equal(t, pool.numBytes, stats.FreeBytes)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stats blocked behind another reader")
+	}
+	runlockAll(&pool)
+
+	// Readers and allocators running together always see a consistent pool
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				p, err := buddyMalloc(&pool, uint(32<<(i%8+g%2)))
+				if err == nil {
+					_ = buddyFree(&pool, p)
+				}
+			}
+		}(g)
+	}
+	var readers sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for !stop.Load() {
+				var stats Stats = buddyStats(&pool)
+				checkStatsSum(t, stats)
+				_ = buddyFragmentation(&pool)
+				_ = buddyMaxAlloc(&pool)
+				_ = buddyCanAlloc(&pool, 100)
+				buddyDump(&pool, io.Discard)
+				assert.NoError(t, buddyVerify(&pool))
+			}
+		}()
+	}
+	wg.Wait()
+	stop.Store(true)
+	readers.Wait()
+
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+// Parallel stat readers next to one goroutine churning malloc and free.
+// Readers only wait on the allocator, never on each other. mallocs/op is how far the allocator got per read
+func BenchmarkStatsReaders(b *testing.B) {
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	var stop atomic.Bool
+	var churned chan int = make(chan int)
+	go func() {
+		var n int
+		for !stop.Load() {
+			p, _ := buddyMalloc(&pool, 64)
+			_ = buddyFree(&pool, p)
+			n++
+		}
+		churned <- n
+	}()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = buddyStats(&pool)
+		}
+	})
+
+	stop.Store(true)
+	b.ReportMetric(float64(<-churned)/float64(b.N), "mallocs/op")
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,37 @@
+package balloc
+
+import "unsafe"
+
+// Strategy selects which free block malloc splits to satisfy a request
+type Strategy int
+
+const (
+	// Takes the most recently freed block of the smallest non-empty list at or above k.
+	// This is already best fit: splitting a block of kval j down to k leaves j - k free
+	// fragments, so the smallest non-empty list is always the one leaving the fewest and a
+	// separate best fit mode would pick the same list every time. Constant time, but
+	// allocations follow the free order and can end up spread over the pool
+	StrategyClimb Strategy = iota
+
+	// Keeps every avail list sorted by ascending address so its head is the lowest free block.
+	// Malloc takes the head in constant time and places blocks like first fit, but
+	// every free and split walks the list to the insertion point, O(n) in the list's length
+	StrategyAddressOrdered
+)
+
+// Links block into the avail list at head according to the pool's strategy.
+// Address ordered pools keep the list sorted, every other strategy pushes the block at the head
+func putBlock(pool *BuddyPool, head *Avail, block *Avail) {
+	if pool.strategy != StrategyAddressOrdered {
+		insertBlock(head, block)
+		return
+	}
+
+	// Insert in front of the first block at a higher address, or at the tail if there is none
+	var addr uintptr = uintptr(unsafe.Pointer(block))
+	var next *Avail = head.next
+	for next != head && uintptr(unsafe.Pointer(next)) < addr {
+		next = next.next
+	}
+	insertBlock(next.prev, block)
+}
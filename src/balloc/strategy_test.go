@@ -0,0 +1,183 @@
+package balloc
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs a sequence that scrambles the free list order before long lived allocations are made,
+// then frees everything else and returns the resulting fragmentation and largest free block
+func pathologicalFragmentation(t *testing.T, strategy Strategy) (float64, uintptr) {
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Strategy: strategy}))
+	defer buddyDestroy(&pool)
+
+	// Fill the pool with 1KiB blocks
+	var blocks []unsafe.Pointer
+	for i := 0; i < 1024; i++ {
+		ptr, err := buddyMalloc(&pool, 1000)
+		assert.NoError(t, err)
+		blocks = append(blocks, ptr)
+	}
+
+	// Free every other block in a random order. Their buddies are still held so nothing merges
+	var rng *rand.Rand = rand.New(rand.NewSource(43))
+	for _, i := range rng.Perm(512) {
+		assert.NoError(t, buddyFree(&pool, blocks[2*i]))
+	}
+
+	// Long lived small allocations carve up some of the freed blocks
+	for i := 0; i < 256; i++ {
+		_, err := buddyMalloc(&pool, 40)
+		assert.NoError(t, err)
+	}
+
+	// Everything else goes away
+	for i := 1; i < len(blocks); i += 2 {
+		assert.NoError(t, buddyFree(&pool, blocks[i]))
+	}
+	assert.NoError(t, buddyVerify(&pool))
+
+	return buddyFragmentation(&pool), buddyStats(&pool).LargestFreeBlock
+}
+
+func TestStrategyClimbIsBestFit(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing climb always splits the list leaving the fewest fragments")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{}))
+
+	// Mixed sizes freed in a random order leave free blocks scattered over many lists
+	var rng *rand.Rand = rand.New(rand.NewSource(43))
+	var live []unsafe.Pointer
+	for i := 0; i < 3000; i++ {
+		if len(live) > 0 && rng.Intn(3) == 0 {
+			var j int = rng.Intn(len(live))
+			assert.NoError(t, buddyFree(&pool, live[j]))
+			live = append(live[:j], live[j+1:]...)
+			continue
+		}
+
+		// Splitting a block of kval j down to k leaves j - k fragments, best fit is the smallest j
+		var size uint = uint(1 + rng.Intn(8000))
+		var k uint = requestK(&pool, size)
+		var best uint = k
+		for best <= pool.kvalM && pool.avail[best].next == &pool.avail[best] {
+			best++
+		}
+		var before int = len(buddyFreeBlocks(&pool))
+		ptr, err := buddyMalloc(&pool, size)
+		if best > pool.kvalM {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		live = append(live, ptr)
+
+		// Climb took one block and left exactly the fewest fragments possible
+		assert.Equal(t, before-1+int(best-k), len(buddyFreeBlocks(&pool)), "malloc of %d bytes", size)
+	}
+	assert.NoError(t, buddyVerify(&pool))
+	_ = buddyDestroy(&pool)
+}
+
+func TestStrategyAddressOrderedSorted(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing address ordered free lists stay sorted")
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Strategy: StrategyAddressOrdered}))
+
+	// Churn mixed sizes and free them in a random order
+	var rng *rand.Rand = rand.New(rand.NewSource(89))
+	var live []unsafe.Pointer
+	for i := 0; i < 3000; i++ {
+		if len(live) > 0 && rng.Intn(2) == 0 {
+			var j int = rng.Intn(len(live))
+			assert.NoError(t, buddyFree(&pool, live[j]))
+			live = append(live[:j], live[j+1:]...)
+			continue
+		}
+		ptr, err := buddyMalloc(&pool, uint(1+rng.Intn(4000)))
+		if err == nil {
+			live = append(live, ptr)
+		}
+	}
+
+	// Every list ascends from its head, which verify checks too
+	for k := pool.smallestK; k <= pool.kvalM; k++ {
+		var prev uintptr
+		for block := pool.avail[k].next; block != &pool.avail[k]; block = block.next {
+			assert.Greater(t, uintptr(unsafe.Pointer(block)), prev, "avail[%d]", k)
+			prev = uintptr(unsafe.Pointer(block))
+		}
+	}
+	assert.NoError(t, buddyVerify(&pool))
+
+	// Moving the lowest block of a list to its tail is reported
+	a, _ := buddyMalloc(&pool, 1000)
+	_, _ = buddyMalloc(&pool, 1000)
+	b, _ := buddyMalloc(&pool, 1000)
+	_, _ = buddyMalloc(&pool, 1000)
+	assert.NoError(t, buddyFree(&pool, b))
+	assert.NoError(t, buddyFree(&pool, a))
+	var k uint = uint(ptrToBlock(&pool, a).kval)
+	var low *Avail = removeFirst(&pool.avail[k])
+	insertBlock(pool.avail[k].prev, low)
+	assert.ErrorIs(t, buddyVerify(&pool), ErrCorruptPool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestStrategyAddressOrderedFragmentation(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing address ordered lists against climb on a pathological sequence")
+	climbFrag, climbLargest := pathologicalFragmentation(t, StrategyClimb)
+	orderedFrag, orderedLargest := pathologicalFragmentation(t, StrategyAddressOrdered)
+
+	// The long lived blocks land at the lowest free addresses of the list climb would pick
+	assert.Less(t, orderedFrag, climbFrag)
+	assert.Greater(t, orderedLargest, climbLargest)
+	assert.Equal(t, uintptr(1)<<(MIN_K-1), orderedLargest)
+}
+
+func TestSplitHigh(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing reverse splits hand out the high end of the pool")
+	var mean [2]float64
+	for i, high := range []bool{false, true} {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{SplitHigh: high, Poison: high}))
+
+		// The first block comes from the very start or the very end of the pool
+		first, err := buddyMalloc(&pool, 100)
+		assert.NoError(t, err)
+		if high {
+			assert.Equal(t, pool.base+pool.numBytes-128, uintptr(first)-BLOCK_HEADER)
+		} else {
+			assert.Equal(t, pool.base, uintptr(first)-BLOCK_HEADER)
+		}
+
+		// Mixed sizes trend towards the same end
+		var rng *rand.Rand = rand.New(rand.NewSource(91))
+		var ptrs []unsafe.Pointer = []unsafe.Pointer{first}
+		for j := 0; j < 200; j++ {
+			ptr, err := buddyMalloc(&pool, uint(1+rng.Intn(2000)))
+			assert.NoError(t, err)
+			mean[i] += float64(uintptr(ptr)-pool.base) / float64(pool.numBytes)
+			ptrs = append(ptrs, ptr)
+		}
+		mean[i] /= 200
+		assert.NoError(t, buddyVerify(&pool))
+
+		// Freeing everything still coalesces back into the whole pool
+		for _, j := range rng.Perm(len(ptrs)) {
+			assert.NoError(t, buddyFree(&pool, ptrs[j]))
+		}
+		checkBuddyPoolFull(t, &pool)
+		_ = buddyDestroy(&pool)
+	}
+
+	assert.Less(t, mean[0], 0.5)
+	assert.Greater(t, mean[1], 0.5)
+}
@@ -0,0 +1,159 @@
+package balloc
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A block handed out by Stress together with the byte it was filled with
+type stressBlock struct {
+	ptr  unsafe.Pointer // user pointer
+	size uint           // bytes requested and filled
+	fill byte           // pattern written over the requested bytes
+}
+
+// Runs ops random allocations, reallocations and frees against pool, seeded by seed so the
+// same seed on a fresh pool always takes the same path. Every block is filled with a pattern
+// that is checked before it is freed, and buddyVerify runs every 64 ops and at the end.
+// Everything Stress allocates is freed before it returns, allocations made by others are left alone.
+// Returns the first invariant violation or failed free, ENOMEM is not an error
+func Stress(pool *BuddyPool, ops int, seed int64) error {
+	if pool == nil || pool.base == 0 {
+		return fmt.Errorf("%w: pool is not mapped", ErrInvalidOptions)
+	}
+
+	var r *rand.Rand = rand.New(rand.NewSource(seed))
+	var live []stressBlock
+	var err error = stressRun(pool, r, ops, &live)
+
+	// Free whatever is left even if the run failed, so a failed check does not leak
+	for _, b := range live {
+		var freeErr error = stressFree(pool, b)
+		if err == nil {
+			err = freeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return buddyVerify(pool)
+}
+
+// The random op loop of Stress, live holds every block it has not freed yet
+func stressRun(pool *BuddyPool, r *rand.Rand, ops int, live *[]stressBlock) error {
+	for i := 0; i < ops; i++ {
+		var op int = r.Intn(10)
+		switch {
+		// Allocate, mostly small sizes with the odd large one
+		case op < 5 || len(*live) == 0:
+			var size uint = stressSize(pool, r)
+			ptr, err := buddyMalloc(pool, size)
+			if errors.Is(err, unix.ENOMEM) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("stress op %d: malloc of %d bytes: %w", i, size, err)
+			}
+			var b stressBlock = stressBlock{ptr: ptr, size: size, fill: byte(r.Intn(256))}
+			stressFill(b)
+			*live = append(*live, b)
+
+		// Resize a live block, its contents must survive the move
+		case op < 7:
+			var j int = r.Intn(len(*live))
+			var b stressBlock = (*live)[j]
+			var size uint = stressSize(pool, r)
+			err := stressCheck(b)
+			if err != nil {
+				return fmt.Errorf("stress op %d: %w", i, err)
+			}
+			ptr, err := buddyRealloc(pool, b.ptr, size)
+			if errors.Is(err, unix.ENOMEM) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("stress op %d: realloc to %d bytes: %w", i, size, err)
+			}
+			b.ptr = ptr
+			b.size = min(b.size, size)
+			err = stressCheck(b)
+			if err != nil {
+				return fmt.Errorf("stress op %d: realloc lost data: %w", i, err)
+			}
+			b.size = size
+			stressFill(b)
+			(*live)[j] = b
+
+		// Free a random live block
+		default:
+			var j int = r.Intn(len(*live))
+			var b stressBlock = (*live)[j]
+			(*live)[j] = (*live)[len(*live)-1]
+			*live = (*live)[:len(*live)-1]
+			err := stressFree(pool, b)
+			if err != nil {
+				return fmt.Errorf("stress op %d: %w", i, err)
+			}
+		}
+
+		if i%64 == 63 {
+			err := buddyVerify(pool)
+			if err != nil {
+				return fmt.Errorf("stress op %d: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Picks a request size: up to 256 bytes most of the time, up to 4KiB often, and rarely up to 1/16 of the pool
+func stressSize(pool *BuddyPool, r *rand.Rand) uint {
+	switch n := r.Intn(100); {
+	case n < 70:
+		return uint(r.Intn(256) + 1)
+	case n < 98:
+		return uint(r.Intn(4096) + 1)
+	default:
+		return uint(r.Int63n(int64(pool.numBytes>>4)) + 1)
+	}
+}
+
+// Writes b's pattern over its requested bytes
+func stressFill(b stressBlock) {
+	var region []byte = unsafe.Slice((*byte)(b.ptr), b.size)
+	for i := range region {
+		region[i] = b.fill
+	}
+}
+
+// Checks b still holds its pattern, returning ErrCorruptPool at the first changed byte
+func stressCheck(b stressBlock) error {
+	for i, c := range unsafe.Slice((*byte)(b.ptr), b.size) {
+		if c != b.fill {
+			return fmt.Errorf("%w: byte %d of block at %p changed from %#x to %#x", ErrCorruptPool, i, b.ptr, b.fill, c)
+		}
+	}
+
+	return nil
+}
+
+// Checks and frees b
+func stressFree(pool *BuddyPool, b stressBlock) error {
+	var err error = stressCheck(b)
+	if err != nil {
+		return err
+	}
+
+	err = buddyFree(pool, b.ptr)
+	if err != nil {
+		return fmt.Errorf("free of block at %p: %w", b.ptr, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStress(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the seeded stress harness")
+	for _, seed := range []int64{1, 42, 20250101} {
+		for _, opts := range []Options{{}, {CacheDepth: 8}, {Redzone: true, Poison: true}, {DeferCoalesce: true, Strategy: StrategyAddressOrdered}} {
+			var pool BuddyPool
+			assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, opts))
+			assert.NoError(t, Stress(&pool, 5000, seed), "seed %d options %+v", seed, opts)
+
+			// Nothing is leaked, the pool is back to one free block once merged
+			if pool.cache != nil {
+				pool.cache.flush(&pool)
+			}
+			buddyCoalesceAll(&pool)
+			assert.Equal(t, int64(0), pool.allocs.Load())
+			checkBuddyPoolFull(t, &pool)
+			_ = buddyDestroy(&pool)
+		}
+	}
+}
+
+func TestStressDeterministic(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the stress harness is reproducible")
+	var logs [2]captureLogger
+	for i := range logs {
+		var pool BuddyPool
+		assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, Options{Logger: &logs[i]}))
+		assert.NoError(t, Stress(&pool, 3000, 9))
+		_ = buddyDestroy(&pool)
+	}
+
+	// Both runs hit the same out of memory conditions in the same order
+	assert.NotEmpty(t, logs[0].messages)
+	assert.Equal(t, logs[0].messages, logs[1].messages)
+}
+
+func TestStressLeavesOtherAllocations(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing the stress harness only frees its own blocks")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	mem, _ := buddyMalloc(&pool, 100)
+	assert.NoError(t, Stress(&pool, 1000, 3))
+	assert.Equal(t, int64(1), pool.allocs.Load())
+	assert.NoError(t, buddyFree(&pool, mem))
+	checkBuddyPoolFull(t, &pool)
+
+	assert.ErrorIs(t, Stress(nil, 10, 1), ErrInvalidOptions)
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,22 @@
+package balloc
+
+import "unsafe"
+
+// Counts the split of block, 2^parentK bytes, into two halves and reports it to the OnSplit hook
+func traceSplit(pool *BuddyPool, parentK uint, block *Avail) {
+	pool.totalSplits.Add(1)
+	if pool.onSplit != nil {
+		pool.onSplit(parentK, uintptr(unsafe.Pointer(block))-pool.base)
+	}
+}
+
+// Counts the merge of two 2^childK byte buddies into block and reports it to the OnMerge hook
+func traceMerge(pool *BuddyPool, childK uint, block *Avail) {
+	pool.totalMerges.Add(1)
+	if pool.prewarmPair.Load() != 0 {
+		leavePrewarm(pool, block)
+	}
+	if pool.onMerge != nil {
+		pool.onMerge(childK, uintptr(unsafe.Pointer(block))-pool.base)
+	}
+}
@@ -0,0 +1,95 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// One split or merge reported to a trace hook
+type traceEvent struct {
+	k      uint
+	offset uintptr
+}
+
+// Records every split and merge of a pool
+type traceRecorder struct {
+	splits []traceEvent
+	merges []traceEvent
+}
+
+// Returns options tracing into r
+func (r *traceRecorder) options(opts Options) Options {
+	opts.OnSplit = func(parentK uint, offset uintptr) { r.splits = append(r.splits, traceEvent{parentK, offset}) }
+	opts.OnMerge = func(childK uint, offset uintptr) { r.merges = append(r.merges, traceEvent{childK, offset}) }
+	return opts
+}
+
+// Returns one event at offset for every k from from towards to, to itself excluded
+func traceRange(from, to uint, offset uintptr) []traceEvent {
+	var events []traceEvent
+	for k := from; k != to; {
+		events = append(events, traceEvent{k, offset})
+		if from < to {
+			k++
+		} else {
+			k--
+		}
+	}
+	return events
+}
+
+func TestTraceSplitMerge(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing split and merge hooks trace the pool's structure")
+	var rec traceRecorder
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, rec.options(Options{})))
+	assert.Empty(t, rec.splits)
+
+	// A 128 byte block splits the whole pool from the top down, always at offset 0
+	a, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, traceRange(MIN_K, 7, 0), rec.splits)
+
+	// Its buddy is already free so the second one splits nothing
+	b, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.Len(t, rec.splits, int(MIN_K-7))
+
+	// Freeing the first merges nothing while its buddy is held, freeing the second merges back to the top
+	assert.NoError(t, buddyFree(&pool, a))
+	assert.Empty(t, rec.merges)
+	assert.NoError(t, buddyFree(&pool, b))
+	assert.Equal(t, traceRange(7, MIN_K, 0), rec.merges)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestTraceGrowAndRecoalesce(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing merges done by realloc and deferred coalescing are traced")
+	var rec traceRecorder
+	var pool BuddyPool
+	assert.NoError(t, buddyInitWithOptions(&pool, 1<<MIN_K, rec.options(Options{DeferCoalesce: true})))
+
+	// Growing a block in place merges it with its free buddies
+	mem, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	grown, err := buddyRealloc(&pool, mem, 500)
+	assert.NoError(t, err)
+	assert.Equal(t, mem, grown)
+	assert.Equal(t, traceRange(7, 9, 0), rec.merges)
+
+	// A deferred free merges nothing until the pool is coalesced
+	rec.merges = nil
+	assert.NoError(t, buddyFree(&pool, grown))
+	assert.Empty(t, rec.merges)
+	buddyCoalesceAll(&pool)
+	assert.Len(t, rec.merges, int(MIN_K-9))
+	for _, event := range rec.merges {
+		assert.Equal(t, uintptr(0), event.offset)
+	}
+
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,117 @@
+package balloc
+
+import "unsafe"
+
+// The typed helpers hand out Go pointers into manually managed pool memory.
+// The garbage collector does not scan the pool, so a T stored there must not
+// hold the only reference to Go heap memory (pointers, slices, maps, strings,
+// interfaces or channels), and the memory stays valid only until it is freed
+
+// Mallocs a zeroed T in the pool
+func buddyNew[T any](pool *BuddyPool) (*T, error) {
+	// A zero sized T still gets its own block so the pointer can be freed
+	var size uint = max(uint(unsafe.Sizeof(*new(T))), 1)
+
+	ptr, err := buddyCalloc(pool, 1, size)
+	if ptr == nil || err != nil {
+		return nil, err
+	}
+
+	return (*T)(ptr), nil
+}
+
+// Frees a T previously allocated with buddyNew
+func buddyFreeTyped[T any](pool *BuddyPool, ptr *T) error {
+	return buddyFree(pool, unsafe.Pointer(ptr))
+}
+
+// Frees *ptr like buddyFreeTyped and then sets it to nil so the caller's variable
+// cannot be used after the free. *ptr is left as it was if the free fails
+func buddyFreeP[T any](pool *BuddyPool, ptr **T) error {
+	if ptr == nil {
+		return nil
+	}
+
+	var err error = buddyFreeTyped(pool, *ptr)
+	if err != nil {
+		return err
+	}
+
+	*ptr = nil
+	return nil
+}
+
+// Mallocs a zeroed slice of n T values in the pool.
+// Returns nil if n is not positive
+func buddyNewSlice[T any](pool *BuddyPool, n int) ([]T, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	var size uint = max(uint(unsafe.Sizeof(*new(T))), 1)
+
+	// Calloc checks n*size for overflow
+	ptr, err := buddyCalloc(pool, uint(n), size)
+	if ptr == nil || err != nil {
+		return nil, err
+	}
+
+	return unsafe.Slice((*T)(ptr), n), nil
+}
+
+// Frees a slice previously allocated with buddyNewSlice.
+// An empty slice with no capacity is a no-op
+func buddyFreeTypedSlice[T any](pool *BuddyPool, s []T) error {
+	if cap(s) == 0 {
+		return nil
+	}
+
+	return buddyFree(pool, unsafe.Pointer(unsafe.SliceData(s)))
+}
+
+// Frees *s like buddyFreeTypedSlice and then sets it to nil so the caller's slice
+// cannot be used after the free. *s is left as it was if the free fails
+func buddyFreeSliceP[T any](pool *BuddyPool, s *[]T) error {
+	if s == nil {
+		return nil
+	}
+
+	var err error = buddyFreeTypedSlice(pool, *s)
+	if err != nil {
+		return err
+	}
+
+	*s = nil
+	return nil
+}
+
+// Allocates a zeroed T from the pool. Named NewOf as New creates a Pool.
+// The GC does not scan pool memory, so T must not hold the only reference to Go heap memory
+func NewOf[T any](p *Pool) (*T, error) {
+	return buddyNew[T](&p.buddy)
+}
+
+// Frees a T previously returned by NewOf
+func Free[T any](p *Pool, ptr *T) error {
+	return buddyFreeTyped(&p.buddy, ptr)
+}
+
+// Frees *ptr, previously returned by NewOf, and sets it to nil
+func FreeP[T any](p *Pool, ptr **T) error {
+	return buddyFreeP(&p.buddy, ptr)
+}
+
+// Allocates a zeroed slice of n T values from the pool.
+// The GC does not scan pool memory, so T must not hold the only reference to Go heap memory
+func NewSlice[T any](p *Pool, n int) ([]T, error) {
+	return buddyNewSlice[T](&p.buddy, n)
+}
+
+// Frees a slice previously returned by NewSlice
+func FreeSlice[T any](p *Pool, s []T) error {
+	return buddyFreeTypedSlice(&p.buddy, s)
+}
+
+// Frees *s, previously returned by NewSlice, and sets it to nil
+func FreeSliceP[T any](p *Pool, s *[]T) error {
+	return buddyFreeSliceP(&p.buddy, s)
+}
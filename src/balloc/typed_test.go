@@ -0,0 +1,152 @@
+package balloc
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+type typedPoint struct {
+	X, Y  int64
+	Label [16]byte
+	Seen  bool
+}
+
+func TestBuddyNew(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing typed allocation")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Dirty a block so the typed allocation has to zero it
+	dirty, _ := buddyMalloc(&pool, uint(unsafe.Sizeof(typedPoint{})))
+	for i := range unsafe.Sizeof(typedPoint{}) {
+		*(*byte)(unsafe.Add(dirty, i)) = 0xAB
+	}
+	_ = buddyFree(&pool, dirty)
+
+	p, err := buddyNew[typedPoint](&pool)
+	assert.NoError(t, err)
+	assert.Equal(t, typedPoint{}, *p)
+	assert.Equal(t, uintptr(0), uintptr(unsafe.Pointer(p))%unsafe.Alignof(typedPoint{}))
+
+	// Fields written through the pointer read back
+	p.X, p.Y, p.Seen = 3, -4, true
+	copy(p.Label[:], "origin")
+	assert.Equal(t, int64(3), p.X)
+	assert.Equal(t, int64(-4), p.Y)
+	assert.Equal(t, "origin", string(p.Label[:6]))
+	assert.True(t, p.Seen)
+
+	assert.NoError(t, buddyFreeTyped(&pool, p))
+	assert.ErrorIs(t, buddyFreeTyped(&pool, p), ErrDoubleFree)
+	checkBuddyPoolFull(t, &pool)
+
+	// A zero sized type still gets a freeable pointer
+	e, err := buddyNew[struct{}](&pool)
+	assert.NoError(t, err)
+	assert.NotNil(t, e)
+	assert.NoError(t, buddyFreeTyped(&pool, e))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyNewSlice(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing typed slice allocation")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	s, err := buddyNewSlice[typedPoint](&pool, 100)
+	assert.NoError(t, err)
+	assert.Len(t, s, 100)
+	assert.Equal(t, 100, cap(s))
+	for i := range s {
+		assert.Equal(t, typedPoint{}, s[i])
+		s[i].X = int64(i)
+	}
+	for i := range s {
+		assert.Equal(t, int64(i), s[i].X)
+	}
+	assert.NoError(t, buddyFreeTypedSlice(&pool, s))
+	checkBuddyPoolFull(t, &pool)
+
+	// Non positive lengths and overflowing sizes allocate nothing
+	s, err = buddyNewSlice[typedPoint](&pool, 0)
+	assert.Nil(t, s)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFreeTypedSlice(&pool, s))
+	big, err := buddyNewSlice[[1 << 20]byte](&pool, math.MaxInt>>10)
+	assert.Nil(t, big)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyFreeP(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing typed frees clear the caller's pointer")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+
+	// The pointer is nil once freed
+	p, err := buddyNew[typedPoint](&pool)
+	assert.NoError(t, err)
+	p.X = 3
+	var kept *typedPoint = p
+	assert.NoError(t, buddyFreeP(&pool, &p))
+	assert.Nil(t, p)
+	checkBuddyPoolFull(t, &pool)
+
+	// Freeing the nil pointer again is a no-op instead of a double free, unlike a copy kept elsewhere
+	assert.NoError(t, buddyFreeP(&pool, &p))
+	assert.ErrorIs(t, buddyFreeP(&pool, &kept), ErrDoubleFree)
+	assert.NotNil(t, kept)
+	assert.NoError(t, buddyFreeP[typedPoint](&pool, nil))
+
+	// Slices are cleared the same way
+	s, err := buddyNewSlice[uint64](&pool, 100)
+	assert.NoError(t, err)
+	s[99] = 1
+	assert.NoError(t, buddyFreeSliceP(&pool, &s))
+	assert.Nil(t, s)
+	assert.NoError(t, buddyFreeSliceP(&pool, &s))
+	assert.NoError(t, buddyFreeSliceP[uint64](&pool, nil))
+	checkBuddyPoolFull(t, &pool)
+
+	_ = buddyDestroy(&pool)
+}
+
+func TestPoolTypedHelpers(t *testing.T) {
+	pool, err := New(1 << MIN_K)
+	assert.NoError(t, err)
+
+	p, err := NewOf[typedPoint](pool)
+	assert.NoError(t, err)
+	p.Y = 7
+	assert.Equal(t, int64(7), p.Y)
+	assert.NoError(t, Free(pool, p))
+
+	s, err := NewSlice[uint32](pool, 10)
+	assert.NoError(t, err)
+	s[9] = 42
+	assert.Equal(t, uint32(42), s[9])
+	assert.NoError(t, FreeSlice(pool, s))
+	checkBuddyPoolFull(t, &pool.buddy)
+
+	p, err = NewOf[typedPoint](pool)
+	assert.NoError(t, err)
+	assert.NoError(t, FreeP(pool, &p))
+	assert.Nil(t, p)
+	s, err = NewSlice[uint32](pool, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, FreeSliceP(pool, &s))
+	assert.Nil(t, s)
+	checkBuddyPoolFull(t, &pool.buddy)
+
+	assert.NoError(t, pool.Destroy())
+}
@@ -0,0 +1,70 @@
+package balloc
+
+import (
+	"context"
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mallocs size bytes, blocking until a free makes room instead of failing with ENOMEM.
+// Returns ctx.Err() if ctx is done first. Requests larger than the whole pool still fail
+// with ENOMEM straight away since no amount of freeing could satisfy them
+func buddyMallocWait(ctx context.Context, pool *BuddyPool, size uint) (unsafe.Pointer, error) {
+	if pool == nil || (size == 0 && !pool.uniqueZero) {
+		return nil, nil
+	}
+
+	for {
+		// Grab the wake channel before trying so a free between the attempt and the wait is not lost
+		var freed <-chan struct{} = waitChan(pool)
+
+		var ptr unsafe.Pointer
+		var err error
+		ptr, err = buddyMalloc(pool, size)
+		if !errors.Is(err, unix.ENOMEM) {
+			return ptr, err
+		}
+		if requestK(pool, size) > pool.kvalM {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+// Returns the channel the next free will close, creating it if nobody is waiting yet
+func waitChan(pool *BuddyPool) <-chan struct{} {
+	pool.waitLock.Lock()
+	defer pool.waitLock.Unlock()
+
+	if pool.freed == nil {
+		pool.freed = make(chan struct{})
+		pool.waiting.Store(true)
+	}
+
+	return pool.freed
+}
+
+// Wakes every goroutine blocked in buddyMallocWait. When nobody is waiting it is a single
+// atomic load, so frees never contend on waitLock. A waiter publishes its channel before its
+// malloc attempt, so a free that misses the flag happened early enough for that attempt to see it
+func notifyFree(pool *BuddyPool) {
+	if !pool.waiting.Load() {
+		return
+	}
+
+	pool.waitLock.Lock()
+	defer pool.waitLock.Unlock()
+
+	if pool.freed != nil {
+		close(pool.freed)
+		pool.freed = nil
+		pool.waiting.Store(false)
+	}
+}
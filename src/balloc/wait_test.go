@@ -0,0 +1,117 @@
+package balloc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestBuddyMallocWaitWakesOnFree(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing blocking malloc wakes on free")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Exhaust the pool
+	all, err := buddyMalloc(&pool, uint(uintptr(1)<<MIN_K-BLOCK_HEADER))
+	assert.NoError(t, err)
+
+	done := make(chan unsafe.Pointer)
+	go func() {
+		p, err := buddyMallocWait(context.Background(), &pool, 100)
+		assert.NoError(t, err)
+		done <- p
+	}()
+
+	// The waiter must still be blocked
+	select {
+	case <-done:
+		t.Fatal("waiter returned before any memory was freed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, buddyFree(&pool, all))
+	select {
+	case p := <-done:
+		assert.NotNil(t, p)
+		assert.NoError(t, buddyFree(&pool, p))
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter was not woken by free")
+	}
+
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
+
+func TestBuddyMallocWaitCancel(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing blocking malloc honors cancellation")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	all, _ := buddyMalloc(&pool, uint(uintptr(1)<<MIN_K-BLOCK_HEADER))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		p, err := buddyMallocWait(ctx, &pool, 100)
+		assert.Nil(t, p)
+		done <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter ignored cancellation")
+	}
+
+	// Requests that can never fit fail straight away
+	p, err := buddyMallocWait(context.Background(), &pool, 1<<(MIN_K+1))
+	assert.Nil(t, p)
+	assert.ErrorIs(t, err, unix.ENOMEM)
+
+	assert.NoError(t, buddyFree(&pool, all))
+	_ = buddyDestroy(&pool)
+}
+
+func TestNotifyFreeNoWaiters(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing frees skip the wait lock while nobody waits")
+	var pool BuddyPool
+	assert.NoError(t, buddyInit(&pool, 1<<MIN_K))
+	a, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	b, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+
+	// With the wait lock held elsewhere both kinds of free still go through
+	pool.waitLock.Lock()
+	var done chan struct{} = make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, buddyFree(&pool, a))
+		assert.NoError(t, buddyFreeBatch(&pool, []unsafe.Pointer{b}))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("free blocked on the wait lock with nobody waiting")
+	}
+	pool.waitLock.Unlock()
+
+	// A waiter's channel sets the flag and the next free clears it
+	var freed <-chan struct{} = waitChan(&pool)
+	assert.True(t, pool.waiting.Load())
+	ptr, err := buddyMalloc(&pool, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, buddyFree(&pool, ptr))
+	<-freed
+	assert.False(t, pool.waiting.Load())
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}
@@ -0,0 +1,28 @@
+package balloc
+
+import "unsafe"
+
+// Calls fn with the user pointer and usable size of every live allocation in address order,
+// walking the pool from base block by block and skipping free and cached blocks.
+// Stops early if fn returns false. Every class lock is held for the whole walk,
+// so fn must not call back into the pool
+func buddyWalk(pool *BuddyPool, fn func(ptr unsafe.Pointer, size uint) bool) {
+	rlockAll(pool)
+	defer runlockAll(pool)
+
+	if pool.base == 0 {
+		return
+	}
+
+	var offset uintptr
+	for offset < pool.numBytes {
+		var block *Avail = (*Avail)(unsafe.Pointer(pool.base + offset))
+		if block.tag == BLOCK_RESERVED {
+			if !fn(blockToPtr(pool, block), userSize(pool, block)) {
+				return
+			}
+		}
+
+		offset += uintptr(1) << block.kval
+	}
+}
@@ -0,0 +1,60 @@
+package balloc
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuddyWalk(t *testing.T) {
+	fmt.Fprintln(os.Stderr, "->Testing walking live allocations")
+	var pool BuddyPool
+	_ = buddyInit(&pool, 1<<MIN_K)
+
+	// Nothing to see in an empty pool
+	buddyWalk(&pool, func(ptr unsafe.Pointer, size uint) bool {
+		t.Error("walk visited a block in an empty pool")
+		return true
+	})
+
+	// Keep every other block and free the ones in between
+	var want map[unsafe.Pointer]uint = make(map[unsafe.Pointer]uint)
+	for i, size := range []uint{1, 100, 1000, 5000, 30, 70000, 2} {
+		ptr, err := buddyMalloc(&pool, size)
+		assert.NoError(t, err)
+		want[ptr] = buddyUsableSize(&pool, ptr)
+		if i%2 == 1 {
+			assert.NoError(t, buddyFree(&pool, ptr))
+			delete(want, ptr)
+		}
+	}
+	assert.Len(t, want, 4)
+
+	// Exactly the reserved blocks are visited, in address order, with their usable size
+	var got map[unsafe.Pointer]uint = make(map[unsafe.Pointer]uint)
+	var last uintptr
+	buddyWalk(&pool, func(ptr unsafe.Pointer, size uint) bool {
+		assert.Greater(t, uintptr(ptr), last)
+		last = uintptr(ptr)
+		got[ptr] = size
+		return true
+	})
+	assert.Equal(t, want, got)
+
+	// Returning false stops the walk
+	var visits int
+	buddyWalk(&pool, func(ptr unsafe.Pointer, size uint) bool {
+		visits++
+		return visits < 2
+	})
+	assert.Equal(t, 2, visits)
+
+	for ptr := range want {
+		assert.NoError(t, buddyFree(&pool, ptr))
+	}
+	checkBuddyPoolFull(t, &pool)
+	_ = buddyDestroy(&pool)
+}